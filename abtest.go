@@ -0,0 +1,39 @@
+package main
+
+import (
+	"math/rand/v2"
+)
+
+// NewABTestMiddleware sends percentA percent of requests to handlerA and the
+// rest to handlerB, marking each response with an X-AB-Variant header of "a" or
+// "b". If either handler is nil, the handler that the middleware wraps is used
+// in its place, so one variant can simply be the existing endpoint.
+//
+// Each request is assigned at random, so requests for the same path may well
+// get different variants.
+func NewABTestMiddleware(handlerA Handler, handlerB Handler, percentA int) Middleware {
+	return func(handler Handler) Handler {
+		a, b := handlerA, handlerB
+		if a == nil {
+			a = handler
+		}
+		if b == nil {
+			b = handler
+		}
+
+		middleware := func(request Request) (Response, error) {
+			variant, chosen := "b", b
+			if rand.IntN(100) < percentA {
+				variant, chosen = "a", a
+			}
+
+			response, err := chosen(request)
+			if err != nil {
+				return response, err
+			}
+			response.Head.Headers = withHeader(response.Head.Headers, "X-AB-Variant", variant)
+			return response, nil
+		}
+		return middleware
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestABTestMiddleware(t *testing.T) {
+	variant := func(name string) Handler {
+		return func(request Request) (Response, error) {
+			response := OKResponse()
+			response.Head.Headers = map[string]string{"X-Handler": name}
+			return response, nil
+		}
+	}
+
+	tests := []struct {
+		percentA int
+	}{{0}, {30}, {50}, {100}}
+	for _, tt := range tests {
+		handler := NewABTestMiddleware(variant("a"), variant("b"), tt.percentA)(nil)
+		const requests = 1000
+		counts := map[string]int{}
+		for range requests {
+			// every request is for the same path, which must still split
+			response, err := handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/same"}})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			got := response.Head.Headers["X-AB-Variant"]
+			if got != response.Head.Headers["X-Handler"] {
+				t.Fatalf("X-AB-Variant is %q, but handler %q ran", got, response.Head.Headers["X-Handler"])
+			}
+			counts[got]++
+		}
+
+		// the binomial standard deviation is at most about 16 requests, so
+		// this is over 4 of them either side
+		want := requests * tt.percentA / 100
+		if counts["a"] < want-70 || counts["a"] > want+70 {
+			t.Errorf("%d%%: %d of %d requests went to a, want about %d", tt.percentA, counts["a"], requests, want)
+		}
+		if counts["a"]+counts["b"] != requests {
+			t.Errorf("%d%%: got variants %v", tt.percentA, counts)
+		}
+	}
+}
+
+func TestABTestMiddlewareDefaultsToWrapped(t *testing.T) {
+	wrapped := func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Head.Headers = map[string]string{"X-Handler": "wrapped"}
+		return response, nil
+	}
+	handler := NewABTestMiddleware(nil, nil, 50)(wrapped)
+	response, _ := handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/"}})
+	if response.Head.Headers["X-Handler"] != "wrapped" {
+		t.Errorf("got handler %q, want the wrapped one", response.Head.Headers["X-Handler"])
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// AccessLogConfig configures AccessLogMiddleware.
+type AccessLogConfig struct {
+	// Logger receives one record per logged request. If it's nil,
+	// slog.Default() is used.
+	Logger *slog.Logger
+	// SampleRate makes the middleware log only 1 in SampleRate successful
+	// requests (status < 400). Failed requests are always logged. 0 and 1 both
+	// mean that every request is logged.
+	SampleRate uint64
+	// ExcludePaths are request paths (e.g. "/healthz") whose successful
+	// requests aren't logged at all, so that health checks don't drown out
+	// real traffic. Failed requests are still logged.
+	ExcludePaths []string
+}
+
+// errorStatus returns the status code that the client will get when a handler
+// returns err.
+func errorStatus(err error) int {
+	if errors.Is(err, ErrBodyTooLarge) {
+		return 413
+	}
+	if httpErr, ok := asHTTPError(err); ok && httpErr.Status != 0 {
+		return httpErr.Status
+	}
+	return 500
+}
+
+// AccessLogMiddleware logs the method, path, status, and duration of requests.
+//
+// When sampling, every record for a successful request carries sampled=true
+// so that whoever analyzes the log knows to weight it by the sample rate.
+// Sampling is decided by a counter rather than randomly, so it costs an atomic
+// add per request.
+func AccessLogMiddleware(config AccessLogConfig) Middleware {
+	logger := config.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	sampling := config.SampleRate > 1
+	var successes atomic.Uint64
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			start := time.Now()
+			response, err := handler(request)
+			duration := time.Since(start)
+
+			status := response.Head.Status
+			if err != nil {
+				status = errorStatus(err)
+			}
+			if status < 400 && slices.Contains(config.ExcludePaths, request.Path) {
+				return response, err
+			}
+			sampled := false
+			if sampling && status < 400 {
+				if successes.Add(1)%config.SampleRate != 0 {
+					return response, err
+				}
+				sampled = true
+			}
+
+			attrs := []slog.Attr{
+				slog.String("method", request.Method),
+				slog.String("path", request.Path),
+				slog.Int("status", status),
+				slog.Duration("duration", duration),
+			}
+			if sampling {
+				attrs = append(attrs, slog.Bool("sampled", sampled))
+			}
+			if err != nil {
+				attrs = append(attrs, slog.String("error", err.Error()))
+			}
+			logger.LogAttrs(context.Background(), slog.LevelInfo, "request", attrs...)
+			return response, err
+		}
+		return middleware
+	}
+}
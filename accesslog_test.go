@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"testing"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	var log bytes.Buffer
+	config := AccessLogConfig{
+		Logger:     slog.New(slog.NewJSONHandler(&log, nil)),
+		SampleRate: 10,
+	}
+	calls := 0
+	handler := AccessLogMiddleware(config)(func(request Request) (Response, error) {
+		calls++
+		if calls%7 == 0 {
+			return Response{}, errors.New("injected failure")
+		}
+		return OKResponse(), nil
+	})
+
+	const requests = 1000
+	for range requests {
+		handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/"}})
+	}
+
+	var successes, failures int
+	scanner := bufio.NewScanner(&log)
+	for scanner.Scan() {
+		var record struct {
+			Status  int   `json:"status"`
+			Sampled *bool `json:"sampled"`
+		}
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			t.Fatalf("parse record %q: %v", scanner.Text(), err)
+		}
+		if record.Sampled == nil {
+			t.Fatalf("record has no sampled attribute: %s", scanner.Text())
+		}
+		switch record.Status {
+		case 200:
+			successes++
+			if !*record.Sampled {
+				t.Errorf("successful request isn't marked as sampled: %s", scanner.Text())
+			}
+		case 500:
+			failures++
+			if *record.Sampled {
+				t.Errorf("failed request is marked as sampled: %s", scanner.Text())
+			}
+		default:
+			t.Errorf("unexpected status in %s", scanner.Text())
+		}
+	}
+
+	wantFailures := requests / 7
+	if failures != wantFailures {
+		t.Errorf("logged %d failures, want every one of the %d", failures, wantFailures)
+	}
+	// about a tenth of the successful requests
+	wantSuccesses := (requests - wantFailures) / 10
+	if successes < wantSuccesses*8/10 || successes > wantSuccesses*12/10 {
+		t.Errorf("logged %d successes, want about %d", successes, wantSuccesses)
+	}
+}
+
+func TestAccessLogExcludePaths(t *testing.T) {
+	var log bytes.Buffer
+	config := AccessLogConfig{
+		Logger:       slog.New(slog.NewJSONHandler(&log, nil)),
+		ExcludePaths: []string{"/healthz"},
+	}
+	status := 200
+	handler := AccessLogMiddleware(config)(func(request Request) (Response, error) {
+		return Response{Head: ResponseHead{Status: status}}, nil
+	})
+
+	handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/healthz"}})
+	if log.Len() != 0 {
+		t.Errorf("successful excluded request was logged: %s", log.String())
+	}
+	status = 503
+	handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/healthz"}})
+	if log.Len() == 0 {
+		t.Error("failed excluded request wasn't logged")
+	}
+}
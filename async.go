@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"runtime/debug"
+)
+
+// Async responds to every request with accept (e.g. a 202 Accepted) straight
+// away, and runs handler in the background. See AsyncNotify.
+func Async(handler Handler, accept Response) Handler {
+	return AsyncNotify(handler, accept, nil)
+}
+
+// AsyncNotify is like Async, but calls done (if it isn't nil) with the
+// background handler's response or error once it has finished. The response's
+// body is closed after done returns.
+//
+// The request body is read into memory before responding, since the connection
+// is finished with once the accept response has been sent. The background
+// handler's request is detached from the client: Done never fires and it has
+// no ContextMiddleware context, so a client hanging up doesn't stop the work.
+// Errors and panics in the background handler are logged.
+//
+// accept must not have a Body, since it would be shared by every request.
+func AsyncNotify(handler Handler, accept Response, done func(Request, Response, error)) Handler {
+	return func(request Request) (Response, error) {
+		detached, err := detachRequest(request)
+		if err != nil {
+			return Response{}, err
+		}
+		go runDetached(handler, detached, done)
+		return accept, nil
+	}
+}
+
+// detachRequest copies request so that it can outlive the connection it came
+// from.
+func detachRequest(request Request) (Request, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		if err != nil {
+			return Request{}, fmt.Errorf("read body of async request: %w", err)
+		}
+	}
+	return copyRequest(request, body), nil
+}
+
+// copyRequest returns a copy of request, with its own headers and a body that
+// reads from body. The copy isn't tied to the client: Done never fires and it
+// has no ContextMiddleware context.
+func copyRequest(request Request, body []byte) Request {
+	detached := request.Clone()
+	detached.state = nil
+	if detached.Headers == nil {
+		detached.Headers = make(map[string]string)
+	}
+	delete(detached.Headers, contextIDHeader)
+	if request.Body != nil {
+		detached.Body = bytes.NewReader(body)
+	}
+	return detached
+}
+
+func runDetached(handler Handler, request Request, done func(Request, Response, error)) {
+	var response Response
+	var err error
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("panic in background handler: %v\n%s", recovered, debug.Stack())
+		}
+		if err != nil {
+			slog.Error("background handler failed", "method", request.Method, "path", request.Path, "error", err)
+		}
+		if done != nil {
+			done(request, response, err)
+		}
+		if response.Body != nil {
+			response.Body.Close()
+		}
+	}()
+	response, err = handler(request)
+}
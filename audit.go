@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sensitiveHeaders are never written to an audit sink. Keys are lower case to
+// match Request.Headers.
+var sensitiveHeaders = map[string]bool{
+	"authorization":       true,
+	"proxy-authorization": true,
+	"cookie":              true,
+	"set-cookie":          true,
+	"x-api-key":           true,
+	"x-auth-token":        true,
+	"x-csrf-token":        true,
+}
+
+// boundedBuffer keeps the first max bytes written to it and silently drops the
+// rest. It always reports the full length as written so that an io.TeeReader
+// wrapping it never fails because the capture is full.
+type boundedBuffer struct {
+	bytes.Buffer
+	max       int64
+	truncated bool
+}
+
+func (b *boundedBuffer) Write(p []byte) (int, error) {
+	room := b.max - int64(b.Len())
+	if room <= 0 {
+		if len(p) > 0 {
+			b.truncated = true
+		}
+		return len(p), nil
+	}
+	if int64(len(p)) > room {
+		b.Buffer.Write(p[:room])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// AuditBodyMiddleware copies up to maxBytes of every request body into sink,
+// framed with the time, method, path, and (non-sensitive) headers of the
+// request. It's meant for debugging clients, so it can be applied to a single
+// route by wrapping that route's handler directly:
+//
+//	s.RegisterHandler("/files/", AuditBodyMiddleware(os.Stderr, 4096)(handler))
+//
+// The body is only captured as the handler reads it, so the handler never sees
+// fewer bytes than it asked for. Once the handler returns, whatever is left of
+// the declared Content-Length is drained (up to maxBytes) so that the record
+// is complete. If that leaves some of the body unread, the response is marked
+// as the connection's last, since the connection can't be read from again.
+func AuditBodyMiddleware(sink io.Writer, maxBytes int64) Middleware {
+	// the same sink is shared between every connection's goroutine
+	var mu sync.Mutex
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			received := time.Now()
+			capture := &boundedBuffer{max: maxBytes}
+			var body *countingReader
+			if request.Body != nil {
+				body = &countingReader{r: io.TeeReader(request.Body, capture)}
+				request.Body = body
+			}
+
+			response, err := handler(request)
+
+			if body != nil && drainDeclaredBody(request, body, maxBytes) {
+				capture.truncated = true
+				if httpErr, ok := asHTTPError(err); ok {
+					httpErr.Headers = withConnectionClose(httpErr.Headers)
+					err = httpErr
+				} else if err == nil {
+					response.Head.Headers = withConnectionClose(response.Head.Headers)
+				}
+			}
+			record := auditRecord(received, request, capture)
+			mu.Lock()
+			_, writeErr := sink.Write(record)
+			mu.Unlock()
+			if writeErr != nil {
+				slog.Error("write audit record", "method", request.Method, "path", request.Path, "error", writeErr)
+			}
+			return response, err
+		}
+		return middleware
+	}
+}
+
+// countingReader keeps track of how many bytes have been read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// drainDeclaredBody reads whatever the handler left of the body declared by
+// Content-Length, but no further than maxBytes into it, since anything after
+// that wouldn't be captured anyway. Request.Body isn't guaranteed to return an
+// EOF, so the declared length is the only safe bound. It returns whether any
+// of the declared body is still unread.
+func drainDeclaredBody(request Request, body *countingReader, maxBytes int64) bool {
+	length, err := strconv.ParseInt(request.Headers["content-length"], 10, 64)
+	if err != nil || length <= body.n {
+		return false
+	}
+	if want := min(length, maxBytes) - body.n; want > 0 {
+		_, err = io.CopyN(io.Discard, body, want)
+		if err != nil {
+			slog.Warn("drain request body for audit", "error", err)
+			return true
+		}
+	}
+	return body.n < length
+}
+
+// withConnectionClose returns a copy of headers with Connection set to close,
+// replacing however the handler spelled it.
+func withConnectionClose(headers map[string]string) map[string]string {
+	headers = withHeader(headers, "Connection", "close")
+	for name := range headers {
+		if name != "Connection" && strings.EqualFold(name, "Connection") {
+			delete(headers, name)
+		}
+	}
+	return headers
+}
+
+func auditRecord(received time.Time, request Request, capture *boundedBuffer) []byte {
+	var record bytes.Buffer
+	record.WriteString(fmt.Sprintf("--- %s %s %s\n", received.UTC().Format(time.RFC3339Nano), request.Method, request.Path))
+
+	keys := make([]string, 0, len(request.Headers))
+	for key := range request.Headers {
+		if !sensitiveHeaders[key] {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		record.WriteString(key)
+		record.WriteString(": ")
+		record.WriteString(request.Headers[key])
+		record.WriteString("\n")
+	}
+
+	// the byte count frames the body, since it may contain anything
+	truncated := ""
+	if capture.truncated {
+		truncated = " (truncated)"
+	}
+	record.WriteString(fmt.Sprintf("body %d bytes%s\n", capture.Len(), truncated))
+	record.Write(capture.Bytes())
+	record.WriteString("\n")
+	return record.Bytes()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readCounter counts how much of a request body has been read.
+type readCounter struct {
+	r io.Reader
+	n int
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+func auditRequest(body string) Request {
+	return Request{
+		RequestLine: RequestLine{Method: "POST", Path: "/upload"},
+		Headers: map[string]string{
+			"content-length": strconv.Itoa(len(body)),
+			"content-type":   "text/plain",
+			"authorization":  "Bearer secret",
+		},
+		Body: strings.NewReader(body),
+	}
+}
+
+func TestAuditBodyMiddleware(t *testing.T) {
+	var sink bytes.Buffer
+	var received string
+	handler := func(request Request) (Response, error) {
+		body, err := io.ReadAll(request.Body)
+		received = string(body)
+		return OKResponse(), err
+	}
+
+	const body = "name=gopher&age=13"
+	_, err := AuditBodyMiddleware(&sink, 1024)(handler)(auditRequest(body))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if received != body {
+		t.Errorf("handler received %q, want %q", received, body)
+	}
+	record := sink.String()
+	if !strings.HasPrefix(record, "--- ") || !strings.Contains(record, " POST /upload\n") {
+		t.Errorf("record doesn't start with the time, method and path:\n%s", record)
+	}
+	if !strings.Contains(record, "body 18 bytes\n"+body+"\n") {
+		t.Errorf("record doesn't have the framed body:\n%s", record)
+	}
+	if !strings.Contains(record, "content-type: text/plain\n") {
+		t.Errorf("record doesn't have the content-type header:\n%s", record)
+	}
+	if strings.Contains(record, "secret") || strings.Contains(record, "authorization") {
+		t.Errorf("record has the authorization header:\n%s", record)
+	}
+}
+
+func TestAuditBodyMiddlewareDrain(t *testing.T) {
+	ignoreBody := func(request Request) (Response, error) {
+		return OKResponse(), nil
+	}
+
+	tests := []struct {
+		name     string
+		body     string
+		maxBytes int64
+		// wantRead is how much of the body should be read in all
+		wantRead      int
+		wantCaptured  string
+		wantTruncated bool
+	}{
+		{"fits", "0123456789", 100, 10, "0123456789", false},
+		{"exactly fits", "0123456789", 10, 10, "0123456789", false},
+		{"too big", "0123456789", 4, 4, "0123", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sink bytes.Buffer
+			request := auditRequest(tt.body)
+			counter := &readCounter{r: request.Body}
+			request.Body = counter
+
+			response, err := AuditBodyMiddleware(&sink, tt.maxBytes)(ignoreBody)(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if counter.n != tt.wantRead {
+				t.Errorf("read %d bytes of the body, want %d", counter.n, tt.wantRead)
+			}
+			record := sink.String()
+			if !strings.Contains(record, "\n"+tt.wantCaptured+"\n") {
+				t.Errorf("record doesn't have %q:\n%s", tt.wantCaptured, record)
+			}
+			if got := strings.Contains(record, "(truncated)"); got != tt.wantTruncated {
+				t.Errorf("record truncated = %v, want %v:\n%s", got, tt.wantTruncated, record)
+			}
+			// the rest of the body is still waiting to be read
+			wantClose := tt.wantTruncated
+			if got := getHeader(response.Head.Headers, "Connection") == "close"; got != wantClose {
+				t.Errorf("Connection: close = %v, want %v", got, wantClose)
+			}
+		})
+	}
+}
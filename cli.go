@@ -0,0 +1,429 @@
+package main
+
+import (
+	"compress/gzip"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is how the server is set up, as given on the command line.
+type config struct {
+	directory string
+	// addresses has at least one address in it
+	addresses []string
+	// deprecatedArg is set if the address was given as a positional argument
+	deprecatedArg bool
+	// trustedProxies enables the PROXY protocol if it isn't empty
+	trustedProxies prefixFlag
+
+	maxBodyBytes    int64
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	idleTimeout     time.Duration
+	bodyIdleTimeout time.Duration
+	handlerTimeout  time.Duration
+	shutdownTimeout time.Duration
+	drainLog        bool
+	tcpKeepAlive    time.Duration
+	reusePort       bool
+
+	tlsCert           string
+	tlsKey            string
+	tlsReloadInterval time.Duration
+	hostCerts         hostCertFlag
+	tlsClientCA       string
+	tlsClientAuth     string
+	// redirectHTTP is where to redirect plain HTTP to HTTPS from, if it isn't
+	// empty
+	redirectHTTP string
+
+	corsOrigins       []string
+	headers           headerFlag
+	gzip              bool
+	gzipLevel         int
+	readOnly          bool
+	listings          bool
+	fileMD5           bool
+	verboseErrors     bool
+	basicAuthUser     string
+	basicAuthPassword string
+
+	logLevel  slog.Level
+	logFormat string
+	// accessLog is the file to log requests to, if it isn't empty
+	accessLog         string
+	accessLogMaxSize  int64
+	accessLogMaxFiles int
+
+	// version is set if the version should be printed instead
+	version bool
+}
+
+// parseFlags turns the command line arguments (without the program name) into
+// a config. If they're invalid, the problem and the usage message are written
+// to output and an error is returned. -h gets the usage message and
+// flag.ErrHelp.
+func parseFlags(name string, args []string, output io.Writer) (config, error) {
+	var c config
+	c.headers = make(headerFlag)
+	var listen listFlag
+	var host, port, logLevel, corsOrigin, basicAuth string
+	var quiet, verbose bool
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	fs.Usage = func() {
+		base := path.Base(name)
+		fmt.Fprintf(fs.Output(), "Usage: %s -port <port> [-host <host>] [flags]\n", base)
+		fmt.Fprintf(fs.Output(), "   or: %s -listen <address> [-listen <address>...] [flags]\n\nFlags:\n", base)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&c.directory, "directory", ".", "Directory to serve.")
+	fs.StringVar(&host, "host", "", "Host or IP address to listen on. IPv6 addresses may be given with or without brackets. By default, every IPv4 and IPv6 address is listened on.")
+	fs.StringVar(&port, "port", "", "Port to listen on. Required unless -listen is given.")
+	fs.Var(&listen, "listen", "Address to listen on, e.g. localhost:8080 or [::1]:8080. Can be repeated. Replaces -host and -port.")
+	fs.Var(&c.trustedProxies, "proxy-protocol-from", "IP or CIDR range (e.g. 10.0.0.0/8) of a load balancer that sends PROXY protocol headers. Can be repeated. Other clients are served as usual.")
+	fs.Int64Var(&c.maxBodyBytes, "max-body-bytes", 0, "Largest request body to accept, in bytes. Requests that declare a larger Content-Length (or send more than that) get a 413 Content Too Large response. 0 means no limit.")
+	fs.DurationVar(&c.readTimeout, "read-timeout", 0, "How long a client has to send its whole request. 0 means no limit.")
+	fs.DurationVar(&c.writeTimeout, "write-timeout", 0, "How long the server has to write a response. 0 means no limit.")
+	fs.DurationVar(&c.idleTimeout, "idle-timeout", 0, "How long a connection may go without sending or receiving anything (outside of a handler) before it's closed. 0 means no limit.")
+	fs.DurationVar(&c.bodyIdleTimeout, "body-idle-timeout", 0, "How long a request body may go without any data arriving. 0 means no limit.")
+	fs.DurationVar(&c.handlerTimeout, "handler-timeout", 0, "How long a handler has to produce a response before the client gets a 503. 0 means no limit.")
+	fs.DurationVar(&c.shutdownTimeout, "shutdown-timeout", 30*time.Second, "How long to wait for requests in flight to finish after SIGINT or SIGTERM before closing their connections. The exit code is 3 if any had to be closed.")
+	fs.BoolVar(&c.drainLog, "drain-log", true, "While shutting down, log the requests in flight every few seconds.")
+	fs.DurationVar(&c.tcpKeepAlive, "tcp-keepalive", 0, "How often to send TCP keep-alive probes on idle connections. 0 means the default (15s) and negative turns them off.")
+	fs.BoolVar(&c.reusePort, "reuse-port", false, "Set SO_REUSEPORT, so that a new server can start on the same port before this one stops.")
+	fs.StringVar(&c.tlsCert, "tls-cert", "", "PEM certificate file. Serves HTTPS when given along with -tls-key.")
+	fs.StringVar(&c.tlsKey, "tls-key", "", "PEM private key file for -tls-cert.")
+	fs.DurationVar(&c.tlsReloadInterval, "tls-reload-interval", time.Minute, "How often to check -tls-cert and -tls-key for changes. Negative turns the checks off. The files are also reloaded on SIGHUP.")
+	fs.Var(&c.hostCerts, "tls-cert-for", "Certificate for one host name, as host=cert.pem,key.pem. The host may be a wildcard like *.example.com. Clients asking for other hosts get -tls-cert. Can be repeated.")
+	fs.StringVar(&c.tlsClientCA, "tls-client-ca", "", "PEM bundle of CAs that client certificates must be signed by. Enables mutual TLS.")
+	fs.StringVar(&c.tlsClientAuth, "tls-client-auth", "require", "With -tls-client-ca, whether clients must send a certificate (require) or only have it checked if they do (verify-if-given).")
+	fs.StringVar(&c.redirectHTTP, "redirect-http", "", "Address (e.g. :80) to answer plain HTTP on with redirects to HTTPS. Needs -tls-cert.")
+	fs.StringVar(&corsOrigin, "cors-origin", "", "Comma separated origins (or \"*\") that browsers may read responses from. Empty disables CORS.")
+	fs.Var(c.headers, "header", "Header to add to every response, e.g. \"X-Environment: staging\". Can be repeated.")
+	fs.BoolVar(&c.gzip, "gzip", true, "Compress responses for clients that accept gzip.")
+	fs.IntVar(&c.gzipLevel, "gzip-level", gzip.DefaultCompression, "gzip compression level, from 1 (fastest) to 9 (smallest). -1 is the default level and -2 is Huffman only.")
+	fs.BoolVar(&c.readOnly, "read-only", false, "Turn away uploads to /files/ with a 405.")
+	fs.BoolVar(&c.listings, "listings", false, "List the contents of directories under /files/ that have no index file.")
+	fs.BoolVar(&c.fileMD5, "file-md5", false, "Add a Content-MD5 trailer to downloads from /files/. Files are hashed as they're sent, so they're sent chunked, without a Content-Length.")
+	fs.BoolVar(&c.verboseErrors, "verbose-errors", false, "Give 500 responses a short plain text explanation instead of an empty body.")
+	fs.StringVar(&basicAuth, "basic-auth", "", "Require HTTP Basic credentials, given as user:password.")
+	fs.StringVar(&logLevel, "log-level", "info", "Minimum level of logs to print: debug, info, warn, or error.")
+	fs.StringVar(&c.logFormat, "log-format", "text", "Format of logs: text or json.")
+	fs.StringVar(&c.accessLog, "access-log", "", "File to log every request to. It's reopened on SIGHUP, e.g. for logrotate.")
+	fs.Int64Var(&c.accessLogMaxSize, "access-log-max-size", 100<<20, "Size in bytes at which -access-log is rotated to <file>.1, <file>.2, and so on. 0 turns rotation off.")
+	fs.IntVar(&c.accessLogMaxFiles, "access-log-max-files", 5, "How many rotated -access-log files to keep.")
+	fs.BoolVar(&quiet, "quiet", false, "Only log errors. Same as -log-level error.")
+	fs.BoolVar(&verbose, "verbose", false, "Log every request, with its headers (but not credentials). Same as -log-level debug.")
+	fs.BoolVar(&c.version, "version", false, "Print the version and exit.")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return config{}, err
+	}
+	if c.version {
+		return c, nil
+	}
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	fail := func(err error) (config, error) {
+		fmt.Fprintf(fs.Output(), "%s\n\n", err)
+		fs.Usage()
+		return config{}, err
+	}
+
+	if len(listen) > 0 {
+		if set["host"] || set["port"] || fs.Arg(0) != "" {
+			return fail(errors.New("give either -listen or -host and -port, not both"))
+		}
+		for _, address := range listen {
+			address, err := normalizeAddress(address)
+			if err != nil {
+				return fail(err)
+			}
+			c.addresses = append(c.addresses, address)
+		}
+	} else {
+		address, err := listenAddress(host, port, fs.Arg(0))
+		if err != nil {
+			return fail(err)
+		}
+		c.addresses = []string{address}
+		c.deprecatedArg = fs.Arg(0) != ""
+	}
+
+	err = validateTLSFlags(c.tlsCert, c.tlsKey, c.tlsClientCA, len(c.hostCerts))
+	if err != nil {
+		return fail(err)
+	}
+	if c.redirectHTTP != "" && c.tlsCert == "" {
+		return fail(errors.New("-redirect-http needs -tls-cert"))
+	}
+	if c.gzipLevel < gzip.HuffmanOnly || c.gzipLevel > gzip.BestCompression {
+		return fail(fmt.Errorf("invalid -gzip-level %d, expected -2 to 9", c.gzipLevel))
+	}
+	if basicAuth != "" {
+		user, password, ok := strings.Cut(basicAuth, ":")
+		if !ok || user == "" {
+			return fail(errors.New("-basic-auth must be of the form user:password"))
+		}
+		c.basicAuthUser, c.basicAuthPassword = user, password
+	}
+	c.corsOrigins = parseOrigins(corsOrigin)
+
+	if (quiet || verbose) && set["log-level"] || quiet && verbose {
+		return fail(errors.New("give only one of -quiet, -verbose, and -log-level"))
+	}
+	if quiet {
+		logLevel = "error"
+	}
+	if verbose {
+		logLevel = "debug"
+	}
+	c.logLevel, err = parseLogLevel(logLevel)
+	if err != nil {
+		return fail(err)
+	}
+	if c.logFormat != "text" && c.logFormat != "json" {
+		return fail(fmt.Errorf("invalid log format '%s', expected text or json", c.logFormat))
+	}
+	if c.accessLogMaxSize < 0 || c.accessLogMaxFiles < 0 {
+		return fail(errors.New("-access-log-max-size and -access-log-max-files can't be negative"))
+	}
+	return c, nil
+}
+
+// logger returns the logger that c asks for, writing to w.
+func (c config) logger(w io.Writer) *slog.Logger {
+	options := &slog.HandlerOptions{Level: c.logLevel}
+	if c.logFormat == "json" {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// accessLogger returns the logger for -access-log, writing to w. It's in the
+// same format as the other logs, but isn't affected by -log-level.
+func (c config) accessLogger(w io.Writer) *slog.Logger {
+	c.logLevel = slog.LevelInfo
+	return c.logger(w)
+}
+
+// newServer sets up a Server with the endpoints and middleware that c asks
+// for. It doesn't start listening.
+func newServer(c config, accessLog io.Writer) (*Server, error) {
+	s := &Server{
+		Address:             c.addresses[0],
+		Addresses:           c.addresses[1:],
+		MaxRequestBodySize:  c.maxBodyBytes,
+		ReadTimeout:         c.readTimeout,
+		WriteTimeout:        c.writeTimeout,
+		ReadBodyIdleTimeout: c.bodyIdleTimeout,
+		IdleTimeout:         c.idleTimeout,
+		VerboseErrors:       c.verboseErrors,
+		HandlerTimeout:      c.handlerTimeout,
+		CertReloadInterval:  c.tlsReloadInterval,
+		TCPKeepAlive:        c.tcpKeepAlive,
+		ReusePort:           c.reusePort,
+		ProxyProtocol:       len(c.trustedProxies) > 0,
+		TrustedProxies:      c.trustedProxies,
+	}
+	for _, hc := range c.hostCerts {
+		cert, err := tls.LoadX509KeyPair(hc.certFile, hc.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load TLS certificate for %s: %w", hc.host, err)
+		}
+		s.AddCertificate(hc.host, cert)
+	}
+	if c.tlsClientCA != "" {
+		var err error
+		s.TLSConfig, err = ClientAuthConfig(c.tlsClientCA, c.tlsClientAuth)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.RegisterHandler("/", rootEndpoint)
+	s.RegisterHandler("/user-agent", userAgentEndpoint)
+	// added / at the end since this endpoint takes a path argument
+	s.RegisterHandler("/echo/", echoEndpoint)
+	s.RegisterHandler("/files/", getFilesEndpoint(c.directory, FilesEndpointOptions{Listings: c.listings, ReadOnly: c.readOnly, ContentMD5: c.fileMD5}))
+	s.EnableHealthEndpoint("/healthz")
+	// covered by -basic-auth along with everything else
+	s.RegisterHandler("/status", s.StatusHandler())
+
+	if c.gzip {
+		s.RegisterMiddleware(NewGzipMiddleware(c.gzipLevel))
+	}
+	if c.basicAuthUser != "" {
+		s.RegisterMiddleware(NewBasicAuthMiddleware(c.basicAuthUser, c.basicAuthPassword, "simple-http-server"))
+	}
+	// -header can override the Server header, since injected headers never
+	// replace ones that are already there
+	headers := make(map[string]string, len(c.headers)+1)
+	for name, value := range c.headers {
+		headers[name] = value
+	}
+	if !hasHeader(headers, "Server") {
+		headers["Server"] = readVersionInfo().serverHeader()
+	}
+	s.ServerHeader = getHeader(headers, "Server")
+	s.RegisterMiddleware(HeaderInjectionMiddleware(headers))
+	// outside of basic auth, since browsers don't send credentials with
+	// preflight requests
+	if len(c.corsOrigins) > 0 {
+		s.RegisterMiddleware(NewCORSMiddleware(c.corsOrigins))
+	}
+	// registered last so that it also catches panics in the other middleware
+	s.RegisterMiddleware(RecoveryMiddleware)
+	if c.accessLog != "" {
+		// outside of RecoveryMiddleware, so that panics are logged as 500s
+		s.RegisterMiddleware(AccessLogMiddleware(AccessLogConfig{
+			Logger:       c.accessLogger(accessLog),
+			ExcludePaths: []string{"/healthz"},
+		}))
+	}
+	return s, nil
+}
+
+// listFlag collects a flag that can be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// prefixFlag collects IP ranges from a flag that can be repeated. A plain IP
+// is a range of one.
+type prefixFlag []netip.Prefix
+
+func (p *prefixFlag) String() string {
+	ranges := make([]string, len(*p))
+	for i, prefix := range *p {
+		ranges[i] = prefix.String()
+	}
+	return strings.Join(ranges, ", ")
+}
+
+func (p *prefixFlag) Set(s string) error {
+	if !strings.Contains(s, "/") {
+		ip, err := netip.ParseAddr(s)
+		if err != nil {
+			return err
+		}
+		*p = append(*p, netip.PrefixFrom(ip, ip.BitLen()))
+		return nil
+	}
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return err
+	}
+	*p = append(*p, prefix.Masked())
+	return nil
+}
+
+// listenAddress combines the -host and -port flags into the address that the
+// Server listens on. For backwards compatibility, the address can instead be
+// given as the first positional argument (arg), which is deprecated.
+func listenAddress(host string, port string, arg string) (string, error) {
+	if arg != "" {
+		if host != "" || port != "" {
+			return "", errors.New("give either -host and -port or an address argument, not both")
+		}
+		return normalizeAddress(arg)
+	}
+	if port == "" {
+		return "", errors.New("-port is required")
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port '%s'", port)
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.Contains(host, ":") {
+		_, err := netip.ParseAddr(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid -host '%s'", host)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// parseLogLevel converts the -log-level flag into a slog.Level.
+func parseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level '%s', expected debug, info, warn, or error", s)
+}
+
+// validateTLSFlags checks that -tls-cert and -tls-key are given together, and
+// that -tls-client-ca and -tls-cert-for (hostCerts times) are only used along
+// with them.
+func validateTLSFlags(cert string, key string, clientCA string, hostCerts int) error {
+	if (cert == "") != (key == "") {
+		return errors.New("-tls-cert and -tls-key must be given together")
+	}
+	if clientCA != "" && cert == "" {
+		return errors.New("-tls-client-ca needs -tls-cert and -tls-key")
+	}
+	if hostCerts > 0 && cert == "" {
+		return errors.New("-tls-cert-for needs a default certificate from -tls-cert and -tls-key")
+	}
+	return nil
+}
+
+// hostCert is one -tls-cert-for flag.
+type hostCert struct {
+	host     string
+	certFile string
+	keyFile  string
+}
+
+// hostCertFlag collects repeated -tls-cert-for host=cert,key flags.
+type hostCertFlag []hostCert
+
+func (h *hostCertFlag) String() string {
+	pairs := make([]string, 0, len(*h))
+	for _, hc := range *h {
+		pairs = append(pairs, hc.host+"="+hc.certFile+","+hc.keyFile)
+	}
+	return strings.Join(pairs, " ")
+}
+
+func (h *hostCertFlag) Set(s string) error {
+	host, files, ok := strings.Cut(s, "=")
+	certFile, keyFile, ok2 := strings.Cut(files, ",")
+	if !ok || !ok2 || host == "" || certFile == "" || keyFile == "" {
+		return fmt.Errorf("'%s' is not of the form 'host=cert.pem,key.pem'", s)
+	}
+	*h = append(*h, hostCert{host: host, certFile: certFile, keyFile: keyFile})
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFlagsAddress(t *testing.T) {
+	tests := []struct {
+		name        string
+		flags       []string
+		positional  string
+		wantAddress string
+	}{
+		{"host and port", []string{"-host", "127.0.0.1", "-port", "8080"}, "127.0.0.1:8080", "127.0.0.1:8080"},
+		{"port only", []string{"-port", "8080"}, ":8080", ":8080"},
+		{"ipv6 host", []string{"-host", "::1", "-port", "8080"}, "[::1]:8080", "[::1]:8080"},
+		{"bracketed ipv6 host", []string{"-host", "[::1]", "-port", "8080"}, "[::1]:8080", "[::1]:8080"},
+		{"host name", []string{"-host", "localhost", "-port", "80"}, "localhost:80", "localhost:80"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withFlags, err := parseFlags("simple-http-server", tt.flags, io.Discard)
+			if err != nil {
+				t.Fatalf("parse %v: %v", tt.flags, err)
+			}
+			withArg, err := parseFlags("simple-http-server", []string{tt.positional}, io.Discard)
+			if err != nil {
+				t.Fatalf("parse %q: %v", tt.positional, err)
+			}
+			if withFlags.deprecatedArg || !withArg.deprecatedArg {
+				t.Errorf("only the positional argument should be deprecated")
+			}
+
+			for _, c := range []config{withFlags, withArg} {
+				s, err := newServer(c, nil)
+				if err != nil {
+					t.Fatalf("new server: %v", err)
+				}
+				if s.Address != tt.wantAddress {
+					t.Errorf("got Address %q, want %q", s.Address, tt.wantAddress)
+				}
+			}
+		})
+	}
+}
+
+func TestParseFlagsAddressErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"no port", []string{"-host", "127.0.0.1"}},
+		{"port and argument", []string{"-port", "8080", "127.0.0.1:8080"}},
+		{"host and argument", []string{"-host", "127.0.0.1", "127.0.0.1:8080"}},
+		{"host, port and argument", []string{"-host", "127.0.0.1", "-port", "8080", ":8080"}},
+		{"bad port", []string{"-port", "http"}},
+		{"port out of range", []string{"-port", "70000"}},
+		{"unbracketed ipv6 argument", []string{"::1:8080:1"}},
+		{"listen and port", []string{"-listen", ":8080", "-port", "8080"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFlags("simple-http-server", tt.args, io.Discard)
+			if err == nil {
+				t.Errorf("parse %v succeeded, want an error", tt.args)
+			}
+		})
+	}
+}
+
+func TestParseFlagsMaxBody(t *testing.T) {
+	dir := t.TempDir()
+	c, err := parseFlags("simple-http-server", []string{"-port", "0", "-directory", dir, "-max-body-bytes", "10"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	if s.MaxRequestBodySize != 10 {
+		t.Errorf("got MaxRequestBodySize %d, want 10", s.MaxRequestBodySize)
+	}
+	addr := startServer(t, s)
+
+	tests := []struct {
+		name       string
+		request    string
+		wantStatus int
+	}{
+		{"at the limit", "POST /files/a.txt HTTP/1.1\r\nContent-Length: 10\r\n\r\n0123456789", 201},
+		{"over the limit", "POST /files/b.txt HTTP/1.1\r\nContent-Length: 11\r\n\r\n0123456789a", 413},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, _ := parseResponse(t, rawRequest(t, addr, tt.request))
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestParseFlagsIdleTimeouts(t *testing.T) {
+	tests := []struct {
+		args     []string
+		wantIdle time.Duration
+		wantBody time.Duration
+	}{
+		{[]string{"-idle-timeout", "1m"}, time.Minute, 0},
+		{[]string{"-body-idle-timeout", "10s"}, 0, 10 * time.Second},
+		{[]string{"-idle-timeout", "1m", "-body-idle-timeout", "10s"}, time.Minute, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		c, err := parseFlags("simple-http-server", append([]string{"-port", "8080"}, tt.args...), io.Discard)
+		if err != nil {
+			t.Fatalf("parse %v: %v", tt.args, err)
+		}
+		s, err := newServer(c, nil)
+		if err != nil {
+			t.Fatalf("new server: %v", err)
+		}
+		if s.IdleTimeout != tt.wantIdle || s.ReadBodyIdleTimeout != tt.wantBody {
+			t.Errorf("%v: got IdleTimeout %v and ReadBodyIdleTimeout %v, want %v and %v",
+				tt.args, s.IdleTimeout, s.ReadBodyIdleTimeout, tt.wantIdle, tt.wantBody)
+		}
+	}
+}
+
+func TestParseFlagsLogLevel(t *testing.T) {
+	tests := []struct {
+		args []string
+		// want are the levels that get logged
+		want []string
+	}{
+		{nil, []string{"INFO", "WARN", "ERROR"}},
+		{[]string{"-log-level", "debug"}, []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+		{[]string{"-log-level", "INFO"}, []string{"INFO", "WARN", "ERROR"}},
+		{[]string{"-log-level", "warn"}, []string{"WARN", "ERROR"}},
+		{[]string{"-log-level", "error"}, []string{"ERROR"}},
+		{[]string{"-quiet"}, []string{"ERROR"}},
+		{[]string{"-verbose"}, []string{"DEBUG", "INFO", "WARN", "ERROR"}},
+	}
+	for _, tt := range tests {
+		c, err := parseFlags("simple-http-server", append([]string{"-port", "8080"}, tt.args...), io.Discard)
+		if err != nil {
+			t.Fatalf("parse %v: %v", tt.args, err)
+		}
+		var out bytes.Buffer
+		logger := c.logger(&out)
+		logger.Debug("message")
+		logger.Info("message")
+		logger.Warn("message")
+		logger.Error("message")
+
+		var got []string
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			_, level, _ := strings.Cut(line, "level=")
+			level, _, _ = strings.Cut(level, " ")
+			got = append(got, level)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%v: got levels %v logged, want %v", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseFlagsLogLevelErrors(t *testing.T) {
+	tests := [][]string{
+		{"-log-level", "verbose"},
+		{"-quiet", "-verbose"},
+		{"-quiet", "-log-level", "info"},
+		{"-log-format", "xml"},
+	}
+	for _, args := range tests {
+		_, err := parseFlags("simple-http-server", append([]string{"-port", "8080"}, args...), io.Discard)
+		if err == nil {
+			t.Errorf("parse %v succeeded, want an error", args)
+		}
+	}
+}
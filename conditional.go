@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+)
+
+// WhenRequest applies m only to requests that pred returns true for. Other
+// requests go straight to the handler.
+func WhenRequest(pred func(Request) bool, m Middleware) Middleware {
+	return func(handler Handler) Handler {
+		wrapped := m(handler)
+		middleware := func(request Request) (Response, error) {
+			if pred(request) {
+				return wrapped(request)
+			}
+			return handler(request)
+		}
+		return middleware
+	}
+}
+
+// ResponseTransformer changes a response after the handler has produced it.
+type ResponseTransformer func(Request, Response) (Response, error)
+
+// Middleware turns t into a Middleware that transforms every successful
+// response.
+func (t ResponseTransformer) Middleware() Middleware {
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if err != nil {
+				return response, err
+			}
+			return t(request, response)
+		}
+		return middleware
+	}
+}
+
+// AsResponseTransformer adapts m so that it can be applied to a response that
+// has already been produced. m is run around a handler that just returns the
+// response, so this only makes sense for middleware that works on the response
+// (like gzipMiddleware). Anything m does to the request happens too late to
+// matter.
+func AsResponseTransformer(m Middleware) ResponseTransformer {
+	return func(request Request, response Response) (Response, error) {
+		produced := func(Request) (Response, error) {
+			return response, nil
+		}
+		return m(produced)(request)
+	}
+}
+
+// WhenResponse applies m's changes to a response only if pred returns true for
+// its head. Since the response has to exist before pred can look at it, m runs
+// after the handler has returned (see AsResponseTransformer).
+func WhenResponse(pred func(ResponseHead) bool, m Middleware) Middleware {
+	transform := AsResponseTransformer(m)
+	return ResponseTransformer(func(request Request, response Response) (Response, error) {
+		if !pred(response.Head) {
+			return response, nil
+		}
+		return transform(request, response)
+	}).Middleware()
+}
+
+// matchContentType reports whether the media type in contentType matches any
+// of types. A type ending in "/" or "/*" (e.g. "text/") matches every subtype.
+func matchContentType(contentType string, types []string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+	if mediaType == "" {
+		return false
+	}
+	for _, t := range types {
+		t = strings.ToLower(t)
+		if prefix, ok := strings.CutSuffix(t, "*"); ok {
+			t = prefix
+		}
+		if strings.HasSuffix(t, "/") {
+			if strings.HasPrefix(mediaType, t) {
+				return true
+			}
+		} else if mediaType == t {
+			return true
+		}
+	}
+	return false
+}
+
+// ContentTypePredicate returns a predicate for WhenResponse that's true when
+// the response's Content-Type is one of types, e.g.
+//
+//	WhenResponse(ContentTypePredicate("text/", "application/json"), gzipMiddleware)
+func ContentTypePredicate(types ...string) func(ResponseHead) bool {
+	return func(head ResponseHead) bool {
+		return matchContentType(getHeader(head.Headers, "Content-Type"), types)
+	}
+}
+
+// RequestContentTypePredicate returns a predicate for WhenRequest that's true
+// when the request's Content-Type is one of types.
+func RequestContentTypePredicate(types ...string) func(Request) bool {
+	return func(request Request) bool {
+		return matchContentType(request.Headers["content-type"], types)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestWhenResponseGzip(t *testing.T) {
+	body := []byte("hello, world! hello, world! hello, world!")
+	tests := []struct {
+		contentType string
+		wantGzip    bool
+	}{
+		{"application/json", true},
+		{"text/html; charset=utf-8", true},
+		{"TEXT/PLAIN", true},
+		{"image/png", false},
+		{"", false},
+	}
+	middleware := WhenResponse(ContentTypePredicate("text/", "application/json"), gzipMiddleware)
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			handler := middleware(func(request Request) (Response, error) {
+				response := OKResponse()
+				if tt.contentType != "" {
+					response.Head.Headers = withHeader(response.Head.Headers, "Content-Type", tt.contentType)
+				}
+				response.Body = newBytesBody(body)
+				return response, nil
+			})
+			request := Request{Headers: map[string]string{"accept-encoding": "gzip"}}
+			response, err := handler(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer response.Body.Close()
+			gzipped := getHeader(response.Head.Headers, "Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Errorf("got gzipped %v, want %v", gzipped, tt.wantGzip)
+			}
+			if !gzipped {
+				got, _ := io.ReadAll(response.Body)
+				if string(got) != string(body) {
+					t.Errorf("got body %q, want it untouched", got)
+				}
+			}
+		})
+	}
+}
+
+func TestWhenRequest(t *testing.T) {
+	tests := []struct {
+		contentType string
+		wantApplied bool
+	}{
+		{"application/json", true},
+		{"application/json; charset=utf-8", true},
+		{"application/xml", false},
+		{"", false},
+	}
+	mark := func(handler Handler) Handler {
+		return func(request Request) (Response, error) {
+			response, err := handler(request)
+			response.Head.Headers = withHeader(response.Head.Headers, "X-Applied", "yes")
+			return response, err
+		}
+	}
+	handler := WhenRequest(RequestContentTypePredicate("application/json"), mark)(func(request Request) (Response, error) {
+		return OKResponse(), nil
+	})
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			request := Request{Headers: map[string]string{}}
+			if tt.contentType != "" {
+				request.Headers["content-type"] = tt.contentType
+			}
+			response, err := handler(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if applied := hasHeader(response.Head.Headers, "X-Applied"); applied != tt.wantApplied {
+				t.Errorf("got applied %v, want %v", applied, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestMatchContentType(t *testing.T) {
+	tests := []struct {
+		contentType string
+		types       []string
+		want        bool
+	}{
+		{"text/plain", []string{"text/"}, true},
+		{"text/plain", []string{"text/*"}, true},
+		{"text/plain", []string{"text/html"}, false},
+		{"textual/plain", []string{"text/"}, false},
+		{"Application/JSON; charset=utf-8", []string{"application/json"}, true},
+		{"application/json", []string{"image/png", "application/json"}, true},
+		{"", []string{"text/"}, false},
+	}
+	for _, tt := range tests {
+		got := matchContentType(tt.contentType, tt.types)
+		if got != tt.want {
+			t.Errorf("matchContentType(%q, %q) = %v, want %v", tt.contentType, tt.types, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+)
+
+// NOTE: A cleaner API would pass a context.Context to every Handler. That
+// would break every existing handler though, so for now ContextMiddleware
+// provides one on the side.
+
+// ErrClientDisconnected is the cause of a request context that was canceled
+// because the response couldn't be written to the client.
+var ErrClientDisconnected = errors.New("client disconnected")
+
+// contextIDHeader is the request header that ContextMiddleware uses to tell
+// handlers where to find their context.
+const contextIDHeader = "x-request-context-id"
+
+// requestContexts maps the IDs in contextIDHeader to their context.Context.
+var requestContexts sync.Map
+
+// newID returns a random hex string that's unique enough to identify a request.
+func newID() string {
+	b := make([]byte, 8)
+	// crypto/rand.Read never returns an error
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// RequestContext returns the context that ContextMiddleware created for
+// request, or context.Background() if there isn't one.
+func RequestContext(request Request) context.Context {
+	id, ok := request.Headers[contextIDHeader]
+	if !ok {
+		return context.Background()
+	}
+	ctx, ok := requestContexts.Load(id)
+	if !ok {
+		return context.Background()
+	}
+	return ctx.(context.Context)
+}
+
+// ContextMiddleware creates a context.Context for every request that handlers
+// can get with RequestContext. The context is canceled once the response has
+// been written, so that it covers a StreamBody too. If the server fails to
+// write the response (e.g. the client hung up), the cause of the cancellation
+// is ErrClientDisconnected, so anything still producing the body knows to
+// stop. If the request is abandoned while the handler is running, the cause is
+// whatever Request.Err says, e.g. ErrClientDisconnected or ErrHandlerTimeout.
+//
+// For requests that weren't made by a Server, there's nothing to say when the
+// response has been written, so the context is canceled once the handler
+// returns.
+func ContextMiddleware(handler Handler) Handler {
+	middleware := func(request Request) (Response, error) {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		id := newID()
+		requestContexts.Store(id, ctx)
+		done := func(cause error) {
+			cancel(cause)
+			requestContexts.Delete(id)
+		}
+		request.Headers = withHeader(request.Headers, contextIDHeader, id)
+
+		if request.state == nil {
+			defer done(context.Canceled)
+			return handler(request)
+		}
+		go func() {
+			select {
+			case <-request.Done():
+				done(request.Err())
+			case <-ctx.Done():
+			}
+		}()
+		request.state.onFinish(func(err error) {
+			if err != nil {
+				done(ErrClientDisconnected)
+				return
+			}
+			done(context.Canceled)
+		})
+		return handler(request)
+	}
+	return middleware
+}
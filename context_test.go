@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForCause waits for ctx to be canceled and returns why.
+func waitForCause(t *testing.T, ctx <-chan context.Context) error {
+	t.Helper()
+	var c context.Context
+	select {
+	case c = <-ctx:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler never ran")
+	}
+	select {
+	case <-c.Done():
+		return context.Cause(c)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the context wasn't canceled")
+		return nil
+	}
+}
+
+func TestContextMiddlewareDisconnectDuringHandler(t *testing.T) {
+	s := &Server{}
+	s.RegisterMiddleware(ContextMiddleware)
+	contexts := make(chan context.Context, 1)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		ctx := RequestContext(request)
+		contexts <- ctx
+		<-ctx.Done()
+		return OKResponse(), nil
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	// hang up once the handler is running
+	ctx := <-contexts
+	conn.Close()
+	contexts <- ctx
+
+	cause := waitForCause(t, contexts)
+	if !errors.Is(cause, ErrClientDisconnected) {
+		t.Errorf("got cause %v, want ErrClientDisconnected", cause)
+	}
+}
+
+func TestContextMiddlewareDisconnectDuringResponse(t *testing.T) {
+	s := &Server{}
+	s.RegisterMiddleware(ContextMiddleware)
+	contexts := make(chan context.Context, 1)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		ctx := RequestContext(request)
+		contexts <- ctx
+		response := OKResponse()
+		response.Body = &StreamBody{AutoFlush: true, Stream: func(w *ResponseWriter) error {
+			for ctx.Err() == nil {
+				_, err := io.WriteString(w, strings.Repeat("x", 1024))
+				if err != nil {
+					return err
+				}
+				time.Sleep(time.Millisecond)
+			}
+			return nil
+		}}
+		return response, nil
+	})
+	addr := startServer(t, s)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	// hang up partway through the body
+	io.ReadFull(conn, make([]byte, 4096))
+	conn.Close()
+
+	cause := waitForCause(t, contexts)
+	if !errors.Is(cause, ErrClientDisconnected) {
+		t.Errorf("got cause %v, want ErrClientDisconnected", cause)
+	}
+}
+
+func TestContextMiddlewareResponseWritten(t *testing.T) {
+	s := &Server{}
+	s.RegisterMiddleware(ContextMiddleware)
+	contexts := make(chan context.Context, 1)
+	s.RegisterHandler("/stream", func(request Request) (Response, error) {
+		ctx := RequestContext(request)
+		contexts <- ctx
+		response := OKResponse()
+		response.Body = &StreamBody{Stream: func(w *ResponseWriter) error {
+			// the context lasts as long as the body is being written
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			_, err := io.WriteString(w, "hello")
+			return err
+		}}
+		return response, nil
+	})
+	s.RegisterHandler("/bytes", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("hello"))
+		return response, nil
+	})
+	addr := startServer(t, s)
+
+	response, body := parseResponse(t, rawRequest(t, addr, "GET /stream HTTP/1.1\r\n\r\n"))
+	if body != "hello" {
+		t.Errorf("got body %q, want %q", body, "hello")
+	}
+	// the middleware mustn't hide the StreamBody from the server
+	if len(response.TransferEncoding) != 1 || response.TransferEncoding[0] != "chunked" {
+		t.Errorf("got Transfer-Encoding %v, want chunked", response.TransferEncoding)
+	}
+	cause := waitForCause(t, contexts)
+	if !errors.Is(cause, context.Canceled) {
+		t.Errorf("got cause %v, want context.Canceled", cause)
+	}
+
+	// nor a body's length
+	response, _ = parseResponse(t, rawRequest(t, addr, "GET /bytes HTTP/1.1\r\n\r\n"))
+	if response.ContentLength != 5 {
+		t.Errorf("got Content-Length %d, want 5", response.ContentLength)
+	}
+}
+
+func TestContextMiddlewareHeaders(t *testing.T) {
+	headers := map[string]string{"host": "example.com"}
+	handler := ContextMiddleware(func(request Request) (Response, error) {
+		if RequestContext(request) == context.Background() {
+			t.Error("the handler didn't get a context")
+		}
+		return OKResponse(), nil
+	})
+	handler(Request{Headers: headers})
+	// the caller's headers may be pooled, so they mustn't be changed
+	if len(headers) != 1 {
+		t.Errorf("the middleware changed the request's headers: %v", headers)
+	}
+}
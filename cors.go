@@ -0,0 +1,77 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// corsAllowMethods is sent in response to every preflight request.
+const corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// NewCORSMiddleware lets browsers on the given origins (e.g.
+// "http://localhost:3000") read responses from the server. An origin of "*"
+// allows every origin. Requests from other origins are still served, they just
+// don't get any CORS headers, so the browser hides the response.
+//
+// Preflight requests (an OPTIONS with Access-Control-Request-Method) from an
+// allowed origin are answered with a 204 without calling the handler.
+func NewCORSMiddleware(origins []string) Middleware {
+	allowed := slices.Clone(origins)
+	allowAll := slices.Contains(allowed, "*")
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			origin := request.Headers["origin"]
+			if origin == "" || !(allowAll || slices.Contains(allowed, origin)) {
+				return handler(request)
+			}
+
+			if request.Method == "OPTIONS" && request.Headers["access-control-request-method"] != "" {
+				headers := map[string]string{
+					"Access-Control-Allow-Origin":  origin,
+					"Access-Control-Allow-Methods": corsAllowMethods,
+					"Vary":                         "Origin",
+				}
+				if requested := request.Headers["access-control-request-headers"]; requested != "" {
+					headers["Access-Control-Allow-Headers"] = requested
+				}
+				return Response{Head: ResponseHead{Status: 204, Reason: "No Content", Headers: headers}}, nil
+			}
+
+			response, err := handler(request)
+			// the browser has to be allowed to read errors too
+			if httpErr, ok := asHTTPError(err); ok {
+				httpErr.Headers = withCORSHeaders(httpErr.Headers, origin)
+				return response, httpErr
+			}
+			if err != nil {
+				return response, err
+			}
+			response.Head.Headers = withCORSHeaders(response.Head.Headers, origin)
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// withCORSHeaders returns a copy of headers that lets origin read the
+// response.
+func withCORSHeaders(headers map[string]string, origin string) map[string]string {
+	headers = withHeader(headers, "Access-Control-Allow-Origin", origin)
+	if !hasHeader(headers, "Vary") {
+		headers["Vary"] = "Origin"
+	}
+	return headers
+}
+
+// parseOrigins splits a comma separated list of origins, dropping empty ones.
+func parseOrigins(list string) []string {
+	var origins []string
+	for _, origin := range strings.Split(list, ",") {
+		origin = strings.TrimSpace(origin)
+		if origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
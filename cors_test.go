@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io"
+	"testing"
+)
+
+func TestCORSFromFlags(t *testing.T) {
+	c, err := parseFlags("simple-http-server", []string{"-port", "0", "-directory", t.TempDir(), "-read-only", "-cors-origin", "http://localhost:3000, http://localhost:8000"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		request    string
+		wantStatus int
+		// wantOrigin is the Access-Control-Allow-Origin header, or "" for
+		// none
+		wantOrigin string
+	}{
+		{"allowed origin", "GET / HTTP/1.1\r\nOrigin: http://localhost:3000\r\n\r\n", 200, "http://localhost:3000"},
+		{"second allowed origin", "GET / HTTP/1.1\r\nOrigin: http://localhost:8000\r\n\r\n", 200, "http://localhost:8000"},
+		{"other origin", "GET / HTTP/1.1\r\nOrigin: http://evil.example.com\r\n\r\n", 200, ""},
+		{"no origin", "GET / HTTP/1.1\r\n\r\n", 200, ""},
+		{"not found", "GET /files/missing.txt HTTP/1.1\r\nOrigin: http://localhost:3000\r\n\r\n", 404, "http://localhost:3000"},
+		{"HTTPError", "POST /files/a.txt HTTP/1.1\r\nOrigin: http://localhost:3000\r\nContent-Length: 1\r\n\r\na", 405, "http://localhost:3000"},
+		{"preflight", "OPTIONS /files/a.txt HTTP/1.1\r\nOrigin: http://localhost:3000\r\nAccess-Control-Request-Method: PUT\r\n\r\n", 204, "http://localhost:3000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := pipeRequest(t, s, tt.request)
+			response, _ := parseResponse(t, raw)
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if got := response.Header.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("got Access-Control-Allow-Origin %q, want %q", got, tt.wantOrigin)
+			}
+			if tt.wantOrigin != "" && response.Header.Get("Vary") != "Origin" {
+				t.Errorf("got Vary %q, want Origin", response.Header.Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSMiddlewareAllowAll(t *testing.T) {
+	handler := NewCORSMiddleware([]string{"*"})(func(request Request) (Response, error) {
+		return Response{}, HTTPError{Status: 400, Message: "bad request", Headers: map[string]string{"Vary": "Accept"}}
+	})
+	_, err := handler(Request{Headers: map[string]string{"origin": "https://example.com"}})
+	httpErr, ok := asHTTPError(err)
+	if !ok {
+		t.Fatalf("got %v, want the HTTPError", err)
+	}
+	if got := getHeader(httpErr.Headers, "Access-Control-Allow-Origin"); got != "https://example.com" {
+		t.Errorf("got Access-Control-Allow-Origin %q, want the request's origin", got)
+	}
+	// a Vary that the handler set is kept
+	if got := getHeader(httpErr.Headers, "Vary"); got != "Accept" {
+		t.Errorf("got Vary %q, want the handler's", got)
+	}
+}
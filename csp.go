@@ -0,0 +1,63 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// cspNonceHeader is the request header that NewCSPNonceMiddleware puts the
+// request's nonce in, for handlers that generate HTML.
+const cspNonceHeader = "x-csp-nonce"
+
+// cspNoncePlaceholder is replaced with the nonce in a CSP template.
+const cspNoncePlaceholder = "{{nonce}}"
+
+// newCSPNonce returns 16 random bytes encoded as base64.
+func newCSPNonce() string {
+	b := make([]byte, 16)
+	// crypto/rand.Read never returns an error
+	rand.Read(b)
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// NewCSPNonceMiddleware generates a random nonce for every request and sends
+// policyTemplate as the Content-Security-Policy header, with each {{nonce}} in
+// it replaced by the nonce, e.g.
+//
+//	script-src 'nonce-{{nonce}}'
+//
+// Handlers get the nonce in the X-Csp-Nonce request header, so that they can
+// add it to the <script> (or <style>) tags they generate. Whatever the client
+// sent in that header is replaced. Responses that already have a
+// Content-Security-Policy are left alone, like with HeaderInjectionMiddleware.
+//
+// A template without {{nonce}}, or that couldn't be sent as a header, is a
+// programming error and panics.
+func NewCSPNonceMiddleware(policyTemplate string) Middleware {
+	if !strings.Contains(policyTemplate, cspNoncePlaceholder) {
+		panic(fmt.Sprintf("NewCSPNonceMiddleware: policy template doesn't contain %s", cspNoncePlaceholder))
+	}
+	err := validateHeader("Content-Security-Policy", policyTemplate)
+	if err != nil {
+		panic(fmt.Sprintf("NewCSPNonceMiddleware: %s", err))
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			nonce := newCSPNonce()
+			request.Headers = withHeader(request.Headers, cspNonceHeader, nonce)
+			response, err := handler(request)
+			if err != nil {
+				return response, err
+			}
+			if !hasHeader(response.Head.Headers, "Content-Security-Policy") {
+				policy := strings.ReplaceAll(policyTemplate, cspNoncePlaceholder, nonce)
+				response.Head.Headers = withHeader(response.Head.Headers, "Content-Security-Policy", policy)
+			}
+			return response, nil
+		}
+		return middleware
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestCSPNonceMiddleware(t *testing.T) {
+	const template = "default-src 'self'; script-src 'nonce-{{nonce}}'; style-src 'nonce-{{nonce}}'"
+	var seen string
+	handler := NewCSPNonceMiddleware(template)(func(request Request) (Response, error) {
+		seen = request.Headers[cspNonceHeader]
+		return OKResponse(), nil
+	})
+
+	nonces := make(map[string]bool)
+	for range 100 {
+		// a nonce sent by the client is never used
+		response, err := handler(Request{Headers: map[string]string{cspNonceHeader: "chosen-by-client"}})
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(seen)
+		if err != nil {
+			t.Fatalf("nonce %q isn't base64: %v", seen, err)
+		}
+		if len(decoded) != 16 {
+			t.Errorf("nonce %q has %d bytes, want 16", seen, len(decoded))
+		}
+		want := strings.ReplaceAll(template, "{{nonce}}", seen)
+		if got := getHeader(response.Head.Headers, "Content-Security-Policy"); got != want {
+			t.Errorf("got Content-Security-Policy %q, want %q", got, want)
+		}
+		if nonces[seen] {
+			t.Fatalf("nonce %q was used twice", seen)
+		}
+		nonces[seen] = true
+	}
+}
+
+func TestCSPNonceMiddlewareResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		response Response
+		err      error
+		want     string
+	}{
+		{"set", OKResponse(), nil, "script-src 'nonce-"},
+		{
+			"already set",
+			Response{Head: ResponseHead{Status: 200, Headers: map[string]string{"Content-Security-Policy": "default-src 'none'"}}},
+			nil, "default-src 'none'",
+		},
+		{"error", Response{}, HTTPError{Status: 404}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewCSPNonceMiddleware("script-src 'nonce-{{nonce}}'")(func(request Request) (Response, error) {
+				return tt.response, tt.err
+			})
+			response, _ := handler(Request{})
+			got := getHeader(response.Head.Headers, "Content-Security-Policy")
+			if !strings.HasPrefix(got, tt.want) || (tt.want == "" && got != "") {
+				t.Errorf("got Content-Security-Policy %q, want %q...", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCSPNonceMiddlewareBadTemplate(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+	}{
+		{"no placeholder", "script-src 'self'"},
+		{"newline", "script-src 'nonce-{{nonce}}'\r\nX-Injected: yes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("NewCSPNonceMiddleware didn't panic")
+				}
+			}()
+			NewCSPNonceMiddleware(tt.template)
+		})
+	}
+}
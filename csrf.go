@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// csrfCookie holds "<session ID>.<token>". It isn't HttpOnly, since the page's
+// scripts need to read the token to send it back in csrfHeader.
+const csrfCookie = "csrf_token"
+
+// csrfHeader and csrfFormField are where a state-changing request has to
+// repeat its token.
+const (
+	csrfHeader    = "x-csrf-token"
+	csrfFormField = "csrf_token"
+)
+
+// maxCSRFFormSize bounds how much of a form body is read looking for the token.
+const maxCSRFFormSize = 1 << 20
+
+// CSRFStore keeps track of the CSRF token for each session.
+type CSRFStore interface {
+	// Generate returns the token for sessionID, creating one if needed.
+	Generate(sessionID string) string
+	// Validate reports whether token is the one issued for sessionID. It
+	// should compare them in constant time.
+	Validate(sessionID string, token string) bool
+}
+
+// Defaults for MemoryCSRFStore.
+const (
+	defaultCSRFTTL         = 12 * time.Hour
+	defaultMaxCSRFSessions = 100_000
+)
+
+// MemoryCSRFStore is a CSRFStore that keeps one token per session in memory.
+// Every visitor without a cookie starts a new session, so sessions are
+// forgotten once they go unused for TTL, and the least recently used ones are
+// forgotten when there are more than MaxSessions.
+type MemoryCSRFStore struct {
+	// TTL is how long a token stays valid after its session was last used. 0
+	// means 12 hours.
+	TTL time.Duration
+	// MaxSessions is how many sessions are remembered at once. 0 means
+	// 100,000.
+	MaxSessions int
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	// lru holds *csrfSessions, most recently used first
+	lru list.List
+}
+
+type csrfSession struct {
+	id      string
+	token   string
+	expires time.Time
+}
+
+func (m *MemoryCSRFStore) Generate(sessionID string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sessions == nil {
+		m.sessions = make(map[string]*list.Element)
+	}
+	now := time.Now()
+	m.evict(now)
+	e, ok := m.sessions[sessionID]
+	if !ok {
+		e = m.lru.PushFront(&csrfSession{id: sessionID, token: newID() + newID()})
+		m.sessions[sessionID] = e
+	}
+	m.touch(e, now)
+	maxSessions := m.MaxSessions
+	if maxSessions <= 0 {
+		maxSessions = defaultMaxCSRFSessions
+	}
+	for m.lru.Len() > maxSessions {
+		m.remove(m.lru.Back())
+	}
+	return e.Value.(*csrfSession).token
+}
+
+func (m *MemoryCSRFStore) Validate(sessionID string, token string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	m.evict(now)
+	e, ok := m.sessions[sessionID]
+	if !ok {
+		return false
+	}
+	valid := subtle.ConstantTimeCompare([]byte(e.Value.(*csrfSession).token), []byte(token)) == 1
+	if valid {
+		m.touch(e, now)
+	}
+	return valid
+}
+
+// touch marks the session in e as used at now. m.mu must be held.
+func (m *MemoryCSRFStore) touch(e *list.Element, now time.Time) {
+	ttl := m.TTL
+	if ttl <= 0 {
+		ttl = defaultCSRFTTL
+	}
+	e.Value.(*csrfSession).expires = now.Add(ttl)
+	m.lru.MoveToFront(e)
+}
+
+// evict forgets the sessions that have expired by now. They're the least
+// recently used, so they're all at the back of m.lru. m.mu must be held.
+func (m *MemoryCSRFStore) evict(now time.Time) {
+	for e := m.lru.Back(); e != nil && !now.Before(e.Value.(*csrfSession).expires); e = m.lru.Back() {
+		m.remove(e)
+	}
+}
+
+// remove forgets the session in e. m.mu must be held.
+func (m *MemoryCSRFStore) remove(e *list.Element) {
+	m.lru.Remove(e)
+	delete(m.sessions, e.Value.(*csrfSession).id)
+}
+
+// getCookie returns the value of the named cookie in the request's Cookie
+// header.
+func getCookie(request Request, name string) (string, bool) {
+	for _, cookie := range strings.Split(request.Headers["cookie"], ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(cookie), "=")
+		if ok && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// NewCSRFMiddleware protects state-changing requests from cross-site request
+// forgery with the double-submit pattern.
+//
+// GET (and other safe) requests get a Set-Cookie for "csrf_token", whose value
+// is "<session ID>.<token>". POST, PUT, PATCH and DELETE requests must send the
+// cookie back along with the token (or the whole cookie value) in the
+// X-CSRF-Token header or, for urlencoded forms, a "csrf_token" form field.
+// Otherwise they get a 403.
+func NewCSRFMiddleware(tokenStore CSRFStore) Middleware {
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			sessionID := ""
+			if value, ok := getCookie(request, csrfCookie); ok {
+				sessionID, _, _ = strings.Cut(value, ".")
+			}
+
+			switch request.Method {
+			case "POST", "PUT", "PATCH", "DELETE":
+				token, err := csrfRequestToken(&request)
+				if err != nil {
+					return Response{}, err
+				}
+				if sessionID == "" || token == "" || !tokenStore.Validate(sessionID, token) {
+					return Response{}, HTTPError{Status: 403, Message: "missing or invalid CSRF token"}
+				}
+				return handler(request)
+			}
+
+			if sessionID == "" {
+				sessionID = newID()
+			}
+			token := tokenStore.Generate(sessionID)
+			response, err := handler(request)
+			if err != nil {
+				return response, err
+			}
+			cookie := fmt.Sprintf("%s=%s.%s; Path=/; SameSite=Strict", csrfCookie, sessionID, token)
+			response.Head.Headers = withHeader(response.Head.Headers, "Set-Cookie", cookie)
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// csrfRequestToken finds the token that a state-changing request repeated. If
+// it has to look in a form body, the body is replaced so that the handler can
+// still read it.
+func csrfRequestToken(request *Request) (string, error) {
+	token := request.Headers[csrfHeader]
+	if token == "" && request.Body != nil && matchContentType(request.Headers["content-type"], []string{"application/x-www-form-urlencoded"}) {
+		body, err := io.ReadAll(io.LimitReader(request.Body, maxCSRFFormSize))
+		if err != nil {
+			return "", fmt.Errorf("read form body for CSRF token: %w", err)
+		}
+		request.Body = io.MultiReader(bytes.NewReader(body), request.Body)
+		form, err := url.ParseQuery(string(body))
+		if err == nil {
+			token = form.Get(csrfFormField)
+		}
+	}
+	// the whole cookie value is accepted too
+	if _, t, ok := strings.Cut(token, "."); ok {
+		token = t
+	}
+	return token, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// csrfCookieValue gets a "csrf_token" cookie's value from a Set-Cookie header.
+func csrfCookieValue(t *testing.T, response Response) string {
+	t.Helper()
+	setCookie := getHeader(response.Head.Headers, "Set-Cookie")
+	cookie, _, _ := strings.Cut(setCookie, ";")
+	value, ok := strings.CutPrefix(cookie, csrfCookie+"=")
+	if !ok {
+		t.Fatalf("got Set-Cookie %q, want a %s cookie", setCookie, csrfCookie)
+	}
+	return value
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := NewCSRFMiddleware(&MemoryCSRFStore{})(echoHandler)
+	response, err := handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/form"}, Headers: map[string]string{}})
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	value := csrfCookieValue(t, response)
+	sessionID, token, _ := strings.Cut(value, ".")
+	if sessionID == "" || token == "" {
+		t.Fatalf("got cookie %q, want <session ID>.<token>", value)
+	}
+
+	// a second page load in the same session gets the same token
+	response, err = handler(Request{RequestLine: RequestLine{Method: "GET"}, Headers: map[string]string{"cookie": csrfCookie + "=" + value}})
+	if err != nil {
+		t.Fatalf("second GET: %v", err)
+	}
+	if got := csrfCookieValue(t, response); got != value {
+		t.Errorf("got cookie %q on the second GET, want %q", got, value)
+	}
+
+	other, err := handler(Request{RequestLine: RequestLine{Method: "GET"}, Headers: map[string]string{}})
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	otherValue := csrfCookieValue(t, other)
+	_, otherToken, _ := strings.Cut(otherValue, ".")
+
+	form := "application/x-www-form-urlencoded"
+	tests := []struct {
+		name    string
+		method  string
+		cookie  string
+		headers map[string]string
+		body    string
+		// wantStatus is 0 if the handler should be reached
+		wantStatus int
+	}{
+		{"header", "POST", value, map[string]string{csrfHeader: token}, "", 0},
+		{"whole cookie in header", "PUT", value, map[string]string{csrfHeader: value}, "", 0},
+		{"form field", "POST", value, map[string]string{"content-type": form}, "a=1&csrf_token=" + token, 0},
+		{"missing token", "POST", value, nil, "", 403},
+		{"missing form field", "POST", value, map[string]string{"content-type": form}, "a=1", 403},
+		{"mismatched token", "DELETE", value, map[string]string{csrfHeader: otherToken}, "", 403},
+		{"wrong session", "PATCH", otherValue, map[string]string{csrfHeader: token}, "", 403},
+		{"unknown session", "POST", "unknown." + token, map[string]string{csrfHeader: token}, "", 403},
+		{"no cookie", "POST", "", map[string]string{csrfHeader: token}, "", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			for name, value := range tt.headers {
+				headers[name] = value
+			}
+			if tt.cookie != "" {
+				headers["cookie"] = "theme=dark; " + csrfCookie + "=" + tt.cookie
+			}
+			request := Request{RequestLine: RequestLine{Method: tt.method, Path: "/form"}, Headers: headers, Body: strings.NewReader(tt.body)}
+			response, err := handler(request)
+			if tt.wantStatus != 0 {
+				httpErr, ok := asHTTPError(err)
+				if !ok || httpErr.Status != tt.wantStatus {
+					t.Errorf("got %v, want a %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want the handler to run", err)
+			}
+			// the handler still gets the whole body
+			body, _ := io.ReadAll(response.Body)
+			if string(body) != tt.body {
+				t.Errorf("handler read body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestMemoryCSRFStoreTTL(t *testing.T) {
+	store := &MemoryCSRFStore{TTL: 50 * time.Millisecond}
+	token := store.Generate("session")
+	if !store.Validate("session", token) {
+		t.Fatal("a fresh token wasn't valid")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if store.Validate("session", token) {
+		t.Error("a token was still valid after its TTL")
+	}
+	if store.lru.Len() != 0 || len(store.sessions) != 0 {
+		t.Errorf("%d sessions are still stored, want 0", len(store.sessions))
+	}
+	if store.Generate("session") == token {
+		t.Error("an expired session got its old token back")
+	}
+}
+
+func TestMemoryCSRFStoreMaxSessions(t *testing.T) {
+	store := &MemoryCSRFStore{MaxSessions: 2}
+	a := store.Generate("a")
+	b := store.Generate("b")
+	// using a makes b the least recently used
+	store.Validate("a", a)
+	c := store.Generate("c")
+
+	tests := []struct {
+		session string
+		token   string
+		want    bool
+	}{
+		{"a", a, true},
+		{"b", b, false},
+		{"c", c, true},
+	}
+	for _, tt := range tests {
+		if got := store.Validate(tt.session, tt.token); got != tt.want {
+			t.Errorf("Validate(%q) = %v, want %v", tt.session, got, tt.want)
+		}
+	}
+	if len(store.sessions) != 2 {
+		t.Errorf("%d sessions are stored, want 2", len(store.sessions))
+	}
+}
+
+func TestMemoryCSRFStoreCookielessRequests(t *testing.T) {
+	store := &MemoryCSRFStore{MaxSessions: 10}
+	handler := NewCSRFMiddleware(store)(echoHandler)
+	// a client that never sends the cookie back starts a session every time
+	for range 100 {
+		_, err := handler(Request{RequestLine: RequestLine{Method: "GET"}, Headers: map[string]string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(store.sessions) != 10 {
+		t.Errorf("%d sessions are stored, want at most 10", len(store.sessions))
+	}
+}
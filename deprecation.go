@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// httpDateFormat is the IMF-fixdate format that HTTP uses for dates, e.g.
+// "Sun, 06 Nov 1994 08:49:37 GMT". Times have to be in UTC.
+const httpDateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// NewDeprecationMiddleware marks every response as coming from a deprecated
+// API, following the IETF Deprecation header draft:
+//
+//	Deprecation: true
+//	Sunset: Sat, 01 Nov 2025 00:00:00 GMT
+//	Link: <https://example.com/v2>; rel="successor-version"
+//
+// Sunset is when the API will stop working, and is left out if sunset is the
+// zero time. Link points to what replaces it, and is left out if link is
+// empty. A Link header that the handler already set is added to rather than
+// replaced. Handlers that fail with an HTTPError get the headers too.
+//
+// A link that can't be put in a header is a programming error and panics.
+func NewDeprecationMiddleware(sunset time.Time, link string) Middleware {
+	if strings.ContainsAny(link, "<>\r\n") {
+		panic(fmt.Sprintf("NewDeprecationMiddleware: invalid link '%s'", link))
+	}
+	deprecate := func(headers map[string]string) map[string]string {
+		headers = withHeader(headers, "Deprecation", "true")
+		if !sunset.IsZero() {
+			headers = withHeader(headers, "Sunset", sunset.UTC().Format(httpDateFormat))
+		}
+		if link != "" {
+			successor := fmt.Sprintf(`<%s>; rel="successor-version"`, link)
+			if existing := getHeader(headers, "Link"); existing != "" {
+				successor = existing + ", " + successor
+			}
+			// headers is already a copy, so it can be changed in place
+			for name := range headers {
+				if strings.EqualFold(name, "Link") {
+					delete(headers, name)
+				}
+			}
+			headers["Link"] = successor
+		}
+		return headers
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if httpErr, ok := asHTTPError(err); ok {
+				httpErr.Headers = deprecate(httpErr.Headers)
+				return response, httpErr
+			}
+			if err != nil {
+				return response, err
+			}
+			response.Head.Headers = deprecate(response.Head.Headers)
+			return response, nil
+		}
+		return middleware
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDeprecationMiddleware(t *testing.T) {
+	// not in UTC, which the Sunset header has to be
+	sunset := time.Date(2025, time.November, 1, 9, 30, 0, 0, time.FixedZone("UTC+9", 9*60*60))
+	tests := []struct {
+		name    string
+		sunset  time.Time
+		link    string
+		headers map[string]string
+		err     error
+		want    map[string]string
+	}{
+		{
+			"everything", sunset, "https://example.com/v2", nil, nil,
+			map[string]string{
+				"Deprecation": "true",
+				"Sunset":      "Sat, 01 Nov 2025 00:30:00 GMT",
+				"Link":        `<https://example.com/v2>; rel="successor-version"`,
+			},
+		},
+		{"no sunset", time.Time{}, "https://example.com/v2", nil, nil, map[string]string{
+			"Deprecation": "true",
+			"Link":        `<https://example.com/v2>; rel="successor-version"`,
+		}},
+		{"no link", sunset, "", nil, nil, map[string]string{
+			"Deprecation": "true",
+			"Sunset":      "Sat, 01 Nov 2025 00:30:00 GMT",
+		}},
+		{
+			"existing link", time.Time{}, "/v2", map[string]string{"link": `</docs>; rel="help"`}, nil,
+			map[string]string{"Deprecation": "true", "Link": `</docs>; rel="help", </v2>; rel="successor-version"`},
+		},
+		{
+			"HTTPError", time.Time{}, "/v2", nil, HTTPError{Status: 404},
+			map[string]string{"Deprecation": "true", "Link": `</v2>; rel="successor-version"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewDeprecationMiddleware(tt.sunset, tt.link)(func(request Request) (Response, error) {
+				if tt.err != nil {
+					return Response{}, tt.err
+				}
+				response := OKResponse()
+				response.Head.Headers = maps.Clone(tt.headers)
+				return response, nil
+			})
+			response, err := handler(Request{})
+			got := response.Head.Headers
+			if tt.err != nil {
+				var httpErr HTTPError
+				if !errors.As(err, &httpErr) {
+					t.Fatalf("got %v, want an HTTPError", err)
+				}
+				got = httpErr.Headers
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got headers %v, want %v", got, tt.want)
+			}
+			// and it's a date that HTTP clients understand
+			if s := got["Sunset"]; s != "" {
+				parsed, err := http.ParseTime(s)
+				if err != nil || !parsed.Equal(tt.sunset) {
+					t.Errorf("Sunset %q parses as %v (%v), want %v", s, parsed, err, tt.sunset)
+				}
+			}
+		})
+	}
+}
+
+func TestDeprecationMiddlewareBadLink(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewDeprecationMiddleware didn't panic")
+		}
+	}()
+	NewDeprecationMiddleware(time.Time{}, "https://example.com/>; rel=evil")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// requestState is shared by every copy of a Request, so that the server can
+// tell the handler when the request should be abandoned.
+type requestState struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+
+	// the watcher is only used to detect clients that disconnect
+	watching chan struct{}
+	stopped  atomic.Bool
+
+	// tempDir is the Server's TempDir, see Request.tempDir
+	tempDir string
+	// received is when the request line was read, see RequestStartMiddleware
+	received time.Time
+
+	// finishMu guards the rest, which is for onFinish
+	finishMu   sync.Mutex
+	finished   bool
+	finishErr  error
+	onFinished []func(err error)
+}
+
+func newRequestState() *requestState {
+	return &requestState{done: make(chan struct{})}
+}
+
+// cancel closes the done channel with err as the reason. Only the first call
+// has any effect.
+func (s *requestState) cancel(err error) {
+	s.once.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// onFinish arranges for f to be called once the server is done with the
+// request, with the error from writing the response (or nil if it was
+// written). If that has already happened, f is called straight away.
+func (s *requestState) onFinish(f func(err error)) {
+	s.finishMu.Lock()
+	if !s.finished {
+		s.onFinished = append(s.onFinished, f)
+		s.finishMu.Unlock()
+		return
+	}
+	err := s.finishErr
+	s.finishMu.Unlock()
+	f(err)
+}
+
+// finish calls everything given to onFinish with err. Only the first call has
+// any effect.
+func (s *requestState) finish(err error) {
+	s.finishMu.Lock()
+	if s.finished {
+		s.finishMu.Unlock()
+		return
+	}
+	s.finished = true
+	s.finishErr = err
+	onFinished := s.onFinished
+	s.onFinished = nil
+	s.finishMu.Unlock()
+	for _, f := range onFinished {
+		f(err)
+	}
+}
+
+// isDisconnect reports whether err is from the client having hung up.
+func isDisconnect(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// readDeadliner is implemented by connections that a watcher can be stopped on.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// watch waits in the background for the client to hang up, and cancels the
+// request if it does. It must only be called once the request body has been
+// read, because buf is read from to notice the hang up. Peeking means that
+// nothing is taken from buf if the client sends more data instead.
+func (s *requestState) watch(buf *bufio.Reader) {
+	s.watching = make(chan struct{})
+	go func() {
+		defer close(s.watching)
+		_, err := buf.Peek(1)
+		if err != nil && !s.stopped.Load() {
+			s.cancel(ErrClientDisconnected)
+		}
+	}()
+}
+
+// stopWatching stops the watcher (if there is one) and waits for it to exit.
+func (s *requestState) stopWatching(conn readDeadliner) {
+	if s.watching == nil {
+		return
+	}
+	s.stopped.Store(true)
+	// a deadline in the past wakes up the blocked Peek
+	conn.SetReadDeadline(time.Unix(1, 0))
+	<-s.watching
+	conn.SetReadDeadline(time.Time{})
+}
+
+// Done returns a channel that's closed when the handler's work is no longer
+// wanted, i.e. the client has disconnected. Err says why. Handlers can check
+// it before starting something expensive.
+//
+// Disconnects are only noticed once the request body has been read, and only
+// while the handler is running. For requests that weren't made by the Server,
+// Done returns nil.
+func (r Request) Done() <-chan struct{} {
+	if r.state == nil {
+		return nil
+	}
+	return r.state.done
+}
+
+// Err returns nil until Done is closed, and after that the reason it was.
+func (r Request) Err() error {
+	if r.state == nil {
+		return nil
+	}
+	select {
+	case <-r.state.done:
+		return r.state.err
+	default:
+		return nil
+	}
+}
+
+// bodyReader reads a request body of a known length, returning io.EOF at the
+// end of it rather than blocking on the connection. consumed is called once
+// the whole body has been read.
+type bodyReader struct {
+	r         io.Reader
+	remaining int64
+	consumed  func()
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	if b.remaining <= 0 {
+		b.finish()
+		return 0, io.EOF
+	}
+	if int64(len(p)) > b.remaining {
+		p = p[:b.remaining]
+	}
+	n, err := b.r.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining <= 0 {
+		b.finish()
+	}
+	return n, err
+}
+
+func (b *bodyReader) finish() {
+	if b.consumed != nil {
+		b.consumed()
+		b.consumed = nil
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRequestDoneOnDisconnect(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"no body", "GET / HTTP/1.1\r\n\r\n"},
+		{"body", "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			errs := make(chan error, 1)
+			running := make(chan struct{})
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				io.Copy(io.Discard, request.Body)
+				close(running)
+				select {
+				case <-request.Done():
+					errs <- request.Err()
+				case <-time.After(5 * time.Second):
+					errs <- nil
+				}
+				return OKResponse(), nil
+			})
+			conn, err := net.Dial("tcp", startServer(t, s))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			io.WriteString(conn, tt.request)
+			<-running
+			conn.Close()
+
+			err = <-errs
+			if !errors.Is(err, ErrClientDisconnected) {
+				t.Errorf("got Err %v, want ErrClientDisconnected", err)
+			}
+		})
+	}
+}
+
+func TestRequestNotDoneWhenClientStays(t *testing.T) {
+	s := &Server{}
+	done := make(chan bool, 1)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		io.Copy(io.Discard, request.Body)
+		// give a watcher the chance to get it wrong
+		select {
+		case <-request.Done():
+			done <- true
+		case <-time.After(50 * time.Millisecond):
+			done <- request.Err() != nil
+		}
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("hello"))
+		return response, nil
+	})
+	addr := startServer(t, s)
+
+	response, body := parseResponse(t, rawRequest(t, addr, "POST / HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello"))
+	if response.StatusCode != 200 || body != "hello" {
+		t.Errorf("got %d %q, want 200 %q", response.StatusCode, body, "hello")
+	}
+	if <-done {
+		t.Error("Done was closed while the client was still there")
+	}
+}
+
+func TestRequestDoneWithoutServer(t *testing.T) {
+	var request Request
+	if request.Done() != nil || request.Err() != nil {
+		t.Error("a Request that the Server didn't make should never be done")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// HTTPError lets a handler respond with an error status without building a
+// whole Response. When a handler returns one, the client gets a response with
+// Status, the extra Headers, and Message as a plain text body.
+type HTTPError struct {
+	Status  int
+	Message string
+	// Headers is optional
+	Headers map[string]string
+}
+
+func (e HTTPError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%d %s", e.Status, statusText(e.Status))
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, statusText(e.Status), e.Message)
+}
+
+// asHTTPError finds an HTTPError (or *HTTPError) in err's chain.
+func asHTTPError(err error) (HTTPError, bool) {
+	var httpErr HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr, true
+	}
+	var httpErrPtr *HTTPError
+	if errors.As(err, &httpErrPtr) && httpErrPtr != nil {
+		return *httpErrPtr, true
+	}
+	return HTTPError{}, false
+}
+
+// internalErrorMessage is the body of the Server's 500s with VerboseErrors.
+const internalErrorMessage = "500 Internal Server Error: the server failed to handle the request. The details have been logged.\nerror id: %s\n"
+
+// errorIDFor returns the ID to log a failed request's error with and send
+// back in its 500, so that a user reporting the 500 can be matched up with the
+// log line. It's the request's X-Request-Id if it has one, or a new ID if it
+// doesn't (or if the request couldn't even be parsed, in which case request
+// is nil).
+func errorIDFor(request *Request) string {
+	if request != nil {
+		id := request.Headers[requestIDHeader]
+		if id != "" && validateHeader("X-Error-Id", id) == nil {
+			return id
+		}
+	}
+	return newID()
+}
+
+// errorResponse is the 500 that the Server sends when a handler (or reading
+// the request) fails with an error that isn't an HTTPError. It's a complete
+// response, so that clients know not to wait for more. errorID is sent back as
+// X-Error-Id, see errorIDFor.
+func (s *Server) errorResponse(errorID string) Response {
+	headers := make(map[string]string, 6)
+	headers["Date"] = time.Now().UTC().Format(httpDateFormat)
+	headers["Connection"] = "close"
+	headers["X-Error-Id"] = errorID
+	if s.ServerHeader != "" {
+		headers["Server"] = s.ServerHeader
+	}
+	response := ErrorResponse()
+	response.Head.Headers = headers
+	if !s.VerboseErrors {
+		headers["Content-Length"] = "0"
+		return response
+	}
+	body := fmt.Sprintf(internalErrorMessage, errorID)
+	headers["Content-Type"] = "text/plain; charset=utf-8"
+	headers["Content-Length"] = strconv.Itoa(len(body))
+	response.Body = newBytesBody([]byte(body))
+	return response
+}
+
+// Response converts e into the Response that's sent to the client.
+func (e HTTPError) Response() Response {
+	headers := make(map[string]string, len(e.Headers)+3)
+	for name, value := range e.Headers {
+		headers[name] = value
+	}
+	headers["Content-Type"] = "text/plain"
+	headers["Content-Length"] = fmt.Sprintf("%d", len(e.Message))
+	headers["Connection"] = "close"
+	status := e.Status
+	if status == 0 {
+		status = 500
+	}
+	response := Response{Head: ResponseHead{Status: status, Reason: statusText(status), Headers: headers}}
+	if e.Message != "" {
+		response.Body = io.NopCloser(bytes.NewBufferString(e.Message))
+	}
+	return response
+}
+
+var statusTexts = map[int]string{
+	100: "Continue",
+	101: "Switching Protocols",
+	200: "OK",
+	201: "Created",
+	202: "Accepted",
+	204: "No Content",
+	206: "Partial Content",
+	301: "Moved Permanently",
+	302: "Found",
+	303: "See Other",
+	304: "Not Modified",
+	307: "Temporary Redirect",
+	308: "Permanent Redirect",
+	400: "Bad Request",
+	401: "Unauthorized",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	408: "Request Timeout",
+	409: "Conflict",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Content Too Large",
+	414: "URI Too Long",
+	415: "Unsupported Media Type",
+	422: "Unprocessable Content",
+	429: "Too Many Requests",
+	431: "Request Header Fields Too Large",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Timeout",
+}
+
+// statusText returns the reason phrase for an HTTP status code, or "" if we
+// don't know it.
+func statusText(status int) string {
+	return statusTexts[status]
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHTTPError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantBody   string
+		wantHeader string
+	}{
+		{"value", HTTPError{Status: 422, Message: "invalid"}, 422, "invalid", ""},
+		{"pointer", &HTTPError{Status: 403, Message: "forbidden"}, 403, "forbidden", ""},
+		{"wrapped", fmt.Errorf("check input: %w", HTTPError{Status: 400, Message: "bad"}), 400, "bad", ""},
+		{"headers", HTTPError{Status: 429, Message: "slow down", Headers: map[string]string{"Retry-After": "5"}}, 429, "slow down", "5"},
+		{"plain error", errors.New("database is down"), 500, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				return Response{}, tt.err
+			})
+			addr := startServer(t, s)
+
+			response, body := parseResponse(t, rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n"))
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if body != tt.wantBody {
+				t.Errorf("got body %q, want %q", body, tt.wantBody)
+			}
+			if got := response.Header.Get("Retry-After"); got != tt.wantHeader {
+				t.Errorf("got Retry-After %q, want %q", got, tt.wantHeader)
+			}
+		})
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	tests := []struct {
+		name          string
+		verbose       bool
+		serverHeader  string
+		wantBody      bool
+		wantServerHdr string
+	}{
+		{"bare", false, "", false, ""},
+		{"server header", false, "simple-http-server/1.0", false, "simple-http-server/1.0"},
+		{"verbose", true, "", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{VerboseErrors: tt.verbose, ServerHeader: tt.serverHeader}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				return Response{}, errors.New("database password is hunter2")
+			})
+			addr := startServer(t, s)
+
+			raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+			response, body := parseResponse(t, raw)
+			if response.StatusCode != 500 {
+				t.Fatalf("got status %d, want 500", response.StatusCode)
+			}
+			// it's framed, so the client knows not to wait for more
+			if response.ContentLength != int64(len(body)) || len(response.TransferEncoding) != 0 {
+				t.Errorf("got Content-Length %d for a %d byte body", response.ContentLength, len(body))
+			}
+			if !response.Close {
+				t.Error("got no Connection: close")
+			}
+			if _, err := http.ParseTime(response.Header.Get("Date")); err != nil {
+				t.Errorf("got Date %q: %v", response.Header.Get("Date"), err)
+			}
+			if got := response.Header.Get("Server"); got != tt.wantServerHdr {
+				t.Errorf("got Server %q, want %q", got, tt.wantServerHdr)
+			}
+			if strings.Contains(raw, "hunter2") {
+				t.Errorf("got %q, which gives away the internal error", raw)
+			}
+			if !tt.wantBody {
+				if body != "" {
+					t.Errorf("got body %q, want none", body)
+				}
+				return
+			}
+			if !strings.HasPrefix(body, "500 Internal Server Error") || response.Header.Get("Content-Type") != "text/plain; charset=utf-8" {
+				t.Errorf("got %q body %q, want a short plain text explanation", response.Header.Get("Content-Type"), body)
+			}
+		})
+	}
+}
+
+func TestErrorIDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers string
+		verbose bool
+		// want is the error ID, or "" for a new one
+		want string
+	}{
+		{"new ID", "", false, ""},
+		{"request ID", "X-Request-Id: abc123\r\n", false, "abc123"},
+		{"verbose", "X-Request-Id: abc123\r\n", true, "abc123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log := captureLog(t)
+			s := &Server{VerboseErrors: tt.verbose}
+			s.RegisterHandler("/fail", func(request Request) (Response, error) {
+				return Response{}, errors.New("database is down")
+			})
+			addr := startServer(t, s)
+
+			response, body := parseResponse(t, rawRequest(t, addr, "GET /fail HTTP/1.1\r\n"+tt.headers+"\r\n"))
+			id := response.Header.Get("X-Error-Id")
+			if id == "" || (tt.want != "" && id != tt.want) {
+				t.Fatalf("got X-Error-Id %q, want %q", id, tt.want)
+			}
+			if tt.verbose && !strings.Contains(body, "error id: "+id+"\n") {
+				t.Errorf("got body %q, want it to have the error ID", body)
+			}
+			// the line is logged before the 500 is sent
+			var line string
+			for _, l := range strings.Split(log.String(), "\n") {
+				if strings.Contains(l, "error_id="+id+" ") {
+					line = l
+				}
+			}
+			for _, want := range []string{"level=ERROR", "method=GET", "path=/fail", `error="database is down"`} {
+				if !strings.Contains(line, want) {
+					t.Errorf("got log line %q for error ID %s, want it to have %s", line, id, want)
+				}
+			}
+		})
+	}
+	// the IDs aren't reused
+	if a, b := errorIDFor(nil), errorIDFor(nil); a == b {
+		t.Errorf("got error ID %q twice", a)
+	}
+}
+
+func TestCannedResponsesClose(t *testing.T) {
+	tests := []struct {
+		name     string
+		response Response
+	}{
+		{"OK", OKResponse()},
+		{"Created", CreatedResponse()},
+		{"Accepted", AcceptedResponse()},
+		{"Moved", MovedResponse()},
+		{"BadRequest", BadRequestResponse()},
+		{"NotFound", NotFoundResponse()},
+		{"Error", ErrorResponse()},
+		{"requestTimeout", requestTimeoutResponse()},
+		{"tooLarge", tooLargeResponse()},
+		{"tooManyRequests", tooManyRequestsResponse()},
+		{"serviceUnavailable", serviceUnavailableResponse()},
+		{"panic", panicResponse("abc123")},
+		{"HTTPError", HTTPError{Status: 400, Message: "bad"}.Response()},
+		{"empty HTTPError", HTTPError{Status: 400}.Response()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.response.Body != nil {
+				err := tt.response.Body.Close()
+				if err != nil {
+					t.Errorf("Body.Close returned %v, want nil", err)
+				}
+			}
+			// writing it closes the body again, which mustn't fail either
+			err := writeResponse(io.Discard, tt.response, &RequestResult{})
+			if err != nil {
+				t.Errorf("writeResponse returned %v, want nil", err)
+			}
+		})
+	}
+}
+
+// failingListener is a net.Listener whose Close fails.
+type failingListener struct {
+	net.Listener
+}
+
+func (failingListener) Close() error {
+	return errors.New("close failed")
+}
+
+func TestServerCloseError(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   bool
+		failing bool
+		wantErr bool
+	}{
+		{"never started", false, false, false},
+		{"started", true, false, false},
+		{"listener fails to close", true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{Address: "127.0.0.1:0"}
+			if tt.start {
+				err := s.Listen()
+				if err != nil {
+					t.Fatalf("listen: %v", err)
+				}
+				if tt.failing {
+					l := s.listeners[0]
+					defer l.Close()
+					s.listeners[0] = failingListener{l}
+				}
+			}
+			err := s.Close()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got %v, want an error: %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.HasPrefix(err.Error(), "close server: ") {
+				t.Errorf("got %q, want it wrapped", err)
+			}
+		})
+	}
+}
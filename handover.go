@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NOTE: Listeners are inherited the same way that systemd passes sockets to
+// socket activated services: they start at fd 3, and LISTEN_FDS says how many
+// there are. systemd also sets LISTEN_PID, which a process handing over its
+// own listeners can't know before the exec, so those set readyFDEnv instead,
+// which is the pipe that the new process says it's ready on. LISTEN_FDNAMES
+// (which systemd sets from FileDescriptorName=) tells the listeners from
+// RedirectHTTPFrom apart from the rest.
+
+const (
+	listenFDsEnv     = "LISTEN_FDS"
+	listenPIDEnv     = "LISTEN_PID"
+	listenFDNamesEnv = "LISTEN_FDNAMES"
+	readyFDEnv       = "SIMPLE_HTTP_SERVER_READY_FD"
+)
+
+// listenEnv are all of the environment variables that describe inherited
+// listeners.
+var listenEnv = []string{listenFDsEnv, listenPIDEnv, listenFDNamesEnv, readyFDEnv}
+
+// The names in LISTEN_FDNAMES for each kind of listener. Listeners with any
+// other name (e.g. systemd's default of "unknown") are served like
+// serverFDName's.
+const (
+	serverFDName   = "server"
+	redirectFDName = "redirect"
+)
+
+// listenFDsStart is the first inherited fd, after stdin, stdout, and stderr.
+const listenFDsStart = 3
+
+// inheritance describes the listeners that a process was started with.
+type inheritance struct {
+	// names has the name of each fd from listenFDsStart on that's a
+	// listener, or "" if it wasn't given one
+	names []string
+	// readyFD is where to say that the listeners are being served, or -1
+	readyFD int
+}
+
+// encodeListenEnv returns the environment variables that tell a new process
+// about the listeners it has been given as its first ExtraFiles: listeners
+// for the Server itself followed by redirects for RedirectHTTPFrom. The
+// readiness pipe comes after them.
+func encodeListenEnv(listeners int, redirects int) []string {
+	names := make([]string, 0, listeners+redirects)
+	for i := 0; i < listeners+redirects; i++ {
+		if i < listeners {
+			names = append(names, serverFDName)
+		} else {
+			names = append(names, redirectFDName)
+		}
+	}
+	return []string{
+		fmt.Sprintf("%s=%d", listenFDsEnv, len(names)),
+		fmt.Sprintf("%s=%s", listenFDNamesEnv, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", readyFDEnv, listenFDsStart+len(names)),
+	}
+}
+
+// decodeListenEnv reads the environment that encodeListenEnv (or systemd)
+// set up. pid is the current process's, since systemd's LISTEN_FDS are only
+// meant for the process in LISTEN_PID. Listeners that were meant for some
+// other process are ignored.
+func decodeListenEnv(getenv func(string) string, pid int) (inheritance, error) {
+	none := inheritance{readyFD: -1}
+	fds := getenv(listenFDsEnv)
+	if fds == "" {
+		return none, nil
+	}
+	listenPID := getenv(listenPIDEnv)
+	ready := getenv(readyFDEnv)
+	if listenPID == "" && ready == "" {
+		return none, nil
+	}
+	if listenPID != "" && listenPID != strconv.Itoa(pid) {
+		return none, nil
+	}
+
+	result := none
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return none, fmt.Errorf("invalid %s '%s'", listenFDsEnv, fds)
+	}
+	result.names = make([]string, n)
+	if names := getenv(listenFDNamesEnv); names != "" {
+		result.names = strings.Split(names, ":")
+		if len(result.names) != n {
+			return none, fmt.Errorf("invalid %s '%s' for %d listeners", listenFDNamesEnv, names, n)
+		}
+	}
+	if ready != "" {
+		result.readyFD, err = strconv.Atoi(ready)
+		if err != nil || result.readyFD < listenFDsStart+n {
+			return none, fmt.Errorf("invalid %s '%s'", readyFDEnv, ready)
+		}
+	}
+	return result, nil
+}
+
+// inheritedListeners returns the listeners that the process was started with,
+// if any: the ones for the Server and the ones for RedirectHTTPOn. ready is
+// the pipe to pass to signalReady once they're being served, or nil. The
+// environment variables that described them are removed, so that they aren't
+// passed on to anything that the process starts.
+func inheritedListeners() (listeners []net.Listener, redirects []net.Listener, ready *os.File, err error) {
+	inherited, err := decodeListenEnv(os.Getenv, os.Getpid())
+	for _, name := range listenEnv {
+		os.Unsetenv(name)
+	}
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	for i, name := range inherited.names {
+		f := os.NewFile(uintptr(listenFDsStart+i), fmt.Sprintf("listener %d", i))
+		l, err := net.FileListener(f)
+		// FileListener has its own copy of the fd
+		f.Close()
+		if err != nil {
+			for _, l := range slices.Concat(listeners, redirects) {
+				l.Close()
+			}
+			return nil, nil, nil, fmt.Errorf("use inherited listener %d: %w", i, err)
+		}
+		if name == redirectFDName {
+			redirects = append(redirects, l)
+		} else {
+			listeners = append(listeners, l)
+		}
+	}
+	if inherited.readyFD >= 0 {
+		ready = os.NewFile(uintptr(inherited.readyFD), "ready")
+	}
+	return listeners, redirects, ready, nil
+}
+
+// signalReady tells the process that handed over its listeners that they're
+// being served, so that it can shut down.
+func signalReady(ready *os.File) error {
+	defer ready.Close()
+	_, err := ready.Write([]byte{1})
+	if err != nil {
+		return fmt.Errorf("signal readiness: %w", err)
+	}
+	return nil
+}
+
+// startReplacement starts the program again (from wherever os.Args[0] now
+// points, so that's the new binary after a deploy) with the same arguments,
+// handing it listeners (from ListenerFiles) and redirects (from
+// RedirectListenerFiles). It returns the new process's PID once it's serving
+// them, or an error if it doesn't say that it's ready within timeout, in which
+// case it's killed. The files are closed either way.
+func startReplacement(listeners []*os.File, redirects []*os.File, timeout time.Duration) (int, error) {
+	files := slices.Concat(listeners, redirects)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	path, err := exec.LookPath(os.Args[0])
+	if err != nil {
+		return 0, fmt.Errorf("find executable: %w", err)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("create readiness pipe: %w", err)
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(path, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyWriter)
+	cmd.Env = append(withoutListenEnv(os.Environ()), encodeListenEnv(len(listeners), len(redirects))...)
+	err = cmd.Start()
+	// only the new process should be able to write to it, so that a crash
+	// shows up as EOF
+	readyWriter.Close()
+	if err != nil {
+		return 0, fmt.Errorf("start replacement: %w", err)
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := ready.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	select {
+	case err = <-readErr:
+	case <-time.After(timeout):
+		err = fmt.Errorf("not ready after %s", timeout)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return 0, fmt.Errorf("replacement failed to start: %w", err)
+	}
+	// it carries on once we exit
+	go cmd.Wait()
+	return cmd.Process.Pid, nil
+}
+
+// withoutListenEnv returns env without any of the variables that describe
+// inherited listeners.
+func withoutListenEnv(env []string) []string {
+	result := make([]string, 0, len(env))
+	for _, kv := range env {
+		name, _, _ := strings.Cut(kv, "=")
+		if !slices.Contains(listenEnv, name) {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
+
+// errCantHandOver is returned by ListenerFiles for listeners that aren't
+// backed by a file descriptor.
+var errCantHandOver = errors.New("listener can't be handed over")
+
+// ListenerFiles returns a copy of the file descriptor of each of the Server's
+// listeners, as they were bound (i.e. without TLS or the PROXY protocol), in
+// the order that Addrs reports them. They can be passed to another process,
+// which can serve them with AdoptListeners. The caller has to close them.
+func (s *Server) ListenerFiles() ([]*os.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listenerFiles(s.bound)
+}
+
+// RedirectListenerFiles is like ListenerFiles, but for the listeners from
+// RedirectHTTPFrom and RedirectHTTPOn. Another process can serve them with
+// RedirectHTTPOn.
+func (s *Server) RedirectListenerFiles() ([]*os.File, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return listenerFiles(s.redirectListeners)
+}
+
+func listenerFiles(listeners []net.Listener) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(listeners))
+	for _, l := range listeners {
+		filer, ok := l.(interface{ File() (*os.File, error) })
+		var f *os.File
+		err := fmt.Errorf("%w: %T", errCantHandOver, l)
+		if ok {
+			f, err = filer.File()
+		}
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, fmt.Errorf("get file of listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// AdoptListeners makes the Server serve listeners (e.g. ones inherited from
+// the process it's replacing) instead of binding to Address and Addresses.
+// It's wrapped for the PROXY protocol if it's enabled, and can then be
+// started like a Server that called Listen.
+func (s *Server) AdoptListeners(listeners []net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners to adopt")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) > 0 {
+		return errors.New("server is already listening")
+	}
+	return s.adopt(listeners)
+}
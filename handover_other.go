@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// restartSignals is empty where listeners can't be handed over to another
+// process.
+var restartSignals []os.Signal
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// envFrom returns a getenv for the "NAME=value" pairs in env.
+func envFrom(env []string) func(string) string {
+	return func(name string) string {
+		for _, kv := range env {
+			if k, v, ok := strings.Cut(kv, "="); ok && k == name {
+				return v
+			}
+		}
+		return ""
+	}
+}
+
+func TestEncodeListenEnv(t *testing.T) {
+	tests := []struct {
+		listeners int
+		redirects int
+		wantNames []string
+	}{
+		{0, 0, []string{}},
+		{1, 0, []string{"server"}},
+		{2, 1, []string{"server", "server", "redirect"}},
+		{0, 2, []string{"redirect", "redirect"}},
+	}
+	for _, tt := range tests {
+		env := encodeListenEnv(tt.listeners, tt.redirects)
+		got, err := decodeListenEnv(envFrom(env), os.Getpid())
+		if err != nil {
+			t.Fatalf("%d listeners and %d redirects: decode %q: %v", tt.listeners, tt.redirects, env, err)
+		}
+		want := inheritance{names: tt.wantNames, readyFD: listenFDsStart + len(tt.wantNames)}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d listeners and %d redirects: got %+v from %q, want %+v", tt.listeners, tt.redirects, got, env, want)
+		}
+	}
+}
+
+func TestDecodeListenEnv(t *testing.T) {
+	const pid = 1234
+	tests := []struct {
+		name    string
+		env     []string
+		want    inheritance
+		wantErr bool
+	}{
+		{"none", nil, inheritance{readyFD: -1}, false},
+		{"handed over", []string{"LISTEN_FDS=2", "SIMPLE_HTTP_SERVER_READY_FD=5"}, inheritance{names: []string{"", ""}, readyFD: 5}, false},
+		{
+			"handed over with names",
+			[]string{"LISTEN_FDS=2", "LISTEN_FDNAMES=server:redirect", "SIMPLE_HTTP_SERVER_READY_FD=5"},
+			inheritance{names: []string{"server", "redirect"}, readyFD: 5}, false,
+		},
+		{"systemd", []string{"LISTEN_FDS=1", "LISTEN_PID=1234"}, inheritance{names: []string{""}, readyFD: -1}, false},
+		{
+			"systemd with names",
+			[]string{"LISTEN_FDS=2", "LISTEN_PID=1234", "LISTEN_FDNAMES=https:redirect"},
+			inheritance{names: []string{"https", "redirect"}, readyFD: -1}, false,
+		},
+		// they were meant for whoever started us
+		{"systemd, other process", []string{"LISTEN_FDS=1", "LISTEN_PID=99"}, inheritance{readyFD: -1}, false},
+		{"neither PID nor ready fd", []string{"LISTEN_FDS=1"}, inheritance{readyFD: -1}, false},
+		{"bad count", []string{"LISTEN_FDS=two", "LISTEN_PID=1234"}, inheritance{}, true},
+		{"negative count", []string{"LISTEN_FDS=-1", "LISTEN_PID=1234"}, inheritance{}, true},
+		{"too few names", []string{"LISTEN_FDS=2", "LISTEN_PID=1234", "LISTEN_FDNAMES=server"}, inheritance{}, true},
+		{"bad ready fd", []string{"LISTEN_FDS=1", "SIMPLE_HTTP_SERVER_READY_FD=x"}, inheritance{}, true},
+		// the pipe can't be one of the listeners
+		{"ready fd overlaps", []string{"LISTEN_FDS=2", "SIMPLE_HTTP_SERVER_READY_FD=4"}, inheritance{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeListenEnv(envFrom(tt.env), pid)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithoutListenEnv(t *testing.T) {
+	env := []string{"HOME=/root", "LISTEN_FDS=1", "LISTEN_PID=1", "LISTEN_FDNAMES=server", "SIMPLE_HTTP_SERVER_READY_FD=4", "LISTEN_FDS_EXTRA=kept"}
+	got := withoutListenEnv(env)
+	want := []string{"HOME=/root", "LISTEN_FDS_EXTRA=kept"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// TestListenerHandover hands one Server's listeners over to another in the
+// same process, the way a restart does across processes.
+func TestListenerHandover(t *testing.T) {
+	old := &Server{Addresses: []string{"127.0.0.1:0", "localhost:0"}}
+	old.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("old"))
+		return response, nil
+	})
+	startServer(t, old)
+	addrs := old.Addrs()
+
+	files, err := old.ListenerFiles()
+	if err != nil {
+		t.Fatalf("get listener files: %v", err)
+	}
+	if len(files) != len(addrs) {
+		t.Fatalf("got %d files for %d listeners", len(files), len(addrs))
+	}
+	listeners := make([]net.Listener, len(files))
+	for i, f := range files {
+		listeners[i], err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("listener from file: %v", err)
+		}
+	}
+
+	replacement := &Server{}
+	replacement.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("new"))
+		return response, nil
+	})
+	err = replacement.AdoptListeners(listeners)
+	if err != nil {
+		t.Fatalf("adopt listeners: %v", err)
+	}
+	for i, addr := range replacement.Addrs() {
+		if addr.String() != addrs[i].String() {
+			t.Errorf("listener %d is on %s, want %s", i, addr, addrs[i])
+		}
+	}
+	err = replacement.AdoptListeners(listeners)
+	if err == nil {
+		t.Error("adopting listeners twice succeeded")
+	}
+	go replacement.Start()
+	t.Cleanup(func() { replacement.Close() })
+	old.Close()
+
+	// nothing was unbound, so the replacement gets every new connection
+	for _, addr := range addrs {
+		_, body := parseResponse(t, rawRequest(t, addr.String(), "GET / HTTP/1.1\r\nConnection: close\r\n\r\n"))
+		if body != "new" {
+			t.Errorf("%s: got %q, want the replacement's response", addr, body)
+		}
+	}
+}
+
+func TestRedirectListenerHandover(t *testing.T) {
+	old := &Server{}
+	startServer(t, old)
+	err := old.RedirectHTTPFrom("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("redirect: %v", err)
+	}
+	from := old.redirectAddrs()[0].String()
+
+	files, err := old.RedirectListenerFiles()
+	if err != nil {
+		t.Fatalf("get redirect listener files: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("got %d files for 1 redirect listener", len(files))
+	}
+	l, err := net.FileListener(files[0])
+	files[0].Close()
+	if err != nil {
+		t.Fatalf("listener from file: %v", err)
+	}
+
+	replacement := &Server{}
+	addr := startServer(t, replacement)
+	_, port, _ := net.SplitHostPort(addr)
+	err = replacement.RedirectHTTPOn(l)
+	if err != nil {
+		t.Fatalf("redirect on inherited listener: %v", err)
+	}
+	old.Close()
+
+	response, _ := parseResponse(t, rawRequest(t, from, "GET /a?b HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if got, want := response.Header.Get("Location"), "https://example.com:"+port+"/a?b"; got != want {
+		t.Errorf("got Location %q, want the replacement's %q", got, want)
+	}
+
+	// and it's closed along with the replacement
+	replacement.Close()
+	conn, err := net.Dial("tcp", from)
+	if err == nil {
+		conn.Close()
+		t.Error("the handed over redirect listener is still accepting connections after Close")
+	}
+}
+
+func TestAdoptListenersErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	tests := []struct {
+		name      string
+		s         *Server
+		listeners []net.Listener
+	}{
+		{"none", &Server{}, nil},
+		{"PROXY protocol without trusted proxies", &Server{ProxyProtocol: true}, []net.Listener{l}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.AdoptListeners(tt.listeners)
+			if err == nil {
+				t.Error("adopting listeners succeeded")
+			}
+		})
+	}
+}
+
+func TestListenerFilesUnsupported(t *testing.T) {
+	s := &Server{Dialer: func(network string, address string) (net.Listener, error) {
+		return newPipeListener(), nil
+	}}
+	startServer(t, s)
+	_, err := s.ListenerFiles()
+	if !errors.Is(err, errCantHandOver) {
+		t.Errorf("got %v, want errCantHandOver", err)
+	}
+}
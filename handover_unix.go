@@ -0,0 +1,12 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals make the server hand its listeners over to a new copy of
+// itself, see startReplacement.
+var restartSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// maxHashMemory is how much of a response body NewHashMiddleware keeps in
+// memory. Anything bigger is spooled to a temp file.
+const maxHashMemory = 1 << 20
+
+var hashAlgorithms = map[string]struct {
+	header string
+	new    func() hash.Hash
+}{
+	"sha256": {"X-Content-SHA256", sha256.New},
+	"sha512": {"X-Content-SHA512", sha512.New},
+	"md5":    {"X-Content-MD5", md5.New},
+}
+
+// NewHashMiddleware adds the hex digest of every response body as a header,
+// e.g. X-Content-SHA256 for "sha256". algorithm may be "sha256", "sha512", or
+// "md5"; anything else is a programming error and panics.
+//
+// The digest has to be in the head, which is written before the body, so the
+// whole body is read first. Small bodies are kept in memory, larger ones are
+// spooled to a temp file. The digest is of the body as this middleware sees
+// it, so register it before gzipMiddleware to hash the uncompressed body.
+func NewHashMiddleware(algorithm string) Middleware {
+	alg, ok := hashAlgorithms[strings.ToLower(algorithm)]
+	if !ok {
+		panic(fmt.Sprintf("NewHashMiddleware: unknown algorithm '%s'", algorithm))
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if err != nil || response.Body == nil {
+				return response, err
+			}
+			defer response.Body.Close()
+
+			h := alg.new()
+			body, err := spool(io.TeeReader(response.Body, h), maxHashMemory, request.tempDir())
+			if err != nil {
+				return Response{}, err
+			}
+			response.Body = body
+			response.Head.Headers = withHeader(response.Head.Headers, alg.header, hex.EncodeToString(h.Sum(nil)))
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// spool reads all of r and returns a body that replays it. Up to maxMemory
+// bytes are kept in memory, beyond that it all goes to a temp file in dir.
+func spool(r io.Reader, maxMemory int64, dir string) (io.ReadCloser, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, r, maxMemory+1)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read response body: %w", err)
+	}
+	if n <= maxMemory {
+		return newBytesBody(buf.Bytes()), nil
+	}
+
+	tmp, err := newTempFile(dir, "Server-spool")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file to spool response body: %w", err)
+	}
+	_, err = io.Copy(tmp, io.MultiReader(&buf, r))
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("spool response body to %s: %w", tmp.Name(), err)
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		tmp.Close()
+		return nil, fmt.Errorf("rewind %s: %w", tmp.Name(), err)
+	}
+	return tmp, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHashMiddleware(t *testing.T) {
+	small := "hello"
+	// big enough to be spooled to a temp file
+	big := strings.Repeat("x", maxHashMemory+1)
+	tests := []struct {
+		algorithm string
+		header    string
+		body      string
+		newHash   func() hash.Hash
+	}{
+		{"sha256", "X-Content-SHA256", small, sha256.New},
+		{"SHA256", "X-Content-SHA256", small, sha256.New},
+		{"sha512", "X-Content-SHA512", small, sha512.New},
+		{"md5", "X-Content-MD5", small, md5.New},
+		{"sha256", "X-Content-SHA256", big, sha256.New},
+		{"md5", "X-Content-MD5", "", md5.New},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algorithm, func(t *testing.T) {
+			dir := t.TempDir()
+			s := &Server{TempDir: dir}
+			s.RegisterMiddleware(NewHashMiddleware(tt.algorithm))
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				response := OKResponse()
+				// a body that doesn't know its length, so that it's read
+				response.Body = &StreamBody{Stream: func(w *ResponseWriter) error {
+					_, err := w.Write([]byte(tt.body))
+					return err
+				}}
+				return response, nil
+			})
+			h := tt.newHash()
+			h.Write([]byte(tt.body))
+			want := hex.EncodeToString(h.Sum(nil))
+
+			raw, _ := pipeRequest(t, s, "GET / HTTP/1.1\r\n\r\n")
+			response, body := parseResponse(t, raw)
+			if got := response.Header.Get(tt.header); got != want {
+				t.Errorf("got %s %q, want %q", tt.header, got, want)
+			}
+			if body != tt.body {
+				t.Errorf("got a %d byte body, want %d bytes", len(body), len(tt.body))
+			}
+			// a spooled body's temp file is removed once it's been sent
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 0 {
+				t.Errorf("got %v (%v) left in the temp dir, want nothing", entries, err)
+			}
+		})
+	}
+}
+
+func TestHashMiddlewareNoBody(t *testing.T) {
+	handler := NewHashMiddleware("sha256")(func(request Request) (Response, error) {
+		return NotFoundResponse(), nil
+	})
+	response, err := handler(Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasHeader(response.Head.Headers, "X-Content-SHA256") {
+		t.Error("a response without a body was given a digest")
+	}
+}
+
+func TestHashMiddlewareUnknownAlgorithm(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("an unknown algorithm didn't panic")
+		}
+	}()
+	NewHashMiddleware("crc32")
+}
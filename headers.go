@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path"
+	"strings"
+	"sync"
+)
+
+// headersPool holds the maps that request headers are read into, since
+// they're most of what a small request allocates.
+var headersPool = sync.Pool{
+	New: func() any { return make(map[string]string) },
+}
+
+func getHeaders() map[string]string {
+	return headersPool.Get().(map[string]string)
+}
+
+// putHeaders empties headers and returns it to the pool. Nothing may use it
+// afterwards.
+func putHeaders(headers map[string]string) {
+	clear(headers)
+	headersPool.Put(headers)
+}
+
+// Clone returns a copy of r with its own Headers, which (unlike r's) can be
+// kept after the handler returns, e.g. by a handler that carries on in the
+// background. The Body is still r's, so read it first if it's needed too.
+func (r Request) Clone() Request {
+	clone := r
+	if r.Headers != nil {
+		clone.Headers = maps.Clone(r.Headers)
+	}
+	return clone
+}
+
+// hasHeader reports whether headers contains key, ignoring case. Response
+// headers are written however the handler spelled them, so a plain map lookup
+// isn't enough.
+func hasHeader(headers map[string]string, key string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// getHeader returns the value of key in headers, ignoring case.
+func getHeader(headers map[string]string, key string) string {
+	if value, ok := headers[key]; ok {
+		return value
+	}
+	for k, v := range headers {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// withHeader returns a copy of headers with key set to value. Response headers
+// may be shared with other responses (e.g. the accept response given to
+// Async), so they have to be copied before they're changed.
+func withHeader(headers map[string]string, key string, value string) map[string]string {
+	result := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		result[k] = v
+	}
+	result[key] = value
+	return result
+}
+
+// validateHeader returns an error if name or value can't be written safely
+// into a response head.
+func validateHeader(name string, value string) error {
+	if name == "" {
+		return errors.New("header name is empty")
+	}
+	if strings.ContainsAny(name, " \t:\r\n") {
+		return fmt.Errorf("header name '%s' contains whitespace or ':'", name)
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		return fmt.Errorf("value of header '%s' contains CR or LF", name)
+	}
+	return nil
+}
+
+// HeaderInjectionMiddleware adds each of the given headers to every response,
+// unless the handler already set a header with the same name. Headers that
+// couldn't be written safely are logged and ignored.
+func HeaderInjectionMiddleware(headers map[string]string) Middleware {
+	// copy the headers so that the caller can't change them from under us
+	inject := make(map[string]string, len(headers))
+	for name, value := range headers {
+		err := validateHeader(name, value)
+		if err != nil {
+			slog.Warn("ignoring injected header", "error", err)
+			continue
+		}
+		inject[name] = value
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if err != nil {
+				return Response{}, err
+			}
+			// Headers may be shared with other responses (e.g. Async's accept
+			// response), so it has to be copied before we add to it
+			headers := make(map[string]string, len(response.Head.Headers)+len(inject))
+			for name, value := range response.Head.Headers {
+				headers[name] = value
+			}
+			for name, value := range inject {
+				if !hasHeader(headers, name) {
+					headers[name] = value
+				}
+			}
+			response.Head.Headers = headers
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// headerFlag collects repeated -header "Name: value" flags.
+type headerFlag map[string]string
+
+func (h headerFlag) String() string {
+	pairs := make([]string, 0, len(h))
+	for name, value := range h {
+		pairs = append(pairs, name+": "+value)
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok {
+		return fmt.Errorf("'%s' is not of the form 'Name: value'", s)
+	}
+	name = strings.TrimSpace(name)
+	value = strings.TrimSpace(value)
+	err := validateHeader(name, value)
+	if err != nil {
+		return err
+	}
+	h[name] = value
+	return nil
+}
+
+// redactedValue replaces the values of headers matched by
+// NewHeaderRedactionMiddleware.
+const redactedValue = "[REDACTED]"
+
+// redactSensitiveHeaders returns a copy of request headers with the values of
+// sensitiveHeaders (the ones kept out of audit records) replaced, for logging.
+func redactSensitiveHeaders(headers map[string]string) map[string]string {
+	result := maps.Clone(headers)
+	for name := range result {
+		if sensitiveHeaders[name] {
+			result[name] = redactedValue
+		}
+	}
+	return result
+}
+
+// NewHeaderRedactionMiddleware replaces the value of every response header
+// whose name matches one of patterns with "[REDACTED]", e.g. so that a proxy
+// doesn't leak tokens in Set-Cookie or internal URLs in Location. Patterns are
+// globs where * matches any run of characters and ? matches any one, and
+// they're matched regardless of case, so "x-internal-*" covers
+// X-Internal-Url. Headers on HTTPErrors are redacted too.
+//
+// An invalid pattern is a programming error and panics.
+func NewHeaderRedactionMiddleware(patterns ...string) Middleware {
+	lower := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		lower[i] = strings.ToLower(pattern)
+		_, err := path.Match(lower[i], "")
+		if err != nil {
+			panic(fmt.Sprintf("NewHeaderRedactionMiddleware: invalid pattern '%s': %s", pattern, err))
+		}
+	}
+	redact := func(headers map[string]string) map[string]string {
+		var result map[string]string
+		for name := range headers {
+			if !matchesAny(lower, strings.ToLower(name)) {
+				continue
+			}
+			// copied the first time, since the headers may be shared
+			if result == nil {
+				result = maps.Clone(headers)
+			}
+			result[name] = redactedValue
+		}
+		if result == nil {
+			return headers
+		}
+		return result
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if httpErr, ok := asHTTPError(err); ok {
+				httpErr.Headers = redact(httpErr.Headers)
+				return response, httpErr
+			}
+			if err != nil {
+				return response, err
+			}
+			response.Head.Headers = redact(response.Head.Headers)
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// matchesAny reports whether name matches one of the glob patterns, which
+// have already been checked by path.Match.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		// header names can't contain '/', so path.Match's special case for it
+		// doesn't matter
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"maps"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStashedRequestHeaders(t *testing.T) {
+	s := &Server{}
+	stashed := make(chan [2]Request, 2)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		stashed <- [2]Request{request, request.Clone()}
+		return OKResponse(), nil
+	})
+	addr := startServer(t, s)
+
+	// a connection's headers go back to the pool just before it stops being
+	// counted, so once there are none left, the first request's are back
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nX-Secret: one\r\n\r\n")
+	first := <-stashed
+	waitForConns(t, s, 0)
+	original, clone := first[0], first[1]
+	if len(original.Headers) != 0 {
+		t.Errorf("got headers %v after the request was finished, want them cleared for the next one", original.Headers)
+	}
+	if got := clone.Headers["x-secret"]; got != "one" {
+		t.Errorf("got X-Secret %q in the clone, want one", got)
+	}
+
+	// the map may well be reused for the next request, which mustn't show up
+	// in the clone
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nX-Secret: two\r\n\r\n")
+	second := <-stashed
+	waitForConns(t, s, 0)
+	if got := clone.Headers["x-secret"]; got != "one" {
+		t.Errorf("got X-Secret %q in the first request's clone after the second, want one", got)
+	}
+	if got := second[1].Headers["x-secret"]; got != "two" {
+		t.Errorf("got X-Secret %q in the second request's clone, want two", got)
+	}
+}
+
+func TestAsyncKeepsHeaders(t *testing.T) {
+	s := &Server{}
+	seen := make(chan string, 1)
+	release := make(chan struct{})
+	s.RegisterHandler("/", Async(func(request Request) (Response, error) {
+		// by now the connection is long gone
+		<-release
+		seen <- request.Headers["x-secret"]
+		return OKResponse(), nil
+	}, AcceptedResponse()))
+	addr := startServer(t, s)
+
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nX-Secret: one\r\n\r\n")
+	waitForConns(t, s, 0)
+	// give the pooled map to another request
+	rawRequest(t, addr, "GET / HTTP/1.1\r\nX-Secret: two\r\n\r\n")
+	waitForConns(t, s, 0)
+	close(release)
+	var got []string
+	for range 2 {
+		select {
+		case secret := <-seen:
+			got = append(got, secret)
+		case <-time.After(5 * time.Second):
+			t.Fatal("the background handler never finished")
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []string{"one", "two"}) {
+		t.Errorf("got X-Secret %q in the background, want each request's own", got)
+	}
+}
+
+func TestHeaderInjectionMiddleware(t *testing.T) {
+	inject := map[string]string{
+		"X-Environment": "staging",
+		"Server":        "simple-http-server",
+		// can't be written safely, so it's left out
+		"X-Bad": "a\r\nSet-Cookie: evil=1",
+	}
+	shared := map[string]string{"server": "handler"}
+	handler := HeaderInjectionMiddleware(inject)(func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Head.Headers = shared
+		return response, nil
+	})
+	// changing the map afterwards doesn't change what's injected
+	inject["X-Environment"] = "production"
+
+	response, err := handler(Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := map[string]string{"X-Environment": "staging", "server": "handler"}
+	if !maps.Equal(response.Head.Headers, want) {
+		t.Errorf("got headers %v, want %v", response.Head.Headers, want)
+	}
+	if len(shared) != 1 {
+		t.Errorf("the handler's header map was changed to %v", shared)
+	}
+}
+
+func TestHeaderRedactionMiddleware(t *testing.T) {
+	headers := map[string]string{
+		"Authorization":  "Bearer secret",
+		"Set-Cookie":     "session=secret",
+		"X-Internal-Url": "http://10.0.0.1/",
+		"X-Internal":     "kept",
+		"Location":       "/kept",
+		"Content-Type":   "text/plain",
+	}
+	tests := []struct {
+		name     string
+		patterns []string
+		err      error
+		want     map[string]string
+	}{
+		{
+			"names", []string{"authorization", "set-cookie"}, nil,
+			map[string]string{
+				"Authorization": redactedValue, "Set-Cookie": redactedValue, "X-Internal-Url": "http://10.0.0.1/",
+				"X-Internal": "kept", "Location": "/kept", "Content-Type": "text/plain",
+			},
+		},
+		{
+			"globs", []string{"X-INTERNAL-*", "set-cook??"}, nil,
+			map[string]string{
+				"Authorization": "Bearer secret", "Set-Cookie": redactedValue, "X-Internal-Url": redactedValue,
+				"X-Internal": "kept", "Location": "/kept", "Content-Type": "text/plain",
+			},
+		},
+		{"no matches", []string{"x-secret"}, nil, headers},
+		{
+			"HTTPError", []string{"authorization", "set-cookie"}, HTTPError{Status: 401, Headers: maps.Clone(headers)},
+			map[string]string{
+				"Authorization": redactedValue, "Set-Cookie": redactedValue, "X-Internal-Url": "http://10.0.0.1/",
+				"X-Internal": "kept", "Location": "/kept", "Content-Type": "text/plain",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := maps.Clone(headers)
+			handler := NewHeaderRedactionMiddleware(tt.patterns...)(func(request Request) (Response, error) {
+				if tt.err != nil {
+					return Response{}, tt.err
+				}
+				response := OKResponse()
+				response.Head.Headers = shared
+				return response, nil
+			})
+			response, err := handler(Request{})
+			got := response.Head.Headers
+			if tt.err != nil {
+				var httpErr HTTPError
+				if !errors.As(err, &httpErr) {
+					t.Fatalf("got %v, want an HTTPError", err)
+				}
+				got = httpErr.Headers
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("got headers %v, want %v", got, tt.want)
+			}
+			if !maps.Equal(shared, headers) {
+				t.Errorf("the handler's header map was changed to %v", shared)
+			}
+		})
+	}
+}
+
+func TestHeaderRedactionMiddlewareBadPattern(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("NewHeaderRedactionMiddleware didn't panic")
+		}
+	}()
+	NewHeaderRedactionMiddleware("x-[")
+}
+
+func TestHeaderFlag(t *testing.T) {
+	tests := []struct {
+		flag      string
+		wantName  string
+		wantValue string
+		wantErr   bool
+	}{
+		{"X-Environment: staging", "X-Environment", "staging", false},
+		{"Content-Security-Policy:default-src 'self'", "Content-Security-Policy", "default-src 'self'", false},
+		{"X-Empty:", "X-Empty", "", false},
+		{"X-Environment staging", "", "", true},
+		{": staging", "", "", true},
+		{"X Environment: staging", "", "", true},
+		{"X-Environment: staging\r\nSet-Cookie: evil=1", "", "", true},
+	}
+	for _, tt := range tests {
+		h := make(headerFlag)
+		err := h.Set(tt.flag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error: %v", tt.flag, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && (len(h) != 1 || h[tt.wantName] != tt.wantValue) {
+			t.Errorf("%q: got %v, want %s=%q", tt.flag, h, tt.wantName, tt.wantValue)
+		}
+	}
+
+	// and it's checked when the flags are parsed, rather than once the
+	// server is running
+	_, err := parseFlags("simple-http-server", []string{"-port", "8080", "-header", "no colon"}, io.Discard)
+	if err == nil {
+		t.Error("parsing a bad -header succeeded")
+	}
+}
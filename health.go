@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// healthCheckTimeout bounds how long a health check request may spend running
+// checks.
+const healthCheckTimeout = 5 * time.Second
+
+type healthCheck struct {
+	name  string
+	check func(context.Context) error
+}
+
+// AddHealthCheck makes HealthHandler run check, reporting the Server as
+// unhealthy if it returns an error. name identifies it in JSON reports.
+func (s *Server) AddHealthCheck(name string, check func(context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthChecks = append(s.healthChecks, healthCheck{name: name, check: check})
+}
+
+// EnableHealthEndpoint serves HealthHandler at path, or at "/healthz" if path
+// is empty.
+func (s *Server) EnableHealthEndpoint(path string) {
+	if path == "" {
+		path = "/healthz"
+	}
+	s.RegisterHandler(path, s.HealthHandler())
+}
+
+// healthReport is the JSON that HealthHandler responds with when it's asked
+// for.
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// HealthHandler responds with 200 "ok" while the Server is healthy. Once
+// Shutdown has begun, it responds with 503 "draining" so that load balancers
+// stop sending traffic (see DrainDelay), and if any check added with
+// AddHealthCheck fails, it responds with 503 "failing".
+//
+// Clients that accept application/json get the status of every check as well,
+// e.g. {"status":"failing","checks":{"db":"ok","cache":"error: timeout"}}.
+func (s *Server) HealthHandler() Handler {
+	return func(request Request) (Response, error) {
+		report := healthReport{Status: "ok"}
+		if s.draining.Load() || s.shuttingDown.Load() {
+			report.Status = "draining"
+		} else {
+			s.mu.RLock()
+			checks := s.healthChecks
+			s.mu.RUnlock()
+
+			ctx, cancel := context.WithTimeout(RequestContext(request), healthCheckTimeout)
+			defer cancel()
+			for _, c := range checks {
+				if report.Checks == nil {
+					report.Checks = make(map[string]string, len(checks))
+				}
+				err := c.check(ctx)
+				if err != nil {
+					report.Status = "failing"
+					report.Checks[c.name] = "error: " + err.Error()
+					continue
+				}
+				report.Checks[c.name] = "ok"
+			}
+		}
+
+		response := OKResponse()
+		if report.Status != "ok" {
+			response = serviceUnavailableResponse()
+		}
+		var body []byte
+		contentType := "text/plain"
+		if strings.Contains(request.Headers["accept"], "application/json") {
+			var err error
+			body, err = json.Marshal(report)
+			if err != nil {
+				return Response{}, fmt.Errorf("encode health report: %w", err)
+			}
+			contentType = "application/json"
+		} else {
+			body = []byte(report.Status)
+		}
+		response.Head.Headers = map[string]string{
+			"Content-Type":  contentType,
+			"Cache-Control": "no-store",
+			"Connection":    "close",
+		}
+		response.Body = newBytesBody(body)
+		return response, nil
+	}
+}
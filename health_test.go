@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	ok := func(context.Context) error { return nil }
+	failing := func(context.Context) error { return errors.New("timeout") }
+	tests := []struct {
+		name       string
+		checks     map[string]func(context.Context) error
+		accept     string
+		wantStatus int
+		wantBody   string
+		wantChecks map[string]string
+	}{
+		{"healthy", nil, "", 200, "ok", nil},
+		{"passing checks", map[string]func(context.Context) error{"db": ok}, "", 200, "ok", nil},
+		{"failing check", map[string]func(context.Context) error{"db": ok, "cache": failing}, "", 503, "failing", nil},
+		{"healthy JSON", map[string]func(context.Context) error{"db": ok}, "application/json", 200, "", map[string]string{"db": "ok"}},
+		{
+			"failing JSON",
+			map[string]func(context.Context) error{"db": ok, "cache": failing},
+			"text/html, application/json",
+			503, "", map[string]string{"db": "ok", "cache": "error: timeout"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			for name, check := range tt.checks {
+				s.AddHealthCheck(name, check)
+			}
+			request := Request{RequestLine: RequestLine{Method: "GET", Path: "/healthz"}}
+			if tt.accept != "" {
+				request.Headers = map[string]string{"accept": tt.accept}
+			}
+			response, err := s.HealthHandler()(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.Head.Status != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.Head.Status, tt.wantStatus)
+			}
+			body, _ := io.ReadAll(response.Body)
+			if tt.wantChecks == nil {
+				if string(body) != tt.wantBody {
+					t.Errorf("got body %q, want %q", body, tt.wantBody)
+				}
+				return
+			}
+			if got := getHeader(response.Head.Headers, "Content-Type"); got != "application/json" {
+				t.Errorf("got Content-Type %q, want application/json", got)
+			}
+			var report healthReport
+			err = json.Unmarshal(body, &report)
+			if err != nil {
+				t.Fatalf("parse report %q: %v", body, err)
+			}
+			for name, want := range tt.wantChecks {
+				if report.Checks[name] != want {
+					t.Errorf("got check %q = %q, want %q", name, report.Checks[name], want)
+				}
+			}
+			if len(report.Checks) != len(tt.wantChecks) {
+				t.Errorf("got checks %v, want %v", report.Checks, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestHealthEndpointDraining(t *testing.T) {
+	s := &Server{DrainDelay: time.Minute}
+	s.EnableHealthEndpoint("")
+	addr := startServer(t, s)
+
+	response, body := parseResponse(t, rawRequest(t, addr, "GET /healthz HTTP/1.1\r\n\r\n"))
+	if response.StatusCode != 200 || body != "ok" {
+		t.Fatalf("got %d %q before shutdown, want 200 \"ok\"", response.StatusCode, body)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(ctx) }()
+	deadline := time.Now().Add(5 * time.Second)
+	for !s.draining.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// connections are still accepted during DrainDelay, but the load
+	// balancer is told to stop sending them
+	response, body = parseResponse(t, rawRequest(t, addr, "GET /healthz HTTP/1.1\r\n\r\n"))
+	if response.StatusCode != 503 || !strings.Contains(body, "draining") {
+		t.Errorf("got %d %q while draining, want 503 \"draining\"", response.StatusCode, body)
+	}
+	cancel()
+	<-shutdown
+}
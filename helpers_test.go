@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startServer starts s on a free loopback port and returns its address. s is
+// closed once the test is done.
+func startServer(t testing.TB, s *Server) string {
+	t.Helper()
+	s.Address = "127.0.0.1:0"
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+// rawRequest sends request to addr exactly as it is, and returns everything
+// the server sends back before closing the connection.
+func rawRequest(t testing.TB, addr string, request string) string {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, request)
+	if err != nil {
+		t.Fatalf("write request: %v", err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return string(response)
+}
+
+// pipeRequest sends request through s.handleRequest over a net.Pipe, so that
+// no ports are needed, and returns what was written back along with the
+// RequestResult.
+func pipeRequest(t testing.TB, s *Server, request string) (string, RequestResult) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan RequestResult, 1)
+	go func() {
+		var result RequestResult
+		result.Err = s.handleRequest(server, s.readDeadlines(server, time.Now()), &result)
+		server.Close()
+		done <- result
+	}()
+	// net.Pipe is unbuffered, so the request has to be written while the
+	// response is read. The write fails once the server hangs up if some of
+	// the request was never read, which is fine.
+	go io.WriteString(client, request)
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	response, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	return string(response), <-done
+}
+
+// logBuffer holds what's logged while a test runs. The Server logs from its
+// connections' goroutines, so it's locked.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+// captureLog sends the default logger's output to a logBuffer until the test
+// is over.
+func captureLog(t testing.TB) *logBuffer {
+	log := &logBuffer{}
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(log, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return log
+}
+
+func (l *logBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logBuffer) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// parseResponse parses a raw response, reading its whole body.
+func parseResponse(t testing.TB, raw string) (*http.Response, string) {
+	t.Helper()
+	response, err := http.ReadResponse(bufio.NewReader(strings.NewReader(raw)), nil)
+	if err != nil {
+		t.Fatalf("parse response %q: %v", raw, err)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("read response body: %v", err)
+	}
+	return response, string(body)
+}
+
+// echoHandler responds with the request body.
+func echoHandler(request Request) (Response, error) {
+	var body []byte
+	if request.Body != nil {
+		var err error
+		body, err = io.ReadAll(request.Body)
+		if err != nil {
+			return Response{}, err
+		}
+	}
+	response := OKResponse()
+	response.Body = newBytesBody(body)
+	return response, nil
+}
+
+// runMainEnv makes the test binary run main instead of the tests, with the
+// arguments it was given, so that tests can run the server as a process of its
+// own (see startMain).
+const runMainEnv = "SIMPLE_HTTP_SERVER_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// mainProcess is the server running as a process of its own.
+type mainProcess struct {
+	cmd *exec.Cmd
+	// addr is the first address that it's listening on
+	addr string
+	// lines are its log lines, as they're written
+	lines chan string
+	// exited is closed once it has exited, after which err is its exit error
+	exited chan struct{}
+	err    error
+}
+
+// startMain runs main in a new process with args, and returns once it has
+// logged the address it's listening on. The process is killed once the test
+// is done, if it hasn't exited by then.
+func startMain(t *testing.T, args ...string) *mainProcess {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runMainEnv+"=1")
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("start server process: %v", err)
+	}
+	p := &mainProcess{cmd: cmd, lines: make(chan string, 100), exited: make(chan struct{})}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			select {
+			case p.lines <- scanner.Text():
+			default:
+				// nobody is reading them
+			}
+		}
+		close(p.lines)
+		p.err = cmd.Wait()
+		close(p.exited)
+	}()
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		<-p.exited
+	})
+
+	line := p.waitForLog(t, "Listening")
+	_, addr, _ := strings.Cut(line, "address=")
+	p.addr, _, _ = strings.Cut(addr, " ")
+	return p
+}
+
+// waitForLog returns the next log line that contains msg.
+func (p *mainProcess) waitForLog(t *testing.T, msg string) string {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				t.Fatalf("the server exited without logging %q", msg)
+			}
+			if strings.Contains(line, msg) {
+				return line
+			}
+		case <-timeout:
+			t.Fatalf("the server didn't log %q", msg)
+		}
+	}
+}
+
+// wait waits for the process to exit and returns its exit code.
+func (p *mainProcess) wait(t *testing.T) int {
+	t.Helper()
+	select {
+	case <-p.exited:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the server didn't exit")
+	}
+	var exitErr *exec.ExitError
+	if errors.As(p.err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	if p.err != nil {
+		t.Fatalf("wait for the server: %v", p.err)
+	}
+	return 0
+}
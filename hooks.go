@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// The Server's hooks are for things like telemetry systems that want to be
+// called back rather than to wrap handlers in middleware. They're all
+// optional, and a nil hook costs nothing.
+//
+// For each connection, OnConnOpen is called once it's been accepted (but not
+// for connections rejected by MaxConnections or MaxConnsPerIP), and
+// OnConnClose once it has been closed, with the error that ended it, if any.
+//
+// For each request, OnRequest is called once its headers have been read,
+// before it's routed, so requests that get a 404 are included. Its Body isn't
+// set yet. OnResponse is called for every request that OnRequest was called
+// for, after the response (which may be a 500 for a failed handler) has been
+// written. If no response could be written, its head has a Status of 0.
+// bytesWritten is the size of the head and body that were sent, and d is how
+// long the whole request took, as in RequestResult.TotalDuration.
+//
+// Hooks are called on the connection's goroutine. A panicking hook is logged
+// and otherwise ignored, so that it can't break the request. Like handlers,
+// hooks mustn't keep a request's Headers after they return, see
+// Request.Clone.
+
+// runHook calls the hook named name, recovering from any panic in it.
+func (s *Server) runHook(name string, hook func()) {
+	defer func() {
+		recovered := recover()
+		if recovered != nil {
+			slog.Error("Server hook panicked", "hook", name, "panic", recovered)
+		}
+	}()
+	hook()
+}
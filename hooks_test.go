@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestResultCountsWireBytes(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+	}{
+		{"uncompressed", ""},
+		{"compressed", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			results := make(chan RequestResult, 1)
+			s.OnRequestComplete = func(result RequestResult) {
+				results <- result
+			}
+			s.RegisterMiddleware(gzipMiddleware)
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				time.Sleep(time.Millisecond)
+				response := OKResponse()
+				response.Body = newBytesBody([]byte(strings.Repeat("hello, world\n", 1000)))
+				return response, nil
+			})
+			addr := startServer(t, s)
+
+			request := "GET / HTTP/1.1\r\n"
+			if tt.acceptEncoding != "" {
+				request += "Accept-Encoding: " + tt.acceptEncoding + "\r\n"
+			}
+			request += "\r\n"
+			raw := rawRequest(t, addr, request)
+			result := <-results
+
+			head := strings.Index(raw, "\r\n\r\n") + 4
+			if result.HeadBytes != int64(head) {
+				t.Errorf("got HeadBytes %d, but the head on the wire was %d bytes", result.HeadBytes, head)
+			}
+			if result.BodyBytes != int64(len(raw)-head) {
+				t.Errorf("got BodyBytes %d, but the body on the wire was %d bytes", result.BodyBytes, len(raw)-head)
+			}
+			compressed := strings.Contains(raw[:head], "Content-Encoding: gzip")
+			if compressed != (tt.acceptEncoding == "gzip") {
+				t.Errorf("compressed = %v, want %v", compressed, tt.acceptEncoding == "gzip")
+			}
+			if compressed && result.BodyBytes >= 13000 {
+				t.Errorf("got BodyBytes %d, want the compressed size", result.BodyBytes)
+			}
+			if result.ReadBytes != int64(len(request)) {
+				t.Errorf("got ReadBytes %d, want %d", result.ReadBytes, len(request))
+			}
+			if result.Status != 200 || result.Method != "GET" || result.Path != "/" {
+				t.Errorf("got %s %s %d, want GET / 200", result.Method, result.Path, result.Status)
+			}
+			if result.HandlerDuration < time.Millisecond || result.TotalDuration < result.HandlerDuration {
+				t.Errorf("got handler duration %v and total %v", result.HandlerDuration, result.TotalDuration)
+			}
+		})
+	}
+}
+
+func TestLifecycleHooks(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		panics  bool
+		want    []string
+		wantRaw string
+	}{
+		{"ok", "/ok", false, []string{"open", "request GET /ok", "response 200", "close <nil>"}, "HTTP/1.1 200 "},
+		{"not found", "/missing", false, []string{"open", "request GET /missing", "response 404", "close <nil>"}, "HTTP/1.1 404 "},
+		{"handler error", "/error", false, []string{"open", "request GET /error", "response 500", "close broken"}, "HTTP/1.1 500 "},
+		// there's no Request, so only the connection hooks are called
+		{"malformed", "/ok HTTP/1.1 extra", false, []string{"open", "close <nil>"}, "HTTP/1.1 400 "},
+		{"panicking hooks", "/ok", true, []string{"open", "request GET /ok", "response 200", "close <nil>"}, "HTTP/1.1 200 "},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []string
+			closed := make(chan struct{})
+			record := func(event string) {
+				mu.Lock()
+				events = append(events, event)
+				mu.Unlock()
+				if tt.panics {
+					panic("hook failed")
+				}
+			}
+			s := &Server{
+				OnConnOpen: func(conn net.Conn) { record("open") },
+				OnConnClose: func(conn net.Conn, err error) {
+					defer close(closed)
+					record(fmt.Sprintf("close %v", err))
+				},
+				OnRequest: func(request Request) { record("request " + request.Method + " " + request.Path) },
+				OnResponse: func(request Request, head ResponseHead, bytesWritten int64, d time.Duration) {
+					if bytesWritten <= 0 || d <= 0 {
+						t.Errorf("got %d bytes written in %v", bytesWritten, d)
+					}
+					record(fmt.Sprintf("response %d", head.Status))
+				},
+			}
+			s.RegisterHandler("/ok", func(request Request) (Response, error) {
+				return OKResponse(), nil
+			})
+			s.RegisterHandler("/error", func(request Request) (Response, error) {
+				return Response{}, errors.New("broken")
+			})
+			addr := startServer(t, s)
+
+			raw := rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nConnection: close\r\n\r\n")
+			if !strings.HasPrefix(raw, tt.wantRaw) {
+				t.Errorf("got response %q, want %q...", raw, tt.wantRaw)
+			}
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("OnConnClose was never called")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if !slices.Equal(events, tt.want) {
+				t.Errorf("got hooks %q, want %q", events, tt.want)
+			}
+		})
+	}
+}
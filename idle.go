@@ -0,0 +1,114 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// minReapInterval keeps a tiny IdleTimeout from turning the reaper into a busy
+// loop.
+const minReapInterval = 10 * time.Millisecond
+
+// connActivity is what the idle reaper knows about a connection. It's updated
+// with atomics on every read and write, so keeping it up to date doesn't need
+// connsMu.
+type connActivity struct {
+	// last is when anything was last read or written, in Unix nanoseconds
+	last atomic.Int64
+	// busy is set while a handler is running, which can take as long as it
+	// likes without the connection counting as idle
+	busy atomic.Bool
+	// reaped is set once the reaper has closed the connection, so that the
+	// error from the read it was blocked in isn't taken for a real one
+	reaped atomic.Bool
+	// request is the request being served, once its request line has been
+	// read, for InFlightRequests
+	request atomic.Pointer[InFlightRequest]
+}
+
+func newConnActivity() *connActivity {
+	a := &connActivity{}
+	a.touch()
+	return a
+}
+
+func (a *connActivity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+// idleSince returns whether the connection has done nothing since cutoff.
+func (a *connActivity) idleSince(cutoff time.Time) bool {
+	return !a.busy.Load() && a.last.Load() < cutoff.UnixNano()
+}
+
+// activityOf returns the activity of the connection that handleRequest was
+// given, or nil if it isn't tracked. The methods below do nothing on nil.
+func activityOf(conn io.ReadWriter) *connActivity {
+	c, ok := conn.(*countingConn)
+	if !ok {
+		return nil
+	}
+	return c.activity
+}
+
+// setBusy marks the connection as waiting on its handler (or not).
+func (a *connActivity) setBusy(busy bool) {
+	if a == nil {
+		return
+	}
+	a.busy.Store(busy)
+	a.touch()
+}
+
+// startRequest records the request that the connection is serving.
+func (a *connActivity) startRequest(line RequestLine, received time.Time) {
+	if a == nil {
+		return
+	}
+	a.request.Store(&InFlightRequest{Method: line.Method, Path: line.Path, Received: received})
+}
+
+// startReaper starts reapIdleConns, once, if there's an IdleTimeout. s.mu must
+// be held.
+func (s *Server) startReaper() {
+	if s.IdleTimeout <= 0 || s.reaping {
+		return
+	}
+	s.reaping = true
+	go s.reapIdleConns()
+}
+
+// reapIdleConns closes connections that have been idle for longer than
+// IdleTimeout, until the Server has shut down and every connection is gone.
+// Read deadlines would do the same for connections blocked in a read, but
+// they can be long (or unset), and this catches slow writes too.
+func (s *Server) reapIdleConns() {
+	ticker := time.NewTicker(max(s.IdleTimeout/4, minReapInterval))
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-s.IdleTimeout)
+		var idle []net.Conn
+		s.connsMu.Lock()
+		for conn, activity := range s.conns {
+			if activity.idleSince(cutoff) {
+				activity.reaped.Store(true)
+				idle = append(idle, conn)
+			}
+		}
+		done := s.shuttingDown.Load() && len(s.conns) == 0
+		s.connsMu.Unlock()
+
+		// the connection's own goroutine untracks it once its read or write
+		// fails, and closing it twice does no harm
+		for _, conn := range idle {
+			slog.Debug("Server closing idle connection", "remote_addr", conn.RemoteAddr().String(), "idle_timeout", s.IdleTimeout)
+			conn.Close()
+		}
+		if done {
+			return
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIdleConnectionsAreReaped(t *testing.T) {
+	const idleTimeout = 100 * time.Millisecond
+	// trickle sends s a byte at a time, never going idle for long
+	trickle := func(t *testing.T, conn net.Conn, s string) {
+		for i := range len(s) {
+			_, err := io.WriteString(conn, s[i:i+1])
+			if err != nil {
+				t.Fatalf("write request: %v", err)
+			}
+			time.Sleep(idleTimeout / 4)
+		}
+	}
+	tests := []struct {
+		name string
+		// send is what the client sends before it waits for a response
+		send       func(t *testing.T, conn net.Conn)
+		wantReaped bool
+	}{
+		{
+			name:       "never sends anything",
+			send:       func(t *testing.T, conn net.Conn) {},
+			wantReaped: true,
+		},
+		{
+			name: "stalls in the headers",
+			send: func(t *testing.T, conn net.Conn) {
+				io.WriteString(conn, "GET /fast HTTP/1.1\r\nHost: exa")
+			},
+			wantReaped: true,
+		},
+		{
+			name: "slow request",
+			send: func(t *testing.T, conn net.Conn) {
+				trickle(t, conn, "GET /fast HTTP/1.1\r\n\r\n")
+			},
+		},
+		{
+			// the handler can take as long as it likes (a stalled body is
+			// ReadBodyIdleTimeout's job)
+			name: "slow handler",
+			send: func(t *testing.T, conn net.Conn) {
+				io.WriteString(conn, "GET /slow HTTP/1.1\r\n\r\n")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{IdleTimeout: idleTimeout}
+			s.RegisterHandler("/fast", echoHandler)
+			s.RegisterHandler("/slow", func(r Request) (Response, error) {
+				time.Sleep(3 * idleTimeout)
+				return echoHandler(r)
+			})
+			conn, err := net.Dial("tcp", startServer(t, s))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			start := time.Now()
+			tt.send(t, conn)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			r := bufio.NewReader(conn)
+			if !tt.wantReaped {
+				response, err := http.ReadResponse(r, nil)
+				if err != nil {
+					t.Fatalf("read response: %v", err)
+				}
+				response.Body.Close()
+				if response.StatusCode != 200 {
+					t.Errorf("got status %d, want 200", response.StatusCode)
+				}
+				return
+			}
+
+			_, err = r.ReadByte()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("the idle connection was never closed")
+			}
+			if err == nil {
+				t.Fatal("got a response on the idle connection, want it closed")
+			}
+			if elapsed := time.Since(start); elapsed < idleTimeout {
+				t.Errorf("the connection was closed after %v, before it had been idle for %v", elapsed, idleTimeout)
+			}
+			waitForConns(t, s, 0)
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// NOTE: This only understands the parts of JSON Schema that come up when
+// checking request bodies, which is a small enough subset to check by hand
+// rather than pulling in a full validator for every user of the package. A
+// schema using anything else (e.g. $ref or oneOf) is rejected by
+// NewJSONSchemaMiddleware rather than silently half-checked.
+
+// jsonSchema is a parsed JSON Schema. Pointers are nil when the keyword isn't
+// in the schema.
+type jsonSchema struct {
+	Types                []string
+	Required             []string
+	Properties           map[string]*jsonSchema
+	AdditionalProperties *jsonSchema
+	// NoAdditionalProperties is "additionalProperties": false
+	NoAdditionalProperties bool
+	Items                  *jsonSchema
+	Enum                   []any
+	MinLength              *int
+	MaxLength              *int
+	Minimum                *float64
+	Maximum                *float64
+	MinItems               *int
+	MaxItems               *int
+	Pattern                *regexp.Regexp
+}
+
+// supportedSchemaKeywords are the keywords parseJSONSchema knows about.
+// Annotations that don't affect validation are allowed too.
+var supportedSchemaKeywords = []string{
+	"type", "required", "properties", "additionalProperties", "items", "enum",
+	"minLength", "maxLength", "minimum", "maximum", "minItems", "maxItems",
+	"pattern", "$schema", "$id", "title", "description", "default", "examples",
+}
+
+// parseJSONSchema parses a schema, returning an error for anything it can't
+// check.
+func parseJSONSchema(raw json.RawMessage) (*jsonSchema, error) {
+	var keywords map[string]json.RawMessage
+	err := json.Unmarshal(raw, &keywords)
+	if err != nil {
+		return nil, fmt.Errorf("parse schema: %w", err)
+	}
+	s := &jsonSchema{}
+	for key, value := range keywords {
+		if !slices.Contains(supportedSchemaKeywords, key) {
+			return nil, fmt.Errorf("unsupported schema keyword '%s'", key)
+		}
+		switch key {
+		case "type":
+			var single string
+			if json.Unmarshal(value, &single) == nil {
+				s.Types = []string{single}
+			} else {
+				err = json.Unmarshal(value, &s.Types)
+			}
+		case "required":
+			err = json.Unmarshal(value, &s.Required)
+		case "properties":
+			var properties map[string]json.RawMessage
+			err = json.Unmarshal(value, &properties)
+			s.Properties = make(map[string]*jsonSchema, len(properties))
+			for name, property := range properties {
+				if err != nil {
+					break
+				}
+				s.Properties[name], err = parseJSONSchema(property)
+			}
+		case "additionalProperties":
+			var allowed bool
+			if json.Unmarshal(value, &allowed) == nil {
+				s.NoAdditionalProperties = !allowed
+			} else {
+				s.AdditionalProperties, err = parseJSONSchema(value)
+			}
+		case "items":
+			s.Items, err = parseJSONSchema(value)
+		case "enum":
+			err = json.Unmarshal(value, &s.Enum)
+		case "minLength":
+			err = json.Unmarshal(value, &s.MinLength)
+		case "maxLength":
+			err = json.Unmarshal(value, &s.MaxLength)
+		case "minimum":
+			err = json.Unmarshal(value, &s.Minimum)
+		case "maximum":
+			err = json.Unmarshal(value, &s.Maximum)
+		case "minItems":
+			err = json.Unmarshal(value, &s.MinItems)
+		case "maxItems":
+			err = json.Unmarshal(value, &s.MaxItems)
+		case "pattern":
+			var pattern string
+			err = json.Unmarshal(value, &pattern)
+			if err == nil {
+				s.Pattern, err = regexp.Compile(pattern)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse schema keyword '%s': %w", key, err)
+		}
+	}
+	return s, nil
+}
+
+// validate appends a message to errs for every way that v (decoded by
+// encoding/json) doesn't match the schema. at is where v is in the document,
+// e.g. "/items/0/name", with "" for the root.
+func (s *jsonSchema) validate(v any, at string, errs []string) []string {
+	where := at
+	if where == "" {
+		where = "/"
+	}
+	if len(s.Types) > 0 && !slices.ContainsFunc(s.Types, func(t string) bool { return isJSONType(v, t) }) {
+		// the other keywords would only pile on confusing errors
+		return append(errs, fmt.Sprintf("%s: expected %s, got %s", where, strings.Join(s.Types, " or "), jsonTypeOf(v)))
+	}
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(e any) bool { return jsonEqual(e, v) }) {
+		errs = append(errs, fmt.Sprintf("%s: not one of the allowed values", where))
+	}
+
+	switch v := v.(type) {
+	case string:
+		length := len([]rune(v))
+		if s.MinLength != nil && length < *s.MinLength {
+			errs = append(errs, fmt.Sprintf("%s: shorter than %d characters", where, *s.MinLength))
+		}
+		if s.MaxLength != nil && length > *s.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s: longer than %d characters", where, *s.MaxLength))
+		}
+		if s.Pattern != nil && !s.Pattern.MatchString(v) {
+			errs = append(errs, fmt.Sprintf("%s: doesn't match pattern %s", where, s.Pattern))
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: less than %v", where, *s.Minimum))
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: greater than %v", where, *s.Maximum))
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			errs = append(errs, fmt.Sprintf("%s: fewer than %d items", where, *s.MinItems))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			errs = append(errs, fmt.Sprintf("%s: more than %d items", where, *s.MaxItems))
+		}
+		if s.Items != nil {
+			for i, item := range v {
+				errs = s.Items.validate(item, fmt.Sprintf("%s/%d", at, i), errs)
+			}
+		}
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property '%s'", where, name))
+			}
+		}
+		// sorted so that the errors come out in the same order every time
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			property, ok := s.Properties[name]
+			switch {
+			case ok:
+				errs = property.validate(v[name], at+"/"+name, errs)
+			case s.NoAdditionalProperties:
+				errs = append(errs, fmt.Sprintf("%s: unexpected property '%s'", where, name))
+			case s.AdditionalProperties != nil:
+				errs = s.AdditionalProperties.validate(v[name], at+"/"+name, errs)
+			}
+		}
+	}
+	return errs
+}
+
+// isJSONType reports whether v is of the JSON Schema type t.
+func isJSONType(v any, t string) bool {
+	switch t {
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	}
+	return jsonTypeOf(v) == t
+}
+
+func jsonTypeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual compares two values decoded by encoding/json.
+func jsonEqual(a any, b any) bool {
+	aj, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bj, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(aj, bj)
+}
+
+// NewJSONSchemaMiddleware checks that the bodies of POST, PUT, and PATCH
+// requests are JSON documents matching schema. Bodies that aren't JSON get a
+// 400, and ones that don't match get a 422 listing every problem, one per line.
+// The body is buffered in memory so that the handler can still read it.
+//
+// Only part of JSON Schema is supported: type, required, properties,
+// additionalProperties, items, enum, minLength, maxLength, minimum, maximum,
+// minItems, maxItems, and pattern. A schema that uses anything else, or isn't
+// valid JSON, is a programming error and panics.
+func NewJSONSchemaMiddleware(schema []byte) Middleware {
+	parsed, err := parseJSONSchema(schema)
+	if err != nil {
+		panic(fmt.Sprintf("NewJSONSchemaMiddleware: %s", err))
+	}
+
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			if request.Method != "POST" && request.Method != "PUT" && request.Method != "PATCH" {
+				return handler(request)
+			}
+
+			var body []byte
+			if request.Body != nil {
+				var err error
+				body, err = io.ReadAll(request.Body)
+				if err != nil {
+					return Response{}, fmt.Errorf("read body to validate it: %w", err)
+				}
+			}
+			request.Body = bytes.NewReader(body)
+
+			var document any
+			err := json.Unmarshal(body, &document)
+			if err != nil {
+				return Response{}, HTTPError{Status: 400, Message: fmt.Sprintf("body is not valid JSON: %s", err)}
+			}
+			errs := parsed.validate(document, "", nil)
+			if len(errs) > 0 {
+				return Response{}, HTTPError{Status: 422, Message: strings.Join(errs, "\n")}
+			}
+			return handler(request)
+		}
+		return middleware
+	}
+}
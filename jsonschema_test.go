@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaMiddleware(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"required": ["name"],
+		"properties": {
+			"name": {"type": "string", "minLength": 1},
+			"age": {"type": "integer", "minimum": 0},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"role": {"enum": ["admin", "user"]}
+		},
+		"additionalProperties": false
+	}`)
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantStatus int
+		// wantErrors are lines that the 422's message must contain
+		wantErrors []string
+	}{
+		{"valid", "POST", `{"name": "Ada", "age": 36}`, 200, nil},
+		{"PUT", "PUT", `{"name": "Ada"}`, 200, nil},
+		{"missing name", "POST", `{"age": 36}`, 422, []string{"/: missing required property 'name'"}},
+		{"PATCH missing name", "PATCH", `{}`, 422, []string{"/: missing required property 'name'"}},
+		{"wrong type", "POST", `{"name": 7}`, 422, []string{"/name: expected string, got number"}},
+		{"not an object", "POST", `[]`, 422, []string{"/: expected object, got array"}},
+		{
+			"several problems", "POST", `{"age": 1.5, "tags": ["a", 2, "c"], "role": "root", "extra": true}`, 422,
+			[]string{
+				"/: missing required property 'name'",
+				"/age: expected integer, got number",
+				"/: unexpected property 'extra'",
+				"/role: not one of the allowed values",
+				"/tags: more than 2 items",
+				"/tags/1: expected string, got number",
+			},
+		},
+		{"not JSON", "POST", `{"name":`, 400, nil},
+		{"empty body", "POST", ``, 400, nil},
+		{"GET isn't checked", "GET", `not JSON`, 200, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := NewJSONSchemaMiddleware(schema)(func(request Request) (Response, error) {
+				body, err := io.ReadAll(request.Body)
+				if err != nil {
+					return Response{}, err
+				}
+				got = string(body)
+				return OKResponse(), nil
+			})
+			request := Request{
+				RequestLine: RequestLine{Method: tt.method, Path: "/"},
+				Body:        strings.NewReader(tt.body),
+			}
+			response, err := handler(request)
+			if tt.wantStatus == 200 {
+				if err != nil || response.Head.Status != 200 {
+					t.Fatalf("got %d, %v, want 200", response.Head.Status, err)
+				}
+				if got != tt.body {
+					t.Errorf("handler read %q, want the whole body %q", got, tt.body)
+				}
+				return
+			}
+			var httpErr HTTPError
+			if !errors.As(err, &httpErr) || httpErr.Status != tt.wantStatus {
+				t.Fatalf("got %v, want an HTTPError with status %d", err, tt.wantStatus)
+			}
+			for _, want := range tt.wantErrors {
+				if !strings.Contains(httpErr.Message, want) {
+					t.Errorf("message %q doesn't contain %q", httpErr.Message, want)
+				}
+			}
+			if tt.wantErrors != nil {
+				if lines := strings.Count(httpErr.Message, "\n") + 1; lines != len(tt.wantErrors) {
+					t.Errorf("got %d errors in %q, want %d", lines, httpErr.Message, len(tt.wantErrors))
+				}
+			}
+		})
+	}
+}
+
+func TestJSONSchemaMiddlewareUnsupportedSchema(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"not JSON", `{`},
+		{"unsupported keyword", `{"oneOf": []}`},
+		{"nested unsupported keyword", `{"properties": {"a": {"$ref": "#/x"}}}`},
+		{"bad pattern", `{"pattern": "("}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("NewJSONSchemaMiddleware didn't panic")
+				}
+			}()
+			NewJSONSchemaMiddleware([]byte(tt.schema))
+		})
+	}
+}
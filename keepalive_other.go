@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || dragonfly)
+
+package main
+
+import (
+	"time"
+)
+
+// setKeepAliveInterval does nothing where the interval between keep-alive
+// probes can't be set (or, like on Windows, SetKeepAlivePeriod already sets
+// it).
+func setKeepAliveInterval(fd uintptr, d time.Duration) error {
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd || netbsd || dragonfly
+
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setKeepAliveInterval sets how long to wait between keep-alive probes on the
+// socket fd. SetKeepAlivePeriod only sets how long the connection has to be
+// idle before the first one.
+func setKeepAliveInterval(fd uintptr, d time.Duration) error {
+	seconds := int((d + time.Second - 1) / time.Second)
+	return unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, seconds)
+}
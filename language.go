@@ -0,0 +1,151 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// negotiatedLanguageHeader is the request header that
+// NewLanguageNegotiationMiddleware stores its choice in.
+const negotiatedLanguageHeader = "x-negotiated-language"
+
+// LanguagePreference is one language range from an Accept-Language header.
+type LanguagePreference struct {
+	// Tag is a language range, e.g. "en-US", "en", "en-*", or "*"
+	Tag string
+	// Q is how much the client prefers Tag, from 1 down to (but not including)
+	// 0
+	Q float64
+}
+
+// AcceptedLanguages returns the language ranges that the client accepts, most
+// preferred first.
+func AcceptedLanguages(request Request) []LanguagePreference {
+	return parseAcceptLanguage(request.Headers["accept-language"])
+}
+
+// NegotiateLanguage returns the supported language tag that best matches the
+// request's Accept-Language header, or the first supported one if none match
+// (or the header is missing or malformed). It returns "" if supported is empty.
+//
+// A range matches a tag if they're equal, or if one is a prefix of the other
+// ending at a subtag, so "en-US" will settle for "en" and "en" for "en-GB".
+func NegotiateLanguage(request Request, supported ...string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	for _, pref := range AcceptedLanguages(request) {
+		if lang := matchLanguage(pref.Tag, supported); lang != "" {
+			return lang
+		}
+	}
+	return supported[0]
+}
+
+// WithContentLanguage returns response with its Content-Language header set to
+// lang, e.g. the result of NegotiateLanguage.
+func WithContentLanguage(response Response, lang string) Response {
+	response.Head.Headers = withHeader(response.Head.Headers, "Content-Language", lang)
+	return response
+}
+
+// parseAcceptLanguage returns the language ranges in an Accept-Language header,
+// most preferred first. Ranges with a q-value of 0 aren't acceptable, so they're
+// left out, as are any that can't be parsed.
+func parseAcceptLanguage(header string) []LanguagePreference {
+	prefs := make([]LanguagePreference, 0)
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(part, ";")
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		q := 1.0
+		params = strings.TrimSpace(params)
+		if params != "" {
+			value, ok := strings.CutPrefix(params, "q=")
+			if !ok {
+				continue
+			}
+			var err error
+			q, err = strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if q == 0 {
+			continue
+		}
+		prefs = append(prefs, LanguagePreference{Tag: tag, Q: q})
+	}
+	// stable, so that ranges with the same q-value keep the client's order
+	slices.SortStableFunc(prefs, func(a LanguagePreference, b LanguagePreference) int {
+		switch {
+		case a.Q > b.Q:
+			return -1
+		case a.Q < b.Q:
+			return 1
+		}
+		return 0
+	})
+	return prefs
+}
+
+// matchLanguage returns the first of supported that satisfies the language
+// range tag, or "" if none do. "*" matches anything and "en-*" matches "en" or
+// any "en-" subtag. Otherwise an exact match is preferred, then one where either
+// tag is a prefix of the other (so "en" matches "en-US" and vice versa).
+func matchLanguage(tag string, supported []string) string {
+	if len(supported) == 0 {
+		return ""
+	}
+	if tag == "*" {
+		return supported[0]
+	}
+	if base, ok := strings.CutSuffix(tag, "-*"); ok {
+		for _, lang := range supported {
+			if strings.EqualFold(lang, base) || hasLanguagePrefix(lang, base) {
+				return lang
+			}
+		}
+		return ""
+	}
+	for _, lang := range supported {
+		if strings.EqualFold(lang, tag) {
+			return lang
+		}
+	}
+	for _, lang := range supported {
+		if hasLanguagePrefix(lang, tag) || hasLanguagePrefix(tag, lang) {
+			return lang
+		}
+	}
+	return ""
+}
+
+// hasLanguagePrefix reports whether prefix is one or more whole subtags at the
+// start of tag, e.g. "en" is a prefix of "en-US" but not of "eng".
+func hasLanguagePrefix(tag string, prefix string) bool {
+	return len(tag) > len(prefix) && strings.EqualFold(tag[:len(prefix)], prefix) && tag[len(prefix)] == '-'
+}
+
+// NewLanguageNegotiationMiddleware picks the best of the supported languages
+// for each request based on its Accept-Language header, and stores it in the
+// request's "x-negotiated-language" header for handlers to use. If the client
+// doesn't accept any of them, the first supported language is used.
+func NewLanguageNegotiationMiddleware(supported []string) Middleware {
+	supported = slices.Clone(supported)
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			if len(supported) == 0 {
+				return handler(request)
+			}
+			chosen := NegotiateLanguage(request, supported...)
+			// the original headers may be the server's, so they're copied
+			request.Headers = withHeader(request.Headers, negotiatedLanguageHeader, chosen)
+			return handler(request)
+		}
+		return middleware
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLanguageNegotiationMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		supported []string
+		want      string
+	}{
+		{"q-values", "en-US;q=0.9, fr;q=1.0", []string{"en-US", "fr"}, "fr"},
+		{"client order breaks ties", "de, fr", []string{"fr", "de"}, "de"},
+		{"exact match first", "en-GB", []string{"en", "en-GB"}, "en-GB"},
+		{"region settles for language", "en-US", []string{"fr", "en"}, "en"},
+		{"language takes a region", "en", []string{"fr", "en-GB"}, "en-GB"},
+		{"not a subtag", "en", []string{"fr", "eng"}, "fr"},
+		{"wildcard subtag", "de;q=0.5, en-*", []string{"de", "en-AU"}, "en-AU"},
+		{"wildcard", "ja, *;q=0.1", []string{"fr", "de"}, "fr"},
+		{"case insensitive", "EN-us", []string{"fr", "en-US"}, "en-US"},
+		{"q=0 is refused", "fr;q=0, de;q=0.2", []string{"fr", "de"}, "de"},
+		{"no match", "ja", []string{"fr", "de"}, "fr"},
+		{"no header", "", []string{"fr", "de"}, "fr"},
+		{"malformed q", "fr;q=high, de;q=0.2", []string{"fr", "de"}, "de"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{}
+			if tt.header != "" {
+				headers["accept-language"] = tt.header
+			}
+			var got string
+			handler := NewLanguageNegotiationMiddleware(tt.supported)(func(request Request) (Response, error) {
+				got = request.Headers[negotiatedLanguageHeader]
+				return OKResponse(), nil
+			})
+			_, err := handler(Request{Headers: headers})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if _, ok := headers[negotiatedLanguageHeader]; ok {
+				t.Error("the request's own headers were changed")
+			}
+		})
+	}
+}
+
+func TestParseAcceptLanguage(t *testing.T) {
+	got := parseAcceptLanguage("en-US;q=0.9, fr, *;q=0.1, de;q=0, it;q=2")
+	want := []LanguagePreference{{"fr", 1}, {"en-US", 0.9}, {"*", 0.1}}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		name      string
+		header    string
+		supported []string
+		want      string
+	}{
+		{"q-ordering", "de;q=0.3, fr;q=0.8, en;q=0.5", []string{"en", "de", "fr"}, "fr"},
+		{"prefix match", "en-US", []string{"de", "en"}, "en"},
+		{"star range", "*", []string{"de", "en"}, "de"},
+		{"star after a miss", "ja, *;q=0.5", []string{"de", "en"}, "de"},
+		{"malformed header", ";;;q=", []string{"de", "en"}, "de"},
+		{"no supported languages", "en", nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := Request{Headers: map[string]string{"accept-language": tt.header}}
+			got := NegotiateLanguage(request, tt.supported...)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAcceptedLanguages(t *testing.T) {
+	request := Request{Headers: map[string]string{"accept-language": "de;q=0.3, fr, en;q=0.5"}}
+	got := AcceptedLanguages(request)
+	want := []LanguagePreference{{"fr", 1}, {"en", 0.5}, {"de", 0.3}}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := AcceptedLanguages(Request{}); len(got) != 0 {
+		t.Errorf("got %v without a header, want none", got)
+	}
+}
+
+func TestWithContentLanguage(t *testing.T) {
+	shared := map[string]string{"Content-Type": "text/html"}
+	response := OKResponse()
+	response.Head.Headers = shared
+	response = WithContentLanguage(response, "fr")
+	if got := getHeader(response.Head.Headers, "Content-Language"); got != "fr" {
+		t.Errorf("got Content-Language %q, want %q", got, "fr")
+	}
+	if _, ok := shared["Content-Language"]; ok {
+		t.Error("the original headers were changed")
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	// minAcceptBackoff and maxAcceptBackoff bound how long Serve waits
+	// between failed accepts.
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+// OverloadPolicy is what the Server does with new connections once it's
+// serving MaxConnections of them.
+type OverloadPolicy int
+
+const (
+	// OverloadWait stops accepting connections until one finishes, leaving
+	// new ones in the kernel's backlog.
+	OverloadWait OverloadPolicy = iota
+	// OverloadReject accepts new connections and immediately answers them
+	// with a 503 Service Unavailable.
+	OverloadReject
+)
+
+var (
+	// errTooManyConnections is returned by trackConn when a connection should
+	// be turned away with a 503.
+	errTooManyConnections = errors.New("too many connections")
+	// errTooManyConnsFromIP is returned by trackConn when a connection should
+	// be turned away with a 429.
+	errTooManyConnsFromIP = errors.New("too many connections from one IP")
+)
+
+func tooManyRequestsResponse() Response {
+	return closingResponse(429, "Too Many Requests")
+}
+
+func serviceUnavailableResponse() Response {
+	return closingResponse(503, "Service Unavailable")
+}
+
+// ActiveConnections returns how many connections the Server is serving right
+// now.
+func (s *Server) ActiveConnections() int {
+	return s.activeConns()
+}
+
+// full reports whether the Server is serving as many connections as it's
+// allowed to. connsMu must be held.
+func (s *Server) full() bool {
+	return s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections
+}
+
+// waitForConnSlot blocks until the Server has room for another connection, if
+// it's using OverloadWait. It returns early if the Server is shutting down.
+func (s *Server) waitForConnSlot() {
+	if s.Overload != OverloadWait {
+		return
+	}
+	for {
+		s.connsMu.Lock()
+		if !s.full() || s.shuttingDown.Load() {
+			s.connsMu.Unlock()
+			return
+		}
+		if s.connsChanged == nil {
+			s.connsChanged = make(chan struct{})
+		}
+		changed := s.connsChanged
+		s.connsMu.Unlock()
+		<-changed
+	}
+}
+
+// notifyConnsChanged wakes up anything in waitForConnSlot. connsMu must be
+// held.
+func (s *Server) notifyConnsChanged() {
+	if s.connsChanged != nil {
+		close(s.connsChanged)
+		s.connsChanged = nil
+	}
+}
+
+// clientKey returns what conn's connections are counted under for
+// MaxConnsPerIP: the remote IP, or its /64 for IPv6 if GroupIPv6By64 is set.
+// Connections that don't come from an IP (e.g. Unix sockets) aren't counted.
+func (s *Server) clientKey(conn net.Conn) (netip.Addr, bool) {
+	addrPort, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	ip := addrPort.Addr().Unmap()
+	if s.GroupIPv6By64 && ip.Is6() {
+		// a v6 client usually has a whole /64 to pick addresses from
+		prefix, _ := ip.WithZone("").Prefix(64)
+		ip = prefix.Addr()
+	}
+	return ip, true
+}
+
+// ipFull reports whether key already has MaxConnsPerIP connections. connsMu
+// must be held.
+func (s *Server) ipFull(key netip.Addr) bool {
+	return s.MaxConnsPerIP > 0 && s.connsPerIP[key] >= s.MaxConnsPerIP
+}
+
+// rejectConn answers conn with response (plus Retry-After, if
+// OverloadRetryAfter is set) and closes it.
+func (s *Server) rejectConn(conn net.Conn, response Response) {
+	defer conn.Close()
+	if s.OverloadRetryAfter > 0 {
+		seconds := int64((s.OverloadRetryAfter + time.Second - 1) / time.Second)
+		response.Head.Headers = withHeader(response.Head.Headers, "Retry-After", strconv.FormatInt(seconds, 10))
+	}
+	// a client that won't read the 503 mustn't tie up a goroutine either
+	timeout := s.WriteTimeout
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	c := &countingConn{Conn: conn, writeTimeout: timeout}
+	var result RequestResult
+	err := writeResponse(c, response, &result)
+	s.stats.record(result)
+	if err != nil {
+		slog.Debug("Server failed to turn away connection", "status", response.Head.Status, "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	lingerClose(conn, timeout)
+}
+
+// lingerClose gets conn ready to be closed when the client may still be
+// sending a request that nothing has read. Closing it with data unread makes
+// the kernel reset the connection, and the client may never see the response
+// that was written before that. So the writing side is closed first, which
+// tells the client that the response is over, and then whatever the client
+// sends is thrown away (up to maxDiscardedBody) until it hangs up or timeout
+// passes.
+func lingerClose(conn net.Conn, timeout time.Duration) {
+	c, ok := conn.(interface{ CloseWrite() error })
+	if !ok || c.CloseWrite() != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	io.CopyN(io.Discard, conn, maxDiscardedBody)
+}
+
+// isTemporaryAcceptError reports whether Accept might succeed if it's tried
+// again later, e.g. once some file descriptors have been closed.
+func isTemporaryAcceptError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	// net still marks some errors as temporary this way, even though it's
+	// deprecated
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// nextAcceptBackoff doubles the time to wait after a failed accept, starting
+// at minAcceptBackoff and going no higher than maxAcceptBackoff.
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return minAcceptBackoff
+	}
+	return min(backoff*2, maxAcceptBackoff)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// startBlockedServer starts s with a handler that blocks until release is
+// closed. It returns once limit requests are blocked in it, along with their
+// connections.
+func startBlockedServer(t *testing.T, s *Server, limit int) (addr string, conns []net.Conn, release chan struct{}) {
+	t.Helper()
+	release = make(chan struct{})
+	started := make(chan struct{}, 100)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		started <- struct{}{}
+		<-release
+		return OKResponse(), nil
+	})
+	addr = startServer(t, s)
+	t.Cleanup(func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	})
+	for range limit {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+		conns = append(conns, conn)
+	}
+	for range limit {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the handlers never started")
+		}
+	}
+	return addr, conns, release
+}
+
+// readResponse reads everything that comes back on conn before it's closed or
+// d is up.
+func readResponse(conn net.Conn, d time.Duration) (string, error) {
+	conn.SetReadDeadline(time.Now().Add(d))
+	raw, err := io.ReadAll(conn)
+	return string(raw), err
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	const limit = 2
+	s := &Server{MaxConnections: limit, Overload: OverloadReject, OverloadRetryAfter: 1500 * time.Millisecond}
+	addr, conns, release := startBlockedServer(t, s, limit)
+
+	for range 3 {
+		raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+		response, _ := parseResponse(t, raw)
+		if response.StatusCode != 503 {
+			t.Errorf("got status %d over the limit, want 503", response.StatusCode)
+		}
+		// rounded up to whole seconds
+		if got := response.Header.Get("Retry-After"); got != "2" {
+			t.Errorf("got Retry-After %q, want 2", got)
+		}
+	}
+	if got := s.ActiveConnections(); got != limit {
+		t.Errorf("got %d active connections, want %d", got, limit)
+	}
+
+	close(release)
+	for _, conn := range conns {
+		raw, err := readResponse(conn, 5*time.Second)
+		if err != nil || !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+			t.Errorf("got %q (%v), want the blocked request's 200", raw, err)
+		}
+	}
+	// there's room again once they've finished
+	waitForConns(t, s, 0)
+	raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+		t.Errorf("got %q once there was room, want a 200", raw)
+	}
+}
+
+func TestMaxConnectionsWait(t *testing.T) {
+	const limit = 2
+	s := &Server{MaxConnections: limit, Overload: OverloadWait}
+	addr, conns, release := startBlockedServer(t, s, limit)
+
+	var waiting []net.Conn
+	for range 3 {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+		waiting = append(waiting, conn)
+	}
+	// the kernel has them, but the Server doesn't
+	for _, conn := range waiting {
+		raw, err := readResponse(conn, 100*time.Millisecond)
+		if raw != "" || err == nil {
+			t.Errorf("got %q (%v) while the Server was full, want nothing", raw, err)
+		}
+	}
+	if got := s.ActiveConnections(); got != limit {
+		t.Errorf("got %d active connections, want %d", got, limit)
+	}
+
+	close(release)
+	for _, conn := range append(conns, waiting...) {
+		raw, err := readResponse(conn, 5*time.Second)
+		if err != nil || !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+			t.Errorf("got %q (%v), want a 200", raw, err)
+		}
+	}
+	waitForConns(t, s, 0)
+}
+
+// waitForConns waits for s to be serving want connections.
+func waitForConns(t *testing.T, s *Server, want int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.ActiveConnections() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d active connections, want %d", s.ActiveConnections(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerIP(t *testing.T) {
+	const limit = 2
+	s := &Server{MaxConnsPerIP: limit}
+	// the blocked requests all come from 127.0.0.1
+	addr, conns, release := startBlockedServer(t, s, limit)
+
+	raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	response, _ := parseResponse(t, raw)
+	if response.StatusCode != 429 {
+		t.Errorf("got status %d from the busy IP, want 429", response.StatusCode)
+	}
+
+	// another IP isn't affected
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	other, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("can't connect from a second loopback address: %v", err)
+	}
+	defer other.Close()
+	io.WriteString(other, "GET / HTTP/1.1\r\n\r\n")
+	waitForConns(t, s, limit+1)
+
+	close(release)
+	for _, conn := range append(conns, other) {
+		raw, err := readResponse(conn, 5*time.Second)
+		if err != nil || !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+			t.Errorf("got %q (%v), want a 200", raw, err)
+		}
+	}
+	waitForConns(t, s, 0)
+	s.connsMu.Lock()
+	tracked := len(s.connsPerIP)
+	s.connsMu.Unlock()
+	if tracked != 0 {
+		t.Errorf("%d IPs are still tracked with no connections, want 0", tracked)
+	}
+	raw = rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+		t.Errorf("got %q once the IP's connections had finished, want a 200", raw)
+	}
+}
+
+// remoteConn is a net.Conn with nothing but a remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func TestClientKey(t *testing.T) {
+	tests := []struct {
+		remote  string
+		group   bool
+		want    string
+		wantKey bool
+	}{
+		{"192.0.2.1:1234", false, "192.0.2.1", true},
+		{"192.0.2.1:1234", true, "192.0.2.1", true},
+		{"[::ffff:192.0.2.1]:1234", false, "192.0.2.1", true},
+		{"[2001:db8::1]:1234", false, "2001:db8::1", true},
+		{"[2001:db8::1]:1234", true, "2001:db8::", true},
+		{"[2001:db8::abcd:1]:1234", true, "2001:db8::", true},
+		{"[fe80::1%eth0]:1234", true, "fe80::", true},
+		{"/run/server.sock", false, "", false},
+	}
+	for _, tt := range tests {
+		s := &Server{GroupIPv6By64: tt.group}
+		var remote net.Addr
+		if strings.HasPrefix(tt.remote, "/") {
+			remote = &net.UnixAddr{Name: tt.remote, Net: "unix"}
+		} else {
+			addr, err := net.ResolveTCPAddr("tcp", tt.remote)
+			if err != nil {
+				t.Fatal(err)
+			}
+			remote = addr
+		}
+		key, ok := s.clientKey(remoteConn{remote: remote})
+		if ok != tt.wantKey || (ok && key.String() != tt.want) {
+			t.Errorf("%s (group %v): got %v (%v), want %s (%v)", tt.remote, tt.group, key, ok, tt.want, tt.wantKey)
+		}
+	}
+}
+
+// flakyListener fails its first failures Accepts with err, and then accepts
+// connections from a pipeListener. It records when each Accept was called.
+type flakyListener struct {
+	*pipeListener
+	err      error
+	failures int
+	mu       sync.Mutex
+	calls    []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.calls = append(l.calls, time.Now())
+	fail := len(l.calls) <= l.failures
+	l.mu.Unlock()
+	if fail {
+		return nil, l.err
+	}
+	return l.pipeListener.Accept()
+}
+
+func TestAcceptBackoff(t *testing.T) {
+	var log bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	const failures = 4
+	l := &flakyListener{pipeListener: newPipeListener(), err: &net.OpError{Op: "accept", Net: "tcp", Err: syscall.EMFILE}, failures: failures}
+	s := &Server{}
+	s.RegisterHandler("/", rootEndpoint)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	// it recovers once Accept works again
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	raw, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil || !strings.HasPrefix(string(raw), "HTTP/1.1 200 ") {
+		t.Errorf("got %q (%v) after the errors, want a 200", raw, err)
+	}
+	s.Close()
+	if err := <-served; err != nil {
+		t.Errorf("Serve returned %v, want nil", err)
+	}
+
+	l.mu.Lock()
+	calls := slices.Clone(l.calls)
+	l.mu.Unlock()
+	if len(calls) < failures+1 {
+		t.Fatalf("Accept was called %d times, want at least %d", len(calls), failures+1)
+	}
+	// each retry waits twice as long as the last, starting at
+	// minAcceptBackoff
+	want := minAcceptBackoff
+	for i := 1; i <= failures; i++ {
+		if gap := calls[i].Sub(calls[i-1]); gap < want {
+			t.Errorf("retry %d came after %v, want at least %v", i, gap, want)
+		}
+		want *= 2
+	}
+	if got := strings.Count(log.String(), "Server failed to accept connection"); got != failures {
+		t.Errorf("logged %d accept failures, want %d:\n%s", got, failures, log.String())
+	}
+}
+
+func TestAcceptFatalError(t *testing.T) {
+	want := errors.New("listener broke")
+	l := &flakyListener{pipeListener: newPipeListener(), err: want, failures: 1}
+	s := &Server{}
+	err := s.Serve(l)
+	if !errors.Is(err, want) {
+		t.Errorf("got %v, want the accept error", err)
+	}
+	if len(l.calls) != 1 {
+		t.Errorf("Accept was called %d times, want no retries", len(l.calls))
+	}
+}
+
+func TestNextAcceptBackoff(t *testing.T) {
+	tests := []struct {
+		backoff time.Duration
+		want    time.Duration
+	}{
+		{0, minAcceptBackoff},
+		{minAcceptBackoff, 2 * minAcceptBackoff},
+		{maxAcceptBackoff / 2, maxAcceptBackoff},
+		{maxAcceptBackoff * 3 / 4, maxAcceptBackoff},
+		{maxAcceptBackoff, maxAcceptBackoff},
+	}
+	for _, tt := range tests {
+		if got := nextAcceptBackoff(tt.backoff); got != tt.want {
+			t.Errorf("nextAcceptBackoff(%v) = %v, want %v", tt.backoff, got, tt.want)
+		}
+	}
+}
+
+func TestIsTemporaryAcceptError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{syscall.EMFILE, true},
+		{syscall.ENFILE, true},
+		{&net.OpError{Op: "accept", Err: os.NewSyscallError("accept4", syscall.EMFILE)}, true},
+		{syscall.ECONNABORTED, true},
+		{net.ErrClosed, false},
+		{errors.New("broken"), false},
+	}
+	for _, tt := range tests {
+		if got := isTemporaryAcceptError(tt.err); got != tt.want {
+			t.Errorf("isTemporaryAcceptError(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
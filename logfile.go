@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// logFlushInterval is how often a logFile's buffer is written out.
+const logFlushInterval = time.Second
+
+// logFile is a log file that's rotated once it gets too big: file becomes
+// file.1, file.1 becomes file.2, and so on, up to maxFiles old files. Writes
+// are buffered and flushed every logFlushInterval (and before rotating), so
+// each log line isn't a write to the file. It's safe to use from several
+// goroutines, and each Write goes into one file, so log lines aren't split
+// across files as long as each one is written in a single Write (as slog
+// does).
+type logFile struct {
+	path string
+	// maxSize is the size a file can reach before it's rotated, or 0 if it
+	// never is
+	maxSize  int64
+	maxFiles int
+
+	mu   sync.Mutex
+	file *os.File
+	buf  *bufio.Writer
+	size int64
+
+	stop    chan struct{}
+	flushed chan struct{}
+}
+
+// openLogFile opens (or creates) path to append to. maxSize is the size in
+// bytes to rotate at, or 0 to never rotate, and maxFiles is how many rotated
+// files to keep.
+func openLogFile(path string, maxSize int64, maxFiles int) (*logFile, error) {
+	l := &logFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		stop:     make(chan struct{}),
+		flushed:  make(chan struct{}),
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	go l.flushLoop()
+	return l, nil
+}
+
+// open opens l.path. l.mu must be held, unless l is new.
+func (l *logFile) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("open log file: %w", err)
+	}
+	l.file = f
+	l.size = info.Size()
+	if l.buf == nil {
+		l.buf = bufio.NewWriter(f)
+	} else {
+		l.buf.Reset(f)
+	}
+	return nil
+}
+
+func (l *logFile) flushLoop() {
+	defer close(l.flushed)
+	ticker := time.NewTicker(logFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.mu.Lock()
+			err := l.buf.Flush()
+			l.mu.Unlock()
+			if err != nil {
+				slog.Error("flush log file", "path", l.path, "error", err)
+			}
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(p)) > l.maxSize {
+		err := l.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := l.buf.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file out of the way and starts a new one. l.mu
+// must be held.
+func (l *logFile) rotate() error {
+	err := l.close()
+	if err != nil {
+		return err
+	}
+	// the oldest file is overwritten by the rename, if it's kept at all
+	if l.maxFiles <= 0 {
+		err = os.Remove(l.path)
+	} else {
+		for i := l.maxFiles - 1; i >= 1; i-- {
+			err = os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("rotate log file: %w", err)
+			}
+		}
+		err = os.Rename(l.path, l.path+".1")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("rotate log file: %w", err)
+	}
+	return l.open()
+}
+
+// close flushes and closes the current file. l.mu must be held.
+func (l *logFile) close() error {
+	err := l.buf.Flush()
+	closeErr := l.file.Close()
+	if err != nil {
+		return fmt.Errorf("flush log file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("close log file: %w", closeErr)
+	}
+	return nil
+}
+
+// Reopen closes the file and opens l's path again, e.g. on SIGHUP after
+// logrotate has moved the file away.
+func (l *logFile) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.close()
+	if err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Close flushes whatever is buffered and closes the file.
+func (l *logFile) Close() error {
+	close(l.stop)
+	<-l.flushed
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.close()
+}
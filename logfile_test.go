@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// readLogLines returns the lines in path and every rotated file kept beside
+// it, oldest first, along with the names of the files.
+func readLogLines(t *testing.T, path string) ([]string, []string) {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("read log dir: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	var lines []string
+	for i := len(names) - 1; i >= 1; i-- {
+		lines = append(lines, readLines(t, fmt.Sprintf("%s.%d", path, i))...)
+	}
+	lines = append(lines, readLines(t, path)...)
+	return lines, names
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+}
+
+func TestLogFileRotation(t *testing.T) {
+	const (
+		// each line is 10 bytes, so 10 fit in a file
+		lines   = 95
+		maxSize = 100
+	)
+	tests := []struct {
+		name      string
+		maxFiles  int
+		wantFiles []string
+		// wantFirst is the first line that's kept
+		wantFirst int
+	}{
+		{"keep everything", 20, []string{"access.log", "access.log.1", "access.log.2", "access.log.3", "access.log.4", "access.log.5", "access.log.6", "access.log.7", "access.log.8", "access.log.9"}, 0},
+		{"keep some", 2, []string{"access.log", "access.log.1", "access.log.2"}, 70},
+		{"keep none", 0, []string{"access.log"}, 90},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			l, err := openLogFile(path, maxSize, tt.maxFiles)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			for i := range lines {
+				fmt.Fprintf(l, "line %04d\n", i)
+			}
+			err = l.Close()
+			if err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			got, names := readLogLines(t, path)
+			if !slices.Equal(names, tt.wantFiles) {
+				t.Errorf("got files %q, want %q", names, tt.wantFiles)
+			}
+			var want []string
+			for i := tt.wantFirst; i < lines; i++ {
+				want = append(want, fmt.Sprintf("line %04d", i))
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got lines %q, want %q", got, want)
+			}
+			for _, name := range names {
+				info, err := os.Stat(filepath.Join(filepath.Dir(path), name))
+				if err != nil {
+					t.Fatalf("stat: %v", err)
+				}
+				if info.Size() > maxSize {
+					t.Errorf("%s is %d bytes, more than %d", name, info.Size(), maxSize)
+				}
+			}
+		})
+	}
+}
+
+func TestLogFileConcurrentWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	l, err := openLogFile(path, 1000, 1000)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	var wg sync.WaitGroup
+	for g := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				fmt.Fprintf(l, "writer %d line %04d\n", g, i)
+			}
+		}()
+	}
+	wg.Wait()
+	l.Close()
+
+	got, _ := readLogLines(t, path)
+	if len(got) != 1000 {
+		t.Errorf("got %d lines, want 1000", len(got))
+	}
+	// each writer's lines are whole and in order, however they're interleaved
+	next := make(map[int]int)
+	for _, line := range got {
+		var g, i int
+		_, err := fmt.Sscanf(line, "writer %d line %d", &g, &i)
+		if err != nil || i != next[g] {
+			t.Fatalf("got line %q, want writer %d line %d", line, g, next[g])
+		}
+		next[g]++
+	}
+}
+
+func TestLogFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	l, err := openLogFile(path, 0, 0)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	fmt.Fprintln(l, "before")
+
+	// what logrotate does before sending SIGHUP
+	err = os.Rename(path, path+".rotated")
+	if err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	err = l.Reopen()
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	fmt.Fprintln(l, "after")
+	l.Close()
+
+	if got := readLines(t, path+".rotated"); !slices.Equal(got, []string{"before"}) {
+		t.Errorf("got %q in the moved file, want the line from before", got)
+	}
+	if got := readLines(t, path); !slices.Equal(got, []string{"after"}) {
+		t.Errorf("got %q in the new file, want the line from after", got)
+	}
+}
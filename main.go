@@ -4,18 +4,32 @@ import (
 	"bufio"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"flag"
 	"fmt"
+	"html"
 	"io"
 	"io/fs"
-	"log"
+	"log/slog"
+	"mime"
 	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 type ResponseHead struct {
@@ -31,8 +45,12 @@ func (r ResponseHead) Bytes() []byte {
 		r.Protocol = "HTTP/1.1"
 	}
 
-	var result bytes.Buffer
-	result.WriteString(fmt.Sprintf("%s %d", r.Protocol, r.Status))
+	result := headBufferPool.Get().(*bytes.Buffer)
+	defer headBufferPool.Put(result)
+	result.Reset()
+	result.WriteString(r.Protocol)
+	result.WriteString(" ")
+	result.Write(strconv.AppendInt(result.AvailableBuffer(), int64(r.Status), 10))
 	result.WriteString(" ")
 	if r.Reason != "" {
 		result.WriteString(r.Reason)
@@ -47,21 +65,132 @@ func (r ResponseHead) Bytes() []byte {
 	}
 	result.WriteString("\r\n")
 
-	return result.Bytes()
+	// the buffer goes back in the pool, so the caller gets a copy
+	return bytes.Clone(result.Bytes())
+}
+
+// headBufferPool holds the buffers that ResponseHead.Bytes builds heads in, so
+// that every response doesn't need a new one.
+var headBufferPool = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
 }
 
 type Response struct {
 	Head ResponseHead
-	// Body should be closed after it's consumed
+	// Body is always closed by the Server once the response has been written,
+	// even if writing it failed. Middleware that replaces Body has to close the
+	// one it replaced.
 	Body io.ReadCloser
 }
 
-var (
-	okResponse       = Response{Head: ResponseHead{Status: 200, Reason: "OK"}}
-	createdResponse  = Response{Head: ResponseHead{Status: 201, Reason: "Created"}}
-	notFoundResponse = Response{Head: ResponseHead{Status: 404, Reason: "Not Found"}}
-	errorResponse    = Response{Head: ResponseHead{Status: 500, Reason: "Internal Server Error"}}
-)
+// The canned responses below return a fresh Response on every call, so a
+// handler can change the one it gets (headers and all) without affecting
+// anyone else's.
+
+func OKResponse() Response {
+	return Response{Head: ResponseHead{Status: 200, Reason: "OK"}}
+}
+
+func CreatedResponse() Response {
+	return Response{Head: ResponseHead{Status: 201, Reason: "Created"}}
+}
+
+func AcceptedResponse() Response {
+	return Response{Head: ResponseHead{Status: 202, Reason: "Accepted"}}
+}
+
+func MovedResponse() Response {
+	return Response{Head: ResponseHead{Status: 301, Reason: "Moved Permanently"}}
+}
+
+func BadRequestResponse() Response {
+	return Response{Head: ResponseHead{Status: 400, Reason: "Bad Request"}}
+}
+
+func NotFoundResponse() Response {
+	return Response{Head: ResponseHead{Status: 404, Reason: "Not Found"}}
+}
+
+func ErrorResponse() Response {
+	return Response{Head: ResponseHead{Status: 500, Reason: "Internal Server Error"}}
+}
+
+// closingResponse is a bodiless response that tells the client the connection
+// is being closed, for errors the Server sends on its own.
+func closingResponse(status int, reason string) Response {
+	headers := map[string]string{"Content-Length": "0", "Connection": "close"}
+	return Response{Head: ResponseHead{Status: status, Reason: reason, Headers: headers}}
+}
+
+func requestTimeoutResponse() Response {
+	return closingResponse(408, "Request Timeout")
+}
+
+func tooLargeResponse() Response {
+	return closingResponse(413, "Content Too Large")
+}
+
+// ErrBodyTooLarge is returned when reading more of a request body than the
+// endpoint allows. If a handler returns it, the client gets a 413 response.
+var ErrBodyTooLarge = errors.New("request body too large")
+
+// maxBytesReader returns ErrBodyTooLarge once more than remaining bytes have
+// been read from r.
+type maxBytesReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (m *maxBytesReader) Read(p []byte) (int, error) {
+	if m.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// read one byte past the limit so that a body that's exactly the limit
+	// isn't mistaken for one that's too large
+	if int64(len(p)) > m.remaining+1 {
+		p = p[:m.remaining+1]
+	}
+	n, err := m.r.Read(p)
+	m.remaining -= int64(n)
+	if m.remaining < 0 {
+		return n + int(m.remaining), ErrBodyTooLarge
+	}
+	return n, err
+}
+
+// bytesBody is a response body that's already in memory. Unlike
+// io.NopCloser(bytes.NewReader(b)), it still knows how long it is, so the
+// server can set Content-Length for it.
+type bytesBody struct {
+	*bytes.Reader
+}
+
+func (bytesBody) Close() error {
+	return nil
+}
+
+func newBytesBody(b []byte) io.ReadCloser {
+	return bytesBody{bytes.NewReader(b)}
+}
+
+// mayHaveBody reports whether a response with the given status is allowed to
+// have a body (and so a Content-Length) at all.
+func mayHaveBody(status int) bool {
+	return status >= 200 && status != 204 && status != 304
+}
+
+// setContentLength adds a Content-Length header to response if it doesn't have
+// one and its body can tell us how many bytes are left in it without being
+// read, e.g. a body that embeds a *bytes.Buffer or *bytes.Reader.
+func setContentLength(response *Response) {
+	body, ok := unwrapBody(response.Body).(interface{ Len() int })
+	if !ok || hasHeader(response.Head.Headers, "Content-Length") {
+		return
+	}
+	response.Head.Headers = withHeader(response.Head.Headers, "Content-Length", strconv.Itoa(body.Len()))
+}
 
 type RequestLine struct {
 	// Method is all uppercase
@@ -75,13 +204,20 @@ func parseRequestLine(line string) (RequestLine, error) {
 	result := RequestLine{}
 	// A valid start line would look like "GET /index.html HTTP/1.1"
 	line = strings.TrimRight(line, "\r\n")
-	sl := strings.Split(line, " ")
-	if len(sl) != 3 {
+	// This runs for every request, so the two spaces are found with
+	// strings.Cut rather than strings.Split, which would allocate a slice
+	// each time.
+	method, rest, ok := strings.Cut(line, " ")
+	if !ok {
+		return result, fmt.Errorf("invalid start line: '%s'", line)
+	}
+	path, protocol, ok := strings.Cut(rest, " ")
+	if !ok || strings.IndexByte(protocol, ' ') >= 0 {
 		return result, fmt.Errorf("invalid start line: '%s'", line)
 	}
-	result.Method = sl[0]
-	result.Path = sl[1]
-	result.Protocol = sl[2]
+	result.Method = method
+	result.Path = path
+	result.Protocol = protocol
 
 	return result, nil
 }
@@ -91,9 +227,24 @@ type Request struct {
 	// Headers stores keys in lower case, since RFC9110 says they're case
 	// insensitive. In a more serious project, this could warrant its own type
 	// with Get() and Set() methods to make this opaque to the user.
+	//
+	// The map is reused for another request once this one is finished with,
+	// so it mustn't be kept (or changed) after the handler (or hook) that was
+	// given it returns. Use Clone for a Request that can be kept.
 	Headers map[string]string
-	// Body is not guaranteed to throw an EOF
+	// Body returns io.EOF after Content-Length bytes. If the request has a
+	// Transfer-Encoding instead, Body is not guaranteed to throw an EOF.
 	Body io.Reader
+	// TLS describes the connection if the request came in over TLS (see
+	// StartTLS), including the client's verified certificates. It's nil for
+	// plaintext requests.
+	TLS *tls.ConnectionState
+	// RemoteAddr is the client's address, e.g. "192.0.2.1:56324". Behind a
+	// proxy that uses the PROXY protocol (see Server.ProxyProtocol), it's the
+	// client the proxy passed on rather than the proxy.
+	RemoteAddr string
+
+	state *requestState
 }
 
 type Handler func(Request) (r Response, err error)
@@ -101,23 +252,190 @@ type Handler func(Request) (r Response, err error)
 type endpointHandler struct {
 	prefix  string
 	handler Handler
+	// composed is handler wrapped in all of the Server's middleware. It's built
+	// whenever the handler or the middleware changes, rather than per request.
+	composed Handler
+	// bodyLimit overrides Server.MaxRequestBodySize when it isn't 0
+	bodyLimit int64
+	// timeout overrides Server.HandlerTimeout when it isn't 0
+	timeout time.Duration
 }
 
-type Middleware func(Handler) Handler
+// HandlerOption configures a single registration made with RegisterHandler.
+type HandlerOption func(*endpointHandler)
+
+// WithBodyLimit caps the size of request bodies for one endpoint, taking
+// precedence over Server.MaxRequestBodySize. 0 means to use the server's
+// setting and a negative limit means there is no limit at all.
+func WithBodyLimit(n int64) HandlerOption {
+	return func(e *endpointHandler) {
+		e.bodyLimit = n
+	}
+}
 
-// NOTE: Adding a deadline so that net conns don't just block forever if there's
-// some kind of error would be a good idea.
+// WithHandlerTimeout gives a single endpoint's handler d to return a response,
+// taking precedence over Server.HandlerTimeout, e.g. to give a slow report
+// longer than everything else. 0 means to use the server's setting and a
+// negative d means there is no limit at all.
+func WithHandlerTimeout(d time.Duration) HandlerOption {
+	return func(e *endpointHandler) {
+		e.timeout = d
+	}
+}
 
-// NOTE: It would also make a lot of sense to add a logger to the Server struct
-// or some kind of logging middleware.
+type Middleware func(Handler) Handler
 
 // Server is a basic HTTP server that can be configured by registering handlers
 // for different endpoints (i.e. request paths that begin with a given prefix).
 type Server struct {
-	Address          string
-	listener         net.Listener
-	endPointHandlers []endpointHandler
-	middlewares      []Middleware
+	// Address is the address to listen on, e.g. "localhost:8080"
+	Address string
+	// Addresses are more addresses to listen on alongside Address, e.g. to
+	// bind to both an IPv4 and an IPv6 interface.
+	Addresses []string
+	// MaxRequestBodySize is the largest request body (in bytes) that handlers
+	// will be allowed to read. Requests that declare a larger Content-Length get
+	// a 413 response. 0 or less means there is no limit.
+	MaxRequestBodySize int64
+	// Dialer creates the listeners that the Server accepts connections on,
+	// e.g. to open them in another network namespace. If it's nil, net.Listen
+	// is used.
+	Dialer func(network, address string) (net.Listener, error)
+	// ReusePort sets SO_REUSEPORT on the listeners that Listen opens (unless
+	// there's a Dialer), so that a new process can start listening on the same
+	// port before the old one stops, for fast restarts. It does nothing on
+	// platforms without it.
+	ReusePort bool
+	// TCPKeepAlive is how often keep-alive probes are sent on idle
+	// connections, so that clients that have silently gone away (e.g. behind
+	// a NAT that forgot them) are noticed. 0 leaves the listener's setting
+	// alone, which for Listen's listeners is Go's default of 15 seconds, and
+	// a negative duration turns probes off.
+	TCPKeepAlive time.Duration
+	// DisableNoDelay turns TCP_NODELAY off (Go turns it on), so that the
+	// kernel may hold back small writes to coalesce them.
+	DisableNoDelay bool
+	// ReadTimeout is how long a client has to send its whole request
+	// (including the TLS handshake and the body) once it has connected. 0
+	// means there's no limit.
+	ReadTimeout time.Duration
+	// ReadHeaderTimeout is how long a client has to send the TLS handshake,
+	// request line, and headers once it has connected. Clients that run out
+	// of time get a 408. 0 means there's no limit besides ReadTimeout.
+	ReadHeaderTimeout time.Duration
+	// ReadBodyIdleTimeout is how long the request body may go without any
+	// data arriving, so big uploads on slow links are fine as long as they
+	// keep moving. 0 means there's no limit besides ReadTimeout.
+	ReadBodyIdleTimeout time.Duration
+	// ReadBufferSize is the size of the buffer that each connection's request
+	// is read through, and so the longest that the request line or a header
+	// can be. 0 means 8 KiB.
+	ReadBufferSize int
+	// WriteTimeout is how long the Server has to write a response once it has
+	// started to. 0 means there's no limit.
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a connection may go without anything being read
+	// from or written to it (other than while its handler is running) before
+	// it's closed. Unlike the read timeouts, it's enforced by a background
+	// reaper rather than deadlines, so it also catches clients that are slow
+	// to read the response. 0 means there's no limit.
+	IdleTimeout time.Duration
+	// HandlerTimeout is how long handlers (along with their middleware) get to
+	// return a response, after which the client gets a 503 and the request is
+	// abandoned with ErrHandlerTimeout. 0 means there's no limit. It can be
+	// changed for each endpoint with WithHandlerTimeout.
+	HandlerTimeout time.Duration
+	// DrainDelay is how long Shutdown keeps serving new connections after
+	// HealthHandler starts reporting that the Server is draining, so that a
+	// load balancer has time to notice before the listeners are closed.
+	DrainDelay time.Duration
+	// TempDir is where middleware such as gzipMiddleware keeps its temp
+	// files. It's best on the same filesystem as whatever they end up being
+	// copied to. If it's empty, os.TempDir() is used.
+	TempDir string
+	// MaxConnections is how many connections the Server will serve at once. 0
+	// means there's no limit. What happens to the rest is up to Overload.
+	// With OverloadWait, each listener can let one more connection through,
+	// so the limit may be overshot by the number of listeners less one.
+	MaxConnections int
+	// Overload is what happens to new connections once there are
+	// MaxConnections of them.
+	Overload OverloadPolicy
+	// MaxConnsPerIP is how many connections the Server will serve at once
+	// from a single client IP. Clients over the limit get a 429. 0 means
+	// there's no limit.
+	MaxConnsPerIP int
+	// GroupIPv6By64 makes MaxConnsPerIP count IPv6 clients by their /64
+	// rather than their full address.
+	GroupIPv6By64 bool
+	// OverloadRetryAfter, if it's set, is sent as Retry-After on the 503 and
+	// 429 responses from MaxConnections and MaxConnsPerIP.
+	OverloadRetryAfter time.Duration
+	// ProxyProtocol makes the Server's listeners expect a PROXY protocol
+	// header on connections from TrustedProxies, e.g. when it's behind HAProxy
+	// in TCP mode, so that it sees the real clients' addresses. See
+	// NewProxyProtocolListener. ReadHeaderTimeout (or 10 seconds) is how long
+	// proxies get to send the header.
+	ProxyProtocol bool
+	// TrustedProxies are the only addresses that PROXY protocol headers are
+	// accepted from. Listen fails if ProxyProtocol is set without any.
+	TrustedProxies []netip.Prefix
+	// ServerHeader, if it's set, is sent as the Server header on the
+	// responses that the Server makes up itself, like the 500 for a handler
+	// that fails. Handlers' responses only get one if middleware adds it.
+	ServerHeader string
+	// VerboseErrors gives the Server's 500s a short plain text body saying
+	// what went wrong, rather than none. The error itself is only ever
+	// logged, since it may give away things about the server.
+	VerboseErrors bool
+	// TLSConfig is used by StartTLS. It may be nil.
+	TLSConfig *tls.Config
+	// CertReloadInterval is how often StartTLS checks its certificate files
+	// for changes. 0 means once a minute, and a negative interval turns the
+	// checks off (ReloadCertificates still works).
+	CertReloadInterval time.Duration
+	// OnRequestComplete, if it's set, is called after every request with what
+	// was actually written to the client and how long it took.
+	OnRequestComplete func(RequestResult)
+	// OnConnOpen, OnConnClose, OnRequest, and OnResponse are optional hooks
+	// into the lifecycle of connections and requests, see hooks.go.
+	OnConnOpen  func(conn net.Conn)
+	OnConnClose func(conn net.Conn, err error)
+	OnRequest   func(Request)
+	OnResponse  func(request Request, head ResponseHead, bytesWritten int64, d time.Duration)
+	// mu guards listeners, serving, reaping, endPointHandlers, middlewares,
+	// the TLS certificates, and healthChecks, since handlers may be registered while requests are being served
+	mu        sync.RWMutex
+	listeners []net.Listener
+	// bound are the listeners as they were bound, before being wrapped by the
+	// PROXY protocol or TLS, for ListenerFiles
+	bound []net.Listener
+	// redirectListeners are the listeners from RedirectHTTPFrom
+	redirectListeners []net.Listener
+	serving           map[net.Listener]bool
+	endPointHandlers  []endpointHandler
+	middlewares       []Middleware
+	certs             *certReloader
+	hostCerts         map[string]*tls.Certificate
+	healthChecks      []healthCheck
+	// reaping is set once the idle reaper has been started
+	reaping bool
+
+	stats serverStats
+	// draining is set as soon as Shutdown is called, for HealthHandler
+	draining atomic.Bool
+	// shuttingDown is set by Close and Shutdown, so that the accept loops know
+	// that their listeners were closed on purpose
+	shuttingDown atomic.Bool
+	// connsMu guards conns and requests, which Shutdown uses to wait for (or
+	// cut off) the connections being served and the handlers running on them,
+	// along with connsPerIP for MaxConnsPerIP, and connsChanged, which is
+	// closed when a connection finishes
+	connsMu      sync.Mutex
+	conns        map[net.Conn]*connActivity
+	connsPerIP   map[netip.Addr]int
+	requests     map[*requestState]struct{}
+	connsChanged chan struct{}
 }
 
 // RegisterHandler makes it so that the specified handler runs on any request
@@ -125,19 +443,26 @@ type Server struct {
 //
 // Note that "/" is a special case. It will only match if the requested path is
 // "/" exactly.
-func (s *Server) RegisterHandler(endpointPrefix string, handler Handler) {
+func (s *Server) RegisterHandler(endpointPrefix string, handler Handler, opts ...HandlerOption) {
+	e := endpointHandler{prefix: endpointPrefix, handler: handler}
+	for _, opt := range opts {
+		opt(&e)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.composed = s.compose(handler)
 	if s.endPointHandlers == nil {
 		s.endPointHandlers = make([]endpointHandler, 0)
 	} else {
 		for i := range s.endPointHandlers {
 			if s.endPointHandlers[i].prefix == endpointPrefix {
-				s.endPointHandlers[i].handler = handler
+				s.endPointHandlers[i] = e
 				return
 			}
 		}
 	}
 
-	e := endpointHandler{endpointPrefix, handler}
 	s.endPointHandlers = append(s.endPointHandlers, e)
 	// always sort the most specific endpoint handlers earlier in the array
 	slices.SortFunc(s.endPointHandlers, func(a endpointHandler, b endpointHandler) int {
@@ -145,132 +470,924 @@ func (s *Server) RegisterHandler(endpointPrefix string, handler Handler) {
 	})
 }
 
+// RegisterMiddleware wraps every handler (including ones registered later) in
+// m. Middleware registered later runs first, i.e. it wraps the middleware
+// registered before it.
+//
+// The middleware chain is built once per handler rather than per request, so
+// this rebuilds the chain for every registered handler. It's safe to call
+// while the Server is running; requests that have already started keep using
+// the old chain.
 func (s *Server) RegisterMiddleware(m Middleware) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.middlewares = append(s.middlewares, m)
+	for i := range s.endPointHandlers {
+		s.endPointHandlers[i].composed = s.compose(s.endPointHandlers[i].handler)
+	}
+}
+
+// compose wraps handler in all of the registered middleware. s.mu must be held.
+func (s *Server) compose(handler Handler) Handler {
+	for i := range s.middlewares {
+		handler = s.middlewares[i](handler)
+	}
+	return handler
+}
+
+// route returns a copy of the endpoint that should handle path, so that it can
+// be used after s.mu is released.
+func (s *Server) route(path string) (endpointHandler, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	e := getEndpoint(s.endPointHandlers, path)
+	if e == nil {
+		return endpointHandler{}, false
+	}
+	return *e, true
+}
+
+// Listen binds to Address and every one of Addresses without accepting any
+// connections yet, so that callers can find out the bound addresses (e.g. of
+// ":0") with Addr before calling Start. It does nothing if the Server is
+// already listening.
+func (s *Server) Listen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.listeners) > 0 {
+		return nil
+	}
+
+	addresses := s.addresses()
+	if len(addresses) == 0 {
+		return errors.New("no address to listen on")
+	}
+	lc := s.listenConfig()
+	listen := func(network string, address string) (net.Listener, error) {
+		return lc.Listen(context.Background(), network, address)
+	}
+	if s.Dialer != nil {
+		listen = s.Dialer
+	}
+	listeners := make([]net.Listener, 0, len(addresses))
+	for _, address := range addresses {
+		address, err := normalizeAddress(address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		l, err := listen("tcp", address)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+	err := s.adopt(listeners)
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return err
+	}
+	return nil
+}
+
+// adopt makes listeners the ones that the Server serves, wrapping them for the
+// PROXY protocol if it's enabled. s.mu must be held.
+func (s *Server) adopt(listeners []net.Listener) error {
+	if s.ProxyProtocol && len(s.TrustedProxies) == 0 {
+		return errors.New("PROXY protocol is enabled without any trusted proxies")
+	}
+	s.bound = listeners
+	s.listeners = make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		if s.ProxyProtocol {
+			l = NewProxyProtocolListener(l, s.TrustedProxies, s.ReadHeaderTimeout)
+		}
+		s.listeners[i] = l
+	}
+	return nil
+}
+
+// Addr returns the address that the Server is listening on (the first one, if
+// there are several), or nil if it isn't listening yet.
+func (s *Server) Addr() net.Addr {
+	addrs := s.Addrs()
+	if len(addrs) == 0 {
+		return nil
+	}
+	return addrs[0]
+}
+
+// Addrs returns every address that the Server is listening on.
+func (s *Server) Addrs() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(s.listeners))
+	for _, l := range s.listeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
 }
 
 // Start only returns an error if the server could not start listening for
-// requests.
+// requests. It listens (see Listen) on Address and every one of Addresses, and
+// serves all of them the same way until the Server is closed.
 func (s *Server) Start() error {
-	l, err := net.Listen("tcp", s.Address)
+	err := s.Listen()
 	if err != nil {
 		return err
 	}
-	s.listener = l
-	defer s.listener.Close()
+	return s.serveAll()
+}
+
+// serveAll serves every one of the Server's listeners until it's closed.
+func (s *Server) serveAll() error {
+	s.mu.RLock()
+	listeners := slices.Clone(s.listeners)
+	s.mu.RUnlock()
+
+	errs := make([]error, len(listeners))
+	var wg sync.WaitGroup
+	for i, l := range listeners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Serve(l)
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
 
+// addresses returns every address that the server should listen on, without
+// duplicates.
+func (s *Server) addresses() []string {
+	addresses := make([]string, 0, len(s.Addresses)+1)
+	if s.Address != "" {
+		addresses = append(addresses, s.Address)
+	}
+	for _, address := range s.Addresses {
+		if !slices.Contains(addresses, address) {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// normalizeAddress checks that address is a host (which may be empty, for
+// every IPv4 and IPv6 address) and port that can be listened on, so that
+// mistakes get a clearer error than net.Listen's. IPv6 hosts have to be in
+// brackets, e.g. "[::1]:8080", since otherwise the port can't be told apart
+// from the address.
+func normalizeAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		if strings.Count(address, ":") > 1 && !strings.HasPrefix(address, "[") {
+			return "", fmt.Errorf("invalid address '%s': IPv6 addresses need brackets, e.g. [::1]:8080", address)
+		}
+		return "", fmt.Errorf("invalid address '%s': expected host:port, e.g. localhost:8080 or :8080", address)
+	}
+	if port == "" {
+		return "", fmt.Errorf("invalid address '%s': no port", address)
+	}
+	_, err = net.LookupPort("tcp", port)
+	if err != nil {
+		return "", fmt.Errorf("invalid address '%s': bad port '%s'", address, port)
+	}
+	if strings.Contains(host, ":") {
+		_, err := netip.ParseAddr(host)
+		if err != nil {
+			return "", fmt.Errorf("invalid address '%s': bad IPv6 address '%s'", address, host)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// ErrAlreadyServing is returned by Serve if the listener is already being
+// served.
+var ErrAlreadyServing = errors.New("listener is already being served")
+
+// Serve accepts connections on l and handles each of them in its own
+// goroutine, until the Server is closed (when it returns nil). l can be any
+// listener, e.g. one wrapped in TLS or handed over by a supervisor. It's closed
+// when Serve returns, and is closed by Close and Shutdown like the Server's
+// own listeners.
+//
+// Temporary accept errors (like running out of file descriptors) are retried
+// with a growing delay. Any other accept error is returned.
+func (s *Server) Serve(l net.Listener) error {
+	err := s.startServing(l)
+	if err != nil {
+		return err
+	}
+	defer s.stopServing(l)
+	defer l.Close()
+
+	var backoff time.Duration
 	for {
-		conn, err := s.listener.Accept()
+		s.waitForConnSlot()
+		conn, err := l.Accept()
+		if err != nil && s.shuttingDown.Load() {
+			return nil
+		}
+		if err != nil && !isTemporaryAcceptError(err) {
+			return fmt.Errorf("accept connection: %w", err)
+		}
 		if err != nil {
-			// don't get blocked on logging
-			go func() {
-				log.Print("Server failed to accept connection: ", err.Error())
-			}()
+			// e.g. we're out of file descriptors. Retrying straight away would
+			// just spin until some are freed up.
+			backoff = nextAcceptBackoff(backoff)
+			slog.Error("Server failed to accept connection", "error", err, "retry_in", backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		s.stats.connectionAccepted()
+		s.setConnOptions(conn)
+		activity, err := s.trackConn(conn)
+		if errors.Is(err, errTooManyConnections) {
+			go s.rejectConn(conn, serviceUnavailableResponse())
+			continue
+		}
+		if errors.Is(err, errTooManyConnsFromIP) {
+			go s.rejectConn(conn, tooManyRequestsResponse())
+			continue
+		}
+		if err != nil {
+			conn.Close()
 			continue
 		}
 
 		go func() {
+			defer s.untrackConn(conn)
+			var connErr error
+			if s.OnConnClose != nil {
+				defer s.runHook("OnConnClose", func() { s.OnConnClose(conn, connErr) })
+			}
 			defer conn.Close()
-			err := s.handleRequest(conn)
-			if err != nil {
-				log.Printf("error handling Server request: %s", err)
-				// TODO: is this where we should send the 500 response?
-				_, err := io.Copy(conn, bytes.NewReader(errorResponse.Head.Bytes()))
+			if s.OnConnOpen != nil {
+				s.runHook("OnConnOpen", func() { s.OnConnOpen(conn) })
+			}
+			deadlines := s.readDeadlines(conn, time.Now())
+			deadlines.startHeaders()
+			// a client that fails the handshake (e.g. without a trusted
+			// certificate) never gets as far as a handler
+			if tlsConn, ok := conn.(*tls.Conn); ok {
+				err := tlsConn.Handshake()
 				if err != nil {
-					log.Printf("Server failed to send 500 response: %s", err)
+					slog.Debug("TLS handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+					connErr = err
+					return
+				}
+				activity.touch()
+			}
+			start := time.Now()
+			var result RequestResult
+			c := &countingConn{Conn: conn, writeTimeout: s.WriteTimeout, activity: activity}
+			defer func() {
+				result.TotalDuration = time.Since(start)
+				result.ReadBytes = c.read.Load()
+				s.stats.record(result)
+				if s.OnResponse != nil && result.request != nil {
+					s.runHook("OnResponse", func() {
+						s.OnResponse(*result.request, result.head, result.HeadBytes+result.BodyBytes, result.TotalDuration)
+					})
+				}
+				if s.OnRequestComplete != nil {
+					s.OnRequestComplete(result)
 				}
+				// nothing of the request's is used after this
+				if result.headers != nil {
+					putHeaders(result.headers)
+				}
+			}()
+
+			err := s.handleRequest(c, deadlines, &result)
+			result.Err = err
+			connErr = err
+			if err == nil {
+				return
+			}
+			if activity.reaped.Load() {
+				return
+			}
+			// e.g. a load balancer's TCP health check, which connects and hangs
+			// up without sending anything
+			if result.request == nil && isDisconnect(err) {
+				slog.Debug("Server connection closed before a whole request was sent", "remote_addr", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			// a client that's too slow to send its request (or to read the
+			// response) won't be any quicker to read a 500
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Warn("Server connection timed out", "remote_addr", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			errorID := errorIDFor(result.request)
+			slog.Error("error handling Server request", "error_id", errorID, "method", result.Method, "path", result.Path, "error", err)
+			// Once any part of a response has been sent, a 500 would just end up
+			// in the middle of it. All we can do is close the connection.
+			if c.written > 0 {
+				slog.Error("Server closing connection partway through a response", "error_id", errorID, "bytes_sent", c.written)
+				return
+			}
+			err = writeResponse(c, s.errorResponse(errorID), &result)
+			if err != nil {
+				slog.Error("Server failed to send 500 response", "error", err)
 			}
 		}()
 	}
 }
 
+// startServing records that l is being served, adding it to the Server's
+// listeners if it isn't one of them already.
+func (s *Server) startServing(l net.Listener) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shuttingDown.Load() {
+		l.Close()
+		return nil
+	}
+	if s.serving[l] {
+		return ErrAlreadyServing
+	}
+	if s.serving == nil {
+		s.serving = make(map[net.Listener]bool)
+	}
+	s.serving[l] = true
+	if !slices.Contains(s.listeners, l) {
+		s.listeners = append(s.listeners, l)
+	}
+	s.startReaper()
+	return nil
+}
+
+func (s *Server) stopServing(l net.Listener) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.serving, l)
+}
+
+// countingConn counts the bytes written to a connection, so that we know
+// whether it's still safe to start a new response on it, along with the bytes
+// read from it for Stats.
+type countingConn struct {
+	net.Conn
+	written int64
+	// read is atomic because the disconnect watcher reads in the background
+	read atomic.Int64
+	// writeTimeout, if it's set, becomes the write deadline on the first write
+	writeTimeout time.Duration
+	deadlineSet  bool
+	// activity, if it's set, is kept up to date for the idle reaper
+	activity *connActivity
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	if n > 0 && c.activity != nil {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.startWriting()
+	n, err := c.Conn.Write(p)
+	c.written += int64(n)
+	if n > 0 && c.activity != nil {
+		c.activity.touch()
+	}
+	return n, err
+}
+
+// startWriting sets the write deadline, if there is one, before the first
+// write.
+func (c *countingConn) startWriting() {
+	if c.writeTimeout > 0 && !c.deadlineSet {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+		c.deadlineSet = true
+	}
+}
+
+// sendfileChunk is how much ReadFrom hands to the connection at a time, so
+// that the idle reaper can see that a big file is still being sent.
+const sendfileChunk = 1 << 20
+
+// ReadFrom copies r to the connection itself rather than through Write, so
+// that a *net.TCPConn can send files with sendfile(2) instead of copying them
+// through user space. TLS connections (and anything else) just copy.
+func (c *countingConn) ReadFrom(r io.Reader) (int64, error) {
+	c.startWriting()
+	dst := c.Conn
+	// it doesn't change what's written, only what the addresses say
+	if p, ok := dst.(*proxyConn); ok {
+		dst = p.Conn
+	}
+	var written int64
+	for {
+		// CopyN wraps r in an io.LimitedReader, which TCPConn.ReadFrom still
+		// recognises as a file
+		n, err := io.CopyN(dst, r, sendfileChunk)
+		written += n
+		c.written += n
+		if n > 0 && c.activity != nil {
+			c.activity.touch()
+		}
+		if errors.Is(err, io.EOF) {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// fileBody returns the file behind a response body, if there is one, so that
+// writeResponse can hand it to the connection as it is.
+func fileBody(body io.Reader) (*os.File, bool) {
+	file, ok := unwrapBody(body).(*os.File)
+	return file, ok
+}
+
+// wrappedBody is implemented by response bodies that wrap another body just to
+// do something extra when they're closed. writeResponse looks through them
+// for what it can write more cleverly, like a *StreamBody, a body with a Len,
+// or an *os.File, so every such wrapper needs to implement it.
+type wrappedBody interface {
+	unwrapBody() io.Reader
+}
+
+// unwrapBody returns the body that body wraps, all the way down, or body
+// itself if it doesn't wrap one.
+func unwrapBody(body io.Reader) io.Reader {
+	for {
+		w, ok := body.(wrappedBody)
+		if !ok {
+			return body
+		}
+		body = w.unwrapBody()
+	}
+}
+
+// remoteAddr returns the address of the client on the other end of conn, or ""
+// if conn isn't a network connection.
+func remoteAddr(conn io.ReadWriter) string {
+	c, ok := conn.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return ""
+	}
+	return c.RemoteAddr().String()
+}
+
 func getHandler(ep []endpointHandler, path string) Handler {
+	e := getEndpoint(ep, path)
+	if e == nil {
+		return nil
+	}
+	return e.handler
+}
+
+func getEndpoint(ep []endpointHandler, path string) *endpointHandler {
 	for i := range ep {
 		prefix := ep[i].prefix
 		if prefix == "/" {
 			if path == "/" {
-				return ep[i].handler
+				return &ep[i]
 			}
 			continue
 		}
 		if strings.HasPrefix(path, prefix) {
-			return ep[i].handler
+			return &ep[i]
 		}
 	}
 	return nil
 }
 
+// bodyLimit returns the request body limit for e, or a negative number if
+// there isn't one.
+func (s *Server) bodyLimit(e *endpointHandler) int64 {
+	if e.bodyLimit != 0 {
+		return e.bodyLimit
+	}
+	if s.MaxRequestBodySize <= 0 {
+		return -1
+	}
+	return s.MaxRequestBodySize
+}
+
+// maxDiscardedBody is how much of a request body discardBody reads when
+// there's no MaxRequestBodySize.
+const maxDiscardedBody = 256 << 10
+
+// discardBody reads and throws away the body of a request that no handler is
+// going to read, up to MaxRequestBodySize (or maxDiscardedBody). Closing the
+// connection with some of the body unread makes the kernel reset it, and the
+// client may never see the response that was written before that. Bodies
+// that are bigger than the limit are left, and may well get the reset.
+func (s *Server) discardBody(body io.Reader, headers map[string]string) {
+	length, err := strconv.ParseInt(headers["content-length"], 10, 64)
+	if err != nil || length <= 0 {
+		return
+	}
+	limit := s.MaxRequestBodySize
+	if limit <= 0 {
+		limit = maxDiscardedBody
+	}
+	if length > limit {
+		return
+	}
+	// if the client stops sending it, the response is no worse off than
+	// without trying
+	io.CopyN(io.Discard, body, length)
+}
+
+// RequestResult describes how a request was handled, once its response has been
+// written (or has failed to be).
+type RequestResult struct {
+	// Method and Path are empty if the request line couldn't be read
+	Method string
+	Path   string
+	// Status is 0 if no response was written
+	Status int
+	// HeadBytes and BodyBytes are what was actually written to the
+	// connection, i.e. after any compression by middleware
+	HeadBytes int64
+	BodyBytes int64
+	// ReadBytes is what was read from the connection: the request line,
+	// headers, and however much of the body was read
+	ReadBytes int64
+	// HandlerDuration is how long the handler (and middleware) took to return
+	// a Response
+	HandlerDuration time.Duration
+	// TotalDuration also includes reading the request and writing the response
+	TotalDuration time.Duration
+	Err           error
+
+	// request is set once the request's headers have been read, and head once
+	// a response has been written, for the OnResponse hook
+	request *Request
+	head    ResponseHead
+	// headers is the request's pooled header map, which goes back to the pool
+	// once the request is finished with. It's nil if something may still be
+	// using it.
+	headers map[string]string
+	// route is the prefix of the endpoint the request was routed to, or
+	// unmatchedRoute, for the per-route stats
+	route string
+}
+
 // if handleRequest fails, it wasn't able to send a response back on the conn
-func (s *Server) handleRequest(conn io.ReadWriter) error {
-	buf := bufio.NewReader(conn)
-	requestLineStr, err := buf.ReadString('\n')
+func (s *Server) handleRequest(conn io.ReadWriter, deadlines *readDeadlines, result *RequestResult) error {
+	size := s.readBufferSize()
+	buf := getReader(conn, size)
+	// nothing reads from buf once we return, unless a handler that timed out
+	// is still going
+	reusable := true
+	defer func() {
+		if reusable {
+			putReader(buf)
+		}
+	}()
+	requestLineStr, err := readHeadLine(buf)
+	if errors.Is(err, errLineTooLong) {
+		slog.Warn("Server got a request line that's too long", "remote_addr", remoteAddr(conn), "max_bytes", size)
+		return writeResponse(conn, HTTPError{Status: 414, Message: "request line is too long"}.Response(), result)
+	}
 	// we should be able to scan at least one line
 	if err != nil {
-		return fmt.Errorf("read from connection: %w", err)
+		return headerReadFailed(conn, fmt.Errorf("read from connection: %w", err), result)
 	}
+	received := time.Now()
 	requestLine, err := parseRequestLine(requestLineStr)
 	if err != nil {
-		return err
+		slog.Warn("Server got a malformed request", "remote_addr", remoteAddr(conn), "error", err)
+		return writeResponse(conn, BadRequestResponse(), result)
 	}
+	activity := activityOf(conn)
+	activity.startRequest(requestLine, received)
+	result.Method = requestLine.Method
+	result.Path = requestLine.Path
 
-	headers := make(map[string]string)
+	headers := getHeaders()
+	result.headers = headers
 	for {
-		line, err := buf.ReadString('\n')
+		line, err := readHeadLine(buf)
+		if errors.Is(err, errLineTooLong) {
+			slog.Warn("Server got a request header that's too long", "remote_addr", remoteAddr(conn), "max_bytes", size)
+			return writeResponse(conn, HTTPError{Status: 431, Message: "request header is too long"}.Response(), result)
+		}
 		if err != nil {
-			return fmt.Errorf("read request headers: %w", err)
+			return headerReadFailed(conn, fmt.Errorf("read request headers: %w", err), result)
 		}
 		line = strings.TrimRight(line, "\r\n")
 		// there are no more headers to read
 		if line == "" {
 			break
 		}
+		if len(headers) >= maxRequestHeaders {
+			slog.Warn("Server got too many request headers", "remote_addr", remoteAddr(conn), "max_headers", maxRequestHeaders)
+			return writeResponse(conn, HTTPError{Status: 431, Message: "too many request headers"}.Response(), result)
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			slog.Warn("Server got a malformed request header", "remote_addr", remoteAddr(conn), "header", line)
+			return writeResponse(conn, BadRequestResponse(), result)
+		}
+		headers[strings.ToLower(key)] = strings.TrimSpace(value)
+	}
 
-		h := strings.Split(line, ": ")
-		key := strings.ToLower(h[0])
-		value := h[1]
-		headers[key] = value
+	request := Request{RequestLine: requestLine, Headers: headers, TLS: connectionState(conn), RemoteAddr: remoteAddr(conn)}
+	result.request = &request
+	// the headers are only worth copying if they're going to be logged
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug("request", "method", requestLine.Method, "path", requestLine.Path, "protocol", requestLine.Protocol,
+			"remote_addr", request.RemoteAddr, "headers", redactSensitiveHeaders(headers))
+	}
+	if s.OnRequest != nil {
+		s.runHook("OnRequest", func() { s.OnRequest(request) })
 	}
 
-	handler := getHandler(s.endPointHandlers, requestLine.Path)
-	if handler == nil {
+	endpoint, ok := s.route(requestLine.Path)
+	if !ok {
 		// if no handler is found, return a 404
-		_, err = io.Copy(conn, bytes.NewReader(notFoundResponse.Head.Bytes()))
-		if err != nil {
-			return fmt.Errorf("write 404 response: %w", err)
+		result.route = unmatchedRoute
+		deadlines.startBody()
+		s.discardBody(&idleReader{r: buf, deadlines: deadlines}, headers)
+		return writeResponse(conn, NotFoundResponse(), result)
+	}
+	result.route = endpoint.prefix
+
+	state := newRequestState()
+	state.tempDir = s.TempDir
+	state.received = received
+	deadliner, canWatch := conn.(readDeadliner)
+	watch := func() {
+		if canWatch {
+			// the request has been read, so the read deadlines are done
+			// with. The watcher would take them for a hang up otherwise.
+			deadlines.clear()
+			state.watch(buf)
 		}
-		return nil
 	}
 
-	for i := range s.middlewares {
-		handler = s.middlewares[i](handler)
+	deadlines.startBody()
+	var body io.Reader = &idleReader{r: buf, deadlines: deadlines}
+	if contentLength, ok := headers["content-length"]; ok {
+		length, err := strconv.ParseInt(contentLength, 10, 64)
+		if err == nil {
+			body = &bodyReader{r: body, remaining: length, consumed: watch}
+		}
+	} else if _, ok := headers["transfer-encoding"]; !ok {
+		// a request with neither header doesn't have a body
+		body = &bodyReader{r: body, consumed: watch}
+	}
+	// there may be nothing for the handler to read
+	if br, ok := body.(*bodyReader); ok && br.remaining <= 0 {
+		br.finish()
+	}
+
+	limit := s.bodyLimit(&endpoint)
+	if limit >= 0 {
+		if contentLength, ok := headers["content-length"]; ok {
+			length, err := strconv.ParseInt(contentLength, 10, 64)
+			if err == nil && length > limit {
+				return writeResponse(conn, tooLargeResponse(), result)
+			}
+		}
+		body = &maxBytesReader{r: body, remaining: limit}
+	}
+
+	handlerStart := time.Now()
+	s.trackRequest(state)
+	request.Body = body
+	request.state = state
+	activity.setBusy(true)
+	response, err := s.callHandler(&endpoint, request)
+	activity.setBusy(false)
+	s.untrackRequest(state)
+	result.HandlerDuration = time.Since(handlerStart)
+	// the handler's done with, so anything waiting on the response (see
+	// requestState.onFinish) is told how writing it went
+	respond := func(response Response) error {
+		err := writeResponse(conn, response, result)
+		state.finish(err)
+		return err
+	}
+	if errors.Is(err, ErrHandlerTimeout) {
+		// The handler may still be reading the body, so the watcher (if it
+		// has started) is left to stop when the connection is closed, and buf
+		// can't be reused, and nor can the headers.
+		reusable = false
+		result.headers = nil
+		return respond(HTTPError{Status: 503, Message: "handler timed out"}.Response())
+	}
+	if canWatch {
+		state.stopWatching(deadliner)
+	}
+	if errors.Is(err, ErrBodyTooLarge) {
+		return respond(tooLargeResponse())
+	}
+	if httpErr, ok := asHTTPError(err); ok {
+		response, err = httpErr.Response(), nil
 	}
-	response, err := handler(Request{requestLine, headers, buf})
 	if err != nil {
+		// the 500 isn't the handler's response
+		state.finish(nil)
 		return err
 	}
-	_, err = io.Copy(conn, bytes.NewReader(response.Head.Bytes()))
+	return respond(response)
+}
+
+// requestBufferSize is the default ReadBufferSize.
+const requestBufferSize = 8 << 10
+
+func (s *Server) readBufferSize() int {
+	if s.ReadBufferSize > 0 {
+		return s.ReadBufferSize
+	}
+	return requestBufferSize
+}
+
+// maxRequestHeaders is how many headers a request can have. Along with
+// ReadBufferSize, it bounds how much memory a request's head can take up.
+const maxRequestHeaders = 100
+
+// errLineTooLong is returned by readHeadLine for lines that don't fit in the
+// buffer.
+var errLineTooLong = errors.New("line is too long")
+
+// readHeadLine reads a line of a request's head (including the line ending).
+// Unlike ReadString, it never grows buf, so a client can't make us buffer an
+// endless line. Lines longer than buf's size get errLineTooLong.
+func readHeadLine(buf *bufio.Reader) (string, error) {
+	line, err := buf.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) {
+		return "", errLineTooLong
+	}
+	// line points into buf, which will be overwritten by the next read
+	return string(line), err
+}
+
+// readerPool holds the bufio.Readers that requests are read through, so that
+// each connection doesn't allocate a new buffer.
+var readerPool sync.Pool
+
+// getReader returns a reader of r with a buffer of size. Pooled readers of
+// another size (i.e. from a Server with a different ReadBufferSize) are left
+// for the garbage collector rather than resized.
+func getReader(r io.Reader, size int) *bufio.Reader {
+	if buf, ok := readerPool.Get().(*bufio.Reader); ok && buf.Size() == size {
+		buf.Reset(r)
+		return buf
+	}
+	return bufio.NewReaderSize(r, size)
+}
+
+// putReader returns buf to the pool. Nothing may use it afterwards.
+func putReader(buf *bufio.Reader) {
+	// so that the pool doesn't keep the connection alive
+	buf.Reset(nil)
+	readerPool.Put(buf)
+}
+
+// writeResponse writes response to conn and closes its body, recording what
+// was written in result.
+func writeResponse(conn io.Writer, response Response, result *RequestResult) error {
+	// the body has to be closed even if we never get to write it
+	if response.Body != nil {
+		defer response.Body.Close()
+		setContentLength(&response)
+	} else if mayHaveBody(response.Head.Status) && !hasHeader(response.Head.Headers, "Content-Length") {
+		// otherwise the client can't tell that there's no body coming
+		response.Head.Headers = withHeader(response.Head.Headers, "Content-Length", "0")
+	}
+	// every connection is closed after its first response
+	if !hasHeader(response.Head.Headers, "Connection") {
+		response.Head.Headers = withHeader(response.Head.Headers, "Connection", "close")
+	}
+	stream, streaming := unwrapBody(response.Body).(*StreamBody)
+	chunked := streaming && !hasHeader(response.Head.Headers, "Content-Length")
+	if chunked {
+		response.Head.Headers = withHeader(response.Head.Headers, "Transfer-Encoding", "chunked")
+	}
+
+	// writes are buffered so that a StreamBody gets to decide when they're sent
+	w := bufio.NewWriter(conn)
+	result.Status = response.Head.Status
+	result.head = response.Head
+	n, err := w.Write(response.Head.Bytes())
+	result.HeadBytes += int64(n)
 	if err != nil {
 		return fmt.Errorf("write response head: %w", err)
 	}
 	if response.Body != nil {
-		defer response.Body.Close()
-		_, err = io.Copy(conn, response.Body)
+		var n int64
+		file, isFile := fileBody(response.Body)
+		readerFrom, canReadFrom := conn.(io.ReaderFrom)
+		switch {
+		case streaming:
+			n, err = stream.writeTo(w, chunked)
+		case isFile && canReadFrom:
+			// the head has to go first, so that the file can go straight to
+			// the connection rather than through w
+			err = w.Flush()
+			if err != nil {
+				return fmt.Errorf("write response head: %w", err)
+			}
+			n, err = readerFrom.ReadFrom(file)
+		default:
+			n, err = io.Copy(w, response.Body)
+		}
+		result.BodyBytes += n
 		if err != nil {
 			return fmt.Errorf("write response body: %w", err)
 		}
 	}
+	err = w.Flush()
+	if err != nil {
+		return fmt.Errorf("flush response: %w", err)
+	}
 	return nil
 }
 
+// Close stops the Server from accepting connections, so that Start returns
+// nil. Connections that are already being served are left alone; see Shutdown
+// for waiting on them. It's safe to call Close more than once.
 func (s *Server) Close() error {
-	return fmt.Errorf("close server: %w", s.listener.Close())
+	s.shuttingDown.Store(true)
+	err := s.closeListeners()
+	if err != nil {
+		return fmt.Errorf("close server: %w", err)
+	}
+	return nil
+}
+
+// closeListeners closes all of the Server's listeners, ignoring ones that were
+// already closed.
+func (s *Server) closeListeners() error {
+	// wake up any accept loops waiting for room, so they see the shutdown
+	s.connsMu.Lock()
+	s.notifyConnsChanged()
+	s.connsMu.Unlock()
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	errs := make([]error, 0, len(s.listeners))
+	for _, l := range slices.Concat(s.listeners, s.redirectListeners) {
+		err := l.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
 }
 
 // NOTE: Proper handlers would probably return a 405 for unsupported methods on
 // an endpoint. One way to work around this in future would be to make
 // RegisterHandler also take the intended method as a parameter.
 
-func getFilesEndpoint(directory string) Handler {
+// FilesEndpointOptions configures getFilesEndpoint.
+type FilesEndpointOptions struct {
+	// IndexFiles are the files to look for, in order, when a directory is
+	// requested. The first one that exists is served. If it's nil,
+	// defaultIndexFiles is used.
+	IndexFiles []string
+	// Listings makes a directory without an index file respond with a list
+	// of its contents, rather than a 404.
+	Listings bool
+	// ReadOnly turns away uploads with a 405.
+	ReadOnly bool
+	// ContentMD5 adds a Content-MD5 (RFC 1864) to downloads, so that clients
+	// can check them. Files are hashed as they're sent, so it comes in a
+	// trailer after the body, which means downloads are sent chunked rather
+	// than with a Content-Length.
+	ContentMD5 bool
+	// CacheControl is the Cache-Control header to send with files, by
+	// extension (with the dot, e.g. ".js"). Extensions are matched without
+	// regard to case.
+	CacheControl map[string]string
+	// DefaultCacheControl is the Cache-Control header for files whose
+	// extension isn't in CacheControl. If it's empty, they get none.
+	DefaultCacheControl string
+}
+
+var defaultIndexFiles = []string{"index.html", "index.htm", "README.md"}
+
+func getFilesEndpoint(directory string, options FilesEndpointOptions) Handler {
+	indexFiles := options.IndexFiles
+	if indexFiles == nil {
+		indexFiles = defaultIndexFiles
+	}
+
 	filesEndpoint := func(directory string, req Request) (Response, error) {
 		fileName, err := parsePathArg(req.Path)
 		filePath := path.Join(directory, fileName)
@@ -278,27 +1395,31 @@ func getFilesEndpoint(directory string) Handler {
 		// and POST. For now we'll just make the GET request the default
 		// functionality.
 		if req.Method != "POST" {
-			file, err := os.Open(filePath)
+			stats, err := os.Stat(filePath)
 			if errors.Is(err, fs.ErrNotExist) {
-				return notFoundResponse, nil
+				return NotFoundResponse(), nil
 			}
 			if err != nil {
 				return Response{}, err
 			}
-
-			stats, err := os.Stat(filePath)
+			dir := filePath
+			if !stats.IsDir() {
+				dir = path.Dir(filePath)
+			}
+			unreadable, err := isUnreadable(dir)
 			if err != nil {
 				return Response{}, err
 			}
-
-			headers := make(map[string]string, 3)
-			headers["Content-Type"] = "application/octet-stream"
-			headers["Content-Length"] = fmt.Sprintf("%d", stats.Size())
-			headers["Connection"] = "close"
-			response := okResponse
-			response.Head.Headers = headers
-			response.Body = file
-			return response, nil
+			if unreadable {
+				return Response{}, HTTPError{Status: 403, Message: "directory is not readable"}
+			}
+			if stats.IsDir() {
+				return serveDirectory(req.Path, filePath, indexFiles, options)
+			}
+			return serveFile(filePath, options)
+		}
+		if options.ReadOnly {
+			return Response{}, HTTPError{Status: 405, Message: "uploads are disabled", Headers: map[string]string{"Allow": "GET, HEAD"}}
 		}
 
 		file, err := os.OpenFile(filePath, os.O_CREATE|os.O_WRONLY, 0644)
@@ -322,7 +1443,7 @@ func getFilesEndpoint(directory string) Handler {
 		}
 		headers := make(map[string]string, 1)
 		headers["Connection"] = "close"
-		response := createdResponse
+		response := CreatedResponse()
 		response.Head.Headers = headers
 
 		return response, nil
@@ -333,8 +1454,139 @@ func getFilesEndpoint(directory string) Handler {
 	}
 }
 
+// noReadFile is the file that, if it's in a directory, makes the files endpoint
+// turn away any request for the files in it (or for the directory itself)
+// with a 403. Subdirectories aren't affected unless they have one too.
+const noReadFile = ".noread"
+
+// isUnreadable reports whether dir has a noReadFile. It's checked on every
+// request, so that adding or removing one takes effect straight away.
+func isUnreadable(dir string) (bool, error) {
+	_, err := os.Stat(path.Join(dir, noReadFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("check for %s in '%s': %w", noReadFile, dir, err)
+	}
+	return true, nil
+}
+
+// serveDirectory serves the first of indexFiles that exists in dir. If none of
+// them do, it responds with a listing of dir if options.Listings is true, or a
+// 404 otherwise. requestPath is the path that dir was requested as.
+func serveDirectory(requestPath string, dir string, indexFiles []string, options FilesEndpointOptions) (Response, error) {
+	for _, name := range indexFiles {
+		filePath := path.Join(dir, name)
+		stats, err := os.Stat(filePath)
+		if err == nil && !stats.IsDir() {
+			return serveFile(filePath, options)
+		}
+	}
+	if !options.Listings {
+		return NotFoundResponse(), nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return Response{}, fmt.Errorf("list directory '%s': %w", dir, err)
+	}
+	base := strings.TrimSuffix(requestPath, "/") + "/"
+	var listing bytes.Buffer
+	fmt.Fprintf(&listing, "<!DOCTYPE html>\n<title>%s</title>\n<ul>\n", html.EscapeString(requestPath))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		href := base + (&url.URL{Path: name}).EscapedPath()
+		fmt.Fprintf(&listing, "<li><a href=\"%s\">%s</a></li>\n", html.EscapeString(href), html.EscapeString(name))
+	}
+	listing.WriteString("</ul>\n")
+
+	headers := make(map[string]string, 2)
+	headers["Content-Type"] = "text/html; charset=utf-8"
+	headers["Connection"] = "close"
+	response := OKResponse()
+	response.Head.Headers = headers
+	response.Body = newBytesBody(listing.Bytes())
+	return response, nil
+}
+
+// serveFile responds with the contents of the file at filePath. options says
+// which extra headers to add.
+func serveFile(filePath string, options FilesEndpointOptions) (Response, error) {
+	file, err := os.Open(filePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NotFoundResponse(), nil
+	}
+	if err != nil {
+		return Response{}, err
+	}
+
+	stats, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return Response{}, err
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(filePath))
+	if contentType == "" {
+		contentType, err = sniffContentType(file)
+		if err != nil {
+			file.Close()
+			return Response{}, err
+		}
+	}
+
+	headers := make(map[string]string, 3)
+	headers["Content-Type"] = contentType
+	headers["Content-Length"] = fmt.Sprintf("%d", stats.Size())
+	headers["Connection"] = "close"
+	if cacheControl := options.cacheControl(filePath); cacheControl != "" {
+		headers["Cache-Control"] = cacheControl
+	}
+	response := OKResponse()
+	response.Head.Headers = headers
+	response.Body = file
+	if options.ContentMD5 {
+		delete(headers, "Content-Length")
+		headers["Trailer"] = "Content-MD5"
+		response.Body = md5Body(file)
+	}
+	return response, nil
+}
+
+// cacheControl returns the Cache-Control header for the file at filePath, or ""
+// if it shouldn't have one.
+func (o FilesEndpointOptions) cacheControl(filePath string) string {
+	ext := path.Ext(filePath)
+	for e, value := range o.CacheControl {
+		if strings.EqualFold(e, ext) {
+			return value
+		}
+	}
+	return o.DefaultCacheControl
+}
+
+// md5Body sends file with chunked transfer encoding, hashing it on the way,
+// and then sends its base64 MD5 digest in a Content-MD5 trailer. file is
+// closed along with the body.
+func md5Body(file *os.File) io.ReadCloser {
+	stream := &StreamBody{Stream: func(w *ResponseWriter) error {
+		h := md5.New()
+		_, err := io.Copy(w, io.TeeReader(file, h))
+		if err != nil {
+			return fmt.Errorf("send '%s': %w", file.Name(), err)
+		}
+		w.SetTrailer("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+		return nil
+	}}
+	return &cleanupBody{ReadCloser: stream, cleanup: func() { file.Close() }}
+}
+
 func rootEndpoint(req Request) (Response, error) {
-	return okResponse, nil
+	return OKResponse(), nil
 }
 
 func userAgentEndpoint(req Request) (Response, error) {
@@ -344,7 +1596,7 @@ func userAgentEndpoint(req Request) (Response, error) {
 	headers["Content-Type"] = "text/plain"
 	headers["Content-Length"] = fmt.Sprintf("%d", len(userAgent))
 	headers["Connection"] = "close"
-	response := okResponse
+	response := OKResponse()
 	response.Head.Headers = headers
 	bodyBytes := bytes.NewBufferString(userAgent)
 	response.Body = io.NopCloser(bodyBytes)
@@ -375,17 +1627,55 @@ func echoEndpoint(req Request) (Response, error) {
 	headers["Content-Type"] = "text/plain"
 	headers["Content-Length"] = fmt.Sprintf("%d", len(arg))
 	headers["Connection"] = "close"
-	response := okResponse
+	response := OKResponse()
 	response.Head.Headers = headers
 	bodyBytes := bytes.NewBufferString(arg)
 	response.Body = io.NopCloser(bodyBytes)
 	return response, nil
 }
 
+// sniffLen is how much of a body http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffContentType guesses the Content-Type of file from its first few bytes.
+// They're read with ReadAt, so the file is still at the start afterwards and
+// can be sent as it is (e.g. with sendfile).
+func sniffContentType(file *os.File) (string, error) {
+	peek := make([]byte, sniffLen)
+	n, err := file.ReadAt(peek, 0)
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("read '%s' to detect its content type: %w", file.Name(), err)
+	}
+	return http.DetectContentType(peek[:n]), nil
+}
+
 type tempFile struct {
 	*os.File
 }
 
+// newTempFile creates a temp file in dir (or os.TempDir() if dir is empty)
+// that's removed once it's closed. pattern is as for os.CreateTemp.
+func newTempFile(dir string, pattern string) (*tempFile, error) {
+	t, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return &tempFile{t}, nil
+}
+
+// tempDir returns the Server.TempDir of the Server that received the request,
+// or "" for requests that weren't made by a Server.
+func (r Request) tempDir() string {
+	if r.state == nil {
+		return ""
+	}
+	return r.state.tempDir
+}
+
+func (t *tempFile) unwrapBody() io.Reader {
+	return t.File
+}
+
 func (t *tempFile) Close() error {
 	t.File.Close()
 	err := os.Remove(t.Name())
@@ -395,10 +1685,75 @@ func (t *tempFile) Close() error {
 	return nil
 }
 
+// compressTo gzips body into tmp at the given compression level and rewinds
+// tmp so that it's ready to be read.
+func compressTo(tmp *tempFile, body io.Reader, level int) error {
+	err := withGzipWriter(tmp, level, func(gw *gzip.Writer) error {
+		_, err := io.Copy(gw, body)
+		if err != nil {
+			return err
+		}
+		return gw.Close()
+	})
+	if err != nil {
+		return fmt.Errorf("compress response body and write to %s: %w", tmp.Name(), err)
+	}
+	_, err = tmp.Seek(0, 0)
+	if err != nil {
+		return fmt.Errorf("rewind %s: %w", tmp.Name(), err)
+	}
+	return nil
+}
+
+// gzipWriterPools hold gzip.Writers for each compression level, from
+// gzip.HuffmanOnly up, since every new one allocates a lot of compression
+// state.
+var gzipWriterPools [gzip.BestCompression - gzip.HuffmanOnly + 1]sync.Pool
+
+// withGzipWriter calls f with a gzip.Writer at level that writes to w. The
+// writer comes from gzipWriterPools, and goes back to it once f returns, even
+// if it fails.
+func withGzipWriter(w io.Writer, level int, f func(gw *gzip.Writer) error) error {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		return fmt.Errorf("invalid gzip compression level %d", level)
+	}
+	pool := &gzipWriterPools[level-gzip.HuffmanOnly]
+	gw, ok := pool.Get().(*gzip.Writer)
+	if ok {
+		gw.Reset(w)
+	} else {
+		var err error
+		gw, err = gzip.NewWriterLevel(w, level)
+		if err != nil {
+			return fmt.Errorf("create gzip writer: %w", err)
+		}
+	}
+	defer func() {
+		// so that the pool doesn't hold on to w
+		gw.Reset(io.Discard)
+		pool.Put(gw)
+	}()
+	return f(gw)
+}
+
 // gzipMiddleware would conflict with another middleware that attempts to choose
 // a compression scheme from Accept-Encoding. It's acceptable here since we know
 // that we're not interested in handling any other schemes.
-func gzipMiddleware(handler Handler) Handler {
+var gzipMiddleware = NewGzipMiddleware(gzip.DefaultCompression)
+
+// NewGzipMiddleware is gzipMiddleware with a compression level from
+// compress/gzip, e.g. gzip.BestSpeed. An invalid level is a programming error
+// and panics.
+func NewGzipMiddleware(level int) Middleware {
+	if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		panic(fmt.Sprintf("NewGzipMiddleware: invalid compression level %d", level))
+	}
+	return func(handler Handler) Handler {
+		return gzipHandler(handler, level)
+	}
+}
+
+func gzipHandler(handler Handler, level int) Handler {
 	middleware := func(request Request) (Response, error) {
 		acceptEncoding := request.Headers["accept-encoding"]
 		response, err := handler(request)
@@ -427,29 +1782,29 @@ func gzipMiddleware(handler Handler) Handler {
 			response.Head.Headers = make(map[string]string, 2)
 		}
 		response.Head.Headers["Content-Encoding"] = "gzip"
+		// it's meant to be the digest of what's sent, so it's no longer right,
+		// and a trailer wouldn't make it through the compression anyway
+		delete(response.Head.Headers, "Content-MD5")
+		delete(response.Head.Headers, "Trailer")
+
+		// the compressed copy replaces the original body, so nobody else is
+		// going to close it
+		defer response.Body.Close()
 
-		t, err := os.CreateTemp(os.TempDir(), "Server-gzip-cache")
-		tmp := &tempFile{t}
+		tmp, err := newTempFile(request.tempDir(), "Server-gzip-cache")
 		if err != nil {
 			return Response{}, fmt.Errorf("create temp file to cache compressed gzip response body: %w", err)
 		}
-		gw := gzip.NewWriter(tmp)
-		_, err = io.Copy(gw, response.Body)
-		if err != nil {
-			return Response{}, fmt.Errorf("compress response body and write to %s: %w", tmp.Name(), err)
-		}
-		err = gw.Close()
-		if err != nil {
-			return Response{}, fmt.Errorf("compress response body and write to %s: %w", tmp.Name(), err)
-		}
-		_, err = tmp.Seek(0, 0)
+		err = compressTo(tmp, response.Body, level)
 		if err != nil {
-			return Response{}, fmt.Errorf("rewind %s: %w", tmp.Name(), err)
+			tmp.Close()
+			return Response{}, err
 		}
 		response.Body = tmp
 
 		stats, err := os.Stat(tmp.Name())
 		if err != nil {
+			tmp.Close()
 			return Response{}, err
 		}
 		compressedSize := strconv.Itoa(int(stats.Size()))
@@ -459,28 +1814,206 @@ func gzipMiddleware(handler Handler) Handler {
 	return middleware
 }
 
-func main() {
-	directory := flag.String("directory", ".", "Directory to serve.")
-	flag.Parse()
+// restart starts a new copy of the server that takes over s's listeners
+// (including the ones redirecting to HTTPS), and returns its PID once it's
+// serving them.
+func restart(s *Server, timeout time.Duration) (int, error) {
+	files, err := s.ListenerFiles()
+	if err != nil {
+		return 0, err
+	}
+	redirects, err := s.RedirectListenerFiles()
+	if err != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return 0, err
+	}
+	slog.Info("Restarting", "listeners", len(files), "redirects", len(redirects))
+	return startReplacement(files, redirects, timeout)
+}
 
-	address := flag.Arg(0)
-	if address == "" {
-		log.Fatalf("Usage: %s <address>\n\naddress is the address and port to listen on. E.g. localhost:8080", path.Base(os.Args[0]))
+func main() {
+	c, err := parseFlags(os.Args[0], os.Args[1:], os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		// the flag set has already printed the problem and the usage message
+		os.Exit(2)
+	}
+	if c.version {
+		fmt.Printf("simple-http-server %s\n", readVersionInfo())
+		return
+	}
+	slog.SetDefault(c.logger(os.Stderr))
+	if c.deprecatedArg {
+		slog.Warn("passing the address as an argument is deprecated, use -host and -port instead")
 	}
 
-	s := Server{
-		Address: address,
+	var accessLog *logFile
+	if c.accessLog != "" {
+		accessLog, err = openLogFile(c.accessLog, c.accessLogMaxSize, c.accessLogMaxFiles)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(2)
+		}
+		defer accessLog.Close()
+	}
+	s, err := newServer(c, accessLog)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(2)
 	}
-	s.RegisterHandler("/", rootEndpoint)
-	s.RegisterHandler("/user-agent", userAgentEndpoint)
-	// added / at the end since this endpoint takes a path argument
-	s.RegisterHandler("/echo/", echoEndpoint)
-	s.RegisterHandler("/files/", getFilesEndpoint(*directory))
 
-	s.RegisterMiddleware(gzipMiddleware)
+	// caught from here on, so that a signal sent as soon as the listening
+	// addresses are logged isn't missed
+	stopping, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	restarts := make(chan os.Signal, 1)
+	if len(restartSignals) > 0 {
+		signal.Notify(restarts, restartSignals...)
+	}
 
-	err := s.Start()
+	// listeners from the process we're replacing (or from systemd) are used
+	// instead of binding new ones
+	inherited, inheritedRedirects, ready, err := inheritedListeners()
+	if err == nil && len(inherited) > 0 {
+		err = s.AdoptListeners(inherited)
+	} else if err == nil {
+		err = s.Listen()
+	}
+	if err != nil {
+		slog.Error("Could not start server", "error", err)
+		os.Exit(1)
+	}
+	for _, addr := range s.Addrs() {
+		slog.Info("Listening", "address", addr.String())
+	}
+	switch {
+	case c.redirectHTTP != "" && len(inheritedRedirects) > 0:
+		for _, l := range inheritedRedirects {
+			err = s.RedirectHTTPOn(l)
+			if err != nil {
+				break
+			}
+		}
+	case c.redirectHTTP != "":
+		err = s.RedirectHTTPFrom(c.redirectHTTP)
+	default:
+		// the process we're replacing was redirecting, but we've been told
+		// not to
+		for _, l := range inheritedRedirects {
+			l.Close()
+		}
+	}
 	if err != nil {
-		log.Printf("Could not start server: %s", err)
+		slog.Error("Could not listen for HTTP to redirect", "error", err)
+		os.Exit(1)
+	}
+	for _, addr := range s.redirectAddrs() {
+		slog.Info("Redirecting HTTP to HTTPS", "address", addr.String())
+	}
+	served := make(chan error, 1)
+	if c.tlsCert != "" || accessLog != nil {
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				// failures are logged by ReloadCertificates
+				_ = s.ReloadCertificates()
+				if accessLog != nil {
+					err := accessLog.Reopen()
+					if err != nil {
+						slog.Error("Could not reopen the access log", "error", err)
+					}
+				}
+			}
+		}()
+	}
+	go func() {
+		if c.tlsCert != "" {
+			served <- s.StartTLS(c.tlsCert, c.tlsKey)
+		} else {
+			served <- s.Start()
+		}
+	}()
+	if ready != nil {
+		// the listeners are already accepting connections into their backlog
+		err = signalReady(ready)
+		if err != nil {
+			slog.Error("Could not tell the old server that we're ready", "error", err)
+		}
+	}
+	for stopping.Err() == nil {
+		select {
+		case err := <-served:
+			if err != nil {
+				slog.Error("Could not start server", "error", err)
+				os.Exit(1)
+			}
+			return
+		case <-stopping.Done():
+		case <-restarts:
+			pid, err := restart(s, c.shutdownTimeout)
+			if err != nil {
+				slog.Error("Could not restart, carrying on", "error", err)
+				continue
+			}
+			slog.Info("Replacement is serving, handing over", "pid", pid)
+			stop()
+		}
+	}
+	// a second signal gets the default behaviour back, i.e. it kills us
+	// straight away
+	stop()
+	draining := s.ActiveConnections()
+	slog.Info("Shutting down", "connections", draining, "requests", len(s.InFlightRequests()), "timeout", c.shutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), c.shutdownTimeout)
+	defer cancel()
+	if c.drainLog {
+		go logDrainProgress(ctx, s)
+	}
+	// Shutdown logs each request that it has to cut off
+	err = s.Shutdown(ctx)
+	if err != nil {
+		slog.Error("Could not shut down cleanly", "forced_closed", s.ActiveConnections(), "error", err)
+		// deferred calls don't run on os.Exit
+		cancel()
+		if accessLog != nil {
+			accessLog.Close()
+		}
+		os.Exit(exitShutdownForced)
+	}
+	slog.Info("Shut down", "drained", draining)
+}
+
+// exitShutdownForced is the exit code when -shutdown-timeout runs out before
+// every request has finished, so that a supervisor can tell that requests
+// were cut off.
+const exitShutdownForced = 3
+
+// drainLogInterval is how often logDrainProgress logs.
+const drainLogInterval = 5 * time.Second
+
+// logDrainProgress logs the requests that s is still serving every
+// drainLogInterval, until ctx is done.
+func logDrainProgress(ctx context.Context, s *Server) {
+	ticker := time.NewTicker(drainLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			requests := s.InFlightRequests()
+			if len(requests) == 0 {
+				slog.Info("Draining", "connections", s.ActiveConnections())
+				continue
+			}
+			oldest := requests[0]
+			slog.Info("Draining", "connections", s.ActiveConnections(), "requests", len(requests),
+				"oldest_path", oldest.Path, "oldest_elapsed", now.Sub(oldest.Received))
+		}
 	}
 }
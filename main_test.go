@@ -0,0 +1,1529 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingBody returns n bytes of data and then an error, like a file on a disk
+// that has gone bad.
+type failingBody struct {
+	n int
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		return 0, errors.New("disk on fire")
+	}
+	n := min(len(p), b.n)
+	for i := range p[:n] {
+		p[i] = 'x'
+	}
+	b.n -= n
+	return n, nil
+}
+
+func (b *failingBody) Close() error {
+	return nil
+}
+
+func TestPartialResponseIsNotFollowedBy500(t *testing.T) {
+	tests := []struct {
+		name string
+		// sent is how much of the body is read before it fails
+		sent int
+		// wantPartial is whether some of the response goes out before the
+		// failure, rather than staying in the write buffer
+		wantPartial bool
+	}{
+		{"failure before anything is sent", 10, false},
+		{"failure partway through", 64 << 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			results := make(chan RequestResult, 1)
+			s.OnRequestComplete = func(result RequestResult) {
+				results <- result
+			}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				response := OKResponse()
+				response.Head.Headers = map[string]string{"Content-Length": "1000000"}
+				response.Body = &failingBody{n: tt.sent}
+				return response, nil
+			})
+			addr := startServer(t, s)
+
+			raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+			result := <-results
+			if result.Err == nil {
+				t.Fatal("the write didn't fail")
+			}
+			statusLines := strings.Count(raw, "HTTP/1.1 ")
+			if statusLines != 1 {
+				t.Fatalf("got %d status lines, want 1", statusLines)
+			}
+			if !tt.wantPartial {
+				// nothing had gone out, so the client can still be told
+				if !strings.HasPrefix(raw, "HTTP/1.1 500 ") {
+					t.Errorf("got %q, want a 500", raw[:min(len(raw), 40)])
+				}
+				return
+			}
+			if !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+				t.Errorf("got %q, want the start of the 200", raw[:min(len(raw), 40)])
+			}
+			// nothing follows the partial response
+			wire := result.HeadBytes + result.BodyBytes
+			if int64(len(raw)) != wire {
+				t.Errorf("client got %d bytes, but %d were written for the response", len(raw), wire)
+			}
+			if strings.Trim(raw[result.HeadBytes:], "x") != "" {
+				t.Errorf("something other than the body followed the head")
+			}
+		})
+	}
+}
+
+func TestRequestHeadTooLong(t *testing.T) {
+	// 10 MB without a newline
+	endless := strings.Repeat("a", 10<<20)
+	tests := []struct {
+		name       string
+		bufferSize int
+		head       string
+		wantStatus int
+	}{
+		{"request line", 0, "GET /" + endless, 414},
+		{"request line with small buffer", 1024, "GET /" + endless, 414},
+		{"header", 0, "GET / HTTP/1.1\r\nX-Long: " + endless, 431},
+		{"header with small buffer", 1024, "GET / HTTP/1.1\r\nX-Long: " + endless, 431},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{ReadBufferSize: tt.bufferSize}
+			s.RegisterHandler("/", rootEndpoint)
+			request := &countingReader{r: strings.NewReader(tt.head)}
+			var response bytes.Buffer
+			conn := struct {
+				io.Reader
+				io.Writer
+			}{request, &response}
+			var result RequestResult
+			err := s.handleRequest(conn, s.readDeadlines(conn, time.Now()), &result)
+			if err != nil {
+				t.Fatalf("handle request: %v", err)
+			}
+			parsed, _ := parseResponse(t, response.String())
+			if parsed.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", parsed.StatusCode, tt.wantStatus)
+			}
+			// it gave up once the buffer was full, rather than reading (and
+			// holding on to) the rest
+			size := s.readBufferSize()
+			if request.n > int64(2*size) {
+				t.Errorf("read %d bytes of the request with a %d byte buffer", request.n, size)
+			}
+		})
+	}
+}
+
+func TestRequestLogLevels(t *testing.T) {
+	const (
+		request   = "msg=request "
+		malformed = "malformed request"
+		failed    = "error handling Server request"
+	)
+	tests := []struct {
+		level slog.Level
+		want  []string
+	}{
+		{slog.LevelDebug, []string{request, malformed, failed}},
+		{slog.LevelInfo, []string{malformed, failed}},
+		{slog.LevelWarn, []string{malformed, failed}},
+		{slog.LevelError, []string{failed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			log := &logBuffer{}
+			old := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(log, &slog.HandlerOptions{Level: tt.level})))
+			t.Cleanup(func() { slog.SetDefault(old) })
+
+			s := &Server{}
+			s.RegisterHandler("/ok", rootEndpoint)
+			s.RegisterHandler("/fail", func(request Request) (Response, error) {
+				return Response{}, errors.New("broken")
+			})
+			addr := startServer(t, s)
+			rawRequest(t, addr, "GET /ok HTTP/1.1\r\nAuthorization: Bearer hunter2\r\nAccept: text/plain\r\n\r\n")
+			rawRequest(t, addr, "nonsense\r\n\r\n")
+			rawRequest(t, addr, "GET /fail HTTP/1.1\r\n\r\n")
+
+			logged := log.String()
+			for _, msg := range []string{request, malformed, failed} {
+				want := slices.Contains(tt.want, msg)
+				if strings.Contains(logged, msg) != want {
+					t.Errorf("got %q logged: %v, want %v", msg, !want, want)
+				}
+			}
+			if strings.Contains(logged, "hunter2") {
+				t.Errorf("got log %q, which has the Authorization header", logged)
+			}
+			if tt.level == slog.LevelDebug && !strings.Contains(logged, "authorization:"+redactedValue) {
+				t.Errorf("got log %q, want the request's headers with Authorization redacted", logged)
+			}
+		})
+	}
+}
+
+func TestCloseStopsStart(t *testing.T) {
+	var log bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	s := &Server{Address: "127.0.0.1:0"}
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	go func() {
+		err := s.Close()
+		if err != nil {
+			t.Errorf("close: %v", err)
+		}
+	}()
+	select {
+	case err := <-started:
+		if err != nil {
+			t.Errorf("Start returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start didn't return after Close")
+	}
+	// closing again does no harm
+	err = s.Close()
+	if err != nil {
+		t.Errorf("second close: %v", err)
+	}
+	if strings.Contains(log.String(), "level=ERROR") || strings.Contains(log.String(), "accept") {
+		t.Errorf("closing logged errors:\n%s", log.String())
+	}
+}
+
+// readFromRecorder is a connection that notes whether a body was handed to its
+// ReadFrom, the way a *net.TCPConn gets to use sendfile.
+type readFromRecorder struct {
+	bytes.Buffer
+	readFrom bool
+}
+
+func (r *readFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.readFrom = true
+	return r.Buffer.ReadFrom(src)
+}
+
+func TestWrappedBodiesKeepTheirFastPaths(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	err := os.WriteFile(path, []byte("from a file"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		body     func(t *testing.T) io.ReadCloser
+		want     string
+		readFrom bool
+	}{
+		{
+			name: "stream",
+			body: func(t *testing.T) io.ReadCloser {
+				return &StreamBody{Stream: func(w *ResponseWriter) error {
+					_, err := io.WriteString(w, "streamed")
+					return err
+				}}
+			},
+			want: "Transfer-Encoding: chunked",
+		},
+		{
+			name: "bytes",
+			body: func(t *testing.T) io.ReadCloser {
+				return newBytesBody([]byte("some bytes"))
+			},
+			want: "Content-Length: 10",
+		},
+		{
+			name: "file",
+			body: func(t *testing.T) io.ReadCloser {
+				file, err := os.Open(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return file
+			},
+			want:     "from a file",
+			readFrom: true,
+		},
+		{
+			name: "temp file",
+			body: func(t *testing.T) io.ReadCloser {
+				temp, err := newTempFile(t.TempDir(), "body")
+				if err != nil {
+					t.Fatal(err)
+				}
+				io.WriteString(temp, "from a file")
+				temp.Seek(0, io.SeekStart)
+				return temp
+			},
+			want:     "from a file",
+			readFrom: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cleanedUp := false
+			response := OKResponse()
+			response.Body = &cleanupBody{ReadCloser: tt.body(t), cleanup: func() { cleanedUp = true }}
+			var conn readFromRecorder
+			err := writeResponse(&conn, response, &RequestResult{})
+			if err != nil {
+				t.Fatalf("write response: %v", err)
+			}
+			if !strings.Contains(conn.String(), tt.want) {
+				t.Errorf("got %q, want it to contain %q", conn.String(), tt.want)
+			}
+			if conn.readFrom != tt.readFrom {
+				t.Errorf("the body went through ReadFrom: %v, want %v", conn.readFrom, tt.readFrom)
+			}
+			if !cleanedUp {
+				t.Error("the wrapper's cleanup didn't run")
+			}
+		})
+	}
+}
+
+func TestCleanupBodyClose(t *testing.T) {
+	calls := 0
+	body := &cleanupBody{ReadCloser: newBytesBody(nil), cleanup: func() { calls++ }}
+	err := body.Close()
+	if err != nil {
+		t.Errorf("close: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("cleanup ran %d times, want 1", calls)
+	}
+}
+
+func TestParseRequestLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    RequestLine
+		wantErr bool
+	}{
+		{"valid", "GET /index.html HTTP/1.1\r\n", RequestLine{"GET", "/index.html", "HTTP/1.1"}, false},
+		{"bare newline", "POST /files/a.txt HTTP/1.1\n", RequestLine{"POST", "/files/a.txt", "HTTP/1.1"}, false},
+		{"query string", "GET /search?q=a+b HTTP/1.0\r\n", RequestLine{"GET", "/search?q=a+b", "HTTP/1.0"}, false},
+		// methods are case sensitive, so it's left to the handler to decide
+		// what to make of "get"
+		{"lowercase method", "get / HTTP/1.1\r\n", RequestLine{"get", "/", "HTTP/1.1"}, false},
+		{"missing version", "GET /index.html\r\n", RequestLine{}, true},
+		{"method only", "GET\r\n", RequestLine{}, true},
+		{"extra space between", "GET  /index.html HTTP/1.1\r\n", RequestLine{}, true},
+		{"trailing space", "GET /index.html HTTP/1.1 \r\n", RequestLine{}, true},
+		{"too many parts", "GET /a /b HTTP/1.1\r\n", RequestLine{}, true},
+		{"empty", "\r\n", RequestLine{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRequestLine(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	const text = "hello, world! hello, world! hello, world!"
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{"no accept-encoding", "", false},
+		{"deflate only", "deflate", false},
+		{"gzip", "gzip", true},
+		{"gzip and deflate", "gzip, deflate", true},
+		{"deflate and gzip", "deflate,gzip", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := gzipMiddleware(func(request Request) (Response, error) {
+				response := OKResponse()
+				response.Body = newBytesBody([]byte(text))
+				return response, nil
+			})
+			request := Request{RequestLine: RequestLine{Method: "GET", Path: "/"}, Headers: map[string]string{}}
+			if tt.acceptEncoding != "" {
+				request.Headers["accept-encoding"] = tt.acceptEncoding
+			}
+			response, err := handler(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			defer response.Body.Close()
+
+			gzipped := response.Head.Headers["Content-Encoding"] == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("got Content-Encoding %q, want gzip: %v", response.Head.Headers["Content-Encoding"], tt.wantGzip)
+			}
+			body := io.Reader(response.Body)
+			if gzipped {
+				zr, err := gzip.NewReader(response.Body)
+				if err != nil {
+					t.Fatalf("read gzip header: %v", err)
+				}
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("read body: %v", err)
+			}
+			if string(got) != text {
+				t.Errorf("got body %q, want %q", got, text)
+			}
+		})
+	}
+}
+
+// parseRequestLine runs for every request, so it mustn't allocate. See
+// BenchmarkParseRequestLine for its speed.
+func TestParseRequestLineDoesNotAllocate(t *testing.T) {
+	allocs := testing.AllocsPerRun(100, func() {
+		parseRequestLine("GET /index.html?q=search HTTP/1.1\r\n")
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per call, want 0", allocs)
+	}
+}
+
+// namedHandler responds with name as its reason phrase, so that tests can tell
+// which handler they got.
+func namedHandler(name string) Handler {
+	return func(Request) (Response, error) {
+		return Response{Head: ResponseHead{Status: 200, Reason: name}}, nil
+	}
+}
+
+// handlerName returns the name of a handler made by namedHandler, or "" if
+// handler is nil.
+func handlerName(t *testing.T, handler Handler) string {
+	t.Helper()
+	if handler == nil {
+		return ""
+	}
+	response, err := handler(Request{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return response.Head.Reason
+}
+
+func TestGetHandler(t *testing.T) {
+	endpoints := func(prefixes ...string) []endpointHandler {
+		ep := make([]endpointHandler, len(prefixes))
+		for i, prefix := range prefixes {
+			ep[i] = endpointHandler{prefix: prefix, handler: namedHandler(prefix)}
+		}
+		return ep
+	}
+	tests := []struct {
+		name string
+		// ep is sorted longest first, as RegisterHandler leaves it
+		ep   []endpointHandler
+		path string
+		// want is the prefix of the handler that should be returned, or ""
+		// for none
+		want string
+	}{
+		{"root exactly", endpoints("/"), "/", "/"},
+		{"root doesn't match other paths", endpoints("/"), "/foo", ""},
+		{"prefix", endpoints("/echo/", "/"), "/echo/hello", "/echo/"},
+		{"exact prefix", endpoints("/echo/", "/"), "/echo/", "/echo/"},
+		{"longer prefix wins", endpoints("/files/private/", "/files/", "/"), "/files/private/a.txt", "/files/private/"},
+		{"shorter prefix otherwise", endpoints("/files/private/", "/files/", "/"), "/files/public/a.txt", "/files/"},
+		// prefixes are plain string prefixes, so a prefix without a trailing
+		// slash matches longer names too
+		{"prefix without a slash", endpoints("/foo", "/"), "/foobar", "/foo"},
+		{"prefix with a slash", endpoints("/foo/", "/"), "/foobar", ""},
+		{"no match", endpoints("/echo/", "/"), "/user-agent", ""},
+		{"no handlers", nil, "/", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := handlerName(t, getHandler(tt.ep, tt.path))
+			if got != tt.want {
+				t.Errorf("got handler %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	prefixes := func(s *Server) []string {
+		var got []string
+		for _, e := range s.endPointHandlers {
+			got = append(got, e.prefix)
+		}
+		return got
+	}
+
+	s := &Server{}
+	steps := []struct {
+		prefix string
+		want   []string
+	}{
+		{"/", []string{"/"}},
+		{"/foo", []string{"/foo", "/"}},
+		{"/foo/bar", []string{"/foo/bar", "/foo", "/"}},
+	}
+	for _, step := range steps {
+		s.RegisterHandler(step.prefix, namedHandler(step.prefix))
+		got := prefixes(s)
+		if !slices.Equal(got, step.want) {
+			t.Fatalf("after registering %q, got %q, want %q", step.prefix, got, step.want)
+		}
+	}
+
+	// registering a prefix again replaces its handler rather than adding
+	// another
+	s.RegisterHandler("/foo", namedHandler("new /foo"))
+	want := []string{"/foo/bar", "/foo", "/"}
+	if got := prefixes(s); !slices.Equal(got, want) {
+		t.Fatalf("after replacing /foo, got %q, want %q", got, want)
+	}
+	if got := handlerName(t, getHandler(s.endPointHandlers, "/foo/baz")); got != "new /foo" {
+		t.Errorf("got handler %q for /foo/baz, want the replacement", got)
+	}
+	if got := handlerName(t, getHandler(s.endPointHandlers, "/foo/bar/baz")); got != "/foo/bar" {
+		t.Errorf("got handler %q for /foo/bar/baz, want /foo/bar", got)
+	}
+}
+
+func TestMiddlewareComposedOncePerRegistration(t *testing.T) {
+	tests := []struct {
+		name string
+		// register sets up s with the counting middleware m
+		register func(s *Server, m Middleware)
+		// want is how many times m should have wrapped a handler
+		want int
+	}{
+		{"middleware first", func(s *Server, m Middleware) {
+			s.RegisterMiddleware(m)
+			s.RegisterHandler("/a", rootEndpoint)
+			s.RegisterHandler("/b", rootEndpoint)
+		}, 2},
+		{"middleware last", func(s *Server, m Middleware) {
+			s.RegisterHandler("/a", rootEndpoint)
+			s.RegisterHandler("/b", rootEndpoint)
+			s.RegisterMiddleware(m)
+		}, 2},
+		// m's chains are rebuilt along with the new middleware's
+		{"more middleware", func(s *Server, m Middleware) {
+			s.RegisterMiddleware(m)
+			s.RegisterHandler("/a", rootEndpoint)
+			s.RegisterHandler("/b", rootEndpoint)
+			s.RegisterMiddleware(HeaderInjectionMiddleware(map[string]string{"X-Other": "yes"}))
+		}, 4},
+		{"replaced handler", func(s *Server, m Middleware) {
+			s.RegisterMiddleware(m)
+			s.RegisterHandler("/a", rootEndpoint)
+			s.RegisterHandler("/b", rootEndpoint)
+			s.RegisterHandler("/a", rootEndpoint)
+		}, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var composed int
+			m := func(handler Handler) Handler {
+				composed++
+				return func(request Request) (Response, error) {
+					response, err := handler(request)
+					response.Head.Headers = withHeader(response.Head.Headers, "X-Wrapped", "yes")
+					return response, err
+				}
+			}
+			s := &Server{}
+			tt.register(s, m)
+			if composed != tt.want {
+				t.Fatalf("got %d compositions after registering, want %d", composed, tt.want)
+			}
+
+			for range 3 {
+				for _, path := range []string{"/a", "/b"} {
+					raw, _ := pipeRequest(t, s, "GET "+path+" HTTP/1.1\r\n\r\n")
+					response, _ := parseResponse(t, raw)
+					if response.Header.Get("X-Wrapped") != "yes" {
+						t.Fatalf("%s: got %q, want it to go through the middleware", path, raw)
+					}
+				}
+			}
+			if composed != tt.want {
+				t.Errorf("got %d compositions after 6 requests, want still %d", composed, tt.want)
+			}
+		})
+	}
+}
+
+// unpooledHeadBytes is how ResponseHead.Bytes built heads before it used
+// headBufferPool, to check that the pooled version writes the same thing.
+func unpooledHeadBytes(r ResponseHead) []byte {
+	if r.Protocol == "" {
+		r.Protocol = "HTTP/1.1"
+	}
+	var result bytes.Buffer
+	result.WriteString(fmt.Sprintf("%s %d", r.Protocol, r.Status))
+	result.WriteString(" ")
+	if r.Reason != "" {
+		result.WriteString(r.Reason)
+	}
+	result.WriteString("\r\n")
+	for header, val := range r.Headers {
+		result.WriteString(header)
+		result.WriteString(": ")
+		result.WriteString(val)
+		result.WriteString("\r\n")
+	}
+	result.WriteString("\r\n")
+	return result.Bytes()
+}
+
+func TestResponseHeadBytes(t *testing.T) {
+	tests := []struct {
+		name string
+		head ResponseHead
+	}{
+		{"empty", ResponseHead{}},
+		{"no reason", ResponseHead{Status: 299}},
+		{"protocol", ResponseHead{Protocol: "HTTP/1.0", Status: 404, Reason: "Not Found"}},
+		{"one header", ResponseHead{Status: 200, Reason: "OK", Headers: map[string]string{"Connection": "close"}}},
+		{"headers", ResponseHead{Status: 503, Reason: "Service Unavailable", Headers: map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": "1234",
+			"Retry-After":    "2",
+		}}},
+	}
+	// map order changes from call to call, so heads are compared line by line
+	lines := func(head []byte) []string {
+		result := strings.Split(string(head), "\r\n")
+		slices.Sort(result[1:])
+		return result
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.head.Bytes()
+			want := unpooledHeadBytes(tt.head)
+			if !slices.Equal(lines(got), lines(want)) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			// the result mustn't be a pooled buffer that's written over by
+			// the next call
+			saved := string(got)
+			ResponseHead{Status: 500, Reason: "Internal Server Error"}.Bytes()
+			if string(got) != saved {
+				t.Errorf("got %q after another call, want %q", got, saved)
+			}
+		})
+	}
+}
+
+func TestWithBodyLimit(t *testing.T) {
+	s := &Server{MaxRequestBodySize: 100}
+	s.RegisterHandler("/json/", echoHandler, WithBodyLimit(10))
+	s.RegisterHandler("/files/", echoHandler, WithBodyLimit(-1))
+	s.RegisterHandler("/other/", echoHandler)
+
+	post := func(path string, body string) string {
+		return fmt.Sprintf("POST %s HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", path, len(body), body)
+	}
+	// the Content-Length is left out, so the limit is only noticed as the
+	// body is read
+	stream := func(path string, body string) string {
+		return fmt.Sprintf("POST %s HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n%s", path, body)
+	}
+	small, medium, large := strings.Repeat("a", 10), strings.Repeat("a", 50), strings.Repeat("a", 200)
+	tests := []struct {
+		name       string
+		request    string
+		wantStatus int
+	}{
+		{"under the route's limit", post("/json/a", small), 200},
+		{"over the route's limit", post("/json/a", medium), 413},
+		{"streamed over the route's limit", stream("/json/a", medium), 413},
+		{"inherits the server's limit", post("/other/a", medium), 200},
+		{"over the server's limit", post("/other/a", large), 413},
+		{"streamed over the server's limit", stream("/other/a", large), 413},
+		{"unlimited route", post("/files/a", large), 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, _ := pipeRequest(t, s, tt.request)
+			response, _ := parseResponse(t, raw)
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestMultipleAddresses(t *testing.T) {
+	// the same address twice would only be listened on once
+	s := &Server{Address: "127.0.0.1:0", Addresses: []string{"localhost:0"}}
+	s.RegisterHandler("/", rootEndpoint)
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	addrs := s.Addrs()
+	if len(addrs) != 2 || addrs[0].String() == addrs[1].String() {
+		t.Fatalf("got addresses %v, want two different ones", addrs)
+	}
+	for _, addr := range addrs {
+		raw := rawRequest(t, addr.String(), "GET / HTTP/1.1\r\n\r\n")
+		if !strings.HasPrefix(raw, "HTTP/1.1 200 ") {
+			t.Errorf("%s: got %q, want a 200", addr, raw)
+		}
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v, want nil", err)
+	}
+	for _, addr := range addrs {
+		conn, err := net.Dial("tcp", addr.String())
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s still accepts connections after Close", addr)
+		}
+	}
+}
+
+func TestListenFailureClosesOtherAddresses(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	s := &Server{Address: freeAddr, Addresses: []string{taken.Addr().String()}}
+	err = s.Listen()
+	if err == nil {
+		s.Close()
+		t.Fatal("listening on a taken address succeeded")
+	}
+	// the address that did work was let go
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("the first address is still bound: %v", err)
+	}
+	l.Close()
+}
+
+func TestNormalizeAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		// wantErr is part of the error, if there should be one
+		wantErr string
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", ""},
+		{":8080", ":8080", ""},
+		{"[::1]:8080", "[::1]:8080", ""},
+		{"[::]:8080", "[::]:8080", ""},
+		{"[fe80::1%eth0]:8080", "[fe80::1%eth0]:8080", ""},
+		{"localhost:http", "localhost:http", ""},
+		{"::1:8080", "", "need brackets"},
+		{"127.0.0.1", "", "expected host:port"},
+		{"127.0.0.1:", "", "no port"},
+		{":70000", "", "bad port"},
+		{"[::g]:8080", "", "bad IPv6 address"},
+	}
+	for _, tt := range tests {
+		got, err := normalizeAddress(tt.address)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%q: got %q (%v), want an error about %q", tt.address, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%q: got %q (%v), want %q", tt.address, got, err, tt.want)
+		}
+	}
+}
+
+func TestListenIPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	l.Close()
+	log := captureLog(t)
+
+	s := &Server{Address: "[::1]:0", MaxConnsPerIP: 1}
+	remoteAddrs := make(chan string, 1)
+	release := make(chan struct{})
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		remoteAddrs <- request.RemoteAddr
+		<-release
+		return OKResponse(), nil
+	})
+	err = s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.Start()
+	t.Cleanup(func() { s.Close() })
+	addr := s.Addr().String()
+	if !strings.HasPrefix(addr, "[::1]:") {
+		t.Fatalf("got Addr %q, want [::1]:port", addr)
+	}
+
+	conn, err := net.Dial("tcp6", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	if got, want := <-remoteAddrs, conn.LocalAddr().String(); got != want {
+		t.Errorf("got RemoteAddr %q, want %q", got, want)
+	}
+	// the limit is per ::1, whichever port the client is on
+	raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	if !strings.HasPrefix(raw, "HTTP/1.1 429 ") {
+		t.Errorf("got %q from a second connection, want a 429", raw)
+	}
+	close(release)
+	waitForConns(t, s, 0)
+
+	bad, err := net.Dial("tcp6", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer bad.Close()
+	io.WriteString(bad, "nonsense\r\n\r\n")
+	io.ReadAll(bad)
+	want := "remote_addr=" + bad.LocalAddr().String()
+	if !strings.Contains(log.String(), want) {
+		t.Errorf("got log %q, want it to have %s", log.String(), want)
+	}
+}
+
+// pipeListener is a net.Listener whose connections are made with net.Pipe, for
+// testing the Server without any sockets.
+type pipeListener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+// dial returns the client's end of a new connection to l.
+func (l *pipeListener) dial() (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
+
+func TestDialer(t *testing.T) {
+	l := newPipeListener()
+	var dialed []string
+	s := &Server{
+		Address: "example.com:80",
+		Dialer: func(network, address string) (net.Listener, error) {
+			dialed = append(dialed, network+" "+address)
+			return l, nil
+		},
+	}
+	s.RegisterHandler("/", rootEndpoint)
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	if !slices.Equal(dialed, []string{"tcp example.com:80"}) {
+		t.Errorf("Dialer was called with %q, want the Server's address", dialed)
+	}
+	if s.Addr() != (pipeAddr{}) {
+		t.Errorf("got Addr %v, want the Dialer's listener's", s.Addr())
+	}
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+
+	conn, err := l.dial()
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	go io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	raw, err := io.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	if !strings.HasPrefix(string(raw), "HTTP/1.1 200 ") {
+		t.Errorf("got %q, want a 200", raw)
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v, want nil", err)
+	}
+}
+
+func TestDialerError(t *testing.T) {
+	want := errors.New("no such namespace")
+	s := &Server{
+		Address: "127.0.0.1:0",
+		Dialer: func(network, address string) (net.Listener, error) {
+			return nil, want
+		},
+	}
+	err := s.Listen()
+	if !errors.Is(err, want) {
+		t.Errorf("got %v, want the Dialer's error", err)
+	}
+}
+
+// bufferBody is a response body that's a *bytes.Buffer, like a handler might
+// build its response in.
+type bufferBody struct {
+	*bytes.Buffer
+}
+
+func (bufferBody) Close() error {
+	return nil
+}
+
+func TestSetContentLength(t *testing.T) {
+	partlyRead := bytes.NewReader([]byte("skip hello"))
+	partlyRead.Seek(5, io.SeekStart)
+	tests := []struct {
+		name    string
+		body    io.ReadCloser
+		headers map[string]string
+		// want is the Content-Length header, or "" for none
+		want string
+	}{
+		{"buffer", bufferBody{bytes.NewBufferString("hello")}, nil, "5"},
+		{"empty buffer", bufferBody{new(bytes.Buffer)}, nil, "0"},
+		{"bytes", newBytesBody([]byte("hello")), nil, "5"},
+		{"partly read", bytesBody{partlyRead}, nil, "5"},
+		{"wrapped", &cleanupBody{ReadCloser: bufferBody{bytes.NewBufferString("hello")}}, nil, "5"},
+		{"already set", bufferBody{bytes.NewBufferString("hello")}, map[string]string{"Content-Length": "5"}, "5"},
+		{"unknown length", io.NopCloser(strings.NewReader("hello")), nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response := Response{Head: ResponseHead{Status: 200, Reason: "OK", Headers: tt.headers}, Body: tt.body}
+			setContentLength(&response)
+			got := getHeader(response.Head.Headers, "Content-Length")
+			if got != tt.want {
+				t.Errorf("got Content-Length %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// and the body that's sent is as long as the header says
+	s := &Server{}
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = bufferBody{bytes.NewBufferString("hello")}
+		return response, nil
+	})
+	raw, _ := pipeRequest(t, s, "GET / HTTP/1.1\r\n\r\n")
+	response, body := parseResponse(t, raw)
+	if response.ContentLength != 5 || body != "hello" {
+		t.Errorf("got Content-Length %d and body %q, want 5 and %q", response.ContentLength, body, "hello")
+	}
+}
+
+func TestEmptyBodyContentLength(t *testing.T) {
+	tests := []struct {
+		name     string
+		response Response
+		// want is the Content-Length header, or "" for none
+		want string
+	}{
+		{"bare 200", Response{Head: ResponseHead{Status: 200, Reason: "OK"}}, "0"},
+		{"404", NotFoundResponse(), "0"},
+		{"204", Response{Head: ResponseHead{Status: 204, Reason: "No Content"}}, ""},
+		{"304", Response{Head: ResponseHead{Status: 304, Reason: "Not Modified"}}, ""},
+		{"1xx", Response{Head: ResponseHead{Status: 103, Reason: "Early Hints"}}, ""},
+		{"already set", Response{Head: ResponseHead{Status: 200, Reason: "OK", Headers: map[string]string{"Content-Length": "0"}}}, "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := writeResponse(&out, tt.response, &RequestResult{})
+			if err != nil {
+				t.Fatalf("write response: %v", err)
+			}
+			head, _, _ := strings.Cut(out.String(), "\r\n\r\n")
+			var got []string
+			for _, line := range strings.Split(head, "\r\n")[1:] {
+				name, value, _ := strings.Cut(line, ": ")
+				if strings.EqualFold(name, "Content-Length") {
+					got = append(got, value)
+				}
+			}
+			var want []string
+			if tt.want != "" {
+				want = []string{tt.want}
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("got Content-Length %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestListenBeforeStart(t *testing.T) {
+	s := &Server{Address: "127.0.0.1:0"}
+	s.RegisterHandler("/", rootEndpoint)
+	if s.Addr() != nil {
+		t.Errorf("got Addr %v before listening, want nil", s.Addr())
+	}
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr, ok := s.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("got Addr %v, want the port that was picked", s.Addr())
+	}
+	// listening again keeps the same listener
+	err = s.Listen()
+	if err != nil || s.Addr().String() != addr.String() {
+		t.Errorf("second Listen gave %v (%v), want %v", s.Addr(), err, addr)
+	}
+
+	// connections are queued as soon as Listen returns, so a request can be
+	// sent before Start is even called
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("dial before Start: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+
+	started := make(chan error, 1)
+	go func() {
+		started <- s.Start()
+	}()
+	raw, err := io.ReadAll(conn)
+	if err != nil || !strings.HasPrefix(string(raw), "HTTP/1.1 200 ") {
+		t.Errorf("got %q (%v), want a 200", raw, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v, want nil", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	l := newPipeListener()
+	s := &Server{}
+	s.RegisterHandler("/echo/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte(strings.TrimPrefix(request.Path, "/echo/")))
+		return response, nil
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(l)
+	}()
+
+	for _, word := range []string{"one", "two", "three"} {
+		conn, err := l.dial()
+		if err != nil {
+			t.Fatalf("dial: %v", err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		go io.WriteString(conn, "GET /echo/"+word+" HTTP/1.1\r\n\r\n")
+		raw, err := io.ReadAll(conn)
+		conn.Close()
+		if err != nil {
+			t.Fatalf("read response: %v", err)
+		}
+		_, body := parseResponse(t, string(raw))
+		if body != word {
+			t.Errorf("got body %q, want %q", body, word)
+		}
+	}
+
+	// a request has been served, so the first Serve is definitely running
+	err := s.Serve(l)
+	if !errors.Is(err, ErrAlreadyServing) {
+		t.Errorf("second Serve returned %v, want ErrAlreadyServing", err)
+	}
+	if !slices.Contains(s.Addrs(), net.Addr(pipeAddr{})) {
+		t.Errorf("got Addrs %v, want the served listener's", s.Addrs())
+	}
+
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Errorf("Serve returned %v, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after Close")
+	}
+	if _, err := l.dial(); err == nil {
+		t.Error("the listener is still open")
+	}
+
+	// a closed Server doesn't serve any more listeners
+	other := newPipeListener()
+	err = s.Serve(other)
+	if err != nil {
+		t.Errorf("Serve after Close returned %v, want nil", err)
+	}
+	if _, err := other.dial(); err == nil {
+		t.Error("Serve after Close left the listener open")
+	}
+}
+
+func TestGzipTempDir(t *testing.T) {
+	dir := t.TempDir()
+	s := &Server{TempDir: dir}
+	s.RegisterMiddleware(gzipMiddleware)
+	// the body is read into the temp file, so it can see it being written
+	var during []string
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = &StreamBody{Stream: func(w *ResponseWriter) error {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				return err
+			}
+			for _, entry := range entries {
+				during = append(during, entry.Name())
+			}
+			_, err = io.WriteString(w, "hello, world! hello, world!")
+			return err
+		}}
+		return response, nil
+	})
+
+	raw, _ := pipeRequest(t, s, "GET / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n")
+	response, _ := parseResponse(t, raw)
+	if response.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", response.Header.Get("Content-Encoding"))
+	}
+	if len(during) != 1 || !strings.HasPrefix(during[0], "Server-gzip-cache") {
+		t.Errorf("got %q in TempDir while compressing, want one gzip cache file", during)
+	}
+	// and it's removed once the response has been sent
+	entries, err := os.ReadDir(dir)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("got %v (%v) in TempDir afterwards, want nothing", entries, err)
+	}
+}
+
+func TestNewTempFile(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		dir  string
+		want string
+	}{
+		{dir, dir},
+		{"", os.TempDir()},
+	}
+	for _, tt := range tests {
+		tmp, err := newTempFile(tt.dir, "Server-test")
+		if err != nil {
+			t.Fatalf("new temp file in %q: %v", tt.dir, err)
+		}
+		if got := filepath.Dir(tmp.Name()); got != filepath.Clean(tt.want) {
+			t.Errorf("dir %q: got a temp file in %q, want %q", tt.dir, got, tt.want)
+		}
+		err = tmp.Close()
+		if err != nil {
+			t.Errorf("close: %v", err)
+		}
+		if _, err := os.Stat(tmp.Name()); !os.IsNotExist(err) {
+			t.Errorf("%s still exists after Close", tmp.Name())
+		}
+	}
+}
+
+func TestCannedResponsesAreFresh(t *testing.T) {
+	canned := []struct {
+		name     string
+		response func() Response
+	}{
+		{"OK", OKResponse},
+		{"Created", CreatedResponse},
+		{"Accepted", AcceptedResponse},
+		{"Moved", MovedResponse},
+		{"BadRequest", BadRequestResponse},
+		{"NotFound", NotFoundResponse},
+		{"Error", ErrorResponse},
+	}
+	for _, tt := range canned {
+		t.Run(tt.name, func(t *testing.T) {
+			// handlers on many connections change their copies at once,
+			// which -race would catch if they were shared
+			var wg sync.WaitGroup
+			for i := range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					response := tt.response()
+					response.Head.Headers = withHeader(response.Head.Headers, "X-Request", strconv.Itoa(i))
+					response.Head.Headers["X-Changed"] = "yes"
+					response.Head.Reason += "!"
+				}()
+			}
+			wg.Wait()
+			response := tt.response()
+			if response.Head.Headers != nil || strings.HasSuffix(response.Head.Reason, "!") {
+				t.Errorf("got %+v, want a fresh response", response.Head)
+			}
+		})
+	}
+}
+
+// getFile requests path from a files endpoint serving dir with options.
+func getFile(t *testing.T, dir string, options FilesEndpointOptions, path string) (*http.Response, string) {
+	t.Helper()
+	s := &Server{}
+	s.RegisterHandler("/files/", getFilesEndpoint(dir, options))
+	raw, _ := pipeRequest(t, s, "GET "+path+" HTTP/1.1\r\n\r\n")
+	return parseResponse(t, raw)
+}
+
+func TestFilesContentType(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01\x08\x06\x00\x00\x00\x1f\x15\xc4\x89")
+	tests := []struct {
+		name     string
+		contents []byte
+		want     string
+	}{
+		{"data", png, "image/png"},
+		{"image.unknown-extension", png, "image/png"},
+		{"notes", []byte("just some text\n"), "text/plain; charset=utf-8"},
+		{"page", []byte("<!DOCTYPE html><title>hi</title>"), "text/html; charset=utf-8"},
+		{"empty", nil, "text/plain; charset=utf-8"},
+		// the extension wins over the contents
+		{"logo.txt", png, "text/plain; charset=utf-8"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := os.WriteFile(filepath.Join(dir, tt.name), tt.contents, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			response, body := getFile(t, dir, FilesEndpointOptions{}, "/files/"+tt.name)
+			if got := response.Header.Get("Content-Type"); got != tt.want {
+				t.Errorf("got Content-Type %q, want %q", got, tt.want)
+			}
+			// what was sniffed is still sent
+			if body != string(tt.contents) {
+				t.Errorf("got body %q, want the whole file", body)
+			}
+		})
+	}
+}
+
+func TestFilesCacheControl(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"app.js", "index.html", "LOUD.JS", "notes.txt", "README"} {
+		err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cacheControl := map[string]string{
+		".js":   "public, max-age=31536000",
+		".html": "no-cache",
+	}
+	tests := []struct {
+		name         string
+		path         string
+		defaultValue string
+		want         string
+	}{
+		{"js", "/files/app.js", "", "public, max-age=31536000"},
+		{"html", "/files/index.html", "", "no-cache"},
+		{"extension case", "/files/LOUD.JS", "", "public, max-age=31536000"},
+		{"unknown extension", "/files/notes.txt", "", ""},
+		{"unknown extension with default", "/files/notes.txt", "max-age=60", "max-age=60"},
+		{"no extension with default", "/files/README", "max-age=60", "max-age=60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := FilesEndpointOptions{CacheControl: cacheControl, DefaultCacheControl: tt.defaultValue}
+			response, _ := getFile(t, dir, options, tt.path)
+			if response.StatusCode != 200 {
+				t.Fatalf("got status %d, want 200", response.StatusCode)
+			}
+			got, ok := response.Header["Cache-Control"]
+			if tt.want == "" {
+				if ok {
+					t.Errorf("got Cache-Control %q, want none", got)
+				}
+				return
+			}
+			if response.Header.Get("Cache-Control") != tt.want {
+				t.Errorf("got Cache-Control %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilesNoRead(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"open.txt", "locked/secret.txt", "locked/.noread", "locked/sub/open.txt"} {
+		name = filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(name), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(name, []byte("contents"), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		path string
+		// want is the status with the .noread file, and wantRemoved without
+		want        int
+		wantRemoved int
+	}{
+		{"/files/locked/secret.txt", 403, 200},
+		{"/files/locked/", 403, 200},
+		{"/files/locked/.noread", 403, 404},
+		// subdirectories need a .noread of their own
+		{"/files/locked/sub/open.txt", 200, 200},
+		{"/files/open.txt", 200, 200},
+	}
+	options := FilesEndpointOptions{Listings: true}
+	for _, tt := range tests {
+		response, _ := getFile(t, dir, options, tt.path)
+		if response.StatusCode != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.path, response.StatusCode, tt.want)
+		}
+	}
+	// it's checked on every request
+	err := os.Remove(filepath.Join(dir, "locked", noReadFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		response, _ := getFile(t, dir, options, tt.path)
+		if response.StatusCode != tt.wantRemoved {
+			t.Errorf("%s without %s: got status %d, want %d", tt.path, noReadFile, response.StatusCode, tt.wantRemoved)
+		}
+	}
+}
+
+func TestFilesContentMD5(t *testing.T) {
+	dir := t.TempDir()
+	// several times io.Copy's buffer, so that it's sent in several chunks
+	contents := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	err := os.WriteFile(filepath.Join(dir, "data.bin"), contents, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := md5.Sum(contents)
+	want := base64.StdEncoding.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		enabled bool
+		gzip    bool
+		// wantMD5 is whether the Content-MD5 trailer is sent
+		wantMD5 bool
+	}{
+		{"enabled", true, false, true},
+		{"disabled", false, false, false},
+		// the digest would be of the uncompressed file
+		{"gzipped", true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{}
+			if tt.gzip {
+				s.RegisterMiddleware(gzipMiddleware)
+			}
+			s.RegisterHandler("/files/", getFilesEndpoint(dir, FilesEndpointOptions{ContentMD5: tt.enabled}))
+			request := "GET /files/data.bin HTTP/1.1\r\n"
+			if tt.gzip {
+				request += "Accept-Encoding: gzip\r\n"
+			}
+			raw, _ := pipeRequest(t, s, request+"\r\n")
+			response, body := parseResponse(t, raw)
+			if response.StatusCode != 200 {
+				t.Fatalf("got status %d, want 200", response.StatusCode)
+			}
+			if response.Header.Get("Content-MD5") != "" {
+				t.Errorf("got a Content-MD5 header, want it only as a trailer")
+			}
+			if !tt.gzip && body != string(contents) {
+				t.Errorf("got a %d byte body, want the whole %d byte file", len(body), len(contents))
+			}
+			got := response.Trailer.Get("Content-MD5")
+			if tt.wantMD5 {
+				if got != want {
+					t.Errorf("got Content-MD5 trailer %q, want %q", got, want)
+				}
+				if !slices.Equal(response.TransferEncoding, []string{"chunked"}) || !strings.Contains(raw, "\r\nTrailer: Content-MD5\r\n") {
+					t.Errorf("got Transfer-Encoding %q, want a chunked response announcing Content-MD5", response.TransferEncoding)
+				}
+				return
+			}
+			if got != "" || strings.Contains(raw, "\r\nTrailer:") {
+				t.Errorf("got Content-MD5 trailer %q, want none", got)
+			}
+			if response.ContentLength < 0 {
+				t.Error("got no Content-Length")
+			}
+		})
+	}
+}
+
+func TestFilesIndexFiles(t *testing.T) {
+	tests := []struct {
+		name       string
+		files      []string
+		indexFiles []string
+		listings   bool
+		wantStatus int
+		// wantBody is the index file that should be served
+		wantBody string
+	}{
+		{"README.md by default", []string{"README.md"}, nil, false, 200, "README.md"},
+		{"index.html first", []string{"README.md", "index.html"}, nil, false, 200, "index.html"},
+		{"index.htm", []string{"index.htm", "README.md"}, nil, false, 200, "index.htm"},
+		{"custom list", []string{"index.html", "home.txt"}, []string{"home.txt", "index.html"}, false, 200, "home.txt"},
+		{"custom list skips the defaults", []string{"index.html"}, []string{"home.txt"}, false, 404, ""},
+		{"empty list", []string{"index.html"}, []string{}, false, 404, ""},
+		{"nothing to serve", []string{"other.txt"}, nil, false, 404, ""},
+		{"listing instead", []string{"other.txt"}, nil, true, 200, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			err := os.Mkdir(filepath.Join(dir, "docs"), 0o755)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range tt.files {
+				err := os.WriteFile(filepath.Join(dir, "docs", name), []byte(name), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			options := FilesEndpointOptions{IndexFiles: tt.indexFiles, Listings: tt.listings}
+			response, body := getFile(t, dir, options, "/files/docs/")
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("got body %q, want %s", body, tt.wantBody)
+			}
+			if tt.listings && !strings.Contains(body, `<a href="/files/docs/other.txt">other.txt</a>`) {
+				t.Errorf("got body %q, want a listing", body)
+			}
+		})
+	}
+}
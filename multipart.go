@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// multipartIDHeader is the request header that NewMultipartMiddleware uses to
+// tell handlers where to find their parsed form, like ContextMiddleware does
+// with contexts.
+const multipartIDHeader = "x-multipart-id"
+
+// parsedMultiparts maps the IDs in multipartIDHeader to their *ParsedMultipart.
+var parsedMultiparts sync.Map
+
+// defaultMultipartMemory is how much of a form's values are kept in memory
+// when NewMultipartMiddleware isn't given a limit, the same as net/http.
+const defaultMultipartMemory = 32 << 20
+
+// ParsedMultipart is a multipart/form-data body that NewMultipartMiddleware
+// has parsed. It's keyed by the parts' form field names.
+type ParsedMultipart struct {
+	Values map[string][]string
+	Files  map[string][]MultipartFile
+}
+
+// MultipartFile is an uploaded file that has been saved to a temp file.
+type MultipartFile struct {
+	// Filename is the name the client gave the file. It's not safe to use as
+	// a path.
+	Filename    string
+	ContentType string
+	// Path is where the file was saved. It's deleted once the response has
+	// been sent, so handlers have to copy or move files they want to keep.
+	Path string
+	Size int64
+}
+
+// MultipartForm returns the form that NewMultipartMiddleware parsed from
+// request's body, or false if there isn't one.
+func MultipartForm(request Request) (*ParsedMultipart, bool) {
+	id, ok := request.Headers[multipartIDHeader]
+	if !ok {
+		return nil, false
+	}
+	form, ok := parsedMultiparts.Load(id)
+	if !ok {
+		return nil, false
+	}
+	return form.(*ParsedMultipart), true
+}
+
+// NewMultipartMiddleware parses multipart/form-data request bodies, so that
+// handlers can get the form with MultipartForm instead of reading the body.
+// Uploaded files are saved to a temp directory (in Server.TempDir) that's
+// removed once the response has been sent. The rest of the form's values are
+// kept in memory, and a form whose values add up to more than maxMemory bytes
+// gets a 413. 0 or less means 32MB. Malformed forms get a 400.
+func NewMultipartMiddleware(maxMemory int64) Middleware {
+	if maxMemory <= 0 {
+		maxMemory = defaultMultipartMemory
+	}
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			contentType := request.Headers["content-type"]
+			if request.Body == nil || !matchContentType(contentType, []string{"multipart/form-data"}) {
+				return handler(request)
+			}
+			_, params, err := mime.ParseMediaType(contentType)
+			if err != nil || params["boundary"] == "" {
+				return Response{}, HTTPError{Status: 400, Message: "multipart/form-data body has no boundary"}
+			}
+
+			dir, err := os.MkdirTemp(request.tempDir(), "multipart-")
+			if err != nil {
+				return Response{}, fmt.Errorf("create directory for uploaded files: %w", err)
+			}
+			id := newID()
+			cleanup := func() {
+				parsedMultiparts.Delete(id)
+				os.RemoveAll(dir)
+			}
+			form, err := parseMultipart(multipart.NewReader(request.Body, params["boundary"]), dir, maxMemory)
+			if err != nil {
+				cleanup()
+				return Response{}, err
+			}
+			parsedMultiparts.Store(id, form)
+			request.Headers = withHeader(request.Headers, multipartIDHeader, id)
+
+			response, err := handler(request)
+			// the files might be what's being sent back
+			if err != nil || response.Body == nil {
+				cleanup()
+				return response, err
+			}
+			response.Body = &cleanupBody{ReadCloser: response.Body, cleanup: cleanup}
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// parseMultipart reads every part of a form, saving the files into dir.
+func parseMultipart(r *multipart.Reader, dir string, maxMemory int64) (*ParsedMultipart, error) {
+	form := &ParsedMultipart{
+		Values: make(map[string][]string),
+		Files:  make(map[string][]MultipartFile),
+	}
+	remaining := maxMemory
+	for {
+		part, err := r.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return nil, multipartError(err)
+		}
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if part.FileName() == "" {
+			// one byte more than is allowed, to tell if the value is too big
+			value, err := io.ReadAll(io.LimitReader(part, remaining+1))
+			part.Close()
+			if err != nil {
+				return nil, multipartError(err)
+			}
+			remaining -= int64(len(value))
+			if remaining < 0 {
+				return nil, HTTPError{Status: 413, Message: "multipart form values are too large"}
+			}
+			form.Values[name] = append(form.Values[name], string(value))
+			continue
+		}
+
+		file, err := saveMultipartFile(part, dir)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		form.Files[name] = append(form.Files[name], file)
+	}
+}
+
+func saveMultipartFile(part *multipart.Part, dir string) (MultipartFile, error) {
+	f, err := os.CreateTemp(dir, "upload-*"+filepath.Ext(filepath.Base(part.FileName())))
+	if err != nil {
+		return MultipartFile{}, fmt.Errorf("create file for upload: %w", err)
+	}
+	defer f.Close()
+	size, err := io.Copy(f, part)
+	if err != nil {
+		return MultipartFile{}, multipartError(err)
+	}
+	return MultipartFile{
+		Filename:    part.FileName(),
+		ContentType: part.Header.Get("Content-Type"),
+		Path:        f.Name(),
+		Size:        size,
+	}, nil
+}
+
+// multipartError turns an error reading the form into a 400, unless it's
+// something the server should handle (like a body that's too large).
+func multipartError(err error) error {
+	if errors.Is(err, ErrBodyTooLarge) || errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("read multipart form: %w", err)
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return fmt.Errorf("save uploaded file: %w", err)
+	}
+	return HTTPError{Status: 400, Message: fmt.Sprintf("malformed multipart form: %s", err)}
+}
+
+// cleanupBody calls cleanup once it's closed.
+type cleanupBody struct {
+	io.ReadCloser
+	cleanup func()
+}
+
+func (c *cleanupBody) unwrapBody() io.Reader {
+	return c.ReadCloser
+}
+
+func (c *cleanupBody) Close() error {
+	err := c.ReadCloser.Close()
+	c.cleanup()
+	return err
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+// multipartBody encodes values and files (keyed by field name, each
+// "filename:contents") as a multipart/form-data body, returning it along with
+// its Content-Type.
+func multipartBody(t *testing.T, values map[string]string, files map[string][]string) (string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range values {
+		w.WriteField(name, value)
+	}
+	for name, list := range files {
+		for _, file := range list {
+			filename, contents, _ := strings.Cut(file, ":")
+			part, err := w.CreateFormFile(name, filename)
+			if err != nil {
+				t.Fatalf("create form file: %v", err)
+			}
+			io.WriteString(part, contents)
+		}
+	}
+	w.Close()
+	return body.String(), w.FormDataContentType()
+}
+
+func TestMultipartMiddleware(t *testing.T) {
+	tests := []struct {
+		name      string
+		maxMemory int64
+		values    map[string]string
+		files     map[string][]string
+		// body and contentType replace the encoded form if they're set
+		body        string
+		contentType string
+		wantStatus  int
+		// want is what the handler responds with: each value, then each file
+		// with its contents
+		want string
+	}{
+		{
+			"two files", 0, map[string]string{"title": "holiday"},
+			map[string][]string{"photos": {"a.txt:first file", "b.txt:second file"}}, "", "",
+			200, "title=holiday\nphotos a.txt .txt 10 first file\nphotos b.txt .txt 11 second file\n",
+		},
+		{"values only", 0, map[string]string{"title": "holiday"}, nil, "", "", 200, "title=holiday\n"},
+		{"values too large", 4, map[string]string{"title": "holiday"}, nil, "", "", 413, ""},
+		{"no boundary", 0, nil, nil, "a=b", "multipart/form-data", 400, ""},
+		{
+			"truncated", 0, nil, nil, "--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\nvalue",
+			"multipart/form-data; boundary=xyz", 400, "",
+		},
+		{"not multipart", 0, nil, nil, "a=b", "text/plain", 200, "no form\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tempDir := t.TempDir()
+			s := &Server{TempDir: tempDir}
+			s.RegisterMiddleware(NewMultipartMiddleware(tt.maxMemory))
+			s.RegisterHandler("/upload", func(request Request) (Response, error) {
+				form, ok := MultipartForm(request)
+				var b strings.Builder
+				if !ok {
+					b.WriteString("no form\n")
+				} else {
+					for name, values := range form.Values {
+						fmt.Fprintf(&b, "%s=%s\n", name, strings.Join(values, ","))
+					}
+					for name, files := range form.Files {
+						for _, file := range files {
+							contents, err := os.ReadFile(file.Path)
+							if err != nil {
+								return Response{}, err
+							}
+							// the saved file keeps its extension
+							ext := file.Path[strings.LastIndex(file.Path, "."):]
+							fmt.Fprintf(&b, "%s %s %s %d %s\n", name, file.Filename, ext, file.Size, contents)
+						}
+					}
+				}
+				response := OKResponse()
+				response.Body = newBytesBody([]byte(b.String()))
+				return response, nil
+			})
+			addr := startServer(t, s)
+
+			body, contentType := multipartBody(t, tt.values, tt.files)
+			if tt.contentType != "" {
+				body, contentType = tt.body, tt.contentType
+			}
+			raw := rawRequest(t, addr, fmt.Sprintf(
+				"POST /upload HTTP/1.1\r\nConnection: close\r\nContent-Type: %s\r\nContent-Length: %d\r\n\r\n%s",
+				contentType, len(body), body,
+			))
+			response, got := parseResponse(t, raw)
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d (%q), want %d", response.StatusCode, got, tt.wantStatus)
+			}
+			if tt.wantStatus == 200 && got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+
+			waitForConns(t, s, 0)
+			entries, err := os.ReadDir(tempDir)
+			if err != nil {
+				t.Fatalf("read temp dir: %v", err)
+			}
+			if len(entries) != 0 {
+				t.Errorf("%d uploads were left in the temp dir", len(entries))
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// methodOverrideHeader and methodOverrideParam are where a POST can ask to be
+// treated as another method.
+const (
+	methodOverrideHeader = "x-http-method-override"
+	methodOverrideParam  = "_method"
+)
+
+// overridableMethods are the methods that a POST may be turned into. Turning
+// it into a GET or HEAD would let a form hit an endpoint that isn't expecting
+// a body, or one that's assumed to be safe to cache.
+var overridableMethods = []string{"PUT", "PATCH", "DELETE"}
+
+// MethodOverrideMiddleware lets clients that can only send GET and POST (like
+// HTML forms) make PUT, PATCH, and DELETE requests. A POST with an
+// X-HTTP-Method-Override header, or failing that a _method query parameter,
+// reaches the handler with that method instead. Any other method in them gets
+// a 400. Requests that aren't POSTs are passed on untouched.
+func MethodOverrideMiddleware(handler Handler) Handler {
+	middleware := func(request Request) (Response, error) {
+		if request.Method != "POST" {
+			return handler(request)
+		}
+		method := request.Headers[methodOverrideHeader]
+		if method == "" {
+			if _, rawQuery, ok := strings.Cut(request.Path, "?"); ok {
+				query, err := url.ParseQuery(rawQuery)
+				if err == nil {
+					method = query.Get(methodOverrideParam)
+				}
+			}
+		}
+		if method == "" {
+			return handler(request)
+		}
+
+		method = strings.ToUpper(method)
+		if !slices.Contains(overridableMethods, method) {
+			message := fmt.Sprintf("can't override POST with %s, only with %s", method, strings.Join(overridableMethods, ", "))
+			return Response{}, HTTPError{Status: 400, Message: message}
+		}
+		request.Method = method
+		return handler(request)
+	}
+	return middleware
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMethodOverrideMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		headers    map[string]string
+		wantMethod string
+		wantErr    bool
+	}{
+		{"header", "POST", "/", map[string]string{"x-http-method-override": "DELETE"}, "DELETE", false},
+		{"lower case", "POST", "/", map[string]string{"x-http-method-override": "patch"}, "PATCH", false},
+		{"query", "POST", "/things/1?_method=PUT", nil, "PUT", false},
+		{"header wins", "POST", "/?_method=PUT", map[string]string{"x-http-method-override": "DELETE"}, "DELETE", false},
+		{"no override", "POST", "/?other=1", nil, "POST", false},
+		{"GET", "POST", "/", map[string]string{"x-http-method-override": "GET"}, "", true},
+		{"HEAD", "POST", "/?_method=HEAD", nil, "", true},
+		{"unknown", "POST", "/", map[string]string{"x-http-method-override": "TRACE"}, "", true},
+		// only POSTs can be overridden
+		{"not a POST", "GET", "/?_method=DELETE", map[string]string{"x-http-method-override": "DELETE"}, "GET", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := MethodOverrideMiddleware(func(request Request) (Response, error) {
+				got = request.Method
+				return OKResponse(), nil
+			})
+			_, err := handler(Request{RequestLine: RequestLine{Method: tt.method, Path: tt.path}, Headers: tt.headers})
+			if tt.wantErr {
+				var httpErr HTTPError
+				if !errors.As(err, &httpErr) || httpErr.Status != 400 {
+					t.Errorf("got %v, want a 400", err)
+				}
+				if got != "" {
+					t.Errorf("the handler was called with %s", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.wantMethod {
+				t.Errorf("the handler saw %s, want %s", got, tt.wantMethod)
+			}
+		})
+	}
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NOTE: This implements both versions of the PROXY protocol as described in
+// https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt, apart from
+// v2's TLVs, which are skipped.
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// maxProxyV1Header is the longest a v1 header can be, including the CRLF.
+const maxProxyV1Header = 107
+
+// defaultProxyHeaderTimeout is how long a proxy gets to send its header when
+// no timeout is given.
+const defaultProxyHeaderTimeout = 10 * time.Second
+
+// maxPendingProxyConns is how many connections a proxyListener will have
+// accepted but not yet handed to Accept, so that it doesn't drain the
+// kernel's backlog when the Server isn't taking any more connections.
+const maxPendingProxyConns = 64
+
+// errMalformedProxyHeader is returned when a trusted proxy's connection
+// doesn't start with a valid PROXY protocol header.
+var errMalformedProxyHeader = errors.New("malformed PROXY protocol header")
+
+// proxyListener reads the PROXY protocol headers from connections in the
+// background, so that a slow proxy can't hold up the accept loop.
+type proxyListener struct {
+	net.Listener
+	trusted       []netip.Prefix
+	headerTimeout time.Duration
+
+	accepted chan acceptResult
+	// slots limits the connections that are being read or waiting for Accept
+	slots     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+// NewProxyProtocolListener wraps l so that connections from the trusted
+// proxies start with a PROXY protocol header (v1 or v2), as sent by load
+// balancers like HAProxy in TCP mode. The header says which client the proxy
+// is passing on, and the connections' RemoteAddr and LocalAddr report the
+// client's addresses instead of the proxy's, so logs, MaxConnsPerIP, and
+// Request.RemoteAddr all see the real client. A connection with a malformed
+// header is closed. Proxies have headerTimeout to send the header, or 10
+// seconds if it's 0 or less.
+//
+// Connections from anywhere else are passed on untouched, since anyone could
+// send a header that claims to be from anywhere. trusted must not be empty;
+// that's a programming error and panics.
+//
+// To use TLS, wrap the returned listener in TLS rather than the other way
+// around, since the header comes before the TLS handshake.
+func NewProxyProtocolListener(l net.Listener, trusted []netip.Prefix, headerTimeout time.Duration) net.Listener {
+	if len(trusted) == 0 {
+		panic("NewProxyProtocolListener: no trusted proxies")
+	}
+	if headerTimeout <= 0 {
+		headerTimeout = defaultProxyHeaderTimeout
+	}
+	p := &proxyListener{
+		Listener:      l,
+		trusted:       trusted,
+		headerTimeout: headerTimeout,
+		accepted:      make(chan acceptResult),
+		slots:         make(chan struct{}, maxPendingProxyConns),
+		done:          make(chan struct{}),
+	}
+	go p.acceptLoop()
+	return p
+}
+
+func (p *proxyListener) acceptLoop() {
+	for {
+		select {
+		case p.slots <- struct{}{}:
+		case <-p.done:
+			return
+		}
+		conn, err := p.Listener.Accept()
+		if err != nil {
+			<-p.slots
+			// the error is passed on to Accept's caller, which decides whether
+			// to keep going
+			if !isTemporaryAcceptError(err) {
+				p.failed(err)
+				return
+			}
+			select {
+			case p.accepted <- acceptResult{err: err}:
+			case <-p.done:
+				return
+			}
+			continue
+		}
+		go p.readHeader(conn)
+	}
+}
+
+// failed returns err from every call to Accept until the listener is closed.
+func (p *proxyListener) failed(err error) {
+	for {
+		select {
+		case p.accepted <- acceptResult{err: err}:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// readHeader reads conn's PROXY protocol header if it's from a trusted proxy,
+// and hands it over to Accept.
+func (p *proxyListener) readHeader(conn net.Conn) {
+	defer func() { <-p.slots }()
+	if p.trusts(conn.RemoteAddr()) {
+		conn.SetReadDeadline(time.Now().Add(p.headerTimeout))
+		proxied, err := readProxyHeader(conn)
+		if err != nil {
+			slog.Warn("Server rejected connection with a bad PROXY protocol header", "remote_addr", conn.RemoteAddr().String(), "error", err)
+			conn.Close()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+		conn = proxied
+	}
+	select {
+	case p.accepted <- acceptResult{conn: conn}:
+	case <-p.done:
+		conn.Close()
+	}
+}
+
+func (p *proxyListener) trusts(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	for _, prefix := range p.trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *proxyListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-p.accepted:
+		return r.conn, r.err
+	case <-p.done:
+		return nil, &net.OpError{Op: "accept", Net: p.Addr().Network(), Addr: p.Addr(), Err: net.ErrClosed}
+	}
+}
+
+func (p *proxyListener) Close() error {
+	p.closeOnce.Do(func() { close(p.done) })
+	return p.Listener.Close()
+}
+
+// proxyConn is a connection that was passed on by a proxy. remote and local
+// are nil if the proxy didn't say who the client was (e.g. for its own health
+// checks), in which case the connection's own addresses are used.
+type proxyConn struct {
+	net.Conn
+	// r holds whatever was read past the header
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return c.Conn.LocalAddr()
+	}
+	return c.local
+}
+
+// readProxyHeader reads the PROXY protocol header from the start of conn.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	r := bufio.NewReader(conn)
+	// the shortest v1 header ("PROXY UNKNOWN\r\n") is longer than this too
+	start, err := r.Peek(len(proxyV2Signature))
+	if err != nil {
+		return nil, fmt.Errorf("read PROXY protocol header: %w", err)
+	}
+	var remote, local net.Addr
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		remote, local, err = readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		remote, local, err = readProxyV1(r)
+	default:
+		err = fmt.Errorf("%w: no PROXY protocol signature", errMalformedProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote, local: local}, nil
+}
+
+// readProxyV1 reads a text header like
+//
+//	PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n
+func readProxyV1(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if errors.Is(err, bufio.ErrBufferFull) || len(line) > maxProxyV1Header {
+		return nil, nil, fmt.Errorf("%w: v1 header is too long", errMalformedProxyHeader)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("read PROXY protocol header: %w", err)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, nil, fmt.Errorf("%w: v1 header doesn't end in CRLF", errMalformedProxyHeader)
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	// the rest of an UNKNOWN header is meant to be ignored
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("%w: '%s'", errMalformedProxyHeader, line[:len(line)-2])
+	}
+	want4 := fields[1] == "TCP4"
+	remote, err := parseProxyV1Addr(fields[2], fields[4], want4)
+	if err != nil {
+		return nil, nil, err
+	}
+	local, err := parseProxyV1Addr(fields[3], fields[5], want4)
+	if err != nil {
+		return nil, nil, err
+	}
+	return remote, local, nil
+}
+
+func parseProxyV1Addr(ip string, port string, want4 bool) (net.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil || addr.Is4() != want4 {
+		return nil, fmt.Errorf("%w: bad address '%s'", errMalformedProxyHeader, ip)
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad port '%s'", errMalformedProxyHeader, port)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(n))), nil
+}
+
+// readProxyV2 reads a binary header: the signature, a version and command
+// byte, an address family and transport byte, the length of the rest, and
+// then the addresses followed by any TLVs.
+func readProxyV2(r *bufio.Reader) (net.Addr, net.Addr, error) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read PROXY protocol header: %w", err)
+	}
+	if header[12]>>4 != 2 {
+		return nil, nil, fmt.Errorf("%w: unsupported version %d", errMalformedProxyHeader, header[12]>>4)
+	}
+	command := header[12] & 0xf
+	if command > 1 {
+		return nil, nil, fmt.Errorf("%w: unknown command %d", errMalformedProxyHeader, command)
+	}
+	family := header[13] >> 4
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read PROXY protocol header: %w", err)
+	}
+	// LOCAL is for the proxy's own connections, e.g. health checks
+	if command == 0 {
+		return nil, nil, nil
+	}
+
+	var remote, local netip.Addr
+	var ports []byte
+	switch family {
+	case 1: // AF_INET
+		if len(payload) < 12 {
+			return nil, nil, fmt.Errorf("%w: IPv4 addresses are truncated", errMalformedProxyHeader)
+		}
+		remote = netip.AddrFrom4([4]byte(payload[0:4]))
+		local = netip.AddrFrom4([4]byte(payload[4:8]))
+		ports = payload[8:12]
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, nil, fmt.Errorf("%w: IPv6 addresses are truncated", errMalformedProxyHeader)
+		}
+		remote = netip.AddrFrom16([16]byte(payload[0:16]))
+		local = netip.AddrFrom16([16]byte(payload[16:32]))
+		ports = payload[32:36]
+	default:
+		// AF_UNSPEC and AF_UNIX don't say anything useful about the client
+		return nil, nil, nil
+	}
+	remotePort := binary.BigEndian.Uint16(ports[0:2])
+	localPort := binary.BigEndian.Uint16(ports[2:4])
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(remote, remotePort)),
+		net.TCPAddrFromAddrPort(netip.AddrPortFrom(local, localPort)), nil
+}
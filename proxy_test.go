@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 header with the given command (0 for LOCAL, 1 for
+// PROXY), address family, and payload.
+func proxyV2Header(command byte, family byte, payload []byte) string {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return string(append(header, payload...))
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	const request = "GET / HTTP/1.1\r\n\r\n"
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), netip.MustParseAddr("2001:db8::2").AsSlice()...)
+	ipv6 = append(ipv6, 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name string
+		// header is sent before request
+		header string
+		// wantRemote and wantLocal are "" when the connection's own addresses
+		// should be kept
+		wantRemote string
+		wantLocal  string
+		wantErr    bool
+	}{
+		{"v1 TCP4", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v1 TCP6", "PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n", "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v1 UNKNOWN", "PROXY UNKNOWN\r\n", "", "", false},
+		{"v1 UNKNOWN with addresses", "PROXY UNKNOWN ::1 ::1 1 2\r\n", "", "", false},
+		{"v2 IPv4", proxyV2Header(1, 1, ipv4), "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v2 IPv6", proxyV2Header(1, 2, ipv6), "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v2 TLVs", proxyV2Header(1, 1, append(ipv4, 0x04, 0x00, 0x01, 0xff)), "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v2 LOCAL", proxyV2Header(0, 0, nil), "", "", false},
+		{"v2 AF_UNSPEC", proxyV2Header(1, 0, nil), "", "", false},
+		{"no header", "", "", "", true},
+		{"v1 wrong family", "PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n", "", "", true},
+		{"v1 bad port", "PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n", "", "", true},
+		{"v1 missing field", "PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n", "", "", true},
+		{"v1 UDP", "PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n", "", "", true},
+		{"v1 no CR", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n", "", "", true},
+		{"v1 too long", "PROXY TCP4 " + strings.Repeat("1", 120) + "\r\n", "", "", true},
+		{"v2 truncated addresses", proxyV2Header(1, 1, ipv4[:8]), "", "", true},
+		{"v2 bad version", strings.Replace(proxyV2Header(1, 1, ipv4), "\x21", "\x11", 1), "", "", true},
+		{"v2 bad command", proxyV2Header(2, 1, ipv4), "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.header+request)
+				client.Close()
+			}()
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+			conn, err := readProxyHeader(server)
+			if tt.wantErr {
+				if !errors.Is(err, errMalformedProxyHeader) {
+					t.Errorf("got %v, want errMalformedProxyHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			wantRemote, wantLocal := tt.wantRemote, tt.wantLocal
+			if wantRemote == "" {
+				wantRemote, wantLocal = server.RemoteAddr().String(), server.LocalAddr().String()
+			}
+			if got := conn.RemoteAddr().String(); got != wantRemote {
+				t.Errorf("got RemoteAddr %s, want %s", got, wantRemote)
+			}
+			if got := conn.LocalAddr().String(); got != wantLocal {
+				t.Errorf("got LocalAddr %s, want %s", got, wantLocal)
+			}
+			// nothing after the header is lost
+			rest, _ := io.ReadAll(conn)
+			if string(rest) != request {
+				t.Errorf("read %q after the header, want %q", rest, request)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderTruncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"before signature", "PROX"},
+		{"v1 before CRLF", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443"},
+		{"v2 before length", proxyV2Header(1, 1, nil)[:14]},
+		{"v2 before payload", proxyV2Header(1, 1, make([]byte, 12))[:20]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				io.WriteString(client, tt.header)
+				client.Close()
+			}()
+			server.SetDeadline(time.Now().Add(5 * time.Second))
+			_, err := readProxyHeader(server)
+			if err == nil {
+				t.Error("reading a truncated header succeeded")
+			}
+		})
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  string
+		// want is the start of the response, or "" for the connection to be
+		// closed without one
+		want string
+	}{
+		{"trusted v1", "127.0.0.0/8", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "192.0.2.1:56324"},
+		{"trusted v2", "127.0.0.0/8", proxyV2Header(1, 1, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}), "192.0.2.1:56324"},
+		{"trusted UNKNOWN", "127.0.0.0/8", "PROXY UNKNOWN\r\n", "127.0.0.1:"},
+		{"trusted without a header", "127.0.0.0/8", "", ""},
+		{"trusted malformed", "127.0.0.0/8", "PROXY TCP4 nonsense\r\n", ""},
+		// anyone else's header is just part of the request
+		{"untrusted", "10.0.0.0/8", "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n", "HTTP/1.1 400 "},
+		{"untrusted without a header", "10.0.0.0/8", "", "127.0.0.1:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			proxied := NewProxyProtocolListener(l, []netip.Prefix{netip.MustParsePrefix(tt.trusted)}, time.Second)
+			s := &Server{}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				response := OKResponse()
+				response.Body = newBytesBody([]byte(request.RemoteAddr))
+				return response, nil
+			})
+			go s.Serve(proxied)
+			t.Cleanup(func() { s.Close() })
+
+			raw := rawRequest(t, l.Addr().String(), tt.header+"GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+			if tt.want == "" {
+				if raw != "" {
+					t.Errorf("got %q, want the connection closed", raw)
+				}
+				return
+			}
+			if strings.HasPrefix(tt.want, "HTTP/") {
+				if !strings.HasPrefix(raw, tt.want) {
+					t.Errorf("got %q, want %q...", raw, tt.want)
+				}
+				return
+			}
+			_, body := parseResponse(t, raw)
+			if !strings.HasPrefix(body, tt.want) {
+				t.Errorf("got RemoteAddr %q, want %q...", body, tt.want)
+			}
+		})
+	}
+}
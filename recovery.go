@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"time"
+)
+
+// maxPanicStack is how much of a panicking goroutine's stack trace is logged.
+const maxPanicStack = 2048
+
+// panicLog is where RecoveryMiddleware writes its JSON records. They don't go
+// through slog so that they stay JSON whatever the log format is.
+var panicLog io.Writer = os.Stderr
+
+// requestIDHeader is the request header that identifies a request across
+// services and log lines.
+const requestIDHeader = "x-request-id"
+
+type panicRecord struct {
+	Time      string `json:"time"`
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Panic     string `json:"panic"`
+	Stack     string `json:"stack"`
+}
+
+// RecoveryMiddleware turns a panicking handler into a 500 response instead of
+// a crashed server. The panic is logged as a single line of JSON with the
+// request's ID (from X-Request-Id, or a new one if the client didn't send a
+// valid one) and the start of the stack trace. The same ID is sent back in the
+// JSON body of the response so that clients can find the matching log line.
+func RecoveryMiddleware(handler Handler) Handler {
+	middleware := func(request Request) (response Response, err error) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			// the ID is sent back in a header, so anything that can't be
+			// written into one is replaced
+			requestID := request.Headers[requestIDHeader]
+			if requestID == "" || validateHeader("X-Request-Id", requestID) != nil {
+				requestID = newID()
+			}
+			stack := debug.Stack()
+			if len(stack) > maxPanicStack {
+				stack = stack[:maxPanicStack]
+			}
+			logPanic(panicRecord{
+				Time:      time.Now().UTC().Format(time.RFC3339Nano),
+				RequestID: requestID,
+				Method:    request.Method,
+				Path:      request.Path,
+				Panic:     fmt.Sprint(recovered),
+				Stack:     string(stack),
+			})
+			response, err = panicResponse(requestID), nil
+		}()
+		return handler(request)
+	}
+	return middleware
+}
+
+func logPanic(record panicRecord) {
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("marshal panic record", "error", err)
+		return
+	}
+	_, err = panicLog.Write(append(line, '\n'))
+	if err != nil {
+		slog.Error("write panic record", "error", err)
+	}
+}
+
+func panicResponse(requestID string) Response {
+	body, _ := json.Marshal(struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}{"internal server error", requestID})
+
+	// Content-Length is filled in by the server, since the body knows its length
+	headers := make(map[string]string, 3)
+	headers["Content-Type"] = "application/json"
+	headers["Connection"] = "close"
+	headers["X-Request-Id"] = requestID
+	response := ErrorResponse()
+	response.Head.Headers = headers
+	response.Body = newBytesBody(body)
+	return response
+}
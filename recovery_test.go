@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	var log bytes.Buffer
+	old := panicLog
+	panicLog = &log
+	t.Cleanup(func() { panicLog = old })
+
+	tests := []struct {
+		name      string
+		requestID string
+		// wantID is empty if a new ID should be made up
+		wantID string
+	}{
+		{"client id", "abc123", "abc123"},
+		{"no id", "", ""},
+		{"header injection", "abc\r\nSet-Cookie: evil=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			log.Reset()
+			request := Request{RequestLine: RequestLine{Method: "GET", Path: "/"}, Headers: map[string]string{}}
+			if tt.requestID != "" {
+				request.Headers[requestIDHeader] = tt.requestID
+			}
+			response, err := RecoveryMiddleware(func(Request) (Response, error) {
+				panic("oh no")
+			})(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.Head.Status != 500 {
+				t.Errorf("got status %d, want 500", response.Head.Status)
+			}
+
+			body, _ := io.ReadAll(response.Body)
+			var parsed struct {
+				RequestID string `json:"request_id"`
+			}
+			err = json.Unmarshal(body, &parsed)
+			if err != nil {
+				t.Fatalf("parse response body %q: %v", body, err)
+			}
+			id := parsed.RequestID
+			if tt.wantID != "" && id != tt.wantID {
+				t.Errorf("got request ID %q, want %q", id, tt.wantID)
+			}
+			if id == "" || id == tt.requestID && tt.wantID == "" {
+				t.Errorf("got request ID %q, want a new one", id)
+			}
+			if got := response.Head.Headers["X-Request-Id"]; got != id {
+				t.Errorf("got X-Request-Id %q, want %q", got, id)
+			}
+			if err := validateHeader("X-Request-Id", id); err != nil {
+				t.Errorf("request ID can't go in a header: %v", err)
+			}
+			if !strings.Contains(log.String(), `"request_id":"`+id+`"`) || !strings.Contains(log.String(), `"panic":"oh no"`) {
+				t.Errorf("panic wasn't logged with the request ID: %s", log.String())
+			}
+		})
+	}
+}
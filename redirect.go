@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewHTTPSRedirectMiddleware responds to any request that arrived over
+// plaintext with a 301 to the same path on https://host:httpsPort. The port is
+// left out of the URL when it's 443. Requests whose Host header could point the
+// redirect at another site get a 400 instead.
+//
+// A request is considered secure if it came in over TLS, or if a proxy in front
+// of us says so with "X-Forwarded-Proto: https".
+func NewHTTPSRedirectMiddleware(httpsPort int) Middleware {
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			proto := strings.ToLower(strings.TrimSpace(request.Headers["x-forwarded-proto"]))
+			if request.TLS != nil || proto == "https" {
+				return handler(request)
+			}
+
+			location, ok := redirectLocation(request.Headers["host"], httpsPort, request.Path)
+			if !ok {
+				return BadRequestResponse(), nil
+			}
+
+			headers := make(map[string]string, 3)
+			headers["Location"] = location
+			headers["Content-Length"] = "0"
+			headers["Connection"] = "close"
+			response := MovedResponse()
+			response.Head.Headers = headers
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// redirectLocation returns the https URL to redirect a request for path to,
+// given its Host header, or false if the host can't be used. Requests without
+// a usable Host header should get a 400.
+func redirectLocation(host string, httpsPort int, path string) (string, bool) {
+	host = hostWithoutPort(strings.TrimSpace(host))
+	// anything else could point the redirect somewhere other than this host
+	if host == "" || strings.ContainsAny(host, "/\\@?# ") {
+		return "", false
+	}
+	// e.g. "@evil.com/" would otherwise end up in the URL's authority
+	if !strings.HasPrefix(path, "/") {
+		path = "/"
+	}
+	return httpsURL(host, httpsPort, path), true
+}
+
+// hostWithoutPort strips the port (and any IPv6 brackets) from a Host header.
+// The port is the plaintext one, which is no use for an https URL.
+func hostWithoutPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// httpsURL builds an https URL for host and path, omitting the port when it's
+// the default one.
+func httpsURL(host string, port int, path string) string {
+	// IPv6 hosts need their brackets back once a port may follow them
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port == 443 || port == 0 {
+		return fmt.Sprintf("https://%s%s", host, path)
+	}
+	return fmt.Sprintf("https://%s:%d%s", host, port, path)
+}
+
+// The redirect listener is meant to face the internet on port 80, so it only
+// ever reads the request line and headers, and gives clients little time and
+// room to send them.
+const (
+	redirectTimeout    = 5 * time.Second
+	maxRedirectRequest = 8 << 10
+)
+
+// RedirectHTTPFrom listens on addr (e.g. ":80") and answers every request on
+// it with a 301 to the same path on https://, at the port the Server itself
+// is listening on (see Addr). It's for running alongside StartTLS, so that
+// people who type a bare hostname end up on the secure site. Nothing else is
+// served there. The listener is closed along with the Server's by Close and
+// Shutdown, and connections on it count towards MaxConnections and
+// MaxConnsPerIP.
+func (s *Server) RedirectHTTPFrom(addr string) error {
+	lc := s.listenConfig()
+	listen := func(network string, address string) (net.Listener, error) {
+		return lc.Listen(context.Background(), network, address)
+	}
+	if s.Dialer != nil {
+		listen = s.Dialer
+	}
+	addr, err := normalizeAddress(addr)
+	if err != nil {
+		return err
+	}
+	l, err := listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.RedirectHTTPOn(l)
+}
+
+// RedirectHTTPOn is like RedirectHTTPFrom, but with a listener that's already
+// bound, e.g. one inherited from the process that the Server is replacing (see
+// RedirectListenerFiles). l is closed if the Server is already shutting down.
+func (s *Server) RedirectHTTPOn(l net.Listener) error {
+	s.mu.Lock()
+	if s.shuttingDown.Load() {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.redirectListeners = append(s.redirectListeners, l)
+	s.mu.Unlock()
+
+	go func() {
+		err := s.serveRedirects(l)
+		if err != nil {
+			slog.Error("Server stopped redirecting to HTTPS", "address", l.Addr().String(), "error", err)
+		}
+	}()
+	return nil
+}
+
+// redirectAddrs returns the addresses of the listeners from RedirectHTTPFrom
+// and RedirectHTTPOn.
+func (s *Server) redirectAddrs() []net.Addr {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	addrs := make([]net.Addr, 0, len(s.redirectListeners))
+	for _, l := range s.redirectListeners {
+		addrs = append(addrs, l.Addr())
+	}
+	return addrs
+}
+
+func (s *Server) serveRedirects(l net.Listener) error {
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil && s.shuttingDown.Load() {
+			return nil
+		}
+		if err != nil && !isTemporaryAcceptError(err) {
+			return fmt.Errorf("accept connection: %w", err)
+		}
+		if err != nil {
+			backoff = nextAcceptBackoff(backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		s.stats.connectionAccepted()
+		activity, err := s.trackConn(conn)
+		if errors.Is(err, errTooManyConnections) {
+			go s.rejectConn(conn, serviceUnavailableResponse())
+			continue
+		}
+		if errors.Is(err, errTooManyConnsFromIP) {
+			go s.rejectConn(conn, tooManyRequestsResponse())
+			continue
+		}
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		go s.redirectToHTTPS(conn, activity)
+	}
+}
+
+// redirectToHTTPS reads just enough of the request on conn to answer it with
+// a redirect.
+func (s *Server) redirectToHTTPS(conn net.Conn, activity *connActivity) {
+	defer s.untrackConn(conn)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redirectTimeout))
+	c := &countingConn{Conn: conn, activity: activity}
+
+	var result RequestResult
+	defer func() {
+		s.stats.record(result)
+	}()
+	response, err := redirectResponse(bufio.NewReader(io.LimitReader(c, maxRedirectRequest)), s.httpsPort())
+	if err != nil {
+		slog.Debug("Server failed to read request to redirect", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	err = writeResponse(c, response, &result)
+	if err != nil {
+		slog.Debug("Server failed to send redirect", "remote_addr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// redirectResponse reads a request line and headers from r, and returns the
+// redirect to send back. Requests without a usable Host header get a 400.
+func redirectResponse(r *bufio.Reader, httpsPort int) (Response, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return Response{}, fmt.Errorf("read request line: %w", err)
+	}
+	requestLine, err := parseRequestLine(line)
+	if err != nil {
+		return BadRequestResponse(), nil
+	}
+	var host string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return Response{}, fmt.Errorf("read request headers: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, _ := strings.Cut(line, ":")
+		if strings.EqualFold(name, "host") {
+			host = value
+		}
+	}
+	location, ok := redirectLocation(host, httpsPort, requestLine.Path)
+	if !ok {
+		return BadRequestResponse(), nil
+	}
+
+	response := MovedResponse()
+	response.Head.Headers = map[string]string{
+		"Location":       location,
+		"Content-Length": "0",
+		"Connection":     "close",
+	}
+	return response, nil
+}
+
+// httpsPort returns the port that the Server is listening on, for redirects to
+// it, or 443 if it isn't listening yet.
+func (s *Server) httpsPort() int {
+	addr := s.Addr()
+	if addr == nil {
+		return 443
+	}
+	_, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 443
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return 443
+	}
+	return n
+}
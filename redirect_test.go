@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSRedirectMiddleware(t *testing.T) {
+	next := func(request Request) (Response, error) {
+		return OKResponse(), nil
+	}
+
+	tests := []struct {
+		name      string
+		httpsPort int
+		host      string
+		path      string
+		forwarded string
+		tls       bool
+		// wantStatus is 200 for requests that are let through
+		wantStatus   int
+		wantLocation string
+	}{
+		{"plain", 443, "example.com", "/index.html?q=1", "", false, 301, "https://example.com/index.html?q=1"},
+		{"plaintext port is dropped", 443, "example.com:8080", "/", "", false, 301, "https://example.com/"},
+		{"https port", 8443, "example.com", "/a", "", false, 301, "https://example.com:8443/a"},
+		{"ipv6 host", 8443, "[::1]:8080", "/a", "", false, 301, "https://[::1]:8443/a"},
+		{"forwarded http", 443, "example.com", "/a", "http", false, 301, "https://example.com/a"},
+		{"forwarded https", 443, "example.com", "/a", "HTTPS", false, 200, ""},
+		{"tls", 443, "example.com", "/a", "", true, 200, ""},
+		{"no host", 443, "", "/a", "", false, 400, ""},
+		{"userinfo host", 443, "example.com@evil.com", "/", "", false, 400, ""},
+		{"host with path", 443, "evil.com/x", "/", "", false, 400, ""},
+		{"host with query", 443, "evil.com?", "/", "", false, 400, ""},
+		{"host with backslash", 443, `evil.com\`, "/", "", false, 400, ""},
+		{"path without slash", 443, "example.com", "@evil.com/", "", false, 301, "https://example.com/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := Request{
+				RequestLine: RequestLine{Method: "GET", Path: tt.path},
+				Headers:     map[string]string{},
+			}
+			if tt.host != "" {
+				request.Headers["host"] = tt.host
+			}
+			if tt.forwarded != "" {
+				request.Headers["x-forwarded-proto"] = tt.forwarded
+			}
+			if tt.tls {
+				request.TLS = &tls.ConnectionState{}
+			}
+
+			response, err := NewHTTPSRedirectMiddleware(tt.httpsPort)(next)(request)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.Head.Status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", response.Head.Status, tt.wantStatus)
+			}
+			if got := response.Head.Headers["Location"]; got != tt.wantLocation {
+				t.Errorf("got Location %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRedirectResponse(t *testing.T) {
+	tests := []struct {
+		name         string
+		request      string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"plain", "GET /a?b HTTP/1.1\r\nHost: example.com\r\n\r\n", 301, "https://example.com:8443/a?b"},
+		{"no host", "GET /a HTTP/1.1\r\n\r\n", 400, ""},
+		{"userinfo host", "GET / HTTP/1.1\r\nHost: a@evil.com\r\n\r\n", 400, ""},
+		{"path without slash", "GET @evil.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", 301, "https://example.com:8443/"},
+		{"malformed", "GET\r\n\r\n", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, err := redirectResponse(bufio.NewReader(strings.NewReader(tt.request)), 8443)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if response.Head.Status != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", response.Head.Status, tt.wantStatus)
+			}
+			if got := response.Head.Headers["Location"]; got != tt.wantLocation {
+				t.Errorf("got Location %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestRedirectHTTPFrom(t *testing.T) {
+	s := &Server{}
+	s.RegisterHandler("/", rootEndpoint)
+	addr := startServer(t, s)
+	_, port, _ := net.SplitHostPort(addr)
+	err := s.RedirectHTTPFrom("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("redirect: %v", err)
+	}
+	from := s.redirectAddrs()[0].String()
+
+	tests := []struct {
+		name         string
+		request      string
+		wantStatus   int
+		wantLocation string
+	}{
+		{"root", "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", 301, "https://example.com:" + port + "/"},
+		{"path and query", "GET /a/b?c=d&e HTTP/1.1\r\nHost: example.com:80\r\n\r\n", 301, "https://example.com:" + port + "/a/b?c=d&e"},
+		{"no host", "GET /a HTTP/1.1\r\n\r\n", 400, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			response, _ := parseResponse(t, rawRequest(t, from, tt.request))
+			if response.StatusCode != tt.wantStatus {
+				t.Fatalf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if got := response.Header.Get("Location"); got != tt.wantLocation {
+				t.Errorf("got Location %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+
+	// it's internet facing, so huge requests are cut off rather than read
+	huge := "GET / HTTP/1.1\r\nHost: example.com\r\nX-Padding: " + strings.Repeat("a", maxRedirectRequest) + "\r\n\r\n"
+	conn, err := net.Dial("tcp", from)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the write or read may be reset, since the request is never all read
+	io.WriteString(conn, huge)
+	got, _ := io.ReadAll(conn)
+	conn.Close()
+	if len(got) != 0 {
+		t.Errorf("got %q for a request bigger than %d bytes, want nothing", got[:min(len(got), 40)], maxRedirectRequest)
+	}
+
+	// and it's closed along with the server
+	s.Close()
+	conn, err = net.Dial("tcp", from)
+	if err == nil {
+		conn.Close()
+		t.Error("the redirect listener is still accepting connections after Close")
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"time"
+)
+
+// NewRetryAfterMiddleware adds a Retry-After header to 429 and 503 responses
+// that don't have one, telling the client how long to wait before trying
+// again. retryAfter is called with each such response, and nothing is added if
+// it returns nil. Durations are rounded up to whole seconds.
+//
+// Handlers that fail with an HTTPError are covered too.
+func NewRetryAfterMiddleware(retryAfter func(Response) *time.Duration) Middleware {
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			response, err := handler(request)
+			if httpErr, ok := asHTTPError(err); ok {
+				response, err = httpErr.Response(), nil
+			}
+			if err != nil {
+				return response, err
+			}
+			status := response.Head.Status
+			if (status != 429 && status != 503) || hasHeader(response.Head.Headers, "Retry-After") {
+				return response, nil
+			}
+			wait := retryAfter(response)
+			if wait == nil {
+				return response, nil
+			}
+			seconds := int64((max(*wait, 0) + time.Second - 1) / time.Second)
+			response.Head.Headers = withHeader(response.Head.Headers, "Retry-After", strconv.FormatInt(seconds, 10))
+			return response, nil
+		}
+		return middleware
+	}
+}
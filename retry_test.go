@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryAfterMiddleware(t *testing.T) {
+	tenSeconds := 10 * time.Second
+	tests := []struct {
+		name     string
+		response Response
+		err      error
+		wait     *time.Duration
+		// want is the Retry-After header, or "" for none
+		want string
+	}{
+		{"429", Response{Head: ResponseHead{Status: 429, Reason: "Too Many Requests"}}, nil, &tenSeconds, "10"},
+		{"503", Response{Head: ResponseHead{Status: 503, Reason: "Service Unavailable"}}, nil, &tenSeconds, "10"},
+		{"HTTPError", Response{}, HTTPError{Status: 429, Message: "slow down"}, &tenSeconds, "10"},
+		{"rounded up", Response{Head: ResponseHead{Status: 429}}, nil, func() *time.Duration { d := 1500 * time.Millisecond; return &d }(), "2"},
+		{"negative", Response{Head: ResponseHead{Status: 429}}, nil, func() *time.Duration { d := -time.Second; return &d }(), "0"},
+		{"nil duration", Response{Head: ResponseHead{Status: 429}}, nil, nil, ""},
+		{"200", OKResponse(), nil, &tenSeconds, ""},
+		{"500", ErrorResponse(), nil, &tenSeconds, ""},
+		{"already set", Response{Head: ResponseHead{Status: 503, Headers: map[string]string{"retry-after": "60"}}}, nil, &tenSeconds, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewRetryAfterMiddleware(func(Response) *time.Duration {
+				return tt.wait
+			})(func(request Request) (Response, error) {
+				return tt.response, tt.err
+			})
+			response, err := handler(Request{})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := getHeader(response.Head.Headers, "Retry-After"); got != tt.want {
+				t.Errorf("got Retry-After %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfterMiddlewareOtherErrors(t *testing.T) {
+	want := errors.New("broken")
+	called := false
+	handler := NewRetryAfterMiddleware(func(Response) *time.Duration {
+		called = true
+		return nil
+	})(func(request Request) (Response, error) {
+		return Response{}, want
+	})
+	_, err := handler(Request{})
+	if err != want || called {
+		t.Errorf("got %v (called %v), want the handler's error untouched", err, called)
+	}
+}
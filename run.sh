@@ -1,6 +1,6 @@
 #!/bin/sh
 go build .
-./simple-http-server localhost:4221 --directory . &
+./simple-http-server --host localhost --port 4221 --directory . &
 SERVER_PID=$!
 SEPARATOR="\n\n=========================\n\n"
 # without this, bash starts curl faster than the server is ready to respond!
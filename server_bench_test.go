@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// benchConn is a connection with a request waiting to be read, which throws
+// away whatever is written to it, so that benchmarks can measure
+// handleRequest without any real I/O.
+type benchConn struct {
+	*strings.Reader
+	io.Writer
+}
+
+func BenchmarkHandleRequest(b *testing.B) {
+	s := &Server{}
+	s.RegisterHandler("/echo/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte(strings.TrimPrefix(request.Path, "/echo/")))
+		return response, nil
+	})
+	const request = "GET /echo/hello HTTP/1.1\r\nHost: localhost\r\nUser-Agent: bench\r\nAccept: */*\r\n\r\n"
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		response, _ := pipeRequest(b, s, request)
+		if !strings.HasSuffix(response, "hello") {
+			b.Fatalf("unexpected response %q", response)
+		}
+	}
+}
+
+func BenchmarkGzipMiddleware(b *testing.B) {
+	body := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 1500))
+	handler := gzipMiddleware(func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody(body)
+		return response, nil
+	})
+	request := Request{
+		RequestLine: RequestLine{Method: "GET", Path: "/"},
+		Headers:     map[string]string{"accept-encoding": "gzip"},
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for range b.N {
+		response, err := handler(request)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.Copy(io.Discard, response.Body)
+		response.Body.Close()
+	}
+}
+
+func BenchmarkGzipMiddlewareConcurrent(b *testing.B) {
+	body := []byte(strings.Repeat("The quick brown fox jumps over the lazy dog.\n", 100))
+	handler := gzipMiddleware(func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody(body)
+		return response, nil
+	})
+	request := Request{
+		RequestLine: RequestLine{Method: "GET", Path: "/"},
+		Headers:     map[string]string{"accept-encoding": "gzip"},
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	// about 100 requests at once
+	b.SetParallelism(max(1, 100/runtime.GOMAXPROCS(0)))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			response, err := handler(request)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			io.Copy(io.Discard, response.Body)
+			response.Body.Close()
+		}
+	})
+}
+
+func BenchmarkGetHandler(b *testing.B) {
+	s := &Server{}
+	noop := func(request Request) (Response, error) {
+		return OKResponse(), nil
+	}
+	for i := range 100 {
+		s.RegisterHandler(fmt.Sprintf("/api/v1/resource%d/", i), noop)
+	}
+	s.RegisterHandler("/", noop)
+	paths := []string{"/api/v1/resource0/item", "/api/v1/resource99/item", "/api/v1/resource50/a/b/c", "/missing", "/"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range b.N {
+		getHandler(s.endPointHandlers, paths[i%len(paths)])
+	}
+}
+
+func BenchmarkParseRequestLine(b *testing.B) {
+	b.ReportAllocs()
+	for range b.N {
+		_, err := parseRequestLine("GET /index.html?q=search HTTP/1.1\r\n")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkResponseHeadBytes(b *testing.B) {
+	head := ResponseHead{
+		Status: 200,
+		Reason: "OK",
+		Headers: map[string]string{
+			"Content-Type":   "text/plain",
+			"Content-Length": "1234",
+			"Connection":     "close",
+			"Server":         "simple-http-server",
+		},
+	}
+	b.ReportAllocs()
+	for range b.N {
+		head.Bytes()
+	}
+}
+
+// BenchmarkHandleRequestNoIO is BenchmarkHandleRequest without the pipe, so
+// that what's left is what handleRequest itself allocates.
+func BenchmarkHandleRequestNoIO(b *testing.B) {
+	s := &Server{}
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("hello"))
+		return response, nil
+	})
+	const request = "GET / HTTP/1.1\r\nHost: localhost\r\nUser-Agent: bench\r\nAccept: */*\r\n\r\n"
+	conn := benchConn{Reader: strings.NewReader(request), Writer: io.Discard}
+	b.ReportAllocs()
+	for range b.N {
+		conn.Reset(request)
+		var result RequestResult
+		err := s.handleRequest(conn, s.readDeadlines(conn, time.Now()), &result)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkServeFile downloads a big file over loopback TCP, which is where
+// sendfile gets to skip copying it through user space.
+func BenchmarkServeFile(b *testing.B) {
+	const size = 16 << 20
+	dir := b.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "big"), make([]byte, size), 0o644)
+	if err != nil {
+		b.Fatal(err)
+	}
+	s := &Server{}
+	s.RegisterHandler("/files/", getFilesEndpoint(dir, FilesEndpointOptions{}))
+	addr := startServer(b, s)
+
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for range b.N {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		io.WriteString(conn, "GET /files/big HTTP/1.1\r\n\r\n")
+		response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(io.Discard, response.Body)
+		if err != nil || n != size {
+			b.Fatalf("read %d bytes of the body: %v", n, err)
+		}
+		conn.Close()
+	}
+}
+
+// BenchmarkConnectionChurn sends one request on each of many short-lived
+// connections, which is what every client of the Server does, since it
+// closes connections after their first response.
+func BenchmarkConnectionChurn(b *testing.B) {
+	for _, size := range []int{0, 64 << 10} {
+		b.Run(fmt.Sprintf("ReadBufferSize=%d", size), func(b *testing.B) {
+			s := &Server{ReadBufferSize: size}
+			s.RegisterHandler("/", rootEndpoint)
+			addr := startServer(b, s)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					conn, err := net.Dial("tcp", addr)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+					io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+					response, err := io.ReadAll(conn)
+					conn.Close()
+					if err != nil || !strings.HasPrefix(string(response), "HTTP/1.1 200 ") {
+						b.Errorf("got %q (%v), want a 200", response, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkHandleRequestHeaders is BenchmarkHandleRequestNoIO with a browser's
+// worth of headers, whose map goes back to the pool after each request like
+// it does in Serve.
+func BenchmarkHandleRequestHeaders(b *testing.B) {
+	s := &Server{}
+	s.RegisterHandler("/", rootEndpoint)
+	const request = "GET / HTTP/1.1\r\n" +
+		"Host: localhost\r\n" +
+		"User-Agent: Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0\r\n" +
+		"Accept: text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8\r\n" +
+		"Accept-Language: en-GB,en;q=0.5\r\n" +
+		"Accept-Encoding: gzip, deflate, br\r\n" +
+		"Connection: keep-alive\r\n" +
+		"Upgrade-Insecure-Requests: 1\r\n" +
+		"Sec-Fetch-Dest: document\r\n" +
+		"\r\n"
+	conn := benchConn{Reader: strings.NewReader(request), Writer: io.Discard}
+	b.ReportAllocs()
+	for range b.N {
+		conn.Reset(request)
+		var result RequestResult
+		err := s.handleRequest(conn, s.readDeadlines(conn, time.Now()), &result)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if result.headers != nil {
+			putHeaders(result.headers)
+		}
+	}
+}
+
+// BenchmarkHandleRequestFiveMiddleware is BenchmarkHandleRequestNoIO with five
+// middleware registered. Their chain is built when the handler is registered,
+// so it shouldn't cost any allocations per request.
+func BenchmarkHandleRequestFiveMiddleware(b *testing.B) {
+	s := &Server{}
+	for range 5 {
+		s.RegisterMiddleware(func(handler Handler) Handler {
+			return func(request Request) (Response, error) {
+				return handler(request)
+			}
+		})
+	}
+	s.RegisterHandler("/", rootEndpoint)
+	const request = "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n"
+	conn := benchConn{Reader: strings.NewReader(request), Writer: io.Discard}
+	b.ReportAllocs()
+	for range b.N {
+		conn.Reset(request)
+		var result RequestResult
+		err := s.handleRequest(conn, s.readDeadlines(conn, time.Now()), &result)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if result.headers != nil {
+			putHeaders(result.headers)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestServerFullCycle sends requests to the built-in endpoints through
+// handleRequest, the same way the command sets them up.
+func TestServerFullCycle(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "test.txt"), []byte("file contents"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := parseFlags("simple-http-server", []string{"-directory", dir, "-port", "0"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		request    string
+		wantStatus int
+		wantBody   string
+	}{
+		{"root", "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n", 200, ""},
+		{"user agent", "GET /user-agent HTTP/1.1\r\nHost: localhost\r\nUser-Agent: foobar/1.2.3\r\n\r\n", 200, "foobar/1.2.3"},
+		{"echo", "GET /echo/hello HTTP/1.1\r\nHost: localhost\r\n\r\n", 200, "hello"},
+		{"get file", "GET /files/test.txt HTTP/1.1\r\nHost: localhost\r\n\r\n", 200, "file contents"},
+		{"missing file", "GET /files/missing.txt HTTP/1.1\r\nHost: localhost\r\n\r\n", 404, ""},
+		{"upload file", "POST /files/upload.txt HTTP/1.1\r\nHost: localhost\r\nContent-Length: 8\r\n\r\nuploaded", 201, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, result := pipeRequest(t, s, tt.request)
+			if result.Err != nil {
+				t.Fatalf("handle request: %v", result.Err)
+			}
+			response, body := parseResponse(t, raw)
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if tt.wantBody != "" && body != tt.wantBody {
+				t.Errorf("got body %q, want %q", body, tt.wantBody)
+			}
+			if !response.Close {
+				t.Error("the response doesn't have Connection: close")
+			}
+		})
+	}
+
+	uploaded, err := os.ReadFile(filepath.Join(dir, "upload.txt"))
+	if err != nil {
+		t.Fatalf("read uploaded file: %v", err)
+	}
+	if string(uploaded) != "uploaded" {
+		t.Errorf("got uploaded file %q, want %q", uploaded, "uploaded")
+	}
+}
+
+// TestConcurrentRequests is mostly for the race detector, so run it with
+// -race. Handlers and middleware are registered while the requests are being
+// served, since that's the shared state most likely to be raced on.
+func TestConcurrentRequests(t *testing.T) {
+	s := &Server{}
+	s.RegisterHandler("/echo/", echoEndpoint)
+	s.RegisterMiddleware(HeaderInjectionMiddleware(map[string]string{"X-Test": "yes"}))
+
+	const connections = 50
+	var wg sync.WaitGroup
+	errs := make(chan error, connections)
+	for i := range connections {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- concurrentRequest(s, i)
+		}()
+	}
+	registered := make(chan struct{})
+	go func() {
+		defer close(registered)
+		for i := range connections {
+			s.RegisterHandler(fmt.Sprintf("/other%d/", i), rootEndpoint)
+			if i%10 == 0 {
+				s.RegisterMiddleware(func(handler Handler) Handler { return handler })
+			}
+		}
+	}()
+	wg.Wait()
+	<-registered
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+// concurrentRequest sends /echo/<i> to s over its own net.Pipe and checks
+// that it's echoed back. It returns an error rather than failing the test
+// since it's run off of the test's goroutine.
+func concurrentRequest(s *Server, i int) error {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		var result RequestResult
+		s.handleRequest(server, s.readDeadlines(server, time.Now()), &result)
+		server.Close()
+	}()
+	go fmt.Fprintf(client, "GET /echo/%d HTTP/1.1\r\nHost: localhost\r\n\r\n", i)
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	raw, err := io.ReadAll(client)
+	if err != nil {
+		return fmt.Errorf("request %d: read response: %w", i, err)
+	}
+	response := string(raw)
+	want := fmt.Sprint(i)
+	if !strings.HasPrefix(response, "HTTP/1.1 200 ") || !strings.HasSuffix(response, "\r\n\r\n"+want) {
+		return fmt.Errorf("request %d: got %q, want a 200 with body %q", i, response, want)
+	}
+	if !strings.Contains(response, "X-Test: yes") {
+		return fmt.Errorf("request %d: got %q, want the injected header", i, response)
+	}
+	return nil
+}
+
+// TestNotFoundReadsBody checks that a client that sends its whole body before
+// reading the response gets the 404, rather than a reset from the server
+// closing the connection with the body unread.
+func TestNotFoundReadsBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBody  int64
+		bodySize int
+	}{
+		{"small", 0, 1 << 10},
+		{"default limit", 0, maxDiscardedBody},
+		{"MaxRequestBodySize", 512 << 10, 512 << 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{MaxRequestBodySize: tt.maxBody}
+			s.RegisterHandler("/exists", rootEndpoint)
+			conn, err := net.Dial("tcp", startServer(t, s))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request := fmt.Sprintf("POST /missing HTTP/1.1\r\nContent-Length: %d\r\n\r\n%s", tt.bodySize, strings.Repeat("a", tt.bodySize))
+			_, err = io.WriteString(conn, request)
+			if err != nil {
+				t.Fatalf("write request: %v", err)
+			}
+			// give the server time to respond and hang up before anything
+			// is read, like a client that's slow to get to the response
+			time.Sleep(50 * time.Millisecond)
+			raw, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("read response: %v", err)
+			}
+			if !strings.HasPrefix(string(raw), "HTTP/1.1 404 ") {
+				t.Errorf("got %q, want a 404", raw)
+			}
+		})
+	}
+}
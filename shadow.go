@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// NewShadowMiddleware sends every request to both primary and shadow, but
+// only ever returns primary's response. If primary is nil, the handler that the
+// middleware wraps is used. This is handy for trying out a new handler on real
+// traffic.
+//
+// With async, shadow runs in the background and its response is thrown away.
+// Otherwise it runs (after primary) before the response is sent, and how long
+// it took is logged. Either way its errors and panics are logged and never
+// reach the client.
+//
+// Both handlers need to read the body, so it's buffered in memory first.
+func NewShadowMiddleware(primary Handler, shadow Handler, async bool) Middleware {
+	return func(handler Handler) Handler {
+		p := primary
+		if p == nil {
+			p = handler
+		}
+
+		middleware := func(request Request) (Response, error) {
+			var body []byte
+			if request.Body != nil {
+				var err error
+				body, err = io.ReadAll(request.Body)
+				if err != nil {
+					return Response{}, fmt.Errorf("read body to shadow request: %w", err)
+				}
+				request.Body = bytes.NewReader(body)
+			}
+			shadowRequest := copyRequest(request, body)
+
+			if async {
+				go runDetached(shadow, shadowRequest, nil)
+				return p(request)
+			}
+
+			response, err := p(request)
+			start := time.Now()
+			done := func(r Request, _ Response, err error) {
+				slog.Info("shadow request finished", "method", r.Method, "path", r.Path, "duration", time.Since(start), "error", err)
+			}
+			runDetached(shadow, shadowRequest, done)
+			return response, err
+		}
+		return middleware
+	}
+}
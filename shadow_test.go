@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShadowMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		async  bool
+		shadow func(Request) (Response, error)
+	}{
+		{"sync", false, echoHandler},
+		{"async", true, echoHandler},
+		{"sync shadow fails", false, func(Request) (Response, error) { return Response{}, errors.New("shadow failed") }},
+		{"async shadow fails", true, func(Request) (Response, error) { return Response{}, errors.New("shadow failed") }},
+		{"sync shadow panics", false, func(Request) (Response, error) { panic("shadow panicked") }},
+		{"async shadow panics", true, func(Request) (Response, error) { panic("shadow panicked") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			old := slog.Default()
+			slog.SetDefault(slog.New(slog.NewTextHandler(&log, nil)))
+			t.Cleanup(func() { slog.SetDefault(old) })
+
+			shadowed := make(chan string, 1)
+			shadow := func(request Request) (Response, error) {
+				body, _ := io.ReadAll(request.Body)
+				shadowed <- string(body)
+				return tt.shadow(request)
+			}
+			primary := func(request Request) (Response, error) {
+				body, _ := io.ReadAll(request.Body)
+				response := OKResponse()
+				response.Body = newBytesBody([]byte("primary: " + string(body)))
+				return response, nil
+			}
+			handler := NewShadowMiddleware(primary, shadow, tt.async)(rootEndpoint)
+
+			request := Request{RequestLine: RequestLine{Method: "POST", Path: "/"}, Body: strings.NewReader("hello")}
+			response, err := handler(request)
+			if err != nil {
+				t.Fatalf("got %v, want primary's response", err)
+			}
+			body, _ := io.ReadAll(response.Body)
+			if string(body) != "primary: hello" {
+				t.Errorf("got body %q, want primary's", body)
+			}
+
+			if !tt.async {
+				// the shadow has already run
+				select {
+				case got := <-shadowed:
+					if got != "hello" {
+						t.Errorf("shadow got body %q, want %q", got, "hello")
+					}
+				default:
+					t.Fatal("the shadow wasn't called before the response was returned")
+				}
+				if !strings.Contains(log.String(), "shadow request finished") || !strings.Contains(log.String(), "duration=") {
+					t.Errorf("the shadow's latency wasn't logged:\n%s", log.String())
+				}
+				return
+			}
+			select {
+			case got := <-shadowed:
+				if got != "hello" {
+					t.Errorf("shadow got body %q, want %q", got, "hello")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the shadow was never called")
+			}
+		})
+	}
+}
+
+func TestShadowMiddlewareDefaultPrimary(t *testing.T) {
+	shadowed := make(chan struct{}, 1)
+	shadow := func(request Request) (Response, error) {
+		shadowed <- struct{}{}
+		return NotFoundResponse(), nil
+	}
+	handler := NewShadowMiddleware(nil, shadow, false)(rootEndpoint)
+	response, err := handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/"}})
+	if err != nil || response.Head.Status != 200 {
+		t.Errorf("got %d (%v), want the wrapped handler's 200", response.Head.Status, err)
+	}
+	if len(shadowed) != 1 {
+		t.Error("the shadow wasn't called")
+	}
+}
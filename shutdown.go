@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+// ErrServerClosed is why a request's Done channel is closed when the Server
+// is shutting down.
+var ErrServerClosed = errors.New("server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether every connection
+// has finished.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown stops the Server gracefully. After DrainDelay (if it's set), it
+// stops accepting connections (so Start returns nil), tells running handlers
+// through Request.Done, and waits for every connection to finish. If ctx
+// expires first, the remaining connections are closed and ctx's error is
+// returned. Each request that's cut off like that is logged, with how long it
+// had been running, to help find the handler that held things up.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.draining.Store(true)
+	if s.DrainDelay > 0 {
+		select {
+		case <-time.After(s.DrainDelay):
+		case <-ctx.Done():
+		}
+	}
+	s.shuttingDown.Store(true)
+
+	err := s.closeListeners()
+
+	s.connsMu.Lock()
+	for state := range s.requests {
+		state.cancel(ErrServerClosed)
+	}
+	s.connsMu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if s.activeConns() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			s.connsMu.Lock()
+			cutOff := s.inFlightRequests()
+			for conn := range s.conns {
+				conn.Close()
+			}
+			s.connsMu.Unlock()
+			now := time.Now()
+			for _, r := range cutOff {
+				slog.Warn("Server cut off request at shutdown", "method", r.Method, "path", r.Path, "elapsed", now.Sub(r.Received))
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackConn records that conn is being served, returning its activity for the
+// idle reaper. It returns ErrServerClosed if the Server is shutting down, in
+// which case conn shouldn't be served at all, or errTooManyConnections or
+// errTooManyConnsFromIP if it should be turned away with a 503 or 429.
+func (s *Server) trackConn(conn net.Conn) (*connActivity, error) {
+	key, keyed := s.clientKey(conn)
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.shuttingDown.Load() {
+		return nil, ErrServerClosed
+	}
+	if s.Overload == OverloadReject && s.full() {
+		return nil, errTooManyConnections
+	}
+	if keyed && s.ipFull(key) {
+		return nil, errTooManyConnsFromIP
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*connActivity)
+	}
+	activity := newConnActivity()
+	s.conns[conn] = activity
+	if keyed && s.MaxConnsPerIP > 0 {
+		if s.connsPerIP == nil {
+			s.connsPerIP = make(map[netip.Addr]int)
+		}
+		s.connsPerIP[key]++
+	}
+	return activity, nil
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	key, keyed := s.clientKey(conn)
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, conn)
+	if keyed && s.connsPerIP[key] > 0 {
+		s.connsPerIP[key]--
+		// only clients that are connected are kept, so the map can't grow
+		// without bound
+		if s.connsPerIP[key] == 0 {
+			delete(s.connsPerIP, key)
+		}
+	}
+	s.notifyConnsChanged()
+}
+
+// InFlightRequest is a request that a connection is in the middle of serving.
+type InFlightRequest struct {
+	Method string
+	Path   string
+	// Received is when its request line was read
+	Received time.Time
+}
+
+// InFlightRequests returns the requests that the Server's connections are
+// serving (or still reading), oldest first. Connections that haven't sent a
+// request line yet aren't included.
+func (s *Server) InFlightRequests() []InFlightRequest {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return s.inFlightRequests()
+}
+
+// inFlightRequests is InFlightRequests. connsMu must be held.
+func (s *Server) inFlightRequests() []InFlightRequest {
+	requests := make([]InFlightRequest, 0, len(s.conns))
+	for _, activity := range s.conns {
+		if r := activity.request.Load(); r != nil {
+			requests = append(requests, *r)
+		}
+	}
+	slices.SortFunc(requests, func(a, b InFlightRequest) int {
+		return a.Received.Compare(b.Received)
+	})
+	return requests
+}
+
+func (s *Server) activeConns() int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return len(s.conns)
+}
+
+// trackRequest records that a handler is running for state, so that Shutdown
+// can cancel it.
+func (s *Server) trackRequest(state *requestState) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if s.shuttingDown.Load() {
+		state.cancel(ErrServerClosed)
+		return
+	}
+	if s.requests == nil {
+		s.requests = make(map[*requestState]struct{})
+	}
+	s.requests[state] = struct{}{}
+}
+
+func (s *Server) untrackRequest(state *requestState) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.requests, state)
+}
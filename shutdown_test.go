@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startSlowRequest sends a request to a handler that takes d, returning once
+// the handler has started. The response (or error) arrives on the channel.
+func startSlowRequest(t *testing.T, d time.Duration) (*Server, <-chan string) {
+	t.Helper()
+	s := &Server{}
+	started := make(chan struct{})
+	s.RegisterHandler("/slow", func(request Request) (Response, error) {
+		close(started)
+		time.Sleep(d)
+		response := OKResponse()
+		response.Body = newBytesBody([]byte("done"))
+		return response, nil
+	})
+	addr := startServer(t, s)
+
+	responses := make(chan string, 1)
+	go func() {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer conn.Close()
+		io.WriteString(conn, "GET /slow HTTP/1.1\r\n\r\n")
+		response, _ := io.ReadAll(conn)
+		responses <- string(response)
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler never started")
+	}
+	return s, responses
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	s, responses := startSlowRequest(t, 100*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	response := <-responses
+	if !strings.HasPrefix(response, "HTTP/1.1 200 ") || !strings.HasSuffix(response, "done") {
+		t.Errorf("got %q, want the whole response", response)
+	}
+	// nothing new is accepted
+	_, err = net.Dial("tcp", s.Addr().String())
+	if err == nil {
+		t.Error("the server still accepts connections")
+	}
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	s, responses := startSlowRequest(t, time.Second)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := s.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("shutdown took %v, longer than its deadline", elapsed)
+	}
+	// the connection was closed, so the client gets nothing
+	if response := <-responses; response != "" {
+		t.Errorf("got %q, want the connection cut off", response)
+	}
+}
+
+func TestShutdownCancelsRequests(t *testing.T) {
+	s := &Server{}
+	canceled := make(chan error, 1)
+	started := make(chan struct{})
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		close(started)
+		<-request.Done()
+		canceled <- request.Err()
+		return OKResponse(), nil
+	})
+	addr := startServer(t, s)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\n\r\n")
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = s.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if err := <-canceled; !errors.Is(err, ErrServerClosed) {
+		t.Errorf("got %v, want ErrServerClosed", err)
+	}
+}
+
+func TestInFlightRequests(t *testing.T) {
+	s, responses := startSlowRequest(t, 200*time.Millisecond)
+	// connected, but without a request line yet
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	waitForConns(t, s, 2)
+
+	requests := s.InFlightRequests()
+	if len(requests) != 1 || requests[0].Method != "GET" || requests[0].Path != "/slow" {
+		t.Fatalf("got %+v, want just the GET /slow", requests)
+	}
+	if elapsed := time.Since(requests[0].Received); elapsed < 0 || elapsed > 5*time.Second {
+		t.Errorf("got Received %v ago, want when the request arrived", elapsed)
+	}
+
+	<-responses
+	waitForConns(t, s, 1)
+	if requests := s.InFlightRequests(); len(requests) != 0 {
+		t.Errorf("got %+v after the response, want none", requests)
+	}
+}
@@ -0,0 +1,148 @@
+//go:build unix
+
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalShutdown(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout string
+		// finish is whether the slow request gets to finish
+		finish   bool
+		wantCode int
+		wantLog  string
+	}{
+		{"drained", "10s", true, 0, "Shut down"},
+		{"forced", "200ms", false, exitShutdownForced, "Could not shut down cleanly"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startMain(t, "-listen", "127.0.0.1:0", "-directory", t.TempDir(), "-shutdown-timeout", tt.timeout, "-drain-log=false")
+
+			// an upload that's only half sent is in flight
+			conn, err := net.Dial("tcp", p.addr)
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(10 * time.Second))
+			io.WriteString(conn, "POST /files/upload.txt HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello")
+			// the server has it once it shows up in the drain log, which
+			// there's no other way to see from here, so give it a moment
+			time.Sleep(50 * time.Millisecond)
+
+			err = p.cmd.Process.Signal(syscall.SIGTERM)
+			if err != nil {
+				t.Fatalf("signal: %v", err)
+			}
+			line := p.waitForLog(t, "Shutting down")
+			if logValue(line, "connections") != "1" || logValue(line, "requests") != "1" {
+				t.Errorf("got %q, want one connection and request to drain", line)
+			}
+
+			if tt.finish {
+				io.WriteString(conn, "world")
+				raw, err := io.ReadAll(conn)
+				if err != nil || !strings.HasPrefix(string(raw), "HTTP/1.1 201 ") {
+					t.Errorf("got %q (%v) for the in-flight upload, want a 201", raw, err)
+				}
+			}
+			if !tt.finish {
+				// which handler held things up
+				line := p.waitForLog(t, "cut off request at shutdown")
+				if logValue(line, "method") != "POST" || logValue(line, "path") != "/files/upload.txt" {
+					t.Errorf("got %q, want the upload to be logged", line)
+				}
+				elapsed, err := time.ParseDuration(logValue(line, "elapsed"))
+				if err != nil || elapsed < 200*time.Millisecond {
+					t.Errorf("got elapsed %q (%v), want at least the shutdown timeout", logValue(line, "elapsed"), err)
+				}
+			}
+			p.waitForLog(t, tt.wantLog)
+			if code := p.wait(t); code != tt.wantCode {
+				t.Errorf("got exit code %d, want %d", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSecondSignalExits(t *testing.T) {
+	p := startMain(t, "-listen", "127.0.0.1:0", "-directory", t.TempDir(), "-shutdown-timeout", "1m", "-drain-log=false")
+	conn, err := net.Dial("tcp", p.addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "POST /files/upload.txt HTTP/1.1\r\nContent-Length: 10\r\n\r\nhello")
+	time.Sleep(50 * time.Millisecond)
+
+	p.cmd.Process.Signal(syscall.SIGINT)
+	p.waitForLog(t, "Shutting down")
+	// it would otherwise wait a minute for the upload
+	p.cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case <-p.exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the second signal didn't stop the server")
+	}
+	if p.cmd.ProcessState.Success() {
+		t.Error("the server exited successfully, want it killed by the signal")
+	}
+}
+
+// logValue returns the value of key in a log line from the default handler,
+// e.g. "1234" for "pid" in "... pid=1234".
+func logValue(line string, key string) string {
+	_, value, _ := strings.Cut(line, key+"=")
+	value, _, _ = strings.Cut(value, " ")
+	return value
+}
+
+func TestRestartHandsOverRedirects(t *testing.T) {
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "localhost", false, "localhost")
+	certFile, keyFile := writeCertFiles(t, t.TempDir(), certPEM, keyPEM)
+	p := startMain(t,
+		"-listen", "127.0.0.1:0", "-directory", t.TempDir(), "-shutdown-timeout", "5s", "-drain-log=false",
+		"-tls-cert", certFile, "-tls-key", keyFile, "-redirect-http", "127.0.0.1:0",
+	)
+	from := logValue(p.waitForLog(t, "Redirecting HTTP to HTTPS"), "address")
+	_, port, _ := net.SplitHostPort(p.addr)
+
+	err := p.cmd.Process.Signal(syscall.SIGUSR2)
+	if err != nil {
+		t.Fatalf("signal: %v", err)
+	}
+	pid, err := strconv.Atoi(logValue(p.waitForLog(t, "Replacement is serving"), "pid"))
+	if err != nil {
+		t.Fatalf("no PID for the replacement: %v", err)
+	}
+	// it has to go before the old process is waited for, since it shares its
+	// stderr, which is also why the old one's exit can't be waited for here
+	t.Cleanup(func() { syscall.Kill(pid, syscall.SIGKILL) })
+	p.waitForLog(t, "Shut down")
+
+	// the replacement is on both of the old server's ports
+	response, _ := parseResponse(t, rawRequest(t, from, "GET /a?b HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	if got, want := response.Header.Get("Location"), "https://localhost:"+port+"/a?b"; response.StatusCode != 301 || got != want {
+		t.Errorf("got %d to %q, want a 301 to %q", response.StatusCode, got, want)
+	}
+	response, _, err = tlsGet(p.addr, &tls.Config{RootCAs: ca.pool(), ServerName: "localhost"}, "/echo/hello")
+	if err != nil {
+		t.Fatalf("HTTPS request: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != 200 || string(body) != "hello" {
+		t.Errorf("got %d %q, want 200 %q", response.StatusCode, body, "hello")
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestSigningMiddleware(t *testing.T) {
+	key := []byte("test key")
+	handler := NewRequestSigningMiddleware(key)(echoHandler)
+	now := time.Now().Unix()
+	tests := []struct {
+		name string
+		// timestamp is added to now for X-Timestamp
+		timestamp time.Duration
+		signKey   []byte
+		body      string
+		// tamper changes the request after it's signed
+		tamper   func(*Request)
+		wantCode int
+	}{
+		{"signed", 0, key, "hello", nil, 200},
+		{"no body", 0, key, "", nil, 200},
+		{"a little clock skew", 2 * time.Minute, key, "hello", nil, 200},
+		{"replayed later", -6 * time.Minute, key, "hello", nil, 401},
+		{"from the future", 6 * time.Minute, key, "hello", nil, 401},
+		{"wrong key", 0, []byte("other key"), "hello", nil, 401},
+		{"body changed", 0, key, "hello", func(r *Request) { r.Body = strings.NewReader("HELLO") }, 401},
+		{"path changed", 0, key, "hello", func(r *Request) { r.Path = "/other" }, 401},
+		{"host changed", 0, key, "hello", func(r *Request) { r.Headers["host"] = "evil.example.com" }, 401},
+		{"timestamp changed", 0, key, "hello", func(r *Request) {
+			r.Headers["x-timestamp"] = strconv.FormatInt(now+1, 10)
+		}, 401},
+		{"no signature", 0, key, "hello", func(r *Request) { delete(r.Headers, "x-signature") }, 401},
+		{"signature not hex", 0, key, "hello", func(r *Request) { r.Headers["x-signature"] = "zz" }, 401},
+		{"no timestamp", 0, key, "hello", func(r *Request) { delete(r.Headers, "x-timestamp") }, 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := map[string]string{
+				"host":         "example.com",
+				"content-type": "text/plain",
+				"x-timestamp":  strconv.FormatInt(now+int64(tt.timestamp/time.Second), 10),
+			}
+			headers["x-signature"] = SignRequest(tt.signKey, "POST", "/upload?x=1", headers, []byte(tt.body))
+			request := Request{
+				RequestLine: RequestLine{Method: "POST", Path: "/upload?x=1"},
+				Headers:     headers,
+				Body:        strings.NewReader(tt.body),
+			}
+			if tt.tamper != nil {
+				tt.tamper(&request)
+			}
+
+			response, err := handler(request)
+			if tt.wantCode != 200 {
+				httpErr, ok := asHTTPError(err)
+				if !ok || httpErr.Status != tt.wantCode {
+					t.Errorf("got %v, want a %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("got %v, want the request to be accepted", err)
+			}
+			// the handler still gets the body that was verified
+			body, _ := io.ReadAll(response.Body)
+			if string(body) != tt.body {
+				t.Errorf("handler read body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	headers := map[string]string{"host": "example.com", "x-timestamp": "1718000000", "x-other": "ignored"}
+	got := string(CanonicalRequest("POST", "/files/a.txt", headers, []byte("body")))
+	want := "POST\n/files/a.txt\nexample.com\n\n1718000000\nbody"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"syscall"
+)
+
+// listenConfig returns the net.ListenConfig that Listen uses when there's no
+// Dialer, with the socket options that have to be set before binding.
+func (s *Server) listenConfig() net.ListenConfig {
+	var lc net.ListenConfig
+	if s.ReusePort {
+		lc.Control = func(network string, address string, c syscall.RawConn) error {
+			var err error
+			controlErr := c.Control(func(fd uintptr) {
+				err = setReusePort(fd)
+			})
+			if controlErr != nil {
+				return controlErr
+			}
+			return err
+		}
+	}
+	return lc
+}
+
+// setConnOptions applies TCPKeepAlive and DisableNoDelay to a newly accepted
+// connection. Connections that aren't TCP (e.g. Unix sockets) are left alone.
+func (s *Server) setConnOptions(conn net.Conn) {
+	if s.TCPKeepAlive == 0 && !s.DisableNoDelay {
+		return
+	}
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		return
+	}
+	var err error
+	switch {
+	case s.TCPKeepAlive < 0:
+		err = tcp.SetKeepAlive(false)
+	case s.TCPKeepAlive > 0:
+		err = tcp.SetKeepAlive(true)
+		if err == nil {
+			err = tcp.SetKeepAlivePeriod(s.TCPKeepAlive)
+		}
+		if err == nil {
+			err = controlConn(tcp, func(fd uintptr) error {
+				return setKeepAliveInterval(fd, s.TCPKeepAlive)
+			})
+		}
+	}
+	if err == nil && s.DisableNoDelay {
+		err = tcp.SetNoDelay(false)
+	}
+	// the connection still works, just not quite as configured
+	if err != nil {
+		slog.Warn("Server failed to set socket options", "remote_addr", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// controlConn runs f on conn's socket.
+func controlConn(conn *net.TCPConn, f func(fd uintptr) error) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	controlErr := raw.Control(func(fd uintptr) {
+		err = f(fd)
+	})
+	if controlErr != nil {
+		return controlErr
+	}
+	return err
+}
+
+// tcpConn digs the TCP connection out of conn, which may be wrapped in TLS or
+// by the PROXY protocol.
+func tcpConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case *tls.Conn:
+			conn = c.NetConn()
+		case *proxyConn:
+			conn = c.Conn
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,128 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// socketOptions are the options that the Server sets on accepted connections,
+// as the kernel reports them.
+type socketOptions struct {
+	keepAlive         bool
+	keepAliveIdle     int
+	keepAliveInterval int
+	noDelay           bool
+}
+
+func readSocketOptions(t *testing.T, conn net.Conn) socketOptions {
+	t.Helper()
+	tcp, ok := tcpConn(conn)
+	if !ok {
+		t.Fatalf("%T isn't a TCP connection", conn)
+	}
+	var opts socketOptions
+	err := controlConn(tcp, func(fd uintptr) error {
+		get := func(level int, name int) int {
+			value, err := unix.GetsockoptInt(int(fd), level, name)
+			if err != nil {
+				t.Errorf("getsockopt %d: %v", name, err)
+			}
+			return value
+		}
+		opts.keepAlive = get(unix.SOL_SOCKET, unix.SO_KEEPALIVE) != 0
+		opts.keepAliveIdle = get(unix.IPPROTO_TCP, unix.TCP_KEEPIDLE)
+		opts.keepAliveInterval = get(unix.IPPROTO_TCP, unix.TCP_KEEPINTVL)
+		opts.noDelay = get(unix.IPPROTO_TCP, unix.TCP_NODELAY) != 0
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("control connection: %v", err)
+	}
+	return opts
+}
+
+func TestSocketOptions(t *testing.T) {
+	tests := []struct {
+		name           string
+		keepAlive      time.Duration
+		disableNoDelay bool
+		// check is called with what was actually set
+		check func(t *testing.T, opts socketOptions)
+	}{
+		{"defaults", 0, false, func(t *testing.T, opts socketOptions) {
+			// Go's own defaults: keep-alives on, and Nagle's algorithm off
+			if !opts.keepAlive || !opts.noDelay {
+				t.Errorf("got %+v, want Go's defaults", opts)
+			}
+		}},
+		{"keep-alive", 5 * time.Second, false, func(t *testing.T, opts socketOptions) {
+			if !opts.keepAlive || opts.keepAliveIdle != 5 || opts.keepAliveInterval != 5 {
+				t.Errorf("got %+v, want 5 second keep-alives", opts)
+			}
+		}},
+		{"keep-alive rounded up", 1500 * time.Millisecond, false, func(t *testing.T, opts socketOptions) {
+			if opts.keepAliveInterval != 2 {
+				t.Errorf("got a keep-alive interval of %d, want 2", opts.keepAliveInterval)
+			}
+		}},
+		{"keep-alive off", -1, false, func(t *testing.T, opts socketOptions) {
+			if opts.keepAlive {
+				t.Errorf("got %+v, want keep-alives off", opts)
+			}
+		}},
+		{"delay", 0, true, func(t *testing.T, opts socketOptions) {
+			if opts.noDelay {
+				t.Errorf("got %+v, want TCP_NODELAY off", opts)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opened := make(chan socketOptions, 1)
+			s := &Server{
+				TCPKeepAlive:   tt.keepAlive,
+				DisableNoDelay: tt.disableNoDelay,
+				OnConnOpen: func(conn net.Conn) {
+					opened <- readSocketOptions(t, conn)
+				},
+			}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				return OKResponse(), nil
+			})
+			addr := startServer(t, s)
+			rawRequest(t, addr, "GET / HTTP/1.1\r\nConnection: close\r\n\r\n")
+			select {
+			case opts := <-opened:
+				tt.check(t, opts)
+			case <-time.After(5 * time.Second):
+				t.Fatal("no connection was opened")
+			}
+		})
+	}
+}
+
+func TestReusePort(t *testing.T) {
+	first := &Server{ReusePort: true}
+	addr := startServer(t, first)
+
+	// a second server can listen on the same port while the first is still
+	// running, which is what lets one replace the other
+	second := &Server{Address: addr, ReusePort: true}
+	err := second.Listen()
+	if err != nil {
+		t.Fatalf("listen on the same port with ReusePort: %v", err)
+	}
+	second.Close()
+
+	without := &Server{Address: addr}
+	err = without.Listen()
+	if err == nil {
+		without.Close()
+		t.Error("listening on the same port without ReusePort succeeded")
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"log/slog"
+)
+
+// setReusePort does nothing on platforms without SO_REUSEPORT, apart from
+// warning that the port can't be shared.
+func setReusePort(fd uintptr) error {
+	slog.Warn("SO_REUSEPORT isn't supported on this platform, ignoring Server.ReusePort")
+	return nil
+}
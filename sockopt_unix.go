@@ -0,0 +1,13 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setReusePort sets SO_REUSEPORT on the socket fd, so that several processes
+// can listen on the same port, e.g. while one replaces the other.
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
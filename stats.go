@@ -0,0 +1,258 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// processStart is roughly when the process started.
+var processStart = time.Now()
+
+// serverStats counts what a Server has done. Recording holds mu for reading
+// (so that requests can be recorded at the same time) and Stats holds it for
+// writing, so that a snapshot never has half of a request in it.
+type serverStats struct {
+	mu          sync.RWMutex
+	connections atomic.Uint64
+	requests    atomic.Uint64
+	// byClass is indexed by status / 100, e.g. byClass[2] counts 2xx
+	byClass      [6]atomic.Uint64
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	// routes maps the prefix that each request was routed to (or
+	// unmatchedRoute) to its *routeStats. Only registered prefixes end up in
+	// it, so it's as big as the number of registrations at most.
+	routes sync.Map
+}
+
+// unmatchedRoute is what requests that no handler matched are counted under
+// in Stats.Routes.
+const unmatchedRoute = "unmatched"
+
+// LatencyBuckets are the upper bounds of the buckets in RouteStats.Latency.
+var LatencyBuckets = [...]time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	2500 * time.Millisecond,
+}
+
+// routeStats counts the requests for one route.
+type routeStats struct {
+	requests atomic.Uint64
+	// latency is indexed like RouteStats.Latency
+	latency      [len(LatencyBuckets) + 1]atomic.Uint64
+	totalLatency atomic.Int64
+}
+
+func (rs *routeStats) record(d time.Duration) {
+	rs.requests.Add(1)
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	rs.latency[i].Add(1)
+	rs.totalLatency.Add(int64(d))
+}
+
+func (st *serverStats) connectionAccepted() {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	st.connections.Add(1)
+}
+
+// record counts result. Only requests whose request line was read count as
+// requests, and only ones that got a response count as responses.
+func (st *serverStats) record(result RequestResult) {
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	if result.Method != "" {
+		st.requests.Add(1)
+	}
+	class := result.Status / 100
+	if class > 0 && class < len(st.byClass) {
+		st.byClass[class].Add(1)
+	}
+	st.bytesRead.Add(uint64(result.ReadBytes))
+	st.bytesWritten.Add(uint64(result.HeadBytes + result.BodyBytes))
+	if result.route != "" {
+		rs, ok := st.routes.Load(result.route)
+		if !ok {
+			rs, _ = st.routes.LoadOrStore(result.route, &routeStats{})
+		}
+		rs.(*routeStats).record(result.TotalDuration)
+	}
+}
+
+// Stats is a snapshot of a Server's counters, see Server.Stats.
+type Stats struct {
+	// StartTime is roughly when the process started
+	StartTime time.Time
+	// TotalConnections counts every connection accepted, including ones
+	// turned away by MaxConnections or MaxConnsPerIP
+	TotalConnections  uint64
+	ActiveConnections int
+	// TotalRequests counts the requests whose request line was read, whether
+	// or not they got a response
+	TotalRequests uint64
+	// Responses1xx to Responses5xx count the responses sent by status class,
+	// including the ones that turn connections away
+	Responses1xx uint64
+	Responses2xx uint64
+	Responses3xx uint64
+	Responses4xx uint64
+	Responses5xx uint64
+	// BytesRead and BytesWritten count what was read from and written to
+	// connections after any TLS decryption, i.e. the HTTP messages
+	BytesRead    uint64
+	BytesWritten uint64
+	// Routes maps each registered prefix that has been routed to to its
+	// counters. Requests that no handler matched are under "unmatched".
+	Routes map[string]RouteStats
+}
+
+// RouteStats counts the requests that were routed to one registered prefix.
+type RouteStats struct {
+	Requests uint64
+	// Latency counts the requests by how long they took, as in
+	// RequestResult.TotalDuration. Latency[i] counts the ones that
+	// took at most LatencyBuckets[i] (and longer than the bucket before), and
+	// the last bucket counts the ones that took longer than every bound.
+	Latency      [len(LatencyBuckets) + 1]uint64
+	TotalLatency time.Duration
+}
+
+// Stats returns a snapshot of the Server's counters, which are what
+// StatusHandler reports. Requests that finish while it's being taken are
+// either entirely in it or not at all.
+func (s *Server) Stats() Stats {
+	st := &s.stats
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	routes := make(map[string]RouteStats)
+	st.routes.Range(func(key, value any) bool {
+		rs := value.(*routeStats)
+		snapshot := RouteStats{Requests: rs.requests.Load(), TotalLatency: time.Duration(rs.totalLatency.Load())}
+		for i := range rs.latency {
+			snapshot.Latency[i] = rs.latency[i].Load()
+		}
+		routes[key.(string)] = snapshot
+		return true
+	})
+	return Stats{
+		StartTime:         processStart,
+		TotalConnections:  st.connections.Load(),
+		ActiveConnections: s.ActiveConnections(),
+		TotalRequests:     st.requests.Load(),
+		Responses1xx:      st.byClass[1].Load(),
+		Responses2xx:      st.byClass[2].Load(),
+		Responses3xx:      st.byClass[3].Load(),
+		Responses4xx:      st.byClass[4].Load(),
+		Responses5xx:      st.byClass[5].Load(),
+		BytesRead:         st.bytesRead.Load(),
+		BytesWritten:      st.bytesWritten.Load(),
+		Routes:            routes,
+	}
+}
+
+// statusReport is the JSON that StatusHandler responds with. The field order
+// is the order of the keys in the output, so don't rearrange it.
+type statusReport struct {
+	StartTime         time.Time              `json:"start_time"`
+	UptimeSeconds     float64                `json:"uptime_seconds"`
+	Version           string                 `json:"version"`
+	GoVersion         string                 `json:"go_version"`
+	Addresses         []string               `json:"addresses"`
+	ActiveConnections int                    `json:"active_connections"`
+	RequestsTotal     uint64                 `json:"requests_total"`
+	Responses         map[string]uint64      `json:"responses"`
+	Routes            map[string]routeReport `json:"routes"`
+}
+
+// routeReport is a route's entry in statusReport. The latency buckets are
+// cumulative, like a Prometheus histogram's, and keyed by their bound in
+// seconds, e.g. "0.005", with "+Inf" counting every request.
+type routeReport struct {
+	Requests            uint64            `json:"requests"`
+	LatencySecondsTotal float64           `json:"latency_seconds_total"`
+	LatencyBuckets      map[string]uint64 `json:"latency_buckets"`
+}
+
+func newRouteReport(rs RouteStats) routeReport {
+	report := routeReport{
+		Requests:            rs.Requests,
+		LatencySecondsTotal: rs.TotalLatency.Seconds(),
+		LatencyBuckets:      make(map[string]uint64, len(rs.Latency)),
+	}
+	var count uint64
+	for i, n := range rs.Latency {
+		count += n
+		bound := "+Inf"
+		if i < len(LatencyBuckets) {
+			bound = strconv.FormatFloat(LatencyBuckets[i].Seconds(), 'g', -1, 64)
+		}
+		report.LatencyBuckets[bound] = count
+	}
+	return report
+}
+
+// StatusHandler responds with JSON describing the Server: when the process
+// started, how long it has been up, its version and listen addresses, how
+// many connections it's serving, how many requests it has read, how many
+// responses it has sent by status class ("1xx" to "5xx"), and each route's
+// request count and latency histogram, as in Stats. e.g.
+//
+//	{"start_time":"2026-10-15T15:00:00Z","uptime_seconds":42.1,...,"responses":{"1xx":0,"2xx":10,...}}
+//
+// It isn't registered automatically, since it may say more than every client
+// should know. Register it behind whatever authentication the route needs.
+func (s *Server) StatusHandler() Handler {
+	return func(request Request) (Response, error) {
+		now := time.Now()
+		stats := s.Stats()
+		report := statusReport{
+			StartTime:         stats.StartTime.UTC(),
+			UptimeSeconds:     now.Sub(stats.StartTime).Seconds(),
+			Version:           readVersionInfo().String(),
+			GoVersion:         runtime.Version(),
+			Addresses:         []string{},
+			ActiveConnections: stats.ActiveConnections,
+			RequestsTotal:     stats.TotalRequests,
+			// encoding/json sorts map keys, so these come out in order
+			Responses: map[string]uint64{
+				"1xx": stats.Responses1xx,
+				"2xx": stats.Responses2xx,
+				"3xx": stats.Responses3xx,
+				"4xx": stats.Responses4xx,
+				"5xx": stats.Responses5xx,
+			},
+			Routes: make(map[string]routeReport, len(stats.Routes)),
+		}
+		for prefix, rs := range stats.Routes {
+			report.Routes[prefix] = newRouteReport(rs)
+		}
+		for _, addr := range s.Addrs() {
+			report.Addresses = append(report.Addresses, addr.String())
+		}
+
+		body, err := json.Marshal(report)
+		if err != nil {
+			return Response{}, fmt.Errorf("encode status report: %w", err)
+		}
+		response := OKResponse()
+		response.Head.Headers = map[string]string{
+			"Content-Type":  "application/json",
+			"Cache-Control": "no-store",
+			"Connection":    "close",
+		}
+		response.Body = newBytesBody(body)
+		return response, nil
+	}
+}
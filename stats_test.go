@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusServer starts a Server with the status endpoint at /status along with
+// the given handlers, and returns its address and a channel that gets the
+// RequestResult of each request once it has been counted.
+func statusServer(t *testing.T, handlers map[string]Handler) (string, <-chan RequestResult) {
+	t.Helper()
+	s := &Server{}
+	results := make(chan RequestResult, 10)
+	// this runs after the request has been counted
+	s.OnRequestComplete = func(result RequestResult) {
+		results <- result
+	}
+	for prefix, handler := range handlers {
+		s.RegisterHandler(prefix, handler)
+	}
+	s.RegisterHandler("/status", s.StatusHandler())
+	return startServer(t, s), results
+}
+
+// getCounted sends a GET for path to addr, and waits for it to be counted.
+func getCounted(t *testing.T, addr string, results <-chan RequestResult, path string) {
+	t.Helper()
+	rawRequest(t, addr, "GET "+path+" HTTP/1.1\r\n\r\n")
+	waitForResult(t, results, 5*time.Second)
+}
+
+func TestStatusHandler(t *testing.T) {
+	addr, results := statusServer(t, map[string]Handler{"/": rootEndpoint})
+	getCounted(t, addr, results, "/")
+	getCounted(t, addr, results, "/")
+	getCounted(t, addr, results, "/missing")
+
+	raw := rawRequest(t, addr, "GET /status HTTP/1.1\r\n\r\n")
+	response, body := parseResponse(t, raw)
+	if response.StatusCode != 200 || response.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("got status %d with Content-Type %q, want JSON", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+	var report statusReport
+	err := json.Unmarshal([]byte(body), &report)
+	if err != nil {
+		t.Fatalf("parse %q: %v", body, err)
+	}
+	// the status request itself isn't counted until it's finished
+	if report.RequestsTotal != 3 {
+		t.Errorf("got requests_total %d, want 3", report.RequestsTotal)
+	}
+	want := map[string]uint64{"1xx": 0, "2xx": 2, "3xx": 0, "4xx": 1, "5xx": 0}
+	for class, n := range want {
+		if report.Responses[class] != n {
+			t.Errorf("got %d %s responses, want %d", report.Responses[class], class, n)
+		}
+	}
+	if report.ActiveConnections != 1 {
+		t.Errorf("got %d active connections, want just the status request's", report.ActiveConnections)
+	}
+	if !slices.Contains(report.Addresses, addr) {
+		t.Errorf("got addresses %q, want %s among them", report.Addresses, addr)
+	}
+	if report.StartTime.IsZero() || report.UptimeSeconds <= 0 || report.GoVersion == "" {
+		t.Errorf("got start time %v, uptime %v, and Go version %q", report.StartTime, report.UptimeSeconds, report.GoVersion)
+	}
+	if report.Version != readVersionInfo().String() {
+		t.Errorf("got version %q, want %q", report.Version, readVersionInfo().String())
+	}
+
+	// scripts may rely on the keys coming out in the same order every time
+	keys := []string{`"start_time"`, `"uptime_seconds"`, `"version"`, `"go_version"`, `"addresses"`, `"active_connections"`, `"requests_total"`, `"responses"`, `"routes"`}
+	last := -1
+	for _, key := range keys {
+		i := strings.Index(body, key)
+		if i <= last {
+			t.Errorf("%s is out of order in %s", key, body)
+		}
+		last = i
+	}
+}
+
+func TestStats(t *testing.T) {
+	s := &Server{}
+	results := make(chan RequestResult, 10)
+	s.OnRequestComplete = func(result RequestResult) {
+		results <- result
+	}
+	s.RegisterHandler("/ok", rootEndpoint)
+	s.RegisterHandler("/error", func(request Request) (Response, error) {
+		return Response{}, errors.New("broken")
+	})
+	s.RegisterHandler("/teapot", func(request Request) (Response, error) {
+		return Response{}, HTTPError{Status: 418}
+	})
+	addr := startServer(t, s)
+	before := s.Stats()
+
+	requests := []string{
+		"GET /ok HTTP/1.1\r\n\r\n",
+		"GET /ok HTTP/1.1\r\n\r\n",
+		"POST /ok HTTP/1.1\r\nContent-Length: 5\r\n\r\nhello",
+		"GET /missing HTTP/1.1\r\n\r\n",
+		"GET /teapot HTTP/1.1\r\n\r\n",
+		"GET /error HTTP/1.1\r\n\r\n",
+		// no request line can be parsed, but it still gets a response
+		"NONSENSE\r\n\r\n",
+	}
+	var read, written int
+	for _, request := range requests {
+		raw := rawRequest(t, addr, request)
+		waitForResult(t, results, 5*time.Second)
+		read += len(request)
+		written += len(raw)
+	}
+	waitForConns(t, s, 0)
+
+	stats := s.Stats()
+	if stats.StartTime != before.StartTime || stats.StartTime.IsZero() {
+		t.Errorf("got start time %v, then %v", before.StartTime, stats.StartTime)
+	}
+	want := Stats{
+		StartTime:        stats.StartTime,
+		TotalConnections: uint64(len(requests)),
+		// the nonsense never got as far as being a request
+		TotalRequests: uint64(len(requests) - 1),
+		Responses2xx:  3,
+		Responses4xx:  3,
+		Responses5xx:  1,
+		BytesRead:     uint64(read),
+		BytesWritten:  uint64(written),
+	}
+	routes := stats.Routes
+	stats.Routes = nil
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("got %+v, want %+v", stats, want)
+	}
+	wantRoutes := map[string]uint64{"/ok": 3, "/error": 1, "/teapot": 1, "unmatched": 1}
+	for route, n := range wantRoutes {
+		if routes[route].Requests != n {
+			t.Errorf("got %d requests for %s, want %d", routes[route].Requests, route, n)
+		}
+	}
+}
+
+func TestRouteStatsBuckets(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int
+	}{
+		{0, 0},
+		{time.Millisecond, 0},
+		{time.Millisecond + 1, 1},
+		{25 * time.Millisecond, 2},
+		{30 * time.Millisecond, 3},
+		{2500 * time.Millisecond, 5},
+		{time.Minute, len(LatencyBuckets)},
+	}
+	for _, tt := range tests {
+		var rs routeStats
+		rs.record(tt.d)
+		for i := range rs.latency {
+			want := uint64(0)
+			if i == tt.want {
+				want = 1
+			}
+			if got := rs.latency[i].Load(); got != want {
+				t.Errorf("%v: got %d in bucket %d, want %d", tt.d, got, i, want)
+			}
+		}
+	}
+}
+
+func TestRouteLatencyHistograms(t *testing.T) {
+	addr, results := statusServer(t, map[string]Handler{
+		"/fast": rootEndpoint,
+		"/slow/": func(request Request) (Response, error) {
+			time.Sleep(150 * time.Millisecond)
+			return OKResponse(), nil
+		},
+	})
+	for range 3 {
+		getCounted(t, addr, results, "/fast")
+	}
+	getCounted(t, addr, results, "/slow/a")
+	getCounted(t, addr, results, "/slow/b")
+	getCounted(t, addr, results, "/missing")
+
+	raw := rawRequest(t, addr, "GET /status HTTP/1.1\r\n\r\n")
+	_, body := parseResponse(t, raw)
+	var report statusReport
+	err := json.Unmarshal([]byte(body), &report)
+	if err != nil {
+		t.Fatalf("parse %q: %v", body, err)
+	}
+
+	// the histograms in the report are cumulative
+	tests := []struct {
+		route    string
+		requests uint64
+		// buckets are what some of the cumulative buckets should hold
+		buckets map[string]uint64
+	}{
+		// quick, but not so quick that a slow machine can't pass
+		{"/fast", 3, map[string]uint64{"0.025": 3, "+Inf": 3}},
+		{"/slow/", 2, map[string]uint64{"0.1": 0, "0.5": 2, "+Inf": 2}},
+		{unmatchedRoute, 1, map[string]uint64{"+Inf": 1}},
+	}
+	for _, tt := range tests {
+		route, ok := report.Routes[tt.route]
+		if !ok {
+			t.Errorf("no stats for %s in %s", tt.route, body)
+			continue
+		}
+		if route.Requests != tt.requests {
+			t.Errorf("%s: got %d requests, want %d", tt.route, route.Requests, tt.requests)
+		}
+		for bound, want := range tt.buckets {
+			if got := route.LatencyBuckets[bound]; got != want {
+				t.Errorf("%s: got %d requests in the %s bucket, want %d", tt.route, got, bound, want)
+			}
+		}
+	}
+	// only the routes that were used are there, and /status isn't counted
+	// until it's finished
+	if len(report.Routes) != len(tests) {
+		t.Errorf("got routes for %d prefixes, want %d: %s", len(report.Routes), len(tests), body)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// StreamBody is a Response.Body that's written as it's produced instead of
+// being read by the server, e.g. for server-sent events or progress reports.
+//
+// If the response doesn't have a Content-Length, it's sent with chunked
+// transfer encoding. Middleware that reads the body (like gzipMiddleware) still
+// can, but then it's up to that middleware when the bytes are sent, so
+// flushing has no effect, and trailers are dropped.
+type StreamBody struct {
+	// Stream writes the body to w. It should return once the body is complete.
+	Stream func(w *ResponseWriter) error
+	// AutoFlush sends every Write to the client straight away, rather than when
+	// the server's write buffer fills up or Flush is called. It's off by
+	// default since it costs a syscall (and a chunk) per write.
+	AutoFlush bool
+
+	// pipe is only used if something reads the body rather than letting the
+	// server stream it
+	pipe *io.PipeReader
+}
+
+// ResponseWriter is where a StreamBody writes its body.
+type ResponseWriter struct {
+	w         io.Writer
+	chunked   bool
+	autoFlush bool
+	written   int64
+	trailers  map[string]string
+}
+
+// Write sends p as its own chunk if the response is chunked.
+func (rw *ResponseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if rw.chunked {
+		n, err := fmt.Fprintf(rw.w, "%x\r\n", len(p))
+		rw.written += int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.w.Write(p)
+	rw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if rw.chunked {
+		m, err := io.WriteString(rw.w, "\r\n")
+		rw.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	if rw.autoFlush {
+		return n, rw.Flush()
+	}
+	return n, nil
+}
+
+// Flush sends everything that has been written so far to the client.
+func (rw *ResponseWriter) Flush() error {
+	f, ok := rw.w.(interface{ Flush() error })
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
+
+// SetTrailer sets a header to send after the body, for things that aren't
+// known until it has been written, like a checksum of it. The response should
+// list the trailers that are coming in its Trailer header. They can only be
+// sent with chunked transfer encoding, so they're dropped if the response has
+// a Content-Length.
+func (rw *ResponseWriter) SetTrailer(name string, value string) {
+	if rw.trailers == nil {
+		rw.trailers = make(map[string]string, 1)
+	}
+	rw.trailers[name] = value
+}
+
+// writeTo streams the body to w, returning the number of bytes written.
+func (b *StreamBody) writeTo(w io.Writer, chunked bool) (int64, error) {
+	rw := &ResponseWriter{w: w, chunked: chunked, autoFlush: b.AutoFlush}
+	err := b.Stream(rw)
+	if err != nil {
+		return rw.written, fmt.Errorf("stream response body: %w", err)
+	}
+	if chunked {
+		var end strings.Builder
+		end.WriteString("0\r\n")
+		for name, value := range rw.trailers {
+			fmt.Fprintf(&end, "%s: %s\r\n", name, value)
+		}
+		end.WriteString("\r\n")
+		n, err := io.WriteString(w, end.String())
+		rw.written += int64(n)
+		if err != nil {
+			return rw.written, err
+		}
+	}
+	return rw.written, nil
+}
+
+func (b *StreamBody) Read(p []byte) (int, error) {
+	if b.pipe == nil {
+		pr, pw := io.Pipe()
+		b.pipe = pr
+		go func() {
+			pw.CloseWithError(b.Stream(&ResponseWriter{w: pw}))
+		}()
+	}
+	return b.pipe.Read(p)
+}
+
+func (b *StreamBody) Close() error {
+	if b.pipe == nil {
+		return nil
+	}
+	return b.pipe.Close()
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStreamBodyFlush(t *testing.T) {
+	tests := []struct {
+		name      string
+		autoFlush bool
+		flush     bool
+	}{
+		{"Flush", false, true},
+		{"AutoFlush", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			s := &Server{}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				response := OKResponse()
+				response.Body = &StreamBody{AutoFlush: tt.autoFlush, Stream: func(w *ResponseWriter) error {
+					_, err := io.WriteString(w, "first")
+					if err != nil {
+						return err
+					}
+					if tt.flush {
+						err = w.Flush()
+						if err != nil {
+							return err
+						}
+					}
+					// the client has to see the first write before the
+					// stream carries on
+					<-release
+					_, err = io.WriteString(w, "second")
+					return err
+				}}
+				return response, nil
+			})
+
+			client, server := net.Pipe()
+			defer client.Close()
+			done := make(chan error, 1)
+			go func() {
+				done <- s.handleRequest(server, s.readDeadlines(server, time.Now()), &RequestResult{})
+				server.Close()
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go io.WriteString(client, "GET / HTTP/1.1\r\n\r\n")
+
+			response, err := http.ReadResponse(bufio.NewReader(client), nil)
+			if err != nil {
+				close(release)
+				t.Fatalf("read response head: %v", err)
+			}
+			first := make([]byte, len("first"))
+			_, err = io.ReadFull(response.Body, first)
+			close(release)
+			if err != nil || string(first) != "first" {
+				t.Fatalf("got %q (%v) before the stream finished, want %q", first, err, "first")
+			}
+			rest, err := io.ReadAll(response.Body)
+			if err != nil || string(rest) != "second" {
+				t.Errorf("got the rest of the body %q (%v), want %q", rest, err, "second")
+			}
+			if err := <-done; err != nil {
+				t.Errorf("handleRequest: %v", err)
+			}
+		})
+	}
+}
+
+func TestStreamBodyChunks(t *testing.T) {
+	s := &Server{}
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		response.Body = &StreamBody{Stream: func(w *ResponseWriter) error {
+			for _, s := range []string{"a", "", "bc"} {
+				_, err := io.WriteString(w, s)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+		return response, nil
+	})
+	raw, _ := pipeRequest(t, s, "GET / HTTP/1.1\r\n\r\n")
+	// empty writes mustn't end the body early with a 0 length chunk
+	_, body, _ := strings.Cut(raw, "\r\n\r\n")
+	if want := "1\r\na\r\n2\r\nbc\r\n0\r\n\r\n"; body != want {
+		t.Errorf("got body %q, want %q", body, want)
+	}
+}
+
+func TestStreamBodyRead(t *testing.T) {
+	body := &StreamBody{Stream: func(w *ResponseWriter) error {
+		_, err := io.WriteString(w, "hello")
+		return err
+	}}
+	got, err := io.ReadAll(body)
+	if err != nil || string(got) != "hello" {
+		t.Errorf("got %q (%v), want %q", got, err, "hello")
+	}
+	if err := body.Close(); err != nil {
+		t.Errorf("close: %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// readDeadlines keeps track of when each part of a request has to be read by,
+// so that a slow client can take its time over a big upload without being
+// allowed to dawdle over its headers.
+type readDeadlines struct {
+	// conn is nil if the connection doesn't support deadlines
+	conn readDeadliner
+	// overall comes from ReadTimeout, and header from ReadHeaderTimeout.
+	// Either is zero if there's no limit.
+	overall  time.Time
+	header   time.Time
+	bodyIdle time.Duration
+}
+
+// readDeadlines works out the deadlines for a connection accepted at the given
+// time.
+func (s *Server) readDeadlines(conn io.Reader, accepted time.Time) *readDeadlines {
+	d := &readDeadlines{bodyIdle: s.ReadBodyIdleTimeout}
+	d.conn, _ = conn.(readDeadliner)
+	if s.ReadTimeout > 0 {
+		d.overall = accepted.Add(s.ReadTimeout)
+	}
+	if s.ReadHeaderTimeout > 0 {
+		d.header = accepted.Add(s.ReadHeaderTimeout)
+	}
+	return d
+}
+
+// startHeaders arms the deadline for the TLS handshake, request line, and
+// headers.
+func (d *readDeadlines) startHeaders() {
+	d.set(earliest(d.overall, d.header))
+}
+
+// startBody arms the deadline for the body. The idle timeout is armed by each
+// read of the body (see idleReader), since it's reset whenever data arrives.
+func (d *readDeadlines) startBody() {
+	d.set(d.overall)
+}
+
+// clear removes the read deadline, e.g. once the whole request has been read.
+func (d *readDeadlines) clear() {
+	d.set(time.Time{})
+}
+
+func (d *readDeadlines) set(t time.Time) {
+	if d.conn != nil {
+		d.conn.SetReadDeadline(t)
+	}
+}
+
+// earliest returns whichever of a and b comes first, ignoring zero times.
+func earliest(a time.Time, b time.Time) time.Time {
+	if a.IsZero() || (!b.IsZero() && b.Before(a)) {
+		return b
+	}
+	return a
+}
+
+// idleReader pushes the read deadline back before every read of a request body,
+// so the body only times out if the client stops sending it for
+// ReadBodyIdleTimeout (or runs out of ReadTimeout).
+type idleReader struct {
+	r         io.Reader
+	deadlines *readDeadlines
+}
+
+func (r *idleReader) Read(p []byte) (int, error) {
+	d := r.deadlines
+	if d.bodyIdle > 0 {
+		d.set(earliest(d.overall, time.Now().Add(d.bodyIdle)))
+	}
+	return r.r.Read(p)
+}
+
+// headerReadFailed is called with the error from reading the request line or
+// headers. If the client ran out of time, it gets a 408 before the connection
+// is closed.
+func headerReadFailed(conn io.Writer, err error, result *RequestResult) error {
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		return err
+	}
+	writeErr := writeResponse(conn, requestTimeoutResponse(), result)
+	if writeErr != nil {
+		return errors.Join(err, writeErr)
+	}
+	return err
+}
+
+// ErrHandlerTimeout is the reason that a request is abandoned (see
+// Request.Err) when its handler runs out of time.
+var ErrHandlerTimeout = errors.New("handler timed out")
+
+// handlerTimeout returns how long e's handler gets, or a negative duration if
+// there's no limit.
+func (s *Server) handlerTimeout(e *endpointHandler) time.Duration {
+	if e.timeout != 0 {
+		return e.timeout
+	}
+	if s.HandlerTimeout <= 0 {
+		return -1
+	}
+	return s.HandlerTimeout
+}
+
+// callHandler runs e's handler (and middleware), giving up on it with
+// ErrHandlerTimeout if it takes longer than its timeout. The handler is told
+// through Request.Done, but it carries on in the background until it notices,
+// and its response is thrown away.
+func (s *Server) callHandler(e *endpointHandler, request Request) (Response, error) {
+	timeout := s.handlerTimeout(e)
+	if timeout < 0 {
+		return e.composed(request)
+	}
+
+	type handled struct {
+		response Response
+		err      error
+	}
+	done := make(chan handled, 1)
+	go func() {
+		response, err := e.composed(request)
+		done <- handled{response, err}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case h := <-done:
+		return h.response, h.err
+	case <-timer.C:
+	}
+
+	request.state.cancel(ErrHandlerTimeout)
+	go func() {
+		h := <-done
+		if h.response.Body != nil {
+			h.response.Body.Close()
+		}
+	}()
+	return Response{}, ErrHandlerTimeout
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// dialServer connects to s, which is started on a free port, and returns the
+// connection along with a channel that gets the RequestResult of every
+// request that s finishes with.
+func dialServer(t *testing.T, s *Server) (net.Conn, <-chan RequestResult) {
+	t.Helper()
+	results := make(chan RequestResult, 1)
+	s.OnRequestComplete = func(result RequestResult) {
+		results <- result
+	}
+	conn, err := net.Dial("tcp", startServer(t, s))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, results
+}
+
+// waitForResult returns the next RequestResult from results, failing the test
+// if it doesn't turn up within d, i.e. the connection's goroutine is stuck.
+func waitForResult(t *testing.T, results <-chan RequestResult, d time.Duration) RequestResult {
+	t.Helper()
+	select {
+	case result := <-results:
+		return result
+	case <-time.After(d):
+		t.Fatalf("the request still wasn't finished after %v", d)
+		return RequestResult{}
+	}
+}
+
+func TestReadTimeoutMidHeaders(t *testing.T) {
+	s := &Server{ReadTimeout: 100 * time.Millisecond}
+	s.RegisterHandler("/", rootEndpoint)
+	conn, results := dialServer(t, s)
+
+	start := time.Now()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n")
+	result := waitForResult(t, results, 2*time.Second)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("the connection was given up on after %v, before ReadTimeout", elapsed)
+	}
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("got error %v, want os.ErrDeadlineExceeded", result.Err)
+	}
+	if result.Status == 500 {
+		t.Error("the client was sent a 500")
+	}
+}
+
+func TestWriteTimeoutClientStopsReading(t *testing.T) {
+	s := &Server{WriteTimeout: 200 * time.Millisecond}
+	chunk := make([]byte, 64<<10)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		response := OKResponse()
+		// far more than the socket buffers can hold, so the writes block
+		// once the client stops reading
+		response.Body = &StreamBody{Stream: func(w *ResponseWriter) error {
+			for range 16 << 10 {
+				_, err := w.Write(chunk)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}}
+		return response, nil
+	})
+	conn, results := dialServer(t, s)
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	// read a little of the body, and then nothing more
+	io.ReadFull(conn, make([]byte, 1024))
+	result := waitForResult(t, results, 3*time.Second)
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("got error %v, want os.ErrDeadlineExceeded", result.Err)
+	}
+	if result.Status != 200 {
+		t.Errorf("got status %d, want the 200 that was cut off", result.Status)
+	}
+}
+
+func TestReadHeaderTimeoutSends408(t *testing.T) {
+	s := &Server{ReadHeaderTimeout: 100 * time.Millisecond}
+	s.RegisterHandler("/", rootEndpoint)
+	conn, results := dialServer(t, s)
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\n")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	response, _ := parseResponse(t, string(raw))
+	if response.StatusCode != 408 {
+		t.Errorf("got status %d, want 408", response.StatusCode)
+	}
+	waitForResult(t, results, time.Second)
+}
+
+// sendSlowly sends the head of an upload that's chunks ten-byte chunks long,
+// and then the first sent of those chunks, one every interval.
+func sendSlowly(conn net.Conn, chunks int, sent int, interval time.Duration) {
+	const chunk = "0123456789"
+	io.WriteString(conn, "POST /upload HTTP/1.1\r\nHost: localhost\r\nContent-Length: ")
+	io.WriteString(conn, strconv.Itoa(chunks*len(chunk))+"\r\n\r\n")
+	for range sent {
+		time.Sleep(interval)
+		io.WriteString(conn, chunk)
+	}
+}
+
+func TestSlowUploadSucceeds(t *testing.T) {
+	s := &Server{ReadHeaderTimeout: 100 * time.Millisecond, ReadBodyIdleTimeout: 200 * time.Millisecond}
+	s.RegisterHandler("/upload", echoHandler)
+	conn, results := dialServer(t, s)
+
+	// it takes longer than both timeouts, but never stops for long
+	go sendSlowly(conn, 10, 10, 50*time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	raw, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("read response: %v", err)
+	}
+	response, body := parseResponse(t, string(raw))
+	if response.StatusCode != 200 || len(body) != 100 {
+		t.Errorf("got status %d with %d bytes, want 200 with the whole upload", response.StatusCode, len(body))
+	}
+	result := waitForResult(t, results, time.Second)
+	if result.Err != nil {
+		t.Errorf("unexpected error: %v", result.Err)
+	}
+}
+
+func TestStalledUploadIsCutOff(t *testing.T) {
+	s := &Server{ReadHeaderTimeout: 100 * time.Millisecond, ReadBodyIdleTimeout: 200 * time.Millisecond}
+	s.RegisterHandler("/upload", echoHandler)
+	conn, results := dialServer(t, s)
+
+	start := time.Now()
+	sendSlowly(conn, 10, 2, 50*time.Millisecond)
+	result := waitForResult(t, results, 2*time.Second)
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("the upload was cut off after %v, before it had been idle for ReadBodyIdleTimeout", elapsed)
+	}
+	if !errors.Is(result.Err, os.ErrDeadlineExceeded) {
+		t.Errorf("got error %v, want os.ErrDeadlineExceeded", result.Err)
+	}
+	// the 408 is only for clients that are slow with their headers
+	if result.Status == 408 {
+		t.Error("the stalled upload got a 408")
+	}
+}
+
+func TestWithHandlerTimeout(t *testing.T) {
+	// each handler takes 200ms, unless it's told to give up
+	slow := func(request Request) (Response, error) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-request.Done():
+			return Response{}, request.Err()
+		}
+		return OKResponse(), nil
+	}
+	s := &Server{HandlerTimeout: 50 * time.Millisecond}
+	s.RegisterHandler("/default", slow)
+	s.RegisterHandler("/reports", slow, WithHandlerTimeout(time.Second))
+	s.RegisterHandler("/quick", slow, WithHandlerTimeout(20*time.Millisecond))
+	s.RegisterHandler("/unlimited", slow, WithHandlerTimeout(-1))
+	addr := startServer(t, s)
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{"/default", 503},
+		{"/reports", 200},
+		{"/quick", 503},
+		{"/unlimited", 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			start := time.Now()
+			response, _ := parseResponse(t, rawRequest(t, addr, "GET "+tt.path+" HTTP/1.1\r\nConnection: close\r\n\r\n"))
+			if response.StatusCode != tt.wantStatus {
+				t.Errorf("got status %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			if elapsed := time.Since(start); tt.wantStatus == 503 && elapsed >= 200*time.Millisecond {
+				t.Errorf("took %v to time out, want the handler abandoned before it finished", elapsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewServerTimingMiddleware adds how long the handler it wraps took to the
+// Server-Timing header, as "name;dur=<milliseconds>". An empty name means
+// "handler". Wrapping several times with different names accumulates the
+// timings in one header, e.g. to time the whole chain and a single step of it:
+//
+//	Server-Timing: handler;dur=1.204513, total;dur=3.871022
+//
+// Handlers that fail with an HTTPError get the header too.
+func NewServerTimingMiddleware(name string) Middleware {
+	if name == "" {
+		name = "handler"
+	}
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			start := time.Now()
+			response, err := handler(request)
+			elapsed := time.Since(start)
+			ms := float64(elapsed.Nanoseconds()) / 1e6
+			metric := name + ";dur=" + strconv.FormatFloat(ms, 'f', -1, 64)
+
+			if httpErr, ok := asHTTPError(err); ok {
+				httpErr.Headers = withServerTiming(httpErr.Headers, metric)
+				return response, httpErr
+			}
+			if err != nil {
+				return response, err
+			}
+			response.Head.Headers = withServerTiming(response.Head.Headers, metric)
+			return response, nil
+		}
+		return middleware
+	}
+}
+
+// withServerTiming returns a copy of headers with metric added to its
+// Server-Timing header.
+func withServerTiming(headers map[string]string, metric string) map[string]string {
+	existing := getHeader(headers, "Server-Timing")
+	if existing != "" {
+		metric = existing + ", " + metric
+	}
+	result := make(map[string]string, len(headers)+1)
+	for k, v := range headers {
+		if !strings.EqualFold(k, "Server-Timing") {
+			result[k] = v
+		}
+	}
+	result["Server-Timing"] = metric
+	return result
+}
+
+// requestStartHeader is the request header that RequestStartMiddleware sets.
+const requestStartHeader = "x-request-start"
+
+// RequestStartMiddleware sets the X-Request-Start request header to
+// "t=<milliseconds since the Unix epoch>" of when the request was received,
+// so that handlers and APM agents can tell how long it was queued for. The
+// time is when the server read the request line, however far into the
+// middleware chain this is. A header that's already there (e.g. from a proxy
+// in front of the server, which saw the request first) is left alone.
+func RequestStartMiddleware(handler Handler) Handler {
+	middleware := func(request Request) (Response, error) {
+		if _, ok := request.Headers[requestStartHeader]; ok {
+			return handler(request)
+		}
+		received := time.Now()
+		if request.state != nil && !request.state.received.IsZero() {
+			received = request.state.received
+		}
+		value := "t=" + strconv.FormatInt(received.UnixMilli(), 10)
+		request.Headers = withHeader(request.Headers, requestStartHeader, value)
+		return handler(request)
+	}
+	return middleware
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parseServerTiming parses a Server-Timing header into each metric's name and
+// duration in milliseconds.
+func parseServerTiming(t *testing.T, header string) map[string]float64 {
+	t.Helper()
+	metrics := make(map[string]float64)
+	for _, metric := range strings.Split(header, ", ") {
+		name, dur, ok := strings.Cut(metric, ";dur=")
+		if !ok || name == "" {
+			t.Fatalf("invalid metric %q in Server-Timing %q", metric, header)
+		}
+		ms, err := strconv.ParseFloat(dur, 64)
+		if err != nil {
+			t.Fatalf("invalid duration %q in Server-Timing %q", dur, header)
+		}
+		metrics[name] = ms
+	}
+	return metrics
+}
+
+func TestServerTimingMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		response Response
+		err      error
+	}{
+		{"200", OKResponse(), nil},
+		{"404", NotFoundResponse(), nil},
+		{"503", Response{Head: ResponseHead{Status: 503, Reason: "Service Unavailable"}}, nil},
+		{"HTTPError", Response{}, HTTPError{Status: 429, Message: "slow down"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewServerTimingMiddleware("")(func(request Request) (Response, error) {
+				time.Sleep(time.Millisecond)
+				return tt.response, tt.err
+			})
+			response, err := handler(Request{})
+			headers := response.Head.Headers
+			if httpErr, ok := asHTTPError(err); ok {
+				headers = httpErr.Headers
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			metrics := parseServerTiming(t, getHeader(headers, "Server-Timing"))
+			if len(metrics) != 1 || metrics["handler"] < 1 {
+				t.Errorf("got metrics %v, want handler with at least 1ms", metrics)
+			}
+		})
+	}
+}
+
+func TestServerTimingMiddlewareNested(t *testing.T) {
+	inner := NewServerTimingMiddleware("db")(func(request Request) (Response, error) {
+		time.Sleep(time.Millisecond)
+		response := OKResponse()
+		response.Head.Headers = map[string]string{"server-timing": "cache;dur=0.5"}
+		return response, nil
+	})
+	handler := NewServerTimingMiddleware("total")(func(request Request) (Response, error) {
+		time.Sleep(time.Millisecond)
+		return inner(request)
+	})
+	response, err := handler(Request{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := getHeader(response.Head.Headers, "Server-Timing")
+	metrics := parseServerTiming(t, header)
+	if len(metrics) != 3 || metrics["cache"] != 0.5 {
+		t.Fatalf("got Server-Timing %q, want the handler's metric and two more", header)
+	}
+	if metrics["total"] <= metrics["db"] {
+		t.Errorf("got total %vms and db %vms, want total to include db", metrics["total"], metrics["db"])
+	}
+	if !strings.HasPrefix(header, "cache;") {
+		t.Errorf("got Server-Timing %q, want the innermost metric first", header)
+	}
+}
+
+func TestServerTimingMiddlewareOtherErrors(t *testing.T) {
+	want := errors.New("broken")
+	handler := NewServerTimingMiddleware("")(func(request Request) (Response, error) {
+		return Response{}, want
+	})
+	_, err := handler(Request{})
+	if err != want {
+		t.Errorf("got %v, want the handler's error untouched", err)
+	}
+}
+
+func TestRequestStartMiddleware(t *testing.T) {
+	tests := []struct {
+		name string
+		// header is the X-Request-Start that the client sends, if any
+		header string
+		// delay is how long middleware that runs first takes
+		delay time.Duration
+	}{
+		{"set", "", 0},
+		{"after slow middleware", "", 200 * time.Millisecond},
+		{"from a proxy", "t=1700000000000", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen := make(chan string, 1)
+			handler := RequestStartMiddleware(func(request Request) (Response, error) {
+				seen <- request.Headers[requestStartHeader]
+				return OKResponse(), nil
+			})
+			s := &Server{}
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				time.Sleep(tt.delay)
+				return handler(request)
+			})
+			addr := startServer(t, s)
+
+			request := "GET / HTTP/1.1\r\nConnection: close\r\n"
+			if tt.header != "" {
+				request += "X-Request-Start: " + tt.header + "\r\n"
+			}
+			sent := time.Now()
+			rawRequest(t, addr, request+"\r\n")
+			got := <-seen
+
+			if tt.header != "" {
+				if got != tt.header {
+					t.Errorf("got X-Request-Start %q, want the proxy's %q", got, tt.header)
+				}
+				return
+			}
+			ms, ok := strings.CutPrefix(got, "t=")
+			start, err := strconv.ParseInt(ms, 10, 64)
+			if !ok || err != nil {
+				t.Fatalf("got X-Request-Start %q, want t=<milliseconds>", got)
+			}
+			if diff := time.UnixMilli(start).Sub(sent); diff < -time.Millisecond || diff > 100*time.Millisecond {
+				t.Errorf("got X-Request-Start %v after the request was sent, want it within 100ms", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCertReloadInterval is used when Server.CertReloadInterval is 0.
+const defaultCertReloadInterval = time.Minute
+
+// StartTLS is like Start, but speaks HTTPS on every address. certFile and
+// keyFile are PEM files for the server's certificate and its private key. They
+// can be left empty if TLSConfig already has a certificate.
+//
+// The files are checked for changes at most once every CertReloadInterval (on
+// the next handshake after it's passed), and can be reloaded straight away with
+// ReloadCertificates, so renewed certificates are picked up without a restart.
+//
+// Certificates added with AddCertificate take priority over this one for the
+// host names they're for.
+func (s *Server) StartTLS(certFile string, keyFile string) error {
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	fallback := config.GetCertificate
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return s.getCertificate(hello, fallback)
+	}
+	if certFile != "" || keyFile != "" {
+		interval := s.CertReloadInterval
+		if interval == 0 {
+			interval = defaultCertReloadInterval
+		}
+		certs, err := newCertReloader(certFile, keyFile, interval)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.certs = certs
+		s.mu.Unlock()
+	}
+
+	err := s.Listen()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	for i := range s.listeners {
+		s.listeners[i] = tls.NewListener(s.listeners[i], config)
+	}
+	s.mu.Unlock()
+	return s.serveAll()
+}
+
+// ReloadCertificates reads the certificate and key given to StartTLS again,
+// e.g. when the process gets a SIGHUP. If they can't be loaded, the Server
+// keeps using the ones it already has. It does nothing if StartTLS wasn't
+// given any files.
+func (s *Server) ReloadCertificates() error {
+	s.mu.RLock()
+	certs := s.certs
+	s.mu.RUnlock()
+	if certs == nil {
+		return nil
+	}
+	return certs.reload()
+}
+
+// AddCertificate makes the Server present cert to TLS clients that ask for
+// host with SNI. host may be a wildcard like "*.example.com", which matches
+// exactly one label. Clients asking for any other host (or none) get the
+// default certificate given to StartTLS. Handlers can see which host a client
+// asked for in Request.TLS.ServerName.
+//
+// It can be called before or after StartTLS. Adding a certificate for a host
+// again replaces the old one.
+func (s *Server) AddCertificate(host string, cert tls.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.hostCerts == nil {
+		s.hostCerts = make(map[string]*tls.Certificate)
+	}
+	s.hostCerts[strings.ToLower(host)] = &cert
+}
+
+// getCertificate picks the certificate for hello's server name: an exact
+// match, then a wildcard match, then the default from StartTLS. fallback is
+// the GetCertificate that TLSConfig came with, if any. Returning nil makes
+// crypto/tls use TLSConfig.Certificates.
+func (s *Server) getCertificate(hello *tls.ClientHelloInfo, fallback func(*tls.ClientHelloInfo) (*tls.Certificate, error)) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	s.mu.RLock()
+	cert, ok := s.hostCerts[name]
+	if !ok && name != "" {
+		if _, parent, found := strings.Cut(name, "."); found {
+			cert, ok = s.hostCerts["*."+parent]
+		}
+	}
+	certs := s.certs
+	s.mu.RUnlock()
+	if ok {
+		return cert, nil
+	}
+
+	if certs != nil {
+		return certs.getCertificate(hello)
+	}
+	if fallback != nil {
+		return fallback(hello)
+	}
+	return nil, nil
+}
+
+// certReloader serves a certificate from a pair of files, swapping in a new
+// one when the files change. Handshakes that are already under way keep the
+// certificate they started with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	// interval is the least time between checks of the files' modification
+	// times. A negative interval turns the checks off.
+	interval time.Duration
+	cert     atomic.Pointer[tls.Certificate]
+
+	// mu guards everything below it, and makes sure only one reload happens
+	// at a time.
+	mu      sync.Mutex
+	checked time.Time
+	certMod time.Time
+	keyMod  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, interval time.Duration) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile, interval: interval}
+	r.certMod, r.keyMod = r.modTimes()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	r.cert.Store(&cert)
+	r.checked = time.Now()
+	return r, nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.reloadIfChanged()
+	return r.cert.Load(), nil
+}
+
+// reloadIfChanged reloads the certificate if the files have been modified
+// since it was loaded, checking at most once per interval.
+func (r *certReloader) reloadIfChanged() {
+	if r.interval < 0 {
+		return
+	}
+	r.mu.Lock()
+	if time.Since(r.checked) < r.interval {
+		r.mu.Unlock()
+		return
+	}
+	r.checked = time.Now()
+	certMod, keyMod := r.modTimes()
+	changed := !certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)
+	r.mu.Unlock()
+	if changed {
+		// the error has already been logged, and the old certificate is still good
+		_ = r.reload()
+	}
+}
+
+func (r *certReloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// read the times before the files, so that a change made while they're
+	// being read is picked up by the next check
+	certMod, keyMod := r.modTimes()
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		err = fmt.Errorf("reload TLS certificate: %w", err)
+		slog.Error("TLS certificate reload failed, keeping the old certificate", "cert", r.certFile, "key", r.keyFile, "error", err)
+		return err
+	}
+	r.cert.Store(&cert)
+	r.certMod, r.keyMod = certMod, keyMod
+	slog.Info("TLS certificate reloaded", "cert", r.certFile, "key", r.keyFile)
+	return nil
+}
+
+// modTimes returns when the certificate and key files were last modified. A
+// file that can't be read has a zero time.
+func (r *certReloader) modTimes() (time.Time, time.Time) {
+	var certMod, keyMod time.Time
+	if info, err := os.Stat(r.certFile); err == nil {
+		certMod = info.ModTime()
+	}
+	if info, err := os.Stat(r.keyFile); err == nil {
+		keyMod = info.ModTime()
+	}
+	return certMod, keyMod
+}
+
+// connectionState returns the TLS state of conn, or nil if it isn't a TLS
+// connection.
+func connectionState(conn io.ReadWriter) *tls.ConnectionState {
+	if c, ok := conn.(*countingConn); ok {
+		conn = c.Conn
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// ClientAuthConfig returns a tls.Config that verifies client certificates
+// against the PEM bundle in caFile. policy is "require" (the default if it's
+// empty), which turns away clients without a valid certificate, or
+// "verify-if-given", which only checks certificates that clients choose to
+// send.
+func ClientAuthConfig(caFile string, policy string) (*tls.Config, error) {
+	var clientAuth tls.ClientAuthType
+	switch policy {
+	case "", "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	case "verify-if-given":
+		clientAuth = tls.VerifyClientCertIfGiven
+	default:
+		return nil, fmt.Errorf("unknown client auth policy '%s', expected require or verify-if-given", policy)
+	}
+
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA bundle '%s'", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: clientAuth}, nil
+}
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority for minting test certificates.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// pem is the CA's certificate, for trusting it
+	pem []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// pool returns a pool that trusts only ca.
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+// issue returns a certificate signed by ca for commonName, along with its PEM
+// certificate and key. Server certificates are valid for 127.0.0.1 and the
+// given DNS names.
+func (ca *testCA) issue(t *testing.T, commonName string, client bool, dnsNames ...string) (tls.Certificate, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		template.IPAddresses = nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+// writeCertFiles writes a PEM certificate and key to dir, returning their
+// paths.
+func writeCertFiles(t *testing.T, dir string, certPEM []byte, keyPEM []byte) (string, string) {
+	t.Helper()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	err := os.WriteFile(certFile, certPEM, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, keyPEM, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// startTLSServer starts s with StartTLS on a free loopback port and returns
+// its address. s is closed once the test is done.
+func startTLSServer(t *testing.T, s *Server, certFile string, keyFile string) string {
+	t.Helper()
+	s.Address = "127.0.0.1:0"
+	err := s.Listen()
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	go s.StartTLS(certFile, keyFile)
+	t.Cleanup(func() { s.Close() })
+	return s.Addr().String()
+}
+
+// tlsGet makes a GET request for path over TLS, returning the response and
+// the state of the connection it came over.
+func tlsGet(addr string, config *tls.Config, path string) (*http.Response, tls.ConnectionState, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr, config)
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return tlsRequest(conn, path)
+}
+
+// tlsRequest makes a GET request for path on conn and reads the whole
+// response.
+func tlsRequest(conn *tls.Conn, path string) (*http.Response, tls.ConnectionState, error) {
+	_, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	response, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return nil, tls.ConnectionState{}, err
+	}
+	body, err := io.ReadAll(response.Body)
+	response.Body = io.NopCloser(bytes.NewReader(body))
+	return response, conn.ConnectionState(), err
+}
+
+func TestStartTLSFromFlags(t *testing.T) {
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "localhost", false)
+	certFile, keyFile := writeCertFiles(t, t.TempDir(), certPEM, keyPEM)
+
+	c, err := parseFlags("simple-http-server", []string{"-port", "0", "-tls-cert", certFile, "-tls-key", keyFile}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	addr := startTLSServer(t, s, c.tlsCert, c.tlsKey)
+
+	response, state, err := tlsGet(addr, &tls.Config{RootCAs: ca.pool()}, "/echo/hello")
+	if err != nil {
+		t.Fatalf("HTTPS request: %v", err)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if response.StatusCode != 200 || string(body) != "hello" {
+		t.Errorf("got %d %q, want 200 %q", response.StatusCode, body, "hello")
+	}
+	if !state.HandshakeComplete {
+		t.Error("the handshake wasn't completed")
+	}
+
+	// plain HTTP doesn't get a response
+	raw := rawRequest(t, addr, "GET / HTTP/1.1\r\n\r\n")
+	if len(raw) >= 5 && raw[:5] == "HTTP/" {
+		t.Errorf("got %q over plain HTTP, want no HTTP response", raw)
+	}
+}
+
+func TestParseFlagsTLSErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{"cert without key", []string{"-tls-cert", "cert.pem"}},
+		{"key without cert", []string{"-tls-key", "key.pem"}},
+		{"client CA without cert", []string{"-tls-client-ca", "ca.pem"}},
+		{"cert for host without default", []string{"-tls-cert-for", "example.com=cert.pem,key.pem"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseFlags("simple-http-server", append([]string{"-port", "0"}, tt.args...), io.Discard)
+			if err == nil {
+				t.Errorf("parse %v succeeded, want an error", tt.args)
+			}
+		})
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "localhost", false)
+	dir := t.TempDir()
+	certFile, keyFile := writeCertFiles(t, dir, certPEM, keyPEM)
+	caFile := filepath.Join(dir, "ca.pem")
+	err := os.WriteFile(caFile, ca.pem, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, _, _ := ca.issue(t, "alice", true)
+	untrusted, _, _ := newTestCA(t).issue(t, "mallory", true)
+
+	tests := []struct {
+		policy string
+		name   string
+		cert   *tls.Certificate
+		// wantSubject is the client certificate that the handler sees, or ""
+		// if the request should never reach it
+		wantSubject string
+		wantServed  bool
+	}{
+		{"require", "trusted", &trusted, "alice", true},
+		{"require", "untrusted", &untrusted, "", false},
+		{"require", "absent", nil, "", false},
+		{"verify-if-given", "trusted", &trusted, "alice", true},
+		{"verify-if-given", "untrusted", &untrusted, "", false},
+		{"verify-if-given", "absent", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.name, func(t *testing.T) {
+			config, err := ClientAuthConfig(caFile, tt.policy)
+			if err != nil {
+				t.Fatalf("client auth config: %v", err)
+			}
+			s := &Server{TLSConfig: config}
+			served := make(chan Request, 1)
+			s.RegisterHandler("/", func(request Request) (Response, error) {
+				served <- request
+				return OKResponse(), nil
+			})
+			addr := startTLSServer(t, s, certFile, keyFile)
+
+			clientConfig := &tls.Config{RootCAs: ca.pool()}
+			if tt.cert != nil {
+				clientConfig.Certificates = []tls.Certificate{*tt.cert}
+			}
+			response, _, err := tlsGet(addr, clientConfig, "/")
+			if !tt.wantServed {
+				if err == nil {
+					t.Fatalf("got a %d, want the handshake to fail", response.StatusCode)
+				}
+				if len(served) != 0 {
+					t.Error("a client that failed verification reached the handler")
+				}
+				return
+			}
+			if err != nil || response.StatusCode != 200 {
+				t.Fatalf("got %v, want a 200", err)
+			}
+			request := <-served
+			if request.TLS == nil {
+				t.Fatal("the handler didn't get the TLS state")
+			}
+			var subject string
+			if len(request.TLS.PeerCertificates) > 0 {
+				subject = request.TLS.PeerCertificates[0].Subject.CommonName
+			}
+			if subject != tt.wantSubject {
+				t.Errorf("handler saw client certificate %q, want %q", subject, tt.wantSubject)
+			}
+			if request.TLS.Version == 0 || request.TLS.CipherSuite == 0 {
+				t.Errorf("got version %x and cipher suite %x, want the negotiated ones", request.TLS.Version, request.TLS.CipherSuite)
+			}
+		})
+	}
+}
+
+func TestClientAuthConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	err := os.WriteFile(caFile, newTestCA(t).pem, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notPEM := filepath.Join(dir, "not.pem")
+	err = os.WriteFile(notPEM, []byte("not a certificate"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		caFile string
+		policy string
+	}{
+		{"unknown policy", caFile, "optional"},
+		{"missing file", filepath.Join(dir, "missing.pem"), "require"},
+		{"no certificates", notPEM, "require"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ClientAuthConfig(tt.caFile, tt.policy)
+			if err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
+
+// presented returns the common name of the certificate that the server at
+// addr presents.
+func presented(t *testing.T, addr string, config *tls.Config) string {
+	t.Helper()
+	response, state, err := tlsGet(addr, config, "/")
+	if err != nil || response.StatusCode != 200 {
+		t.Fatalf("got %v, want a 200", err)
+	}
+	return state.PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadCertificates(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	_, certPEM, keyPEM := ca.issue(t, "old", false)
+	certFile, keyFile := writeCertFiles(t, dir, certPEM, keyPEM)
+	// only reloaded when asked to
+	s := &Server{CertReloadInterval: -1}
+	s.RegisterHandler("/", rootEndpoint)
+	addr := startTLSServer(t, s, certFile, keyFile)
+	config := &tls.Config{RootCAs: ca.pool()}
+
+	if got := presented(t, addr, config); got != "old" {
+		t.Fatalf("got certificate %q, want old", got)
+	}
+	// a connection made before the reload
+	existing, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer existing.Close()
+	existing.SetDeadline(time.Now().Add(5 * time.Second))
+	err = existing.Handshake()
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+
+	_, certPEM, keyPEM = ca.issue(t, "new", false)
+	writeCertFiles(t, dir, certPEM, keyPEM)
+	if got := presented(t, addr, config); got != "old" {
+		t.Errorf("got certificate %q before reloading, want old", got)
+	}
+	err = s.ReloadCertificates()
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if got := presented(t, addr, config); got != "new" {
+		t.Errorf("got certificate %q after reloading, want new", got)
+	}
+	response, state, err := tlsRequest(existing, "/")
+	if err != nil || response.StatusCode != 200 {
+		t.Errorf("the existing connection got %v, want a 200", err)
+	} else if got := state.PeerCertificates[0].Subject.CommonName; got != "old" {
+		t.Errorf("the existing connection has certificate %q, want old", got)
+	}
+
+	// files that can't be loaded leave the certificate alone
+	writeCertFiles(t, dir, []byte("not a certificate"), keyPEM)
+	err = s.ReloadCertificates()
+	if err == nil {
+		t.Error("reloading a broken certificate succeeded")
+	}
+	if got := presented(t, addr, config); got != "new" {
+		t.Errorf("got certificate %q after a failed reload, want new", got)
+	}
+}
+
+func TestReloadCertificatesOnChange(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	_, certPEM, keyPEM := ca.issue(t, "old", false)
+	certFile, keyFile := writeCertFiles(t, dir, certPEM, keyPEM)
+	s := &Server{CertReloadInterval: time.Nanosecond}
+	s.RegisterHandler("/", rootEndpoint)
+	addr := startTLSServer(t, s, certFile, keyFile)
+	config := &tls.Config{RootCAs: ca.pool()}
+
+	if got := presented(t, addr, config); got != "old" {
+		t.Fatalf("got certificate %q, want old", got)
+	}
+	_, certPEM, keyPEM = ca.issue(t, "new", false)
+	writeCertFiles(t, dir, certPEM, keyPEM)
+	// make sure that the modification times change, however coarse they are
+	later := time.Now().Add(time.Hour)
+	for _, file := range []string{certFile, keyFile} {
+		err := os.Chtimes(file, later, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := presented(t, addr, config); got != "new" {
+		t.Errorf("got certificate %q after the files changed, want new", got)
+	}
+}
+
+func TestSNICertificates(t *testing.T) {
+	ca := newTestCA(t)
+	_, certPEM, keyPEM := ca.issue(t, "default", false, "default.example.org")
+	certFile, keyFile := writeCertFiles(t, t.TempDir(), certPEM, keyPEM)
+	exact, _, _ := ca.issue(t, "exact", false, "a.example.com")
+	wildcard, _, _ := ca.issue(t, "wildcard", false, "*.example.com")
+
+	s := &Server{}
+	// added before StartTLS
+	s.AddCertificate("a.example.com", exact)
+	names := make(chan string, 1)
+	s.RegisterHandler("/", func(request Request) (Response, error) {
+		names <- request.TLS.ServerName
+		return OKResponse(), nil
+	})
+	addr := startTLSServer(t, s, certFile, keyFile)
+	// and after
+	s.AddCertificate("*.Example.com", wildcard)
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"a.example.com", "exact"},
+		{"A.Example.Com", "exact"},
+		{"b.example.com", "wildcard"},
+		// a wildcard only covers one label
+		{"c.b.example.com", "default"},
+		{"example.com", "default"},
+		{"other.example.org", "default"},
+		{"", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.serverName, func(t *testing.T) {
+			// the names aren't all in the certificates, so this only checks
+			// which one is sent
+			config := &tls.Config{ServerName: tt.serverName, InsecureSkipVerify: true}
+			if got := presented(t, addr, config); got != tt.want {
+				t.Errorf("got certificate %q, want %q", got, tt.want)
+			}
+			if got := <-names; got != tt.serverName {
+				t.Errorf("handler saw server name %q, want %q", got, tt.serverName)
+			}
+		})
+	}
+}
+
+func TestSNICertificatesFromFlags(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	_, certPEM, keyPEM := ca.issue(t, "default", false)
+	certFile, keyFile := writeCertFiles(t, dir, certPEM, keyPEM)
+	hostDir := filepath.Join(dir, "host")
+	err := os.Mkdir(hostDir, 0o700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, hostCertPEM, hostKeyPEM := ca.issue(t, "host", false, "api.example.com")
+	hostCert, hostKey := writeCertFiles(t, hostDir, hostCertPEM, hostKeyPEM)
+
+	c, err := parseFlags("simple-http-server", []string{
+		"-port", "0", "-tls-cert", certFile, "-tls-key", keyFile,
+		"-tls-cert-for", "api.example.com=" + hostCert + "," + hostKey,
+	}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	addr := startTLSServer(t, s, c.tlsCert, c.tlsKey)
+
+	config := &tls.Config{ServerName: "api.example.com", RootCAs: ca.pool()}
+	if got := presented(t, addr, config); got != "host" {
+		t.Errorf("got certificate %q for api.example.com, want host", got)
+	}
+	config = &tls.Config{ServerName: "www.example.com", InsecureSkipVerify: true}
+	if got := presented(t, addr, config); got != "default" {
+		t.Errorf("got certificate %q for another host, want default", got)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"strconv"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceContext reads and writes the W3C traceparent and tracestate headers.
+var traceContext = propagation.TraceContext{}
+
+// NewTracingMiddleware starts a server span for every request using tracer.
+// If the client sent traceparent and tracestate headers, the span continues
+// that trace. The span gets the http.method, http.target, and
+// http.status_code attributes, is marked as an error for 5xx statuses, and is
+// ended once the handler returns.
+//
+// Handlers can start child spans from RequestContext, which carries the span
+// (on top of the context from ContextMiddleware, if that runs first).
+func NewTracingMiddleware(tracer trace.Tracer) Middleware {
+	return func(handler Handler) Handler {
+		middleware := func(request Request) (Response, error) {
+			// Headers are already lower case, which is how TraceContext looks them up
+			parent := traceContext.Extract(RequestContext(request), propagation.MapCarrier(request.Headers))
+			ctx, span := tracer.Start(parent, request.Method+" "+request.Path,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.method", request.Method),
+					attribute.String("http.target", request.Path),
+				),
+			)
+			defer span.End()
+
+			// handed over the same way as ContextMiddleware's contexts
+			id := newID()
+			requestContexts.Store(id, ctx)
+			defer requestContexts.Delete(id)
+			request.Headers = withHeader(request.Headers, contextIDHeader, id)
+			response, err := handler(request)
+			status := response.Head.Status
+			if err != nil {
+				status = errorStatus(err)
+			}
+			span.SetAttributes(attribute.Int("http.status_code", status))
+			if status >= 500 {
+				description := "status " + strconv.Itoa(status)
+				if err != nil {
+					description = err.Error()
+				}
+				span.SetStatus(codes.Error, description)
+			}
+			return response, err
+		}
+		return middleware
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTracingMiddlewareNoop(t *testing.T) {
+	handler := NewTracingMiddleware(noop.NewTracerProvider().Tracer("test"))(func(request Request) (Response, error) {
+		return OKResponse(), nil
+	})
+	response, err := handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/"}})
+	if err != nil || response.Head.Status != 200 {
+		t.Errorf("got %d, %v, want 200", response.Head.Status, err)
+	}
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	const (
+		traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+		spanID  = "00f067aa0ba902b7"
+	)
+	tests := []struct {
+		name        string
+		headers     map[string]string
+		response    Response
+		err         error
+		wantStatus  int
+		wantError   bool
+		wantParent  bool
+		wantTraceID string
+	}{
+		{"ok", nil, OKResponse(), nil, 200, false, false, ""},
+		{"not found", nil, NotFoundResponse(), nil, 404, false, false, ""},
+		{"HTTPError", nil, Response{}, HTTPError{Status: 503}, 503, true, false, ""},
+		{"handler error", nil, Response{}, errors.New("broken"), 500, true, false, ""},
+		{
+			"traceparent",
+			map[string]string{
+				"traceparent": "00-" + traceID + "-" + spanID + "-01",
+				"tracestate":  "vendor=value",
+			},
+			OKResponse(), nil, 200, false, true, traceID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exporter := tracetest.NewInMemoryExporter()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+			var handlerSpan trace.SpanContext
+			handler := NewTracingMiddleware(provider.Tracer("test"))(func(request Request) (Response, error) {
+				handlerSpan = trace.SpanContextFromContext(RequestContext(request))
+				return tt.response, tt.err
+			})
+			handler(Request{RequestLine: RequestLine{Method: "GET", Path: "/things"}, Headers: tt.headers})
+
+			spans := exporter.GetSpans()
+			if len(spans) != 1 {
+				t.Fatalf("got %d ended spans, want 1", len(spans))
+			}
+			span := spans[0]
+			if span.Name != "GET /things" || span.SpanKind != trace.SpanKindServer {
+				t.Errorf("got span %q of kind %v, want a server span named \"GET /things\"", span.Name, span.SpanKind)
+			}
+			want := []attribute.KeyValue{
+				attribute.String("http.method", "GET"),
+				attribute.String("http.target", "/things"),
+				attribute.Int("http.status_code", tt.wantStatus),
+			}
+			for _, kv := range want {
+				found := false
+				for _, got := range span.Attributes {
+					if got == kv {
+						found = true
+					}
+				}
+				if !found {
+					t.Errorf("span attributes %v are missing %v", span.Attributes, kv)
+				}
+			}
+			if gotError := span.Status.Code == codes.Error; gotError != tt.wantError {
+				t.Errorf("got span status %v, want error %v", span.Status, tt.wantError)
+			}
+			if handlerSpan.SpanID() != span.SpanContext.SpanID() {
+				t.Errorf("the handler's context has span %v, want %v", handlerSpan.SpanID(), span.SpanContext.SpanID())
+			}
+			if span.Parent.IsValid() != tt.wantParent {
+				t.Errorf("got parent %v, want a parent: %v", span.Parent, tt.wantParent)
+			}
+			if tt.wantParent {
+				if got := span.SpanContext.TraceID().String(); got != tt.wantTraceID {
+					t.Errorf("got trace ID %s, want %s", got, tt.wantTraceID)
+				}
+				if got := span.Parent.SpanID().String(); got != spanID {
+					t.Errorf("got parent span ID %s, want %s", got, spanID)
+				}
+				if got := span.SpanContext.TraceState().Get("vendor"); got != "value" {
+					t.Errorf("got tracestate vendor=%q, want \"value\"", got)
+				}
+			}
+		})
+	}
+}
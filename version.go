@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// versionInfo describes the running build, as stamped by the go command.
+type versionInfo struct {
+	// Version is the module version, or "devel" for a build from a checkout
+	Version string
+	// Revision and Time describe the commit that was built. They're empty if
+	// the build wasn't stamped with VCS information (e.g. -buildvcs=false).
+	Revision string
+	Time     string
+	// Modified is set if the checkout had uncommitted changes
+	Modified bool
+}
+
+// readVersionInfo returns the versionInfo of the running binary.
+func readVersionInfo() versionInfo {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return versionInfoFrom(nil)
+	}
+	return versionInfoFrom(info)
+}
+
+// versionInfoFrom picks the versionInfo out of info, which may be nil if the
+// binary has no build information.
+func versionInfoFrom(info *debug.BuildInfo) versionInfo {
+	v := versionInfo{Version: "devel"}
+	if info == nil {
+		return v
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v.Version = info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			v.Revision = setting.Value
+		case "vcs.time":
+			v.Time = setting.Value
+		case "vcs.modified":
+			v.Modified = setting.Value == "true"
+		}
+	}
+	return v
+}
+
+// String formats v for -version, e.g.
+// "v1.2.0 (revision 0123456789ab, committed 2026-01-02T15:04:05Z)".
+func (v versionInfo) String() string {
+	if v.Revision == "" {
+		return v.Version
+	}
+	revision := v.Revision
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	var details []string
+	details = append(details, "revision "+revision)
+	if v.Modified {
+		details[0] += "+dirty"
+	}
+	if v.Time != "" {
+		details = append(details, "committed "+v.Time)
+	}
+	return fmt.Sprintf("%s (%s)", v.Version, strings.Join(details, ", "))
+}
+
+// serverHeader is the default Server header, e.g. "simple-http-server/v1.2.0".
+func (v versionInfo) serverHeader() string {
+	return "simple-http-server/" + v.Version
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestVersionInfoFrom(t *testing.T) {
+	const revision = "0123456789abcdef0123456789abcdef01234567"
+	tests := []struct {
+		name       string
+		info       *debug.BuildInfo
+		want       versionInfo
+		wantString string
+	}{
+		{"no build info", nil, versionInfo{Version: "devel"}, "devel"},
+		{"devel without VCS", &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, versionInfo{Version: "devel"}, "devel"},
+		{"module version", &debug.BuildInfo{Main: debug.Module{Version: "v1.2.0"}}, versionInfo{Version: "v1.2.0"}, "v1.2.0"},
+		{
+			"VCS stamped",
+			&debug.BuildInfo{Main: debug.Module{Version: "(devel)"}, Settings: []debug.BuildSetting{
+				{Key: "-compiler", Value: "gc"},
+				{Key: "vcs.revision", Value: revision},
+				{Key: "vcs.time", Value: "2026-01-02T15:04:05Z"},
+				{Key: "vcs.modified", Value: "false"},
+			}},
+			versionInfo{Version: "devel", Revision: revision, Time: "2026-01-02T15:04:05Z"},
+			"devel (revision 0123456789ab, committed 2026-01-02T15:04:05Z)",
+		},
+		{
+			"modified checkout",
+			&debug.BuildInfo{Main: debug.Module{Version: "v1.2.0"}, Settings: []debug.BuildSetting{
+				{Key: "vcs.revision", Value: "abc123"},
+				{Key: "vcs.modified", Value: "true"},
+			}},
+			versionInfo{Version: "v1.2.0", Revision: "abc123", Modified: true},
+			"v1.2.0 (revision abc123+dirty)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := versionInfoFrom(tt.info)
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+			if got.String() != tt.wantString {
+				t.Errorf("got String %q, want %q", got.String(), tt.wantString)
+			}
+			if got.serverHeader() != "simple-http-server/"+tt.want.Version {
+				t.Errorf("got Server header %q", got.serverHeader())
+			}
+		})
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	c, err := parseFlags("simple-http-server", []string{"-version"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse -version: %v", err)
+	}
+	if !c.version {
+		t.Error("-version wasn't set")
+	}
+
+	// the version is also the default Server header
+	c, err = parseFlags("simple-http-server", []string{"-port", "0"}, io.Discard)
+	if err != nil {
+		t.Fatalf("parse flags: %v", err)
+	}
+	s, err := newServer(c, nil)
+	if err != nil {
+		t.Fatalf("new server: %v", err)
+	}
+	raw, _ := pipeRequest(t, s, "GET / HTTP/1.1\r\n\r\n")
+	response, _ := parseResponse(t, raw)
+	if got := response.Header.Get("Server"); !strings.HasPrefix(got, "simple-http-server/") || got != readVersionInfo().serverHeader() {
+		t.Errorf("got Server %q, want %q", got, readVersionInfo().serverHeader())
+	}
+}